@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func newChallengeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "challenge",
+		Short: "Manage the challenges of the course",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "deploy [NAME...]",
+		Short: "Deploy challenges, students can connect to them afterwards",
+		Long:  "Deploy the given challenges of the config file. All configured challenges are deployed if no name is given.",
+		RunE:  runChallengeDeploy,
+	})
+	return cmd
+}
+
+func runChallengeDeploy(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	names := args
+	if len(names) == 0 {
+		for _, challenge := range cfg.Challenges {
+			names = append(names, challenge.Name)
+		}
+	}
+	for _, name := range names {
+		if _, ok := cfg.Challenge(name); !ok {
+			return fmt.Errorf("challenge %s is not in the config file", name)
+		}
+	}
+
+	log, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+	kubeClient, err := newKubeClient(cmd, cfg, log)
+	if err != nil {
+		return err
+	}
+	ctx := cmd.Context()
+	for _, name := range names {
+		exists, err := kubeClient.Client.NamespaceExists(ctx, name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			log.Info("challenge is already deployed", zap.String("challenge", name))
+			continue
+		}
+		if err := kubeClient.Client.CreateNamespace(ctx, name); err != nil {
+			return fmt.Errorf("failed to create namespace: %w", err)
+		}
+		log.Info("challenge deployed", zap.String("challenge", name))
+	}
+	return nil
+}
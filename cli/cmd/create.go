@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func newCreateCmd() *cobra.Command {
+	defaults := config.Default()
+	cmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create a cluster",
+		Long: "Create the VMs, initialize Kubernetes, install the CNI and deploy the ssh relay if ssh.deployment.image is set.\n" +
+			"If the state file records an unfinished cluster, the missing steps are resumed.",
+		Args: cobra.NoArgs,
+		RunE: runCreate,
+	}
+	cmd.Flags().String("path", "", "path to the image of the VMs, overrides the config file")
+	cmd.Flags().Int("control-planes", defaults.Cluster.ControlPlane.Count, "number of control plane nodes, overrides the config file")
+	cmd.Flags().Int("workers", defaults.Cluster.Worker.Count, "number of worker nodes, overrides the config file")
+	return cmd
+}
+
+func runCreate(cmd *cobra.Command, args []string) error {
+	statePath, err := cmd.Flags().GetString("state")
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("path") {
+		if cfg.Infrastructure.ImagePath, err = cmd.Flags().GetString("path"); err != nil {
+			return err
+		}
+	}
+	s, err := loadState(cmd)
+	if err != nil {
+		return err
+	}
+	recorded := s.NodeCounts != nil && !s.Empty()
+	if cmd.Flags().Changed("control-planes") {
+		if cfg.Cluster.ControlPlane.Count, err = cmd.Flags().GetInt("control-planes"); err != nil {
+			return err
+		}
+	}
+	if cmd.Flags().Changed("workers") {
+		if cfg.Cluster.Worker.Count, err = cmd.Flags().GetInt("workers"); err != nil {
+			return err
+		}
+	}
+	if recorded && (cfg.Cluster.ControlPlane.Count != s.NodeCounts.ControlPlanes || cfg.Cluster.Worker.Count != s.NodeCounts.Workers) {
+		return fmt.Errorf("the cluster of the state file has %d control planes and %d workers, destroy it to change them",
+			s.NodeCounts.ControlPlanes, s.NodeCounts.Workers)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if cfg.Infrastructure.ImagePath == "" {
+		return errors.New("the image of the VMs is neither set in the config file nor with --path")
+	}
+
+	log, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+	log.Info("starting delegatio cli", zap.String("version", cmd.Root().Version))
+	ctx := cmd.Context()
+
+	lInstance, err := connectInfrastructure(cmd, cfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lInstance.TerminateConnection(); err != nil {
+			log.Error("error while closing the connection", zap.Error(err))
+		}
+	}()
+
+	if err := lInstance.InitializeInfrastructure(ctx); err != nil {
+		return fmt.Errorf("failed to start VMs: %w", err)
+	}
+	kubeConf, err := infrastructure.GetKubeInitConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to get kubeConfig: %w", err)
+	}
+	if err := lInstance.InitializeKubernetes(ctx, kubeConf); err != nil {
+		return fmt.Errorf("failed to run Kubernetes: %w", err)
+	}
+
+	kubeClient, err := newKubeClient(cmd, cfg, log)
+	if err != nil {
+		return err
+	}
+	if err := kubeClient.InstallCilium(ctx); err != nil {
+		return fmt.Errorf("failed to install helm charts: %w", err)
+	}
+	if cfg.SSH.Deployment.Enabled() {
+		if err := kubeClient.DeployRelay(ctx); err != nil {
+			return fmt.Errorf("failed to deploy the ssh relay: %w", err)
+		}
+	}
+	log.Info("cluster is running", zap.String("state", statePath))
+	return nil
+}
@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func newDestroyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "destroy",
+		Short: "Tear down the cluster recorded in the state file",
+		Args:  cobra.NoArgs,
+		RunE:  runDestroy,
+	}
+}
+
+func runDestroy(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	log, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+
+	lInstance, err := connectInfrastructure(cmd, cfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lInstance.TerminateConnection(); err != nil {
+			log.Error("error while closing the connection", zap.Error(err))
+		}
+	}()
+	if err := lInstance.TerminateInfrastructure(); err != nil {
+		return fmt.Errorf("error while cleaning up: %w", err)
+	}
+	log.Info("instances terminated successfully")
+	return nil
+}
@@ -0,0 +1,37 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newKubeconfigCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "kubeconfig",
+		Short: "Print the admin kubeconfig of the cluster",
+		Args:  cobra.NoArgs,
+		RunE:  runKubeconfig,
+	}
+}
+
+func runKubeconfig(cmd *cobra.Command, args []string) error {
+	s, err := loadState(cmd)
+	if err != nil {
+		return err
+	}
+	if s.KubeconfigPath == "" {
+		return errors.New("the cluster is not initialized, run create first")
+	}
+	kubeconfig, err := os.ReadFile(s.KubeconfigPath)
+	if err != nil {
+		return err
+	}
+	_, err = cmd.OutOrStdout().Write(kubeconfig)
+	return err
+}
@@ -0,0 +1,254 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure"
+	"github.com/benschlueter/delegatio/cli/kubernetes"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"golang.org/x/term"
+)
+
+func newNodeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "node",
+		Short: "Grow or shrink a running cluster",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "add",
+		Short: "Create a worker and join it into the cluster",
+		Args:  cobra.NoArgs,
+		RunE:  runNodeAdd,
+	})
+	removeCmd := &cobra.Command{
+		Use:   "remove NAME",
+		Short: "Drain a worker, remove it from the cluster and delete its VM",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runNodeRemove,
+	}
+	removeCmd.Flags().Duration("drain-timeout", 5*time.Minute, "how long to wait for the pods to be evicted")
+	cmd.AddCommand(removeCmd)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "info NAME",
+		Short: "Show the state of a node reported by its agent",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runNodeInfo,
+	})
+	consoleCmd := &cobra.Command{
+		Use:   "console NAME",
+		Short: "Show the serial console log of a node or attach to its console",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runNodeConsole,
+	}
+	consoleCmd.Flags().IntP("lines", "n", 50, "number of lines of the log to show")
+	consoleCmd.Flags().BoolP("follow", "f", false, "keep printing the output of the console")
+	consoleCmd.Flags().Bool("attach", false, "attach to the console, press Ctrl+] to detach")
+	cmd.AddCommand(consoleCmd)
+	return cmd
+}
+
+func runNodeAdd(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	log, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+
+	lInstance, err := connectInfrastructure(cmd, cfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lInstance.TerminateConnection(); err != nil {
+			log.Error("error while closing the connection", zap.Error(err))
+		}
+	}()
+	name, err := lInstance.AddNode(cmd.Context())
+	if err != nil {
+		return fmt.Errorf("failed to add node: %w", err)
+	}
+	log.Info("node joined the cluster", zap.String("node", name))
+	return nil
+}
+
+func runNodeRemove(cmd *cobra.Command, args []string) error {
+	drainTimeout, err := cmd.Flags().GetDuration("drain-timeout")
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	s, err := loadState(cmd)
+	if err != nil {
+		return err
+	}
+	node, ok := s.Nodes[args[0]]
+	if !ok {
+		return fmt.Errorf("node %s is not recorded in the state file", args[0])
+	}
+	if node.ControlPlane {
+		return fmt.Errorf("node %s is a control plane, only workers can be removed", args[0])
+	}
+	log, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+	ctx := cmd.Context()
+
+	// The Kubernetes node is named after the hostname of the VM, it is found by its address.
+	var kubeClient *kubernetes.Client
+	var k8sNodeName string
+	if node.Joined && node.IP != "" {
+		if kubeClient, err = newKubeClient(cmd, cfg, log); err != nil {
+			return err
+		}
+		k8sNode, err := kubeClient.Client.GetNodeByInternalIP(ctx, node.IP)
+		if err != nil {
+			return err
+		}
+		k8sNodeName = k8sNode.Name
+		log.Info("draining node", zap.String("node", args[0]), zap.String("kubernetes node", k8sNodeName))
+		if err := kubeClient.Client.DrainNode(ctx, k8sNodeName, drainTimeout); err != nil {
+			return fmt.Errorf("failed to drain node: %w", err)
+		}
+	}
+
+	lInstance, err := connectInfrastructure(cmd, cfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lInstance.TerminateConnection(); err != nil {
+			log.Error("error while closing the connection", zap.Error(err))
+		}
+	}()
+	if err := lInstance.RemoveNode(ctx, args[0]); err != nil {
+		return fmt.Errorf("failed to remove node: %w", err)
+	}
+	if kubeClient != nil {
+		if err := kubeClient.Client.DeleteNode(ctx, k8sNodeName); err != nil {
+			return fmt.Errorf("failed to delete the node object: %w", err)
+		}
+	}
+	log.Info("node removed", zap.String("node", args[0]))
+	return nil
+}
+
+func runNodeInfo(cmd *cobra.Command, args []string) error {
+	log, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+	client, err := dialNode(cmd, log, args[0])
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	info, err := client.GetNodeInfo(cmd.Context())
+	if err != nil {
+		return fmt.Errorf("failed to get the state of %s: %w", args[0], err)
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Hostname:\t%s\n", info.GetHostname())
+	fmt.Fprintf(w, "Addresses:\t%s\n", strings.Join(info.GetAddresses(), ", "))
+	fmt.Fprintf(w, "Kernel:\t%s\n", info.GetKernelRelease())
+	fmt.Fprintf(w, "Uptime:\t%s\n", info.GetUptime().AsDuration())
+	for _, service := range info.GetServices() {
+		fmt.Fprintf(w, "Service %s:\t%s\n", service.GetName(), service.GetActiveState())
+	}
+	for _, disk := range info.GetDisks() {
+		fmt.Fprintf(w, "Disk %s:\t%s free of %s\n", disk.GetPath(), formatBytes(disk.GetAvailableBytes()), formatBytes(disk.GetTotalBytes()))
+	}
+	fmt.Fprintf(w, "Memory:\t%s available of %s\n", formatBytes(info.GetMemory().GetAvailableBytes()), formatBytes(info.GetMemory().GetTotalBytes()))
+	return w.Flush()
+}
+
+func runNodeConsole(cmd *cobra.Command, args []string) error {
+	lines, err := cmd.Flags().GetInt("lines")
+	if err != nil {
+		return err
+	}
+	follow, err := cmd.Flags().GetBool("follow")
+	if err != nil {
+		return err
+	}
+	attach, err := cmd.Flags().GetBool("attach")
+	if err != nil {
+		return err
+	}
+	return withInfrastructure(cmd, func(lInstance infrastructure.Infrastructure, cfg *config.Config, log *zap.Logger) error {
+		consoler, ok := lInstance.(infrastructure.Consoler)
+		if !ok {
+			return fmt.Errorf("the %s provider does not give access to the consoles", cfg.Infrastructure.Provider)
+		}
+		if !attach {
+			return consoler.ConsoleLog(cmd.Context(), args[0], lines, follow, cmd.OutOrStdout())
+		}
+		stdin := int(os.Stdin.Fd())
+		if term.IsTerminal(stdin) {
+			state, err := term.MakeRaw(stdin)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = term.Restore(stdin, state) }()
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Connected to the console of %s, press Ctrl+] to detach.\r\n", args[0])
+		return consoler.AttachConsole(cmd.Context(), args[0], &escapeReader{r: os.Stdin}, cmd.OutOrStdout())
+	})
+}
+
+// consoleEscape is Ctrl+], which detaches from the console like in virsh.
+const consoleEscape = 0x1d
+
+// escapeReader ends the input once the escape character was read.
+type escapeReader struct {
+	r    io.Reader
+	done bool
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	if e.done {
+		return 0, io.EOF
+	}
+	n, err := e.r.Read(p)
+	if i := bytes.IndexByte(p[:n], consoleEscape); i >= 0 {
+		e.done = true
+		return i, nil
+	}
+	return n, err
+}
+
+// formatBytes prints a size with a binary unit, i.e. 1.5 GiB.
+func formatBytes(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
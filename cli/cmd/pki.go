@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/benschlueter/delegatio/client/pki"
+	"github.com/spf13/cobra"
+)
+
+func newPKICmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pki",
+		Short: "Manage the certificates of the agent API",
+	}
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Create the CA and the certificates of the CLI and the agent",
+		Long: "Create the CA and the certificates of the CLI and the agent. The CLI keeps its certificate in " +
+			"infrastructure.pkiDir of the config, the certificate of the agent is written to the mkosi skeleton and " +
+			"baked into the image. Run it once before building the image.",
+		Args: cobra.NoArgs,
+		RunE: runPKIInit,
+	}
+	initCmd.Flags().String("agent-dir", "images/mkosi.skeleton/etc/delegatio/pki", "directory which receives the certificate of the agent")
+	cmd.AddCommand(initCmd)
+	return cmd
+}
+
+func runPKIInit(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	agentDir, err := cmd.Flags().GetString("agent-dir")
+	if err != nil {
+		return err
+	}
+	if err := pki.Generate(cfg.Infrastructure.PKIDir, agentDir); err != nil {
+		return fmt.Errorf("failed to create the certificates: %w", err)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "certificates of the CLI written to %s, certificates of the agent written to %s\n", cfg.Infrastructure.PKIDir, agentDir)
+	return nil
+}
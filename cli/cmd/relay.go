@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func newRelayCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "relay",
+		Short: "Manage the ssh relay inside of the cluster",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "deploy",
+		Short: "Deploy the ssh relay into the cluster",
+		Long: "Deploy the ssh relay with the image of ssh.deployment behind a NodePort or LoadBalancer service.\n" +
+			"Existing resources are updated, the host key of the relay is kept.",
+		Args: cobra.NoArgs,
+		RunE: runRelayDeploy,
+	})
+	return cmd
+}
+
+func runRelayDeploy(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	if !cfg.SSH.Deployment.Enabled() {
+		return errors.New("ssh.deployment.image is not set in the config file")
+	}
+
+	log, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+	kubeClient, err := newKubeClient(cmd, cfg, log)
+	if err != nil {
+		return err
+	}
+	if err := kubeClient.DeployRelay(cmd.Context()); err != nil {
+		return fmt.Errorf("failed to deploy the ssh relay: %w", err)
+	}
+	return nil
+}
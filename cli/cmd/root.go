@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure"
+	"github.com/benschlueter/delegatio/cli/infrastructure/agent"
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
+	"github.com/benschlueter/delegatio/cli/kubernetes"
+	"github.com/benschlueter/delegatio/client/pki"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// NewRootCmd returns the delegatio command with all its subcommands.
+func NewRootCmd(version string) *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:          "delegatio",
+		Short:        "Manage the delegatio cluster of a course",
+		Long:         "Manage the delegatio cluster of a course. The cluster outlives the CLI, its resources are recorded in the state file.",
+		Version:      version,
+		SilenceUsage: true,
+	}
+	rootCmd.PersistentFlags().String("state", "delegatio-state.json", "path to the state file of the cluster")
+	rootCmd.PersistentFlags().String("config", "", "path to the config file of the course, the defaults are used if it is empty")
+	rootCmd.PersistentFlags().String("libvirt-uri", config.Default().Infrastructure.LibvirtURI, "URI of the libvirt daemon, overrides the config file")
+
+	rootCmd.AddCommand(newCreateCmd())
+	rootCmd.AddCommand(newDestroyCmd())
+	rootCmd.AddCommand(newStatusCmd())
+	rootCmd.AddCommand(newKubeconfigCmd())
+	rootCmd.AddCommand(newSSHCmd())
+	rootCmd.AddCommand(newChallengeCmd())
+	rootCmd.AddCommand(newRelayCmd())
+	rootCmd.AddCommand(newNodeCmd())
+	rootCmd.AddCommand(newSnapshotCmd())
+	rootCmd.AddCommand(newPKICmd())
+	return rootCmd
+}
+
+func newLogger() (*zap.Logger, error) {
+	return zap.NewDevelopmentConfig().Build()
+}
+
+// loadState reads the state file given by the --state flag.
+func loadState(cmd *cobra.Command) (*state.State, error) {
+	statePath, err := cmd.Flags().GetString("state")
+	if err != nil {
+		return nil, err
+	}
+	return state.Load(statePath)
+}
+
+// loadConfig reads the config file given by the --config flag. Explicitly set flags and the
+// node counts recorded in the state file take precedence over the values of the file.
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Flags().Changed("libvirt-uri") {
+		if cfg.Infrastructure.LibvirtURI, err = cmd.Flags().GetString("libvirt-uri"); err != nil {
+			return nil, err
+		}
+	}
+	s, err := loadState(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if s.NodeCounts != nil && !s.Empty() {
+		cfg.Cluster.ControlPlane.Count = s.NodeCounts.ControlPlanes
+		cfg.Cluster.Worker.Count = s.NodeCounts.Workers
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration for the cluster of the state file: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// connectInfrastructure connects to the provider of the config and re-attaches to the
+// resources of the state file. The caller must terminate the connection.
+func connectInfrastructure(cmd *cobra.Command, cfg *config.Config, log *zap.Logger) (infrastructure.Infrastructure, error) {
+	statePath, err := cmd.Flags().GetString("state")
+	if err != nil {
+		return nil, err
+	}
+	lInstance, url, err := infrastructure.New(log.Named("infra"), statePath, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := lInstance.ConnectWithInfrastructureService(cmd.Context(), url); err != nil {
+		return nil, fmt.Errorf("failed to connect to infrastructure service: %w", err)
+	}
+	return lInstance, nil
+}
+
+// withInfrastructure connects to the infrastructure, runs fn and closes the connection.
+func withInfrastructure(cmd *cobra.Command, fn func(infrastructure.Infrastructure, *config.Config, *zap.Logger) error) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	log, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+
+	lInstance, err := connectInfrastructure(cmd, cfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lInstance.TerminateConnection(); err != nil {
+			log.Error("error while closing the connection", zap.Error(err))
+		}
+	}()
+	return fn(lInstance, cfg, log)
+}
+
+// newKubeClient connects to the cluster with the kubeconfig recorded in the state file.
+func newKubeClient(cmd *cobra.Command, cfg *config.Config, log *zap.Logger) (*kubernetes.Client, error) {
+	s, err := loadState(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if s.KubeconfigPath == "" {
+		return nil, errors.New("the cluster is not initialized, run create first")
+	}
+	client, err := kubernetes.NewK8sClient(s.KubeconfigPath, cfg, log.Named("k8sAPI"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kubernetes: %w", err)
+	}
+	return client, nil
+}
+
+// dialNode connects to the agent of a node recorded in the state file.
+func dialNode(cmd *cobra.Command, log *zap.Logger, name string) (*agent.Client, error) {
+	s, err := loadState(cmd)
+	if err != nil {
+		return nil, err
+	}
+	node, ok := s.Nodes[name]
+	if !ok {
+		return nil, fmt.Errorf("node %s is not part of the cluster", name)
+	}
+	if node.Address() == "" {
+		return nil, fmt.Errorf("the address of node %s is unknown", name)
+	}
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := infrastructure.AgentCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Only the qemu nodes get a certificate for their name with their metadata.
+	serverName := name
+	if s.Provider == config.ProviderCloud {
+		serverName = pki.AgentServerName
+	}
+	return agent.Dial(cmd.Context(), log.Named("agent").With(zap.String("id", name)), node.Address(), serverName, creds)
+}
@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func newSnapshotCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Checkpoint the nodes of the cluster and roll it back",
+	}
+	createCmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Snapshot the disks of all nodes, the nodes are paused meanwhile",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runSnapshotCreate,
+	}
+	createCmd.Flags().Bool("memory", false, "save the memory of the nodes as well, they resume instead of booting after a rollback")
+	cmd.AddCommand(createCmd)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the snapshots recorded in the state file",
+		Args:  cobra.NoArgs,
+		RunE:  runSnapshotList,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rollback NAME",
+		Short: "Restore all nodes from a snapshot, nodes created afterwards are deleted",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runSnapshotRollback,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "delete NAME",
+		Short: "Delete a snapshot",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runSnapshotDelete,
+	})
+	return cmd
+}
+
+// withSnapshotter connects to the infrastructure and runs fn if the provider supports snapshots.
+func withSnapshotter(cmd *cobra.Command, fn func(infrastructure.Snapshotter, *zap.Logger) error) error {
+	return withInfrastructure(cmd, func(lInstance infrastructure.Infrastructure, cfg *config.Config, log *zap.Logger) error {
+		snapshotter, ok := lInstance.(infrastructure.Snapshotter)
+		if !ok {
+			return fmt.Errorf("the %s provider does not support snapshots", cfg.Infrastructure.Provider)
+		}
+		return fn(snapshotter, log)
+	})
+}
+
+func runSnapshotCreate(cmd *cobra.Command, args []string) error {
+	memory, err := cmd.Flags().GetBool("memory")
+	if err != nil {
+		return err
+	}
+	return withSnapshotter(cmd, func(snapshotter infrastructure.Snapshotter, log *zap.Logger) error {
+		if err := snapshotter.CreateSnapshot(cmd.Context(), args[0], memory); err != nil {
+			return fmt.Errorf("failed to create snapshot: %w", err)
+		}
+		return nil
+	})
+}
+
+func runSnapshotList(cmd *cobra.Command, args []string) error {
+	s, err := loadState(cmd)
+	if err != nil {
+		return err
+	}
+	snapshots := append(s.Snapshots[:0:0], s.Snapshots...)
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED\tNODES\tMEMORY")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%t\n", snapshot.Name, snapshot.Created.Local().Format(time.RFC3339), len(snapshot.Nodes), snapshot.Memory)
+	}
+	return w.Flush()
+}
+
+func runSnapshotRollback(cmd *cobra.Command, args []string) error {
+	return withSnapshotter(cmd, func(snapshotter infrastructure.Snapshotter, log *zap.Logger) error {
+		if err := snapshotter.RollbackSnapshot(cmd.Context(), args[0]); err != nil {
+			return fmt.Errorf("failed to roll back to snapshot: %w", err)
+		}
+		log.Info("cluster rolled back, check the nodes with \"delegatio status\"", zap.String("snapshot", args[0]))
+		return nil
+	})
+}
+
+func runSnapshotDelete(cmd *cobra.Command, args []string) error {
+	return withSnapshotter(cmd, func(snapshotter infrastructure.Snapshotter, log *zap.Logger) error {
+		if err := snapshotter.DeleteSnapshot(cmd.Context(), args[0]); err != nil {
+			return fmt.Errorf("failed to delete snapshot: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"github.com/benschlueter/delegatio/cli/infrastructure/agent"
+	"github.com/spf13/cobra"
+)
+
+func newSSHCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ssh NODE -- COMMAND [ARGS...]",
+		Short: "Run a command on a node",
+		Long:  "Run a command on a node through the delegatio agent and stream its output. The exit code of the command is the one of the cli.",
+		Args:  cobra.MinimumNArgs(2),
+		RunE:  runSSH,
+	}
+	cmd.Flags().BoolP("stdin", "i", false, "forward the standard input to the command")
+	cmd.Flags().StringArrayP("env", "e", nil, "set an environment variable of the command, KEY=VALUE")
+	cmd.Flags().StringP("workdir", "w", "", "working directory of the command")
+	cmd.Flags().Duration("timeout", 0, "kill the command after this time, zero means no timeout")
+	return cmd
+}
+
+func runSSH(cmd *cobra.Command, args []string) error {
+	forwardStdin, err := cmd.Flags().GetBool("stdin")
+	if err != nil {
+		return err
+	}
+	env, err := cmd.Flags().GetStringArray("env")
+	if err != nil {
+		return err
+	}
+	workdir, err := cmd.Flags().GetString("workdir")
+	if err != nil {
+		return err
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	log, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+
+	client, err := dialNode(cmd, log, args[0])
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	command := &agent.Command{
+		Name:    args[1],
+		Args:    args[2:],
+		Env:     env,
+		Dir:     workdir,
+		Timeout: timeout,
+		Stdout:  cmd.OutOrStdout(),
+		Stderr:  cmd.ErrOrStderr(),
+	}
+	if forwardStdin {
+		command.Stdin = cmd.InOrStdin()
+	}
+	return client.Run(cmd.Context(), command)
+}
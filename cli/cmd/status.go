@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	coreAPI "k8s.io/api/core/v1"
+)
+
+func newStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show the nodes of the cluster",
+		Args:  cobra.NoArgs,
+		RunE:  runStatus,
+	}
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	s, err := loadState(cmd)
+	if err != nil {
+		return err
+	}
+	out := cmd.OutOrStdout()
+	if s.Empty() {
+		fmt.Fprintln(out, "no cluster is recorded in the state file")
+		return nil
+	}
+	fmt.Fprintf(out, "Network:\t%s\n", s.Network)
+	fmt.Fprintf(out, "Storage pools:\t%v\n", s.Pools)
+	if s.KubeconfigPath != "" {
+		fmt.Fprintf(out, "Kubeconfig:\t%s\n", s.KubeconfigPath)
+	}
+	if s.JoinToken != nil {
+		fmt.Fprintf(out, "Join token expiry:\t%s\n", s.JoinToken.Expiry)
+	}
+
+	// The readiness is only known if the API server is reachable.
+	ready := map[string]string{}
+	if s.KubeconfigPath != "" {
+		log, err := newLogger()
+		if err != nil {
+			return err
+		}
+		defer func() { _ = log.Sync() }()
+		cfg, err := loadConfig(cmd)
+		if err != nil {
+			return err
+		}
+		kubeClient, err := newKubeClient(cmd, cfg, log.WithOptions(zap.IncreaseLevel(zap.WarnLevel)))
+		if err != nil {
+			return err
+		}
+		nodes, err := kubeClient.Client.ListNodes(cmd.Context())
+		if err != nil {
+			fmt.Fprintf(out, "API server not reachable: %v\n", err)
+		}
+		for _, node := range nodes {
+			for _, addr := range node.Status.Addresses {
+				if addr.Type == coreAPI.NodeInternalIP {
+					ready[addr.Address] = strconv.FormatBool(nodeReady(node))
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(s.Nodes))
+	for name := range s.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tROLE\tIP\tJOINED\tREADY")
+	for _, name := range names {
+		node := s.Nodes[name]
+		role := "worker"
+		if node.ControlPlane {
+			role = "control-plane"
+		}
+		nodeReady, ok := ready[node.IP]
+		if !ok {
+			nodeReady = "unknown"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", name, role, node.IP, node.Joined, nodeReady)
+	}
+	return w.Flush()
+}
+
+func nodeReady(node coreAPI.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == coreAPI.NodeReady {
+			return condition.Status == coreAPI.ConditionTrue
+		}
+	}
+	return false
+}
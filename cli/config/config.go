@@ -0,0 +1,704 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Version is the version of the config file format.
+const Version = "v1"
+
+// Config is the declarative configuration of a delegatio installation.
+// It is shared by the CLI, the ssh relay and the Kubernetes helpers.
+type Config struct {
+	Version        string               `json:"version"`
+	Infrastructure InfrastructureConfig `json:"infrastructure"`
+	Cluster        ClusterConfig        `json:"cluster"`
+	Kubernetes     KubernetesConfig     `json:"kubernetes"`
+	Challenges     []ChallengeConfig    `json:"challenges"`
+	Storage        StorageConfig        `json:"storage"`
+	SSH            SSHConfig            `json:"ssh"`
+}
+
+// The infrastructure providers which can create the VMs.
+const (
+	// ProviderQemu creates the VMs on the local libvirt daemon.
+	ProviderQemu = "qemu"
+	// ProviderCloud creates the VMs through the compute API of a public cloud.
+	ProviderCloud = "cloud"
+)
+
+// InfrastructureConfig describes where the VMs are created.
+type InfrastructureConfig struct {
+	Provider   string `json:"provider"`
+	LibvirtURI string `json:"libvirtURI"`
+	ImagePath  string `json:"imagePath"`
+	// ImageChecksums is the SHA256SUMS manifest of the image, it defaults to the one next to the image.
+	ImageChecksums string `json:"imageChecksums"`
+	// ImageSigningKey is an OpenPGP public key. If it is set, the manifest must be signed by it.
+	ImageSigningKey string `json:"imageSigningKey"`
+	// PKIDir contains the CA and the client certificate which authenticate the CLI to the agents.
+	PKIDir  string        `json:"pkiDir"`
+	Network NetworkConfig `json:"network"`
+	Cloud   CloudConfig   `json:"cloud"`
+}
+
+// CloudConfig describes the compute API of a public cloud.
+type CloudConfig struct {
+	Endpoint string `json:"endpoint"`
+	// TokenEnv is the environment variable which contains the API token, the token is never stored in the config.
+	TokenEnv string `json:"tokenEnv"`
+}
+
+// NetworkConfig describes the libvirt network of the VMs. The first address of the CIDR is the host.
+// The node with number N gets the address dhcpStart+N, which the DHCP server reserves for it.
+type NetworkConfig struct {
+	CIDR      string `json:"cidr"`
+	DHCPStart string `json:"dhcpStart"`
+	DHCPEnd   string `json:"dhcpEnd"`
+	// Bridge is the name of the bridge device of the network on the host.
+	Bridge string `json:"bridge"`
+	// Domain is the DNS domain of the network, the nodes resolve as <name>.<domain>.
+	Domain string `json:"domain"`
+	// IPv6CIDR enables IPv6 if it is set. The node with number N gets the address <network>+0x100+N.
+	IPv6CIDR string `json:"ipv6CIDR,omitempty"`
+}
+
+// NodeSpec describes how many VMs of one role are created and how they are sized.
+type NodeSpec struct {
+	Count     int    `json:"count"`
+	VCPUs     uint   `json:"vcpus"`
+	MemoryMiB uint   `json:"memoryMiB"`
+	DiskGiB   uint64 `json:"diskGiB"`
+}
+
+// ClusterConfig describes the topology of the cluster.
+type ClusterConfig struct {
+	ControlPlane NodeSpec `json:"controlPlane"`
+	Worker       NodeSpec `json:"worker"`
+	// APIServerVIP is the virtual IP in front of the API servers. It is only used
+	// if the cluster has more than one control plane and must be outside of the DHCP range.
+	APIServerVIP string `json:"apiServerVIP"`
+}
+
+// KubernetesConfig contains the settings passed to kubeadm and the charts installed afterwards.
+type KubernetesConfig struct {
+	// Version is the Kubernetes version, kubeadm uses its own version if it is empty.
+	Version         string `json:"version,omitempty"`
+	PodSubnet       string `json:"podSubnet,omitempty"`
+	ServiceSubnet   string `json:"serviceSubnet"`
+	CiliumChartPath string `json:"ciliumChartPath"`
+}
+
+// ChallengeConfig describes a challenge. Every challenge has its own namespace,
+// in which each student gets a container with the given image.
+type ChallengeConfig struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// StorageConfig describes the persistent home directories of the students.
+type StorageConfig struct {
+	StorageClass string `json:"storageClass"`
+	Size         string `json:"size"`
+}
+
+// SSHConfig contains the settings of the ssh relay.
+type SSHConfig struct {
+	ListenAddress string `json:"listenAddress"`
+	HostKeyPath   string `json:"hostKeyPath"`
+	// KubeconfigPath is empty if the relay runs inside of the cluster, it uses its service account then.
+	KubeconfigPath string `json:"kubeconfigPath"`
+	// AuthorizedKeys may enter every challenge, they are only used with the config user source.
+	AuthorizedKeys []string `json:"authorizedKeys"`
+	// AllowedEnv are the environment variables which students may pass into their pods, i.e.
+	// with SendEnv of OpenSSH. The names may contain the wildcards of path.Match.
+	AllowedEnv []string `json:"allowedEnv"`
+	// SFTPServer is the path of the sftp-server of OpenSSH in the challenge images, it serves
+	// the sftp subsystem.
+	SFTPServer string `json:"sftpServer"`
+	// UploadLimit is the quantity of bytes a student may send into all their non-interactive
+	// sessions, i.e. sftp, scp and exec. The relays share the counts in the store if it is
+	// enabled, otherwise every relay counts since it started. Students may have their own
+	// limit, 0 disables it.
+	UploadLimit string          `json:"uploadLimit"`
+	Users       UserStoreConfig `json:"users"`
+	Store       StoreConfig     `json:"store"`
+	Deployment  RelayDeployment `json:"deployment"`
+}
+
+// The types of the service in front of the relays in the cluster.
+const (
+	ServiceTypeNodePort     = "NodePort"
+	ServiceTypeLoadBalancer = "LoadBalancer"
+)
+
+// RelayDeployment describes the relays which the CLI runs inside of the cluster.
+type RelayDeployment struct {
+	// Image of the relay. The CLI only deploys the relay if it is set.
+	Image     string `json:"image,omitempty"`
+	Namespace string `json:"namespace"`
+	Replicas  int32  `json:"replicas"`
+	// ServiceType is NodePort or LoadBalancer.
+	ServiceType string `json:"serviceType"`
+	// NodePort of the service, Kubernetes picks a free one if it is 0.
+	NodePort int32 `json:"nodePort,omitempty"`
+}
+
+// Enabled reports whether the CLI deploys the relay.
+func (d RelayDeployment) Enabled() bool {
+	return d.Image != ""
+}
+
+// StoreConfig describes the replicated store in which the ssh relays share their students,
+// sessions and audit log. Without endpoints and members the relay keeps its state in memory.
+type StoreConfig struct {
+	// Endpoints are the client URLs of an external etcd cluster.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Members maps the names of the relays to their peer URLs. Every relay runs a member of
+	// an embedded etcd cluster, which initially consists of these members.
+	Members map[string]string `json:"members,omitempty"`
+	// ClientURL is where the embedded member serves the relay, it defaults to a loopback address.
+	ClientURL string `json:"clientURL,omitempty"`
+	// DataDir is the directory of the embedded member.
+	DataDir string `json:"dataDir,omitempty"`
+	// ClientTLS authenticates the relay and the member it connects to each other. The
+	// certificate is presented by the relay and by its embedded member.
+	ClientTLS TLSFiles `json:"clientTLS,omitempty"`
+	// PeerTLS authenticates the embedded members to each other.
+	PeerTLS TLSFiles `json:"peerTLS,omitempty"`
+}
+
+// TLSFiles are the PEM files of a mutually authenticated TLS connection. The certificate is
+// used as server and as client certificate, it must be valid for both.
+type TLSFiles struct {
+	// CACert is the CA which signed the certificates of the other side.
+	CACert string `json:"caCert,omitempty"`
+	Cert   string `json:"cert,omitempty"`
+	Key    string `json:"key,omitempty"`
+}
+
+func (f TLSFiles) validate(field string) error {
+	if f.CACert == "" || f.Cert == "" || f.Key == "" {
+		return fmt.Errorf("%s requires caCert, cert and key", field)
+	}
+	return nil
+}
+
+// Enabled reports whether the relays share their state.
+func (s StoreConfig) Enabled() bool {
+	return len(s.Endpoints) > 0 || len(s.Members) > 0
+}
+
+// The sources of the students of the ssh relay.
+const (
+	// UserSourceConfig lets every authorized key of the config enter every challenge.
+	UserSourceConfig = "config"
+	// UserSourceFile reads the students from a file, which is reloaded when it changes.
+	UserSourceFile = "file"
+	// UserSourceKubernetes reads the students from a config map, which is watched for changes.
+	UserSourceKubernetes = "kubernetes"
+	// UserSourceStore reads the students from the replicated store of the relays.
+	UserSourceStore = "store"
+)
+
+// UserStoreConfig describes where the ssh relay loads the students, their public keys and
+// the challenges they may enter from.
+type UserStoreConfig struct {
+	Source string `json:"source"`
+	// Path is the users file of the file source.
+	Path string `json:"path,omitempty"`
+	// Namespace and ConfigMap locate the users of the kubernetes source.
+	Namespace string `json:"namespace,omitempty"`
+	ConfigMap string `json:"configMap,omitempty"`
+}
+
+// Default returns the configuration delegatio used before it became configurable.
+func Default() *Config {
+	return &Config{
+		Version: Version,
+		Infrastructure: InfrastructureConfig{
+			Provider:   ProviderQemu,
+			LibvirtURI: "qemu:///system",
+			PKIDir:     "pki",
+			Network: NetworkConfig{
+				CIDR: "10.42.0.0/16",
+				// 10.42.0.0/24 is kept free for static addresses, i.e. the API server VIP.
+				DHCPStart: "10.42.1.1",
+				DHCPEnd:   "10.42.255.254",
+				Bridge:    "virbr1",
+				Domain:    "delegatio.internal",
+			},
+			Cloud: CloudConfig{
+				TokenEnv: "DELEGATIO_CLOUD_TOKEN",
+			},
+		},
+		Cluster: *DefaultClusterConfig(),
+		Kubernetes: KubernetesConfig{
+			ServiceSubnet:   "10.96.0.0/12",
+			CiliumChartPath: "cli/kubernetes/helm/charts/cilium",
+		},
+		Challenges: []ChallengeConfig{
+			{
+				Name:  "testchallenge1",
+				Image: "ghcr.io/benschlueter/delegatio/archimage:0.1",
+			},
+		},
+		Storage: StorageConfig{
+			StorageClass: "azurefile-csi",
+			Size:         "5Gi",
+		},
+		SSH: SSHConfig{
+			ListenAddress:  "0.0.0.0:2200",
+			HostKeyPath:    "./server_test",
+			KubeconfigPath: "admin.conf",
+			AllowedEnv:     []string{"LANG", "LC_*"},
+			SFTPServer:     "/usr/lib/ssh/sftp-server",
+			UploadLimit:    "1Gi",
+			Users: UserStoreConfig{
+				Source: UserSourceConfig,
+			},
+			Store: StoreConfig{
+				ClientURL: "https://127.0.0.1:2379",
+				DataDir:   "relay-store",
+			},
+			Deployment: RelayDeployment{
+				Namespace:   "delegatio-ssh",
+				Replicas:    1,
+				ServiceType: ServiceTypeNodePort,
+			},
+		},
+	}
+}
+
+// Load reads the config file at path. Fields which are missing in the file keep their defaults,
+// unknown fields are rejected. If path is empty, the defaults are returned.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is a superset of JSON, both formats are accepted.
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the whole configuration and reports all errors at once.
+func (c *Config) Validate() error {
+	var err error
+	if c.Version != Version {
+		err = multierr.Append(err, fmt.Errorf("unsupported version %q, expected %q", c.Version, Version))
+	}
+	switch c.Infrastructure.Provider {
+	case ProviderQemu:
+		if c.Infrastructure.LibvirtURI == "" {
+			err = multierr.Append(err, errors.New("infrastructure.libvirtURI must not be empty"))
+		}
+	case ProviderCloud:
+		if u, pErr := url.Parse(c.Infrastructure.Cloud.Endpoint); pErr != nil || u.Scheme == "" || u.Host == "" {
+			err = multierr.Append(err, fmt.Errorf("infrastructure.cloud.endpoint: invalid URL %q", c.Infrastructure.Cloud.Endpoint))
+		}
+		// kube-vip announces the VIP with ARP, which does not work in the networks of cloud providers.
+		if c.Cluster.HighAvailability() {
+			err = multierr.Append(err, errors.New("the cloud provider supports a single control plane only"))
+		}
+	default:
+		err = multierr.Append(err, fmt.Errorf("unknown infrastructure.provider %q", c.Infrastructure.Provider))
+	}
+	if c.Infrastructure.PKIDir == "" {
+		err = multierr.Append(err, errors.New("infrastructure.pkiDir must not be empty"))
+	}
+	err = multierr.Append(err, c.Infrastructure.Network.validate())
+	if vErr := c.Cluster.Validate(); vErr != nil {
+		err = multierr.Append(err, fmt.Errorf("cluster: %w", vErr))
+	}
+	if c.Cluster.HighAvailability() {
+		if c.Infrastructure.Network.InDHCPRange(c.Cluster.APIServerVIP) {
+			err = multierr.Append(err, fmt.Errorf("cluster.apiServerVIP %s is inside the DHCP range", c.Cluster.APIServerVIP))
+		}
+		if _, ipNet, pErr := net.ParseCIDR(c.Infrastructure.Network.CIDR); pErr == nil && !ipNet.Contains(net.ParseIP(c.Cluster.APIServerVIP)) {
+			err = multierr.Append(err, fmt.Errorf("cluster.apiServerVIP %s is outside of the network", c.Cluster.APIServerVIP))
+		}
+	}
+	for _, subnet := range []string{c.Kubernetes.PodSubnet, c.Kubernetes.ServiceSubnet} {
+		if subnet == "" {
+			continue
+		}
+		if _, _, pErr := net.ParseCIDR(subnet); pErr != nil {
+			err = multierr.Append(err, fmt.Errorf("kubernetes: invalid subnet %q", subnet))
+		}
+	}
+	if c.Kubernetes.CiliumChartPath == "" {
+		err = multierr.Append(err, errors.New("kubernetes.ciliumChartPath must not be empty"))
+	}
+	names := map[string]struct{}{}
+	for _, challenge := range c.Challenges {
+		if challenge.Name == "" || challenge.Image == "" {
+			err = multierr.Append(err, errors.New("challenges: name and image must not be empty"))
+			continue
+		}
+		// The name of a challenge is the namespace of its pods.
+		for _, msg := range validation.IsDNS1123Label(challenge.Name) {
+			err = multierr.Append(err, fmt.Errorf("challenges: name %q: %s", challenge.Name, msg))
+		}
+		if _, ok := names[challenge.Name]; ok {
+			err = multierr.Append(err, fmt.Errorf("challenges: duplicate challenge %s", challenge.Name))
+		}
+		names[challenge.Name] = struct{}{}
+	}
+	if _, pErr := resource.ParseQuantity(c.Storage.Size); pErr != nil {
+		err = multierr.Append(err, fmt.Errorf("storage.size: %w", pErr))
+	}
+	if c.Storage.StorageClass == "" {
+		err = multierr.Append(err, errors.New("storage.storageClass must not be empty"))
+	}
+	if _, _, pErr := net.SplitHostPort(c.SSH.ListenAddress); pErr != nil {
+		err = multierr.Append(err, fmt.Errorf("ssh.listenAddress: %w", pErr))
+	}
+	for _, key := range c.SSH.AuthorizedKeys {
+		if _, _, _, _, pErr := ssh.ParseAuthorizedKey([]byte(key)); pErr != nil {
+			err = multierr.Append(err, fmt.Errorf("ssh.authorizedKeys: %w", pErr))
+		}
+	}
+	for _, pattern := range c.SSH.AllowedEnv {
+		if _, pErr := path.Match(pattern, ""); pErr != nil {
+			err = multierr.Append(err, fmt.Errorf("ssh.allowedEnv: invalid pattern %q", pattern))
+		}
+	}
+	if !path.IsAbs(c.SSH.SFTPServer) {
+		err = multierr.Append(err, fmt.Errorf("ssh.sftpServer %q must be an absolute path", c.SSH.SFTPServer))
+	}
+	if q, pErr := resource.ParseQuantity(c.SSH.UploadLimit); pErr != nil {
+		err = multierr.Append(err, fmt.Errorf("ssh.uploadLimit: %w", pErr))
+	} else if q.Sign() < 0 {
+		err = multierr.Append(err, errors.New("ssh.uploadLimit must not be negative"))
+	}
+	err = multierr.Append(err, c.SSH.Users.validate())
+	if c.SSH.Users.Source == UserSourceStore && !c.SSH.Store.Enabled() {
+		err = multierr.Append(err, errors.New("ssh.users.source store requires ssh.store"))
+	}
+	err = multierr.Append(err, c.SSH.Store.validate())
+	if c.SSH.Deployment.Enabled() {
+		err = multierr.Append(err, c.SSH.validateDeployment())
+	}
+	return err
+}
+
+// validateDeployment checks the settings of the relays inside of the cluster.
+func (s SSHConfig) validateDeployment() error {
+	var err error
+	d := s.Deployment
+	for _, msg := range validation.IsDNS1123Label(d.Namespace) {
+		err = multierr.Append(err, fmt.Errorf("ssh.deployment.namespace: %s", msg))
+	}
+	if d.Replicas < 1 {
+		err = multierr.Append(err, errors.New("ssh.deployment.replicas must be at least 1"))
+	}
+	switch d.ServiceType {
+	case ServiceTypeNodePort, ServiceTypeLoadBalancer:
+	default:
+		err = multierr.Append(err, fmt.Errorf("ssh.deployment.serviceType: unknown type %q", d.ServiceType))
+	}
+	if d.NodePort != 0 && (d.NodePort < 30000 || d.NodePort > 32767) {
+		err = multierr.Append(err, fmt.Errorf("ssh.deployment.nodePort %d is outside of 30000-32767", d.NodePort))
+	}
+	// The pods of a deployment have neither the users file nor stable names for embedded members.
+	if s.Users.Source == UserSourceFile {
+		err = multierr.Append(err, errors.New("ssh.deployment does not support the file user source"))
+	}
+	if len(s.Store.Members) > 0 {
+		err = multierr.Append(err, errors.New("ssh.deployment requires ssh.store.endpoints instead of members"))
+	}
+	return err
+}
+
+func (s StoreConfig) validate() error {
+	var err error
+	if len(s.Endpoints) > 0 && len(s.Members) > 0 {
+		err = multierr.Append(err, errors.New("ssh.store: endpoints and members are mutually exclusive"))
+	}
+	if !s.Enabled() {
+		return err
+	}
+	// The store holds the public keys of the students, it is only reachable over TLS.
+	err = multierr.Append(err, s.ClientTLS.validate("ssh.store.clientTLS"))
+	for _, endpoint := range s.Endpoints {
+		if !isHTTPS(endpoint) {
+			err = multierr.Append(err, fmt.Errorf("ssh.store.endpoints: invalid URL %q, it must be https", endpoint))
+		}
+	}
+	if len(s.Members) == 0 {
+		return err
+	}
+	err = multierr.Append(err, s.PeerTLS.validate("ssh.store.peerTLS"))
+	memberURLs := []string{s.ClientURL}
+	for name, peerURL := range s.Members {
+		if name == "" {
+			err = multierr.Append(err, errors.New("ssh.store.members: names must not be empty"))
+		}
+		memberURLs = append(memberURLs, peerURL)
+	}
+	for _, memberURL := range memberURLs {
+		if !isHTTPS(memberURL) {
+			err = multierr.Append(err, fmt.Errorf("ssh.store: invalid URL %q of the embedded members, it must be https", memberURL))
+		}
+	}
+	if s.DataDir == "" {
+		err = multierr.Append(err, errors.New("ssh.store.dataDir must not be empty"))
+	}
+	return err
+}
+
+// isHTTPS reports whether rawURL is a https URL with a host.
+func isHTTPS(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Host != "" && u.Scheme == "https"
+}
+
+func (u UserStoreConfig) validate() error {
+	switch u.Source {
+	case UserSourceConfig, UserSourceStore:
+	case UserSourceFile:
+		if u.Path == "" {
+			return errors.New("ssh.users.path must not be empty")
+		}
+	case UserSourceKubernetes:
+		if u.Namespace == "" || u.ConfigMap == "" {
+			return errors.New("ssh.users.namespace and ssh.users.configMap must not be empty")
+		}
+	default:
+		return fmt.Errorf("unknown ssh.users.source %q", u.Source)
+	}
+	return nil
+}
+
+// Challenge returns the challenge with the given name.
+func (c *Config) Challenge(name string) (ChallengeConfig, bool) {
+	for _, challenge := range c.Challenges {
+		if challenge.Name == name {
+			return challenge, true
+		}
+	}
+	return ChallengeConfig{}, false
+}
+
+// Gateway returns the address of the host inside the network and the prefix length.
+func (n NetworkConfig) Gateway() (string, uint, error) {
+	ip, ipNet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return "", 0, err
+	}
+	gateway := ip.Mask(ipNet.Mask).To4()
+	if gateway == nil {
+		return "", 0, fmt.Errorf("network %s is not an IPv4 network", n.CIDR)
+	}
+	gateway[3]++
+	prefix, _ := ipNet.Mask.Size()
+	return gateway.String(), uint(prefix), nil
+}
+
+// GatewayIPv6 returns the address of the host inside the IPv6 network and the prefix length.
+func (n NetworkConfig) GatewayIPv6() (string, uint, error) {
+	ip, prefix, err := n.ipv6Network()
+	if err != nil {
+		return "", 0, err
+	}
+	ip[len(ip)-1]++
+	return ip.String(), prefix, nil
+}
+
+// NodeAddress returns the IPv4 address reserved for the node with the given number.
+func (n NetworkConfig) NodeAddress(index int) (string, error) {
+	start, end := net.ParseIP(n.DHCPStart).To4(), net.ParseIP(n.DHCPEnd).To4()
+	if start == nil || end == nil || index < 0 {
+		return "", fmt.Errorf("no address for node %d in the DHCP range %s-%s", index, n.DHCPStart, n.DHCPEnd)
+	}
+	ip := addToIP(start, uint64(index))
+	if ip == nil || compareIPv4(ip, end) > 0 {
+		return "", fmt.Errorf("no address for node %d in the DHCP range %s-%s", index, n.DHCPStart, n.DHCPEnd)
+	}
+	return ip.String(), nil
+}
+
+// NodeAddressIPv6 returns the IPv6 address reserved for the node with the given number.
+func (n NetworkConfig) NodeAddressIPv6(index int) (string, error) {
+	network, _, err := n.ipv6Network()
+	if err != nil {
+		return "", err
+	}
+	_, ipNet, _ := net.ParseCIDR(n.IPv6CIDR)
+	ip := addToIP(network, uint64(ipv6NodeOffset+index))
+	if index < 0 || ip == nil || !ipNet.Contains(ip) {
+		return "", fmt.Errorf("no address for node %d in %s", index, n.IPv6CIDR)
+	}
+	return ip.String(), nil
+}
+
+// ipv6NodeOffset is the offset of the first node address in the IPv6 network.
+const ipv6NodeOffset = 0x100
+
+func (n NetworkConfig) ipv6Network() (net.IP, uint, error) {
+	ip, ipNet, err := net.ParseCIDR(n.IPv6CIDR)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ip.To4() != nil {
+		return nil, 0, fmt.Errorf("network %s is not an IPv6 network", n.IPv6CIDR)
+	}
+	prefix, _ := ipNet.Mask.Size()
+	return ip.Mask(ipNet.Mask), uint(prefix), nil
+}
+
+// addToIP returns ip+n, or nil if the addition overflows.
+func addToIP(ip net.IP, n uint64) net.IP {
+	sum := make(net.IP, len(ip))
+	copy(sum, ip)
+	for i := len(sum) - 1; i >= 0 && n > 0; i-- {
+		n += uint64(sum[i])
+		sum[i] = byte(n)
+		n >>= 8
+	}
+	if n > 0 {
+		return nil
+	}
+	return sum
+}
+
+// InDHCPRange returns true if the address is handed out by the DHCP server.
+func (n NetworkConfig) InDHCPRange(addr string) bool {
+	ip, start, end := net.ParseIP(addr).To4(), net.ParseIP(n.DHCPStart).To4(), net.ParseIP(n.DHCPEnd).To4()
+	if ip == nil || start == nil || end == nil {
+		return false
+	}
+	return compareIPv4(start, ip) <= 0 && compareIPv4(ip, end) <= 0
+}
+
+func (n NetworkConfig) validate() error {
+	_, ipNet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return fmt.Errorf("infrastructure.network.cidr: %w", err)
+	}
+	if _, _, err := n.Gateway(); err != nil {
+		return fmt.Errorf("infrastructure.network.cidr: %w", err)
+	}
+	for _, addr := range []string{n.DHCPStart, n.DHCPEnd} {
+		ip := net.ParseIP(addr)
+		if ip == nil || !ipNet.Contains(ip) {
+			return fmt.Errorf("infrastructure.network: dhcp address %q is not inside %s", addr, n.CIDR)
+		}
+	}
+	if compareIPv4(net.ParseIP(n.DHCPStart).To4(), net.ParseIP(n.DHCPEnd).To4()) > 0 {
+		return errors.New("infrastructure.network: dhcpStart must not be after dhcpEnd")
+	}
+	if n.Bridge == "" {
+		return errors.New("infrastructure.network.bridge must not be empty")
+	}
+	if n.IPv6CIDR != "" {
+		_, prefix, err := n.ipv6Network()
+		if err != nil {
+			return fmt.Errorf("infrastructure.network.ipv6CIDR: %w", err)
+		}
+		// The node addresses start at the offset, a few hundred nodes have to fit.
+		if prefix > 112 {
+			return fmt.Errorf("infrastructure.network.ipv6CIDR: prefix /%d is too long, at most /112 is supported", prefix)
+		}
+	}
+	return nil
+}
+
+func compareIPv4(a, b net.IP) int {
+	for i := 0; i < net.IPv4len; i++ {
+		if a[i] != b[i] {
+			return int(a[i]) - int(b[i])
+		}
+	}
+	return 0
+}
+
+// DefaultClusterConfig returns the topology delegatio used before it became configurable,
+// one control plane and two workers.
+func DefaultClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		ControlPlane: NodeSpec{
+			Count:     1,
+			VCPUs:     16,
+			MemoryMiB: 4096,
+			DiskGiB:   100,
+		},
+		Worker: NodeSpec{
+			Count:     2,
+			VCPUs:     16,
+			MemoryMiB: 4096,
+			DiskGiB:   100,
+		},
+		APIServerVIP: "10.42.0.100",
+	}
+}
+
+// NumNodes returns the total number of VMs in the cluster.
+func (c *ClusterConfig) NumNodes() int {
+	return c.ControlPlane.Count + c.Worker.Count
+}
+
+// HighAvailability returns true if the API servers are fronted by a virtual IP.
+func (c *ClusterConfig) HighAvailability() bool {
+	return c.ControlPlane.Count > 1
+}
+
+// Validate checks that the cluster can be created with the given topology.
+func (c *ClusterConfig) Validate() error {
+	if c.ControlPlane.Count < 1 {
+		return errors.New("at least one control plane is required")
+	}
+	if c.HighAvailability() && net.ParseIP(c.APIServerVIP) == nil {
+		return fmt.Errorf("invalid api server vip: %q", c.APIServerVIP)
+	}
+	if c.Worker.Count < 0 {
+		return errors.New("number of workers must not be negative")
+	}
+	if err := c.ControlPlane.validate(); err != nil {
+		return fmt.Errorf("control plane: %w", err)
+	}
+	if c.Worker.Count > 0 {
+		if err := c.Worker.validate(); err != nil {
+			return fmt.Errorf("worker: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s NodeSpec) validate() error {
+	if s.VCPUs == 0 {
+		return errors.New("vcpus must be greater than zero")
+	}
+	if s.MemoryMiB == 0 {
+		return errors.New("memory must be greater than zero")
+	}
+	if s.DiskGiB == 0 {
+		return errors.New("disk size must be greater than zero")
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/benschlueter/delegatio/cli/config"
+)
+
+func TestDefault(t *testing.T) {
+	cfg := config.Default()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("the defaults are invalid: %v", err)
+	}
+	if cfg.Version != config.Version || cfg.Infrastructure.Provider != config.ProviderQemu {
+		t.Errorf("got version %q and provider %q", cfg.Version, cfg.Infrastructure.Provider)
+	}
+	if cfg.Cluster.HighAvailability() {
+		t.Error("the default cluster has several control planes")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := map[string]struct {
+		change  func(cfg *config.Config)
+		wantErr bool
+	}{
+		"defaults": {
+			change: func(cfg *config.Config) {},
+		},
+		"unsupported version": {
+			change:  func(cfg *config.Config) { cfg.Version = "v0" },
+			wantErr: true,
+		},
+		"unknown provider": {
+			change:  func(cfg *config.Config) { cfg.Infrastructure.Provider = "vmware" },
+			wantErr: true,
+		},
+		"challenge name with upper case letters": {
+			change:  func(cfg *config.Config) { cfg.Challenges[0].Name = "TestChallenge" },
+			wantErr: true,
+		},
+		"challenge name with a dot": {
+			change:  func(cfg *config.Config) { cfg.Challenges[0].Name = "web.1" },
+			wantErr: true,
+		},
+		"challenge name too long": {
+			change: func(cfg *config.Config) {
+				cfg.Challenges[0].Name = "challenge-with-a-name-which-is-longer-than-sixty-three-characters"
+			},
+			wantErr: true,
+		},
+		"challenge without image": {
+			change:  func(cfg *config.Config) { cfg.Challenges[0].Image = "" },
+			wantErr: true,
+		},
+		"duplicate challenge": {
+			change:  func(cfg *config.Config) { cfg.Challenges = append(cfg.Challenges, cfg.Challenges[0]) },
+			wantErr: true,
+		},
+		"invalid storage size": {
+			change:  func(cfg *config.Config) { cfg.Storage.Size = "five" },
+			wantErr: true,
+		},
+		"negative upload limit": {
+			change:  func(cfg *config.Config) { cfg.SSH.UploadLimit = "-1" },
+			wantErr: true,
+		},
+		"relative sftp server": {
+			change:  func(cfg *config.Config) { cfg.SSH.SFTPServer = "sftp-server" },
+			wantErr: true,
+		},
+		"invalid environment pattern": {
+			change:  func(cfg *config.Config) { cfg.SSH.AllowedEnv = []string{"LC_["} },
+			wantErr: true,
+		},
+		"store users without store": {
+			change:  func(cfg *config.Config) { cfg.SSH.Users.Source = config.UserSourceStore },
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			cfg := config.Default()
+			tc.change(cfg)
+			if err := cfg.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want an error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	testCases := map[string]struct {
+		content string
+		want    func(cfg *config.Config)
+		wantErr bool
+	}{
+		"missing fields keep their defaults": {
+			content: "version: v1\nstorage:\n  size: 10Gi\n",
+			want:    func(cfg *config.Config) { cfg.Storage.Size = "10Gi" },
+		},
+		"json": {
+			content: `{"version": "v1", "challenges": [{"name": "web", "image": "nginx"}]}`,
+			want: func(cfg *config.Config) {
+				cfg.Challenges = []config.ChallengeConfig{{Name: "web", Image: "nginx"}}
+			},
+		},
+		"unknown field": {
+			content: "version: v1\nstorag:\n  size: 10Gi\n",
+			wantErr: true,
+		},
+		"invalid yaml": {
+			content: "version: [v1\n",
+			wantErr: true,
+		},
+		"invalid challenge name": {
+			content: "version: v1\nchallenges:\n- name: Web_1\n  image: nginx\n",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "delegatio.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := config.Load(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			want := config.Default()
+			tc.want(want)
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("got %+v, want %+v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestLoadWithoutPath(t *testing.T) {
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, config.Default()) {
+		t.Errorf("got %+v, want the defaults", cfg)
+	}
+}
+
+func TestLoadExample(t *testing.T) {
+	if _, err := config.Load(filepath.Join("..", "..", "delegatio.example.yaml")); err != nil {
+		t.Fatalf("the example config is invalid: %v", err)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := config.Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("a missing config file was loaded")
+	}
+}
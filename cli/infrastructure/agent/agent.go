@@ -0,0 +1,256 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package agent drives the delegatio agent, which runs in every VM, over its gRPC API.
+// It is shared by all infrastructure backends, which only differ in how the VMs are created.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/benschlueter/delegatio/client/config"
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapio"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Client is a connection to the agent of a single VM.
+type Client struct {
+	conn *grpc.ClientConn
+	api  vmproto.APIClient
+	log  *zap.Logger
+}
+
+// Dial connects to the agent listening on host. The agent requires the client certificate
+// of creds, see pki.ClientCredentials, and must present a certificate for serverName.
+func Dial(ctx context.Context, log *zap.Logger, host, serverName string, creds credentials.TransportCredentials) (*Client, error) {
+	conn, err := grpc.DialContext(ctx, net.JoinHostPort(host, config.PublicAPIport),
+		grpc.WithTransportCredentials(creds),
+		// The TLS credentials verify the authority, the certificates do not contain the address.
+		grpc.WithAuthority(serverName),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn: conn,
+		api:  vmproto.NewAPIClient(conn),
+		log:  log,
+	}, nil
+}
+
+// Close closes the connection to the agent.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// WaitUntilReady blocks until the health service of the agent reports it as serving or the
+// timeout expires. The agent is polled with an exponential backoff.
+func (c *Client) WaitUntilReady(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	healthClient := healthpb.NewHealthClient(c.conn)
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, ReadyBackoff(), func() (bool, error) {
+		resp, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: vmproto.API_ServiceDesc.ServiceName})
+		switch {
+		case err != nil:
+			lastErr = err
+		case resp.GetStatus() != healthpb.HealthCheckResponse_SERVING:
+			lastErr = fmt.Errorf("agent reports %s", resp.GetStatus())
+		default:
+			return true, nil
+		}
+		c.log.Debug("agent is not ready yet", zap.Error(lastErr))
+		return false, nil
+	})
+	if err != nil {
+		if lastErr == nil {
+			lastErr = err
+		}
+		return fmt.Errorf("agent not ready after %v: %w", timeout, lastErr)
+	}
+	return nil
+}
+
+// GetNodeInfo returns the state of the VM.
+func (c *Client) GetNodeInfo(ctx context.Context) (*vmproto.GetNodeInfoResponse, error) {
+	return c.api.GetNodeInfo(ctx, &vmproto.GetNodeInfoRequest{})
+}
+
+// ReadyBackoff is the backoff to poll VMs which are booting.
+func ReadyBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: 250 * time.Millisecond,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      5 * time.Second,
+	}
+}
+
+// Command is a command executed by the agent.
+type Command struct {
+	Name string
+	Args []string
+	// Env entries have the form KEY=VALUE, they are added to the environment of the agent.
+	Env []string
+	// Dir is the working directory, the one of the agent if it is empty.
+	Dir string
+	// Timeout kills the command once it expires, zero means no timeout.
+	Timeout time.Duration
+	// Stdin is streamed to the command until it returns io.EOF. The command reads no input if it is nil.
+	Stdin io.Reader
+	// Stdout and Stderr receive the output while the command runs, it is discarded if they are nil.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ExitError is returned for commands which did not exit with code zero.
+type ExitError struct {
+	Code     int
+	TimedOut bool
+	// Stderr is the error output of the command, if the caller did not consume it.
+	Stderr []byte
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("command exited with code %d", e.Code)
+	if e.TimedOut {
+		msg = "command timed out"
+	}
+	if len(e.Stderr) > 0 {
+		msg += ": " + strings.TrimSpace(string(e.Stderr))
+	}
+	return msg
+}
+
+func (cmd *Command) request() *vmproto.ExecCommandRequest {
+	req := &vmproto.ExecCommandRequest{
+		Command: cmd.Name,
+		Args:    cmd.Args,
+		Env:     cmd.Env,
+		Dir:     cmd.Dir,
+	}
+	if cmd.Timeout > 0 {
+		req.Timeout = durationpb.New(cmd.Timeout)
+	}
+	return req
+}
+
+// exitError converts a non-zero exit status into an *ExitError.
+func exitError(exit *vmproto.ExitStatus, stderr []byte) error {
+	if exit.GetCode() == 0 && !exit.GetTimedOut() {
+		return nil
+	}
+	return &ExitError{Code: int(exit.GetCode()), TimedOut: exit.GetTimedOut(), Stderr: stderr}
+}
+
+// Run executes cmd and streams its input and output while it runs.
+// If the command does not exit with code zero, an *ExitError is returned.
+func (c *Client) Run(ctx context.Context, cmd *Command) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.api.ExecCommandStream(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&vmproto.ExecCommandStreamRequest{
+		Content: &vmproto.ExecCommandStreamRequest_Start{Start: cmd.request()},
+	}); err != nil {
+		return err
+	}
+	if cmd.Stdin == nil {
+		if err := stream.CloseSend(); err != nil {
+			return err
+		}
+	} else {
+		// The goroutine outlives Run if Stdin blocks, i.e. on a terminal.
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := cmd.Stdin.Read(buf)
+				if n > 0 {
+					if sendErr := stream.Send(&vmproto.ExecCommandStreamRequest{
+						Content: &vmproto.ExecCommandStreamRequest_Stdin{Stdin: buf[:n]},
+					}); sendErr != nil {
+						return
+					}
+				}
+				if err != nil {
+					_ = stream.CloseSend()
+					return
+				}
+			}
+		}()
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("the agent closed the stream without an exit status")
+			}
+			return err
+		}
+		switch content := resp.GetContent().(type) {
+		case *vmproto.ExecCommandStreamResponse_Stdout:
+			if cmd.Stdout != nil {
+				if _, err := cmd.Stdout.Write(content.Stdout); err != nil {
+					return err
+				}
+			}
+		case *vmproto.ExecCommandStreamResponse_Stderr:
+			if cmd.Stderr != nil {
+				if _, err := cmd.Stderr.Write(content.Stderr); err != nil {
+					return err
+				}
+			}
+		case *vmproto.ExecCommandStreamResponse_Exit:
+			return exitError(content.Exit, nil)
+		}
+	}
+}
+
+// Exec executes a command and returns its output.
+func (c *Client) Exec(ctx context.Context, command string, args ...string) ([]byte, error) {
+	resp, err := c.api.ExecCommand(ctx, (&Command{Name: command, Args: args}).request())
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetStdout(), exitError(resp.GetExit(), resp.GetStderr())
+}
+
+// ExecStream executes a long running command and logs its output while it runs.
+// The output is returned once the command finished.
+func (c *Client) ExecStream(ctx context.Context, command string, args ...string) ([]byte, error) {
+	stdoutLog := &zapio.Writer{Log: c.log.With(zap.String("command", command)), Level: zap.DebugLevel}
+	defer stdoutLog.Close()
+	stderrLog := &zapio.Writer{Log: c.log.With(zap.String("command", command), zap.Bool("stderr", true)), Level: zap.DebugLevel}
+	defer stderrLog.Close()
+	var stdout, stderr bytes.Buffer
+	err := c.Run(ctx, &Command{
+		Name:   command,
+		Args:   args,
+		Stdout: io.MultiWriter(&stdout, stdoutLog),
+		Stderr: io.MultiWriter(&stderr, stderrLog),
+	})
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
@@ -0,0 +1,170 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+)
+
+// uploadChunkSize is the size of the chunks of UploadFile, it stays below the gRPC message limit.
+const uploadChunkSize = 1 << 20
+
+// FileOptions describe how a file is created in the VM.
+type FileOptions struct {
+	// Mode holds the permission bits, 0644 if it is zero.
+	Mode fs.FileMode
+	// UID and GID own the file, zero is root.
+	UID, GID uint32
+	// CreateParents creates missing parent directories.
+	CreateParents bool
+}
+
+func (o FileOptions) proto() *vmproto.FileOptions {
+	mode := uint32(o.Mode.Perm())
+	if o.Mode&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if o.Mode&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if o.Mode&fs.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return &vmproto.FileOptions{Mode: mode, Uid: o.UID, Gid: o.GID, CreateParents: o.CreateParents}
+}
+
+// FileInfo describes a file in the VM.
+type FileInfo struct {
+	Name    string
+	Type    vmproto.FileInfo_Type
+	Size    int64
+	Mode    uint32
+	UID     uint32
+	GID     uint32
+	ModTime time.Time
+}
+
+// IsDir reports whether the file is a directory.
+func (i *FileInfo) IsDir() bool {
+	return i.Type == vmproto.FileInfo_TYPE_DIRECTORY
+}
+
+func newFileInfo(info *vmproto.FileInfo) *FileInfo {
+	return &FileInfo{
+		Name:    info.GetName(),
+		Type:    info.GetType(),
+		Size:    info.GetSize(),
+		Mode:    info.GetMode(),
+		UID:     info.GetUid(),
+		GID:     info.GetGid(),
+		ModTime: info.GetModTime().AsTime(),
+	}
+}
+
+// WriteFile writes content to dir/name in the VM. The file is replaced atomically.
+func (c *Client) WriteFile(ctx context.Context, dir, name string, content []byte, opts FileOptions) error {
+	_, err := c.api.WriteFile(ctx, &vmproto.WriteFileRequest{
+		Filepath: dir,
+		Filename: name,
+		Content:  content,
+		Options:  opts.proto(),
+	})
+	return err
+}
+
+// UploadFile streams the content of r to dir/name in the VM, i.e., container image archives
+// which exceed the size of a single message. The file appears once r returned io.EOF.
+func (c *Client) UploadFile(ctx context.Context, dir, name string, r io.Reader, opts FileOptions) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	// Canceling the stream makes the agent drop the incomplete file.
+	defer cancel()
+	stream, err := c.api.UploadFile(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := stream.Send(&vmproto.UploadFileRequest{
+		Content: &vmproto.UploadFileRequest_Header{Header: &vmproto.UploadFileHeader{
+			Filepath: dir,
+			Filename: name,
+			Options:  opts.proto(),
+		}},
+	}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&vmproto.UploadFileRequest{
+				Content: &vmproto.UploadFileRequest_Chunk{Chunk: buf[:n]},
+			}); err != nil {
+				// the reason is returned by CloseAndRecv.
+				if errors.Is(err, io.EOF) {
+					_, err = stream.CloseAndRecv()
+				}
+				return 0, err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetSize(), nil
+}
+
+// ReadFile returns the content of a file in the VM.
+func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	stream, err := c.api.ReadFile(ctx, &vmproto.ReadFileRequest{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	var content bytes.Buffer
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return content.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		content.Write(resp.GetChunk())
+	}
+}
+
+// Stat returns the attributes of a file in the VM.
+func (c *Client) Stat(ctx context.Context, path string) (*FileInfo, error) {
+	resp, err := c.api.Stat(ctx, &vmproto.StatRequest{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(resp.GetInfo()), nil
+}
+
+// ListDir returns the entries of a directory in the VM.
+func (c *Client) ListDir(ctx context.Context, path string) ([]*FileInfo, error) {
+	resp, err := c.api.ListDir(ctx, &vmproto.ListDirRequest{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*FileInfo, 0, len(resp.GetEntries()))
+	for _, entry := range resp.GetEntries() {
+		entries = append(entries, newFileInfo(entry))
+	}
+	return entries, nil
+}
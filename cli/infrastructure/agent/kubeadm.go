@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// InitCluster runs kubeadm init with the given configuration and returns the join token for
+// the other nodes together with the admin kubeconfig. If uploadCerts is set, the control plane
+// certificates are uploaded into the cluster and the certificate key of the join token is
+// required to join further control planes.
+func (c *Client) InitCluster(ctx context.Context, initConfig []byte, uploadCerts bool) (*state.JoinToken, []byte, error) {
+	c.log.Info("execute kubeadm init")
+	resp, err := c.api.InitCluster(ctx, &vmproto.InitClusterRequest{
+		Config:      initConfig,
+		UploadCerts: uploadCerts,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	joinToken, err := newJoinToken(resp.GetJoinToken())
+	if err != nil {
+		return nil, nil, err
+	}
+	return joinToken, resp.GetKubeconfig(), nil
+}
+
+// JoinCluster runs kubeadm join. A control plane requires the certificate key of the join token.
+func (c *Client) JoinCluster(ctx context.Context, joinToken *state.JoinToken, controlPlane bool) error {
+	_, err := c.api.JoinCluster(ctx, &vmproto.JoinClusterRequest{
+		JoinToken: &vmproto.JoinToken{
+			ApiServerEndpoint: joinToken.APIServerEndpoint,
+			Token:             joinToken.Token,
+			CaCertHash:        joinToken.CACertHash,
+			CertificateKey:    joinToken.CertificateKey,
+		},
+		ControlPlane: controlPlane,
+	})
+	return err
+}
+
+// CreateJoinToken creates a new bootstrap token with kubeadm's default lifetime. It must be
+// called on a control plane. If uploadCerts is set, the control plane certificates are
+// uploaded again and the token contains the new certificate key.
+func (c *Client) CreateJoinToken(ctx context.Context, uploadCerts bool) (*state.JoinToken, error) {
+	resp, err := c.api.CreateJoinToken(ctx, &vmproto.CreateJoinTokenRequest{UploadCerts: uploadCerts})
+	if err != nil {
+		return nil, err
+	}
+	return newJoinToken(resp.GetJoinToken())
+}
+
+// ResetNode reverts the changes of kubeadm init or join.
+func (c *Client) ResetNode(ctx context.Context) error {
+	_, err := c.api.ResetNode(ctx, &vmproto.ResetNodeRequest{})
+	return err
+}
+
+// GetKubeconfig returns the admin kubeconfig of a control plane.
+func (c *Client) GetKubeconfig(ctx context.Context) ([]byte, error) {
+	resp, err := c.api.GetKubeconfig(ctx, &vmproto.GetKubeconfigRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetKubeconfig(), nil
+}
+
+// newJoinToken converts the join token of the agent into the one of the state file.
+func newJoinToken(token *vmproto.JoinToken) (*state.JoinToken, error) {
+	if token.GetApiServerEndpoint() == "" || token.GetToken() == "" || token.GetCaCertHash() == "" {
+		return nil, errors.New("the agent returned an incomplete join token")
+	}
+	joinToken := &state.JoinToken{
+		APIServerEndpoint: token.ApiServerEndpoint,
+		Token:             token.Token,
+		CACertHash:        token.CaCertHash,
+		Expiry:            asTime(token.Expiry),
+		CertificateKey:    token.CertificateKey,
+	}
+	if token.CertificateKey != "" {
+		joinToken.CertificateKeyExpiry = asTime(token.CertificateKeyExpiry)
+	}
+	return joinToken, nil
+}
+
+// asTime returns the zero time for unset timestamps.
+func asTime(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
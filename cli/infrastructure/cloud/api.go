@@ -0,0 +1,202 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Status of servers and images, as reported by the API.
+const (
+	ServerStatusBuild  = "BUILD"
+	ServerStatusActive = "ACTIVE"
+	ServerStatusError  = "ERROR"
+	ImageStatusQueued  = "queued"
+	ImageStatusActive  = "active"
+)
+
+// errNotFound is returned if the API does not know the requested resource.
+var errNotFound = errors.New("resource not found")
+
+// Network is a private network of the VMs.
+type Network struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	CIDR string `json:"cidr"`
+}
+
+// Image is a disk image the VMs boot from.
+type Image struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	DiskFormat string `json:"diskFormat"`
+	Status     string `json:"status"`
+}
+
+// Server is a VM.
+type Server struct {
+	ID          string            `json:"id,omitempty"`
+	Name        string            `json:"name"`
+	ImageID     string            `json:"imageID"`
+	NetworkID   string            `json:"networkID"`
+	VCPUs       uint              `json:"vcpus"`
+	MemoryMiB   uint              `json:"memoryMiB"`
+	DiskGiB     uint64            `json:"diskGiB"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Status      string            `json:"status,omitempty"`
+	PrivateIPv4 string            `json:"privateIPv4,omitempty"`
+	PublicIPv4  string            `json:"publicIPv4,omitempty"`
+}
+
+// apiClient talks to the OpenStack-style compute API of a cloud provider.
+type apiClient struct {
+	endpoint   *url.URL
+	token      string
+	httpClient *http.Client
+}
+
+func newAPIClient(endpoint, token string, httpClient *http.Client) (*apiClient, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &apiClient{
+		endpoint:   u,
+		token:      token,
+		httpClient: httpClient,
+	}, nil
+}
+
+func (a *apiClient) createNetwork(ctx context.Context, network *Network) (*Network, error) {
+	var created Network
+	if err := a.do(ctx, http.MethodPost, "networks", network, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (a *apiClient) getNetwork(ctx context.Context, id string) (*Network, error) {
+	var network Network
+	if err := a.do(ctx, http.MethodGet, "networks/"+id, nil, &network); err != nil {
+		return nil, err
+	}
+	return &network, nil
+}
+
+func (a *apiClient) deleteNetwork(ctx context.Context, id string) error {
+	return a.do(ctx, http.MethodDelete, "networks/"+id, nil, nil)
+}
+
+func (a *apiClient) createImage(ctx context.Context, image *Image) (*Image, error) {
+	var created Image
+	if err := a.do(ctx, http.MethodPost, "images", image, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// uploadImage uploads the content of the image. The size must be known, the body is streamed.
+func (a *apiClient) uploadImage(ctx context.Context, id string, content io.Reader, size int64) error {
+	// the transport closes the body, the caller owns content.
+	req, err := a.newRequest(ctx, http.MethodPut, "images/"+id+"/file", io.NopCloser(content))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return a.send(req, nil)
+}
+
+func (a *apiClient) getImage(ctx context.Context, id string) (*Image, error) {
+	var image Image
+	if err := a.do(ctx, http.MethodGet, "images/"+id, nil, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (a *apiClient) deleteImage(ctx context.Context, id string) error {
+	return a.do(ctx, http.MethodDelete, "images/"+id, nil, nil)
+}
+
+func (a *apiClient) createServer(ctx context.Context, server *Server) (*Server, error) {
+	var created Server
+	if err := a.do(ctx, http.MethodPost, "servers", server, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (a *apiClient) getServer(ctx context.Context, id string) (*Server, error) {
+	var server Server
+	if err := a.do(ctx, http.MethodGet, "servers/"+id, nil, &server); err != nil {
+		return nil, err
+	}
+	return &server, nil
+}
+
+func (a *apiClient) deleteServer(ctx context.Context, id string) error {
+	return a.do(ctx, http.MethodDelete, "servers/"+id, nil, nil)
+}
+
+// do sends the JSON encoded body to the API and decodes the response into result.
+func (a *apiClient) do(ctx context.Context, method, path string, body, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := a.newRequest(ctx, method, path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return a.send(req, result)
+}
+
+func (a *apiClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	u := a.endpoint.JoinPath("v1", path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	return req, nil
+}
+
+func (a *apiClient) send(req *http.Request, result any) error {
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, errNotFound)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,636 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package cloud creates the VMs of the cluster at a public cloud.
+//
+// The provider is accessed through a small OpenStack-style REST API below the configured endpoint:
+//
+//	POST   /v1/networks           create a network         {"name", "cidr"}
+//	GET    /v1/networks/{id}      get a network
+//	DELETE /v1/networks/{id}      delete a network
+//	POST   /v1/images             create an image          {"name", "diskFormat"}
+//	PUT    /v1/images/{id}/file   upload the image content
+//	GET    /v1/images/{id}        get an image
+//	DELETE /v1/images/{id}        delete an image
+//	POST   /v1/servers            create a server          {"name", "imageID", "networkID", "vcpus", "memoryMiB", "diskGiB"}
+//	GET    /v1/servers/{id}       get a server, including its status and addresses
+//	DELETE /v1/servers/{id}       delete a server
+//
+// The VMs boot the same image as with qemu, Kubernetes is set up through the delegatio agent.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure/agent"
+	"github.com/benschlueter/delegatio/cli/infrastructure/image"
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
+	"github.com/benschlueter/delegatio/client/pki"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// ServerPrefix is the prefix of every server name, the number of each VM is appended.
+	ServerPrefix = "delegatio-"
+	// NetworkName is the name of the network in which the VMs are connected.
+	NetworkName = "delegatio-net"
+	// ImageName is the name of the image the VMs boot from.
+	ImageName = "delegatio"
+)
+
+// Instance creates the cluster at a cloud provider.
+type Instance struct {
+	Log            *zap.Logger
+	StatePath      string
+	KubeconfigPath string
+	Config         *config.Config
+	// HTTPClient is used for all requests to the API, http.DefaultClient if it is nil.
+	HTTPClient *http.Client
+	// PollInterval is the time between two status requests while waiting for a server.
+	PollInterval time.Duration
+	// AgentTimeout is the time the agent of a new server has to come up.
+	AgentTimeout time.Duration
+	// AgentCredentials authenticate the CLI to the agents. The servers boot an image with the
+	// agent certificate baked in, which is issued for pki.AgentServerName.
+	AgentCredentials credentials.TransportCredentials
+
+	mux sync.Mutex
+	// saveMux orders the writes of the state file, a snapshot must not overwrite a newer one.
+	saveMux   sync.Mutex
+	api       *apiClient
+	networkID string
+	imageID   string
+	nodes     map[string]*nodeInfo
+	joinToken *state.JoinToken
+}
+
+type nodeInfo struct {
+	id           string
+	controlPlane bool
+	privateIP    string
+	publicIP     string
+	joined       bool
+}
+
+// address returns the address under which the CLI reaches the node.
+func (n *nodeInfo) address() string {
+	if n.publicIP != "" {
+		return n.publicIP
+	}
+	return n.privateIP
+}
+
+// ConnectWithInfrastructureService sets up the client of the API at url and re-attaches
+// to the resources recorded in the state file.
+func (c *Instance) ConnectWithInfrastructureService(ctx context.Context, url string) error {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	api, err := newAPIClient(url, os.Getenv(c.Config.Infrastructure.Cloud.TokenEnv), httpClient)
+	if err != nil {
+		return err
+	}
+	c.api = api
+	if c.nodes == nil {
+		c.nodes = make(map[string]*nodeInfo)
+	}
+	return c.loadState(ctx)
+}
+
+// InitializeInfrastructure creates the network and uploads the image.
+// Resources recorded in the state file are reused.
+func (c *Instance) InitializeInfrastructure(ctx context.Context) error {
+	if c.networkID == "" {
+		c.Log.Info("creating network", zap.String("cidr", c.Config.Infrastructure.Network.CIDR))
+		network, err := c.api.createNetwork(ctx, &Network{
+			Name: NetworkName,
+			CIDR: c.Config.Infrastructure.Network.CIDR,
+		})
+		if err != nil {
+			return fmt.Errorf("creating network: %w", err)
+		}
+		c.networkID = network.ID
+		if err := c.saveState(); err != nil {
+			return err
+		}
+	}
+	if c.imageID == "" {
+		if err := c.uploadImage(ctx); err != nil {
+			return err
+		}
+		if err := c.saveState(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadImage verifies the image the VMs boot from and uploads it.
+func (c *Instance) uploadImage(ctx context.Context) (err error) {
+	infra := c.Config.Infrastructure
+	imagePath := infra.ImagePath
+	c.Log.Info("verifying image", zap.String("path", imagePath))
+	digest, err := image.Verify(imagePath, infra.ImageChecksums, infra.ImageSigningKey)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("error while opening %s: %w", imagePath, err)
+	}
+	defer func() {
+		err = multierr.Append(err, file.Close())
+	}()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	diskFormat := "raw"
+	if strings.HasSuffix(imagePath, ".qcow2") {
+		diskFormat = "qcow2"
+	}
+	created, err := c.api.createImage(ctx, &Image{Name: ImageName, DiskFormat: diskFormat})
+	if err != nil {
+		return fmt.Errorf("creating image: %w", err)
+	}
+	c.Log.Info("uploading image", zap.String("path", imagePath), zap.Int64("size", fi.Size()))
+	progress := image.NewProgress(c.Log, 0, fi.Size())
+	if err := c.api.uploadImage(ctx, created.ID, progress.Reader(file), fi.Size()); err != nil {
+		// an image without content is useless, do not leave it behind.
+		return multierr.Append(fmt.Errorf("uploading image: %w", err), c.api.deleteImage(context.Background(), created.ID))
+	}
+	c.imageID = created.ID
+	c.Log.Info("image upload successful", zap.String("id", created.ID), zap.String("sha256", digest))
+	return nil
+}
+
+// InitializeKubernetes creates the servers and initializes Kubernetes on them.
+// Nodes which already joined the cluster according to the state file are skipped.
+func (c *Instance) InitializeKubernetes(ctx context.Context, k8sConfig []byte) error {
+	if c.Config.Cluster.HighAvailability() {
+		return errors.New("the cloud provider supports a single control plane only")
+	}
+	g, ctxGo := errgroup.WithContext(ctx)
+	// The first node is the control plane, the remaining ones are workers.
+	for i := 0; i < c.Config.Cluster.NumNodes(); i++ {
+		name := ServerPrefix + strconv.Itoa(i)
+		if node := c.node(name); node != nil {
+			// the CLI might have exited before the server got its address.
+			if node.privateIP == "" {
+				g.Go(func() error {
+					return c.waitForServer(ctxGo, name)
+				})
+			}
+			continue
+		}
+		spec, controlPlane := c.Config.Cluster.Worker, false
+		if i < c.Config.Cluster.ControlPlane.Count {
+			spec, controlPlane = c.Config.Cluster.ControlPlane, true
+		}
+		g.Go(func() error {
+			return c.createServer(ctxGo, name, spec, controlPlane)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	g, ctxGo = errgroup.WithContext(ctx)
+	for i := 0; i < c.Config.Cluster.NumNodes(); i++ {
+		name := ServerPrefix + strconv.Itoa(i)
+		if c.node(name).joined {
+			continue
+		}
+		g.Go(func() error {
+			return c.waitUntilReady(ctxGo, name)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	c.Log.Info("delegatio-agent is ready")
+
+	firstControlPlane := ServerPrefix + "0"
+	if c.joinToken == nil {
+		if err := c.initializeFirstControlPlane(ctx, firstControlPlane, k8sConfig); err != nil {
+			return err
+		}
+	} else {
+		c.Log.Info("kubernetes is already initialized")
+	}
+	if !c.node(firstControlPlane).joined {
+		return fmt.Errorf("the only control plane %s was lost, the cluster must be destroyed", firstControlPlane)
+	}
+	if c.joinToken.Expired(time.Now()) && !c.allNodesJoined() {
+		c.Log.Info("join token expired, creating a new one", zap.Time("expiry", c.joinToken.Expiry))
+		if err := c.refreshJoinToken(ctx); err != nil {
+			return err
+		}
+	}
+
+	g, ctxGo = errgroup.WithContext(ctx)
+	for i := c.Config.Cluster.ControlPlane.Count; i < c.Config.Cluster.NumNodes(); i++ {
+		name := ServerPrefix + strconv.Itoa(i)
+		if c.node(name).joined {
+			continue
+		}
+		g.Go(func() error {
+			return c.joinWorker(ctxGo, name)
+		})
+	}
+	return g.Wait()
+}
+
+// AddNode creates a new worker and joins it into the running cluster.
+// It returns the name of the new node.
+func (c *Instance) AddNode(ctx context.Context) (string, error) {
+	if c.joinToken == nil {
+		return "", errors.New("the cluster is not initialized, run create first")
+	}
+	name := c.nextWorkerName()
+	c.Log.Info("adding worker", zap.String("id", name))
+	if err := c.createServer(ctx, name, c.Config.Cluster.Worker, false); err != nil {
+		return "", err
+	}
+	if err := c.waitUntilReady(ctx, name); err != nil {
+		return "", err
+	}
+	// The token of kubeadm init is only valid for a day, the cluster usually lives longer.
+	if err := c.refreshJoinToken(ctx); err != nil {
+		return "", err
+	}
+	return name, c.joinWorker(ctx, name)
+}
+
+// RemoveNode resets Kubernetes on a worker and deletes its server.
+// The node must be drained beforehand.
+func (c *Instance) RemoveNode(ctx context.Context, name string) error {
+	node := c.node(name)
+	if node == nil {
+		return fmt.Errorf("node %s does not exist", name)
+	}
+	if node.controlPlane {
+		return fmt.Errorf("node %s is a control plane, only workers can be removed", name)
+	}
+	if node.joined {
+		client, err := agent.Dial(ctx, c.Log.Named("agent").With(zap.String("id", name)), node.address(), pki.AgentServerName, c.AgentCredentials)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		c.Log.Info("executing kubeadm reset", zap.String("id", name))
+		if err := client.ResetNode(ctx); err != nil {
+			return fmt.Errorf("resetting node %s: %w", name, err)
+		}
+	}
+	if err := c.api.deleteServer(ctx, node.id); err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	c.mux.Lock()
+	delete(c.nodes, name)
+	c.mux.Unlock()
+	c.Log.Info("node removed", zap.String("id", name))
+	return c.saveState()
+}
+
+// TerminateInfrastructure deletes all resources created at the provider.
+// The state file is removed once everything is gone.
+func (c *Instance) TerminateInfrastructure() error {
+	ctx := context.Background()
+	var err error
+	c.mux.Lock()
+	for name, node := range c.nodes {
+		if dErr := c.api.deleteServer(ctx, node.id); dErr != nil && !errors.Is(dErr, errNotFound) {
+			err = multierr.Append(err, dErr)
+			continue
+		}
+		delete(c.nodes, name)
+	}
+	c.mux.Unlock()
+	if err != nil {
+		// the network and the image are still in use.
+		return multierr.Append(err, c.saveState())
+	}
+	if c.networkID != "" {
+		if dErr := c.api.deleteNetwork(ctx, c.networkID); dErr != nil && !errors.Is(dErr, errNotFound) {
+			err = multierr.Append(err, dErr)
+		} else {
+			c.networkID = ""
+		}
+	}
+	if c.imageID != "" {
+		if dErr := c.api.deleteImage(ctx, c.imageID); dErr != nil && !errors.Is(dErr, errNotFound) {
+			err = multierr.Append(err, dErr)
+		} else {
+			c.imageID = ""
+		}
+	}
+	if err != nil {
+		return multierr.Append(err, c.saveState())
+	}
+	c.joinToken = nil
+	if c.StatePath == "" {
+		return nil
+	}
+	return state.Remove(c.StatePath)
+}
+
+// TerminateConnection closes the idle connections to the API.
+func (c *Instance) TerminateConnection() error {
+	if c.api != nil {
+		c.api.httpClient.CloseIdleConnections()
+	}
+	return nil
+}
+
+// createServer creates a server and waits until the provider assigned its addresses.
+func (c *Instance) createServer(ctx context.Context, name string, spec config.NodeSpec, controlPlane bool) error {
+	c.Log.Info("creating server", zap.String("name", name))
+	server, err := c.api.createServer(ctx, &Server{
+		Name:      name,
+		ImageID:   c.imageID,
+		NetworkID: c.networkID,
+		VCPUs:     spec.VCPUs,
+		MemoryMiB: spec.MemoryMiB,
+		DiskGiB:   spec.DiskGiB,
+	})
+	if err != nil {
+		return fmt.Errorf("creating server %s: %w", name, err)
+	}
+	c.mux.Lock()
+	c.nodes[name] = &nodeInfo{id: server.ID, controlPlane: controlPlane}
+	c.mux.Unlock()
+	if err := c.saveState(); err != nil {
+		return err
+	}
+	return c.waitForServer(ctx, name)
+}
+
+// waitForServer waits until the server is active and records its addresses.
+func (c *Instance) waitForServer(ctx context.Context, name string) error {
+	server, err := c.api.getServer(ctx, c.node(name).id)
+	if err != nil {
+		return err
+	}
+	for server.Status != ServerStatusActive || server.PrivateIPv4 == "" {
+		if server.Status == ServerStatusError {
+			return fmt.Errorf("server %s failed to start", name)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.pollInterval()):
+		}
+		if server, err = c.api.getServer(ctx, server.ID); err != nil {
+			return err
+		}
+	}
+	c.mux.Lock()
+	c.nodes[name].privateIP = server.PrivateIPv4
+	c.nodes[name].publicIP = server.PublicIPv4
+	c.mux.Unlock()
+	c.Log.Info("server is active", zap.String("name", name), zap.String("ip", server.PrivateIPv4))
+	return c.saveState()
+}
+
+// waitUntilReady blocks until the agent of the node reports it is serving.
+func (c *Instance) waitUntilReady(ctx context.Context, name string) error {
+	client, err := agent.Dial(ctx, c.Log.Named("agent").With(zap.String("id", name)), c.node(name).address(), pki.AgentServerName, c.AgentCredentials)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	timeout := c.AgentTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	if err := client.WaitUntilReady(ctx, timeout); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// initializeFirstControlPlane runs kubeadm init and records the join token.
+func (c *Instance) initializeFirstControlPlane(ctx context.Context, name string, k8sConfig []byte) error {
+	node := c.node(name)
+	client, err := agent.Dial(ctx, c.Log.Named("agent").With(zap.String("id", name)), node.address(), pki.AgentServerName, c.AgentCredentials)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	joinToken, kubeconfig, err := client.InitCluster(ctx, k8sConfig, false)
+	if err != nil {
+		return err
+	}
+	c.Log.Info("kubernetes init successful")
+	if err := c.writeKubeconfig(kubeconfig, node); err != nil {
+		return err
+	}
+	c.Log.Info("admin.conf written to disk", zap.String("path", c.KubeconfigPath))
+	c.joinToken = joinToken
+	return c.markJoined(name)
+}
+
+// writeKubeconfig writes the admin kubeconfig to disk. The API server advertises its private
+// address, which is not reachable from the CLI. The public address is used instead, the
+// certificate is still verified against the private one.
+func (c *Instance) writeKubeconfig(kubeconfig []byte, node *nodeInfo) error {
+	kubeConf, err := clientcmd.Load(kubeconfig)
+	if err != nil {
+		return err
+	}
+	if node.publicIP != "" {
+		for _, cluster := range kubeConf.Clusters {
+			_, port, err := net.SplitHostPort(strings.TrimPrefix(cluster.Server, "https://"))
+			if err != nil {
+				return err
+			}
+			cluster.Server = "https://" + net.JoinHostPort(node.publicIP, port)
+			cluster.TLSServerName = node.privateIP
+		}
+	}
+	return clientcmd.WriteToFile(*kubeConf, c.KubeconfigPath)
+}
+
+// refreshJoinToken creates a new bootstrap token on the control plane and records it.
+func (c *Instance) refreshJoinToken(ctx context.Context) error {
+	name := ServerPrefix + "0"
+	client, err := agent.Dial(ctx, c.Log.Named("agent").With(zap.String("id", name)), c.node(name).address(), pki.AgentServerName, c.AgentCredentials)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	joinToken, err := client.CreateJoinToken(ctx, false)
+	if err != nil {
+		return err
+	}
+	c.joinToken = joinToken
+	return c.saveState()
+}
+
+// joinWorker joins a worker into the cluster with the recorded join token.
+func (c *Instance) joinWorker(ctx context.Context, name string) error {
+	client, err := agent.Dial(ctx, c.Log.Named("agent").With(zap.String("id", name)), c.node(name).address(), pki.AgentServerName, c.AgentCredentials)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	c.Log.Info("executing kubeadm join", zap.String("id", name))
+	if err := client.JoinCluster(ctx, c.joinToken, false); err != nil {
+		return err
+	}
+	c.Log.Info("kubeadm join succeed", zap.String("id", name))
+	return c.markJoined(name)
+}
+
+func (c *Instance) node(name string) *nodeInfo {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.nodes[name]
+}
+
+// markJoined records that a node is part of the cluster.
+func (c *Instance) markJoined(name string) error {
+	c.mux.Lock()
+	c.nodes[name].joined = true
+	c.mux.Unlock()
+	return c.saveState()
+}
+
+func (c *Instance) allNodesJoined() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, node := range c.nodes {
+		if !node.joined {
+			return false
+		}
+	}
+	return true
+}
+
+// nextWorkerName returns the name with the smallest free number after the control planes.
+func (c *Instance) nextWorkerName() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for id := c.Config.Cluster.ControlPlane.Count; ; id++ {
+		name := ServerPrefix + strconv.Itoa(id)
+		if _, ok := c.nodes[name]; !ok {
+			return name
+		}
+	}
+}
+
+func (c *Instance) pollInterval() time.Duration {
+	if c.PollInterval == 0 {
+		return 2 * time.Second
+	}
+	return c.PollInterval
+}
+
+// loadState re-attaches to the resources recorded in the state file.
+// Resources which no longer exist at the provider are dropped.
+func (c *Instance) loadState(ctx context.Context) error {
+	if c.StatePath == "" {
+		return nil
+	}
+	s, err := state.Load(c.StatePath)
+	if err != nil {
+		return err
+	}
+	if !s.Empty() && s.Provider != config.ProviderCloud {
+		return fmt.Errorf("the state file %s does not belong to the cloud provider", c.StatePath)
+	}
+	if s.Network != "" {
+		if _, err := c.api.getNetwork(ctx, s.Network); err == nil {
+			c.networkID = s.Network
+		} else if !errors.Is(err, errNotFound) {
+			return err
+		}
+	}
+	if s.Image != "" {
+		image, err := c.api.getImage(ctx, s.Image)
+		switch {
+		case errors.Is(err, errNotFound):
+		case err != nil:
+			return err
+		case image.Status == ImageStatusActive:
+			c.imageID = s.Image
+		}
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for name, node := range s.Nodes {
+		if _, err := c.api.getServer(ctx, node.ID); errors.Is(err, errNotFound) {
+			c.Log.Info("recorded server vanished", zap.String("name", name))
+			continue
+		} else if err != nil {
+			return err
+		}
+		c.nodes[name] = &nodeInfo{
+			id:           node.ID,
+			controlPlane: node.ControlPlane,
+			privateIP:    node.IP,
+			publicIP:     node.PublicIP,
+			joined:       node.Joined,
+		}
+	}
+	c.joinToken = s.JoinToken
+	if !s.Empty() {
+		c.Log.Info("re-attaching to existing infrastructure", zap.String("state", c.StatePath))
+	}
+	return nil
+}
+
+// saveState writes the currently known resources to the state file.
+func (c *Instance) saveState() error {
+	if c.StatePath == "" {
+		return nil
+	}
+	c.saveMux.Lock()
+	defer c.saveMux.Unlock()
+	s := state.New()
+	s.Provider = config.ProviderCloud
+	s.NodeCounts = &state.NodeCounts{
+		ControlPlanes: c.Config.Cluster.ControlPlane.Count,
+		Workers:       c.Config.Cluster.Worker.Count,
+	}
+	c.mux.Lock()
+	s.Network = c.networkID
+	s.Image = c.imageID
+	for name, node := range c.nodes {
+		s.Nodes[name] = &state.Node{
+			ID:           node.id,
+			ControlPlane: node.controlPlane,
+			IP:           node.privateIP,
+			PublicIP:     node.publicIP,
+			Joined:       node.joined,
+		}
+	}
+	s.JoinToken = c.joinToken
+	c.mux.Unlock()
+	if c.joinToken != nil {
+		kubeconfigPath, err := filepath.Abs(c.KubeconfigPath)
+		if err != nil {
+			return err
+		}
+		s.KubeconfigPath = kubeconfigPath
+	}
+	return s.Save(c.StatePath)
+}
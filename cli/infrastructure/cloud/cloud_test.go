@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package cloud_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure/cloud"
+	"github.com/benschlueter/delegatio/cli/infrastructure/cloud/fakeapi"
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
+	"github.com/benschlueter/delegatio/client/pki"
+	"go.uber.org/zap/zaptest"
+)
+
+const testToken = "secret"
+
+func newInstance(t *testing.T, endpoint, statePath string) *cloud.Instance {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Infrastructure.Provider = config.ProviderCloud
+	cfg.Infrastructure.Cloud.Endpoint = endpoint
+	cfg.Infrastructure.Cloud.TokenEnv = "DELEGATIO_TEST_CLOUD_TOKEN"
+	cfg.Infrastructure.ImagePath = filepath.Join(filepath.Dir(statePath), "image.qcow2")
+	cfg.Infrastructure.PKIDir = filepath.Join(t.TempDir(), "pki")
+	if err := pki.Generate(cfg.Infrastructure.PKIDir, filepath.Join(t.TempDir(), "agent")); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := pki.ClientCredentials(cfg.Infrastructure.PKIDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := &cloud.Instance{
+		Log:              zaptest.NewLogger(t),
+		StatePath:        statePath,
+		KubeconfigPath:   filepath.Join(filepath.Dir(statePath), "admin.conf"),
+		Config:           cfg,
+		PollInterval:     time.Millisecond,
+		AgentTimeout:     100 * time.Millisecond,
+		AgentCredentials: creds,
+	}
+	if err := instance.ConnectWithInfrastructureService(context.Background(), endpoint); err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	return instance
+}
+
+func TestLifecycle(t *testing.T) {
+	t.Setenv("DELEGATIO_TEST_CLOUD_TOKEN", testToken)
+	api := fakeapi.New()
+	api.Token = testToken
+	// nothing listens on the agent port of the discard prefix, joining the cluster must fail.
+	api.PublicIPv4 = "100::1"
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	image := []byte("not really a disk image")
+	if err := os.WriteFile(filepath.Join(dir, "image.qcow2"), image, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	manifest := fmt.Sprintf("%x  image.qcow2\n", sha256.Sum256(image))
+	if err := os.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte(manifest), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	instance := newInstance(t, server.URL, statePath)
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatalf("initializing infrastructure: %v", err)
+	}
+	s, err := state.Load(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Provider != config.ProviderCloud || s.Network == "" || s.Image == "" {
+		t.Fatalf("resources not recorded: %+v", s)
+	}
+	if content, ok := api.ImageContent(s.Image); !ok || !bytes.Equal(content, image) {
+		t.Fatalf("image content not uploaded, got %q", content)
+	}
+
+	if err := instance.InitializeKubernetes(context.Background(), nil); err == nil {
+		t.Fatal("initializing Kubernetes without agents succeeded")
+	}
+	if got, want := len(api.Servers()), instance.Config.Cluster.NumNodes(); got != want {
+		t.Fatalf("got %d servers, want %d", got, want)
+	}
+	if s, err = state.Load(statePath); err != nil {
+		t.Fatal(err)
+	}
+	for name, node := range s.Nodes {
+		if node.ID == "" || node.IP == "" || node.PublicIP != api.PublicIPv4 || node.Joined {
+			t.Errorf("node %s not recorded correctly: %+v", name, node)
+		}
+	}
+	if !s.Nodes[cloud.ServerPrefix+"0"].ControlPlane || s.Nodes[cloud.ServerPrefix+"1"].ControlPlane {
+		t.Errorf("roles not recorded correctly: %+v", s.Nodes)
+	}
+
+	// A new CLI invocation re-attaches to the resources instead of creating new ones.
+	instance = newInstance(t, server.URL, statePath)
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatalf("re-attaching: %v", err)
+	}
+	if len(api.Networks()) != 1 {
+		t.Fatalf("got %d networks, want 1", len(api.Networks()))
+	}
+
+	if err := instance.TerminateInfrastructure(); err != nil {
+		t.Fatalf("terminating: %v", err)
+	}
+	if len(api.Servers()) != 0 || len(api.Networks()) != 0 {
+		t.Fatalf("resources left behind: %v %v", api.Servers(), api.Networks())
+	}
+	if _, ok := api.ImageContent(s.Image); ok {
+		t.Fatal("image left behind")
+	}
+	if _, err := os.Stat(statePath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("state file not removed: %v", err)
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	t.Setenv("DELEGATIO_TEST_CLOUD_TOKEN", "wrong")
+	api := fakeapi.New()
+	api.Token = testToken
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dir := t.TempDir()
+	instance := newInstance(t, server.URL, filepath.Join(dir, "state.json"))
+	if err := instance.InitializeInfrastructure(context.Background()); err == nil {
+		t.Fatal("creating resources with an invalid token succeeded")
+	}
+	if len(api.Networks()) != 0 {
+		t.Fatal("network created with an invalid token")
+	}
+}
@@ -0,0 +1,254 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package fakeapi implements the compute API used by the cloud infrastructure in memory.
+// It is meant to be served with net/http/httptest, to test the cloud backend without a provider.
+package fakeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/benschlueter/delegatio/cli/infrastructure/cloud"
+)
+
+// API is an in-memory cloud provider. Servers become active on the first status request
+// after their creation and get consecutive addresses of their network.
+type API struct {
+	// Token is the expected bearer token, every token is accepted if it is empty.
+	Token string
+	// PublicIPv4 is reported as public address of every server, if it is set.
+	PublicIPv4 string
+
+	mux      sync.Mutex
+	nextID   int
+	networks map[string]*cloud.Network
+	images   map[string]*cloud.Image
+	content  map[string][]byte
+	servers  map[string]*cloud.Server
+	nextHost map[string]net.IP
+}
+
+// New returns an empty API.
+func New() *API {
+	return &API{
+		networks: map[string]*cloud.Network{},
+		images:   map[string]*cloud.Image{},
+		content:  map[string][]byte{},
+		servers:  map[string]*cloud.Server{},
+		nextHost: map[string]net.IP{},
+	}
+}
+
+// Servers returns a copy of all servers.
+func (a *API) Servers() []cloud.Server {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	servers := make([]cloud.Server, 0, len(a.servers))
+	for _, server := range a.servers {
+		servers = append(servers, *server)
+	}
+	return servers
+}
+
+// Networks returns a copy of all networks.
+func (a *API) Networks() []cloud.Network {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	networks := make([]cloud.Network, 0, len(a.networks))
+	for _, network := range a.networks {
+		networks = append(networks, *network)
+	}
+	return networks
+}
+
+// ImageContent returns the uploaded content of the image.
+func (a *API) ImageContent(id string) ([]byte, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	content, ok := a.content[id]
+	return content, ok
+}
+
+// ServeHTTP implements http.Handler.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.Token != "" && r.Header.Get("Authorization") != "Bearer "+a.Token {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" {
+		http.NotFound(w, r)
+		return
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		a.create(w, r, parts[1])
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		a.get(w, r, parts[1], parts[2])
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		a.delete(w, r, parts[1], parts[2])
+	case len(parts) == 4 && parts[1] == "images" && parts[3] == "file" && r.Method == http.MethodPut:
+		a.upload(w, r, parts[2])
+	default:
+		http.Error(w, "unsupported request", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) create(w http.ResponseWriter, r *http.Request, kind string) {
+	a.nextID++
+	id := fmt.Sprintf("%s-%d", kind, a.nextID)
+	switch kind {
+	case "networks":
+		var network cloud.Network
+		if !decode(w, r, &network) {
+			return
+		}
+		ip, ipNet, err := net.ParseCIDR(network.CIDR)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		network.ID = id
+		a.networks[id] = &network
+		// the first address belongs to the gateway.
+		a.nextHost[id] = nextIP(nextIP(ip.Mask(ipNet.Mask)))
+		encode(w, http.StatusCreated, &network)
+	case "images":
+		var image cloud.Image
+		if !decode(w, r, &image) {
+			return
+		}
+		image.ID = id
+		image.Status = cloud.ImageStatusQueued
+		a.images[id] = &image
+		encode(w, http.StatusCreated, &image)
+	case "servers":
+		var server cloud.Server
+		if !decode(w, r, &server) {
+			return
+		}
+		if image, ok := a.images[server.ImageID]; !ok || image.Status != cloud.ImageStatusActive {
+			http.Error(w, "image is not active", http.StatusBadRequest)
+			return
+		}
+		if _, ok := a.networks[server.NetworkID]; !ok {
+			http.Error(w, "unknown network", http.StatusBadRequest)
+			return
+		}
+		server.ID = id
+		server.Status = cloud.ServerStatusBuild
+		a.servers[id] = &server
+		encode(w, http.StatusAccepted, &server)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *API) get(w http.ResponseWriter, r *http.Request, kind, id string) {
+	switch kind {
+	case "networks":
+		if network, ok := a.networks[id]; ok {
+			encode(w, http.StatusOK, network)
+			return
+		}
+	case "images":
+		if image, ok := a.images[id]; ok {
+			encode(w, http.StatusOK, image)
+			return
+		}
+	case "servers":
+		if server, ok := a.servers[id]; ok {
+			if server.Status == cloud.ServerStatusBuild {
+				server.Status = cloud.ServerStatusActive
+				server.PrivateIPv4 = a.nextHost[server.NetworkID].String()
+				server.PublicIPv4 = a.PublicIPv4
+				a.nextHost[server.NetworkID] = nextIP(a.nextHost[server.NetworkID])
+			}
+			encode(w, http.StatusOK, server)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (a *API) delete(w http.ResponseWriter, r *http.Request, kind, id string) {
+	switch kind {
+	case "networks":
+		if _, ok := a.networks[id]; ok {
+			for _, server := range a.servers {
+				if server.NetworkID == id {
+					http.Error(w, "network is in use", http.StatusConflict)
+					return
+				}
+			}
+			delete(a.networks, id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case "images":
+		if _, ok := a.images[id]; ok {
+			delete(a.images, id)
+			delete(a.content, id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case "servers":
+		if _, ok := a.servers[id]; ok {
+			delete(a.servers, id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (a *API) upload(w http.ResponseWriter, r *http.Request, id string) {
+	image, ok := a.images[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.content[id] = content
+	image.Status = cloud.ImageStatusActive
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func encode(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package image verifies the disk image of the VMs before it is uploaded.
+// mkosi writes a SHA256SUMS manifest next to the image (Checksum=yes) and signs it
+// with a detached OpenPGP signature in SHA256SUMS.gpg (Sign=yes).
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// ChecksumsName is the name of the manifest mkosi writes next to the image.
+	ChecksumsName = "SHA256SUMS"
+	// SignatureSuffix is appended to the manifest for its detached signature.
+	SignatureSuffix = ".gpg"
+)
+
+// ErrDigestMismatch is returned if data does not match the digest of the manifest.
+var ErrDigestMismatch = errors.New("sha256 digest mismatch")
+
+// Verify checks the image at path against its entry in the checksums manifest and returns
+// its hex encoded SHA-256 digest. If checksums is empty, the manifest next to the image is used.
+// If signingKey is set, it is the path of an OpenPGP public key, which must have signed the manifest.
+func Verify(path, checksums, signingKey string) (string, error) {
+	if checksums == "" {
+		checksums = filepath.Join(filepath.Dir(path), ChecksumsName)
+	}
+	manifest, err := os.ReadFile(checksums)
+	if err != nil {
+		return "", fmt.Errorf("reading checksums of the image: %w", err)
+	}
+	if signingKey != "" {
+		if err := verifySignature(manifest, checksums+SignatureSuffix, signingKey); err != nil {
+			return "", fmt.Errorf("verifying the signature of %s: %w", checksums, err)
+		}
+	}
+	digests, err := ParseChecksums(manifest)
+	if err != nil {
+		return "", fmt.Errorf("parsing %s: %w", checksums, err)
+	}
+	want, ok := digests[filepath.Base(path)]
+	if !ok {
+		return "", fmt.Errorf("%s contains no checksum of %s", checksums, filepath.Base(path))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	got, err := Digest(file)
+	if err != nil {
+		return "", fmt.Errorf("hashing %s: %w", path, err)
+	}
+	if got != want {
+		return "", fmt.Errorf("%s: %w, got %s, want %s", path, ErrDigestMismatch, got, want)
+	}
+	return got, nil
+}
+
+// ParseChecksums parses a manifest in the format of sha256sum and returns the digests by filename.
+func ParseChecksums(manifest []byte) (map[string]string, error) {
+	digests := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		digest, name, ok := strings.Cut(text, " ")
+		// sha256sum marks files hashed in binary mode with an asterisk.
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected a digest and a filename", line)
+		}
+		if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("line %d: invalid sha256 digest %q", line, digest)
+		}
+		digests[name] = strings.ToLower(digest)
+	}
+	return digests, scanner.Err()
+}
+
+// Digest returns the hex encoded SHA-256 digest of the data read from r.
+func Digest(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifySignature checks the detached signature of the manifest, the signature and the key
+// are accepted armored or binary.
+func verifySignature(manifest []byte, signaturePath, keyPath string) (err error) {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(key))
+	}
+	if err != nil {
+		return fmt.Errorf("reading signing key %s: %w", keyPath, err)
+	}
+	signature, err := os.Open(signaturePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, signature.Close())
+	}()
+	reader := bufio.NewReader(signature)
+	check := openpgp.CheckDetachedSignature
+	if prefix, _ := reader.Peek(len("-----BEGIN")); string(prefix) == "-----BEGIN" {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+	_, err = check(keyring, bytes.NewReader(manifest), reader)
+	return err
+}
@@ -0,0 +1,233 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package image_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/benschlueter/delegatio/cli/infrastructure/image"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+var testImage = []byte("not really a disk image")
+
+func digestOf(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func TestParseChecksums(t *testing.T) {
+	digest := digestOf(testImage)
+	testCases := map[string]struct {
+		manifest string
+		want     map[string]string
+		wantErr  bool
+	}{
+		"text mode": {
+			manifest: digest + "  image.qcow2\n",
+			want:     map[string]string{"image.qcow2": digest},
+		},
+		"binary mode and comments": {
+			manifest: "# written by mkosi\n\n" + digest + " *image.qcow2\n" + digestOf(nil) + " *image.raw\n",
+			want:     map[string]string{"image.qcow2": digest, "image.raw": digestOf(nil)},
+		},
+		"upper case digest": {
+			manifest: fmt.Sprintf("%X  image.qcow2\n", sha256.Sum256(testImage)),
+			want:     map[string]string{"image.qcow2": digest},
+		},
+		"missing filename": {
+			manifest: digest + "\n",
+			wantErr:  true,
+		},
+		"short digest": {
+			manifest: digest[:32] + "  image.qcow2\n",
+			wantErr:  true,
+		},
+		"not hex": {
+			manifest: "z" + digest[1:] + "  image.qcow2\n",
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got, err := image.ParseChecksums([]byte(tc.manifest))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parsing succeeded: %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// signer writes an armored public key and signs manifests with the private key.
+type signer struct {
+	entity  *openpgp.Entity
+	keyPath string
+}
+
+func newSigner(t *testing.T, dir string) *signer {
+	t.Helper()
+	entity, err := openpgp.NewEntity("delegatio", "", "images@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key bytes.Buffer
+	w, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "key.asc")
+	if err := os.WriteFile(keyPath, key.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &signer{entity: entity, keyPath: keyPath}
+}
+
+func (s *signer) sign(t *testing.T, manifest []byte, armored bool) []byte {
+	t.Helper()
+	var signature bytes.Buffer
+	sign := openpgp.DetachSign
+	if armored {
+		sign = openpgp.ArmoredDetachSign
+	}
+	if err := sign(&signature, s.entity, bytes.NewReader(manifest), nil); err != nil {
+		t.Fatal(err)
+	}
+	return signature.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	manifest := []byte(digestOf(testImage) + " *image.qcow2\n")
+	testCases := map[string]struct {
+		image      []byte
+		manifest   []byte
+		sign       bool
+		armored    bool
+		signature  func(s *signer, t *testing.T) []byte
+		wantErr    error
+		wantAnyErr bool
+	}{
+		"unsigned": {
+			image:    testImage,
+			manifest: manifest,
+		},
+		"signed": {
+			image:    testImage,
+			manifest: manifest,
+			sign:     true,
+		},
+		"armored signature": {
+			image:    testImage,
+			manifest: manifest,
+			sign:     true,
+			armored:  true,
+		},
+		"modified image": {
+			image:    []byte("not really a disk image either"),
+			manifest: manifest,
+			wantErr:  image.ErrDigestMismatch,
+		},
+		"image not in manifest": {
+			image:      testImage,
+			manifest:   []byte(digestOf(testImage) + " *other.qcow2\n"),
+			wantAnyErr: true,
+		},
+		"missing manifest": {
+			image:      testImage,
+			wantAnyErr: true,
+		},
+		"signature of another manifest": {
+			image:    testImage,
+			manifest: manifest,
+			sign:     true,
+			signature: func(s *signer, t *testing.T) []byte {
+				return s.sign(t, []byte(digestOf(nil)+" *image.qcow2\n"), false)
+			},
+			wantAnyErr: true,
+		},
+		"missing signature": {
+			image:    testImage,
+			manifest: manifest,
+			sign:     true,
+			signature: func(s *signer, t *testing.T) []byte {
+				return nil
+			},
+			wantAnyErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			imagePath := filepath.Join(dir, "image.qcow2")
+			if err := os.WriteFile(imagePath, tc.image, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			checksums := filepath.Join(dir, image.ChecksumsName)
+			if tc.manifest != nil {
+				if err := os.WriteFile(checksums, tc.manifest, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var keyPath string
+			if tc.sign {
+				s := newSigner(t, dir)
+				keyPath = s.keyPath
+				signature := s.sign(t, tc.manifest, tc.armored)
+				if tc.signature != nil {
+					signature = tc.signature(s, t)
+				}
+				if signature != nil {
+					if err := os.WriteFile(checksums+image.SignatureSuffix, signature, 0o600); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			digest, err := image.Verify(imagePath, "", keyPath)
+			if tc.wantErr != nil || tc.wantAnyErr {
+				if err == nil {
+					t.Fatal("verification succeeded")
+				}
+				if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digest != digestOf(testImage) {
+				t.Errorf("got digest %s, want %s", digest, digestOf(testImage))
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package image
+
+import (
+	"io"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// progressStep is the fraction of the upload after which the progress is logged, in percent.
+const progressStep = 10
+
+// Progress logs how much of an upload is done, every 10 percent.
+type Progress struct {
+	mux   sync.Mutex
+	log   *zap.Logger
+	total int64
+	done  int64
+	next  int64
+}
+
+// NewProgress returns the progress of an upload of total bytes, starting at done bytes.
+func NewProgress(log *zap.Logger, done, total int64) *Progress {
+	p := &Progress{log: log, total: total, done: done}
+	p.next = (p.percent()/progressStep + 1) * progressStep
+	return p
+}
+
+// Add records that n more bytes were transferred.
+func (p *Progress) Add(n int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.done += int64(n)
+	if percent := p.percent(); percent >= p.next {
+		p.log.Info("uploading image", zap.Int64("percent", percent), zap.Int64("bytes", p.done), zap.Int64("total", p.total))
+		p.next = (percent/progressStep + 1) * progressStep
+	}
+}
+
+// Reader returns a reader which records the progress of everything read from r.
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+func (p *Progress) percent() int64 {
+	if p.total <= 0 {
+		return 100
+	}
+	return p.done * 100 / p.total
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.Add(n)
+	return n, err
+}
@@ -6,10 +6,16 @@ package infrastructure
 
 import (
 	"context"
+	"fmt"
+	"io"
 
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure/cloud"
 	"github.com/benschlueter/delegatio/cli/infrastructure/qemu"
 	"github.com/benschlueter/delegatio/cli/infrastructure/utils"
+	"github.com/benschlueter/delegatio/client/pki"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
 )
 
 // Infrastructure Interface to create Cluster.
@@ -19,19 +25,81 @@ type Infrastructure interface {
 	ConnectWithInfrastructureService(ctx context.Context, url string) error
 	TerminateInfrastructure() error
 	TerminateConnection() error
+	AddNode(ctx context.Context) (string, error)
+	RemoveNode(ctx context.Context, name string) error
 }
 
-// NewQemu creates a new Qemu Infrastructure.
-func NewQemu(log *zap.Logger, imagePath string) Infrastructure {
+// Snapshotter is implemented by the infrastructures which can checkpoint the nodes and roll the cluster back.
+type Snapshotter interface {
+	CreateSnapshot(ctx context.Context, name string, memory bool) error
+	RollbackSnapshot(ctx context.Context, name string) error
+	DeleteSnapshot(ctx context.Context, name string) error
+}
+
+// Consoler is implemented by the infrastructures which give access to the serial consoles of the nodes.
+type Consoler interface {
+	ConsoleLog(ctx context.Context, name string, lines int, follow bool, w io.Writer) error
+	AttachConsole(ctx context.Context, name string, in io.Reader, out io.Writer) error
+}
+
+// NewQemu creates a new Qemu Infrastructure as described by cfg.
+// The created resources are recorded in the file at statePath, creds authenticate the CLI to the agents.
+func NewQemu(log *zap.Logger, statePath string, cfg *config.Config, creds credentials.TransportCredentials) Infrastructure {
 	return &qemu.LibvirtInstance{
 		Log:               log,
-		ImagePath:         imagePath,
+		StatePath:         statePath,
+		KubeconfigPath:    "admin.conf",
+		Config:            cfg,
+		AgentCredentials:  creds,
 		RegisteredDomains: make(map[string]*qemu.DomainInfo),
 	}
 }
 
+// NewCloud creates a new cloud Infrastructure as described by cfg.
+// The created resources are recorded in the file at statePath, creds authenticate the CLI to the agents.
+func NewCloud(log *zap.Logger, statePath string, cfg *config.Config, creds credentials.TransportCredentials) Infrastructure {
+	return &cloud.Instance{
+		Log:              log,
+		StatePath:        statePath,
+		KubeconfigPath:   "admin.conf",
+		Config:           cfg,
+		AgentCredentials: creds,
+	}
+}
+
+// New creates the Infrastructure of the provider selected in cfg and returns it together
+// with the URL of the service it connects to.
+func New(log *zap.Logger, statePath string, cfg *config.Config) (Infrastructure, string, error) {
+	creds, err := AgentCredentials(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	switch cfg.Infrastructure.Provider {
+	case config.ProviderQemu:
+		return NewQemu(log, statePath, cfg, creds), cfg.Infrastructure.LibvirtURI, nil
+	case config.ProviderCloud:
+		return NewCloud(log, statePath, cfg, creds), cfg.Infrastructure.Cloud.Endpoint, nil
+	default:
+		return nil, "", fmt.Errorf("unknown infrastructure provider %q", cfg.Infrastructure.Provider)
+	}
+}
+
+// AgentCredentials loads the client certificate of the CLI from the PKI directory of cfg.
+func AgentCredentials(cfg *config.Config) (credentials.TransportCredentials, error) {
+	creds, err := pki.ClientCredentials(cfg.Infrastructure.PKIDir)
+	if err != nil {
+		return nil, fmt.Errorf("loading the agent certificates from %s, create them with \"delegatio pki init\": %w", cfg.Infrastructure.PKIDir, err)
+	}
+	return creds, nil
+}
+
 // GetKubeInitConfig returns the init config for kubernetes.
-func GetKubeInitConfig() ([]byte, error) {
+func GetKubeInitConfig(cfg *config.Config) ([]byte, error) {
 	k8sConfig := utils.InitConfiguration()
+	k8sConfig.SetKubernetesVersion(cfg.Kubernetes.Version)
+	k8sConfig.SetNetworking(cfg.Kubernetes.PodSubnet, cfg.Kubernetes.ServiceSubnet)
+	if cfg.Cluster.HighAvailability() {
+		k8sConfig.SetControlPlaneEndpoint(cfg.Cluster.APIServerVIP)
+	}
 	return utils.MarshalK8SResources(&k8sConfig)
 }
@@ -0,0 +1,269 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"go.uber.org/multierr"
+	"libvirt.org/go/libvirt"
+)
+
+const (
+	// consoleErrorLines is the number of lines of the console added to the error of a node which did not come up.
+	consoleErrorLines = 30
+	// consoleTailBytes is the amount of the end of the log which is searched for the last lines.
+	consoleTailBytes = 256 * 1024
+	// consolePollInterval is the interval in which a followed log is checked for new output.
+	consolePollInterval = 500 * time.Millisecond
+)
+
+// consoleLogName returns the name of the file the serial console of a node is logged to.
+// It is written into the directory of the storage pool, such that it can be read as a volume.
+func consoleLogName(name string) string {
+	return name + ".console.log"
+}
+
+// ConsoleLog writes the last lines of the serial console log of a node to w.
+// If follow is set, new output is written until the context is canceled.
+func (l *LibvirtInstance) ConsoleLog(ctx context.Context, name string, lines int, follow bool, w io.Writer) error {
+	l.ConnMux.Lock()
+	_, ok := l.RegisteredDomains[name]
+	l.ConnMux.Unlock()
+	if !ok {
+		return fmt.Errorf("node %s does not exist", name)
+	}
+	data, size, err := l.readConsoleLog(ctx, name, -consoleTailBytes)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(lastLines(data, lines)); err != nil {
+		return err
+	}
+	if !follow {
+		return nil
+	}
+	ticker := time.NewTicker(consolePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		data, size, err = l.readConsoleLog(ctx, name, int64(size))
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+// readConsoleLog returns the console log of a node from offset and the size of the log.
+// A negative offset is counted from the end. The log starts over when the domain is created,
+// in this case it is read from the start.
+func (l *LibvirtInstance) readConsoleLog(ctx context.Context, name string, offset int64) ([]byte, uint64, error) {
+	pool, err := l.Conn.LookupStoragePoolByName(definitions.DiskPoolName)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = pool.Free() }()
+	// The log is written by libvirt, the pool does not know it until it is refreshed.
+	if err := pool.Refresh(0); err != nil {
+		return nil, 0, err
+	}
+	volume, err := pool.LookupStorageVolByName(consoleLogName(name))
+	if isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = volume.Free() }()
+	info, err := volume.GetInfo()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Capacity
+	start := uint64(0)
+	switch {
+	case offset < 0 && uint64(-offset) < size:
+		start = size - uint64(-offset)
+	case offset >= 0 && uint64(offset) <= size:
+		start = uint64(offset)
+	}
+	if start == size {
+		return nil, size, nil
+	}
+	data, err := l.downloadVolume(ctx, volume, start, size-start)
+	return data, size, err
+}
+
+// downloadVolume returns length bytes of the volume from offset.
+func (l *LibvirtInstance) downloadVolume(ctx context.Context, volume StorageVol, offset, length uint64) (data []byte, err error) {
+	stream, err := l.Conn.NewStream(0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = stream.Free() }()
+	if err := volume.Download(stream, offset, length, 0); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = stream.Abort()
+		}
+	}()
+	var buf bytes.Buffer
+	chunk := make([]byte, 64*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := stream.Recv(chunk)
+		buf.Write(chunk[:n])
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), stream.Finish()
+}
+
+// AttachConsole connects in and out to the serial console of a node. It returns once in
+// is closed, the context is canceled or the domain stops.
+func (l *LibvirtInstance) AttachConsole(ctx context.Context, name string, in io.Reader, out io.Writer) (err error) {
+	domain, err := l.Conn.LookupDomainByName(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = domain.Free() }()
+	stream, err := l.Conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stream.Free() }()
+	// Safe fails if another client is attached instead of disconnecting it.
+	if err := domain.OpenConsole("", stream, libvirt.DOMAIN_CONSOLE_SAFE); err != nil {
+		return fmt.Errorf("opening console of %s: %w", name, err)
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, err := stream.Recv(buffer)
+			if n > 0 {
+				if _, wErr := out.Write(buffer[:n]); wErr != nil {
+					received <- wErr
+					return
+				}
+			}
+			if err != nil {
+				received <- err
+				return
+			}
+		}
+	}()
+	sent := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, err := in.Read(buffer)
+			if n > 0 {
+				if sErr := sendAll(stream, buffer[:n]); sErr != nil {
+					sent <- sErr
+					return
+				}
+			}
+			if err != nil {
+				sent <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+	case err = <-received:
+		// The stream ends when the domain stops.
+		if errors.Is(err, io.EOF) {
+			return stream.Finish()
+		}
+	case err = <-sent:
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	// Aborting the stream stops the receiving goroutine, reading from in cannot be interrupted.
+	return multierr.Append(err, stream.Abort())
+}
+
+// withConsoleLog adds the last lines of the console of a node to the error, it is returned unchanged if
+// there is no log. It explains why a node did not come up.
+func (l *LibvirtInstance) withConsoleLog(name string, err error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	data, _, logErr := l.readConsoleLog(ctx, name, -consoleTailBytes)
+	if logErr != nil || len(bytes.TrimSpace(data)) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w\nlast lines of the serial console of %s:\n%s", err, name, lastLines(data, consoleErrorLines))
+}
+
+// deleteConsoleLog deletes the console log of a node.
+func (l *LibvirtInstance) deleteConsoleLog(name string) error {
+	pool, err := l.Conn.LookupStoragePoolByName(definitions.DiskPoolName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = pool.Free() }()
+	if err := pool.Refresh(0); err != nil {
+		return err
+	}
+	volume, err := pool.LookupStorageVolByName(consoleLogName(name))
+	if isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = volume.Free() }()
+	return volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+}
+
+// lastLines returns the last n lines of data. A partial last line counts as a line.
+func lastLines(data []byte, n int) []byte {
+	if n <= 0 {
+		return nil
+	}
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if data[i] != '\n' {
+			continue
+		}
+		n--
+		if n == 0 {
+			return data[i+1:]
+		}
+	}
+	return data
+}
@@ -5,12 +5,14 @@
 package qemu
 
 import (
-	"context"
 	"fmt"
 	"path"
 
+	"github.com/benschlueter/delegatio/cli/config"
 	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"go.uber.org/zap"
 	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
 )
 
 func (l *LibvirtInstance) createStoragePool() error {
@@ -24,21 +26,21 @@ func (l *LibvirtInstance) createStoragePool() error {
 	l.Log.Info("creating storage pool")
 	poolObject, err := l.Conn.StoragePoolDefineXML(poolXMLString, libvirt.STORAGE_POOL_DEFINE_VALIDATE)
 	if err != nil {
-		return fmt.Errorf("error defining libvirt storage pool: %s", err)
+		return fmt.Errorf("error defining libvirt storage pool: %w", err)
 	}
 	defer func() { _ = poolObject.Free() }()
 	if err := poolObject.Build(libvirt.STORAGE_POOL_BUILD_NEW); err != nil {
-		return fmt.Errorf("error building libvirt storage pool: %s", err)
+		return fmt.Errorf("error building libvirt storage pool: %w", err)
 	}
 	if err := poolObject.Create(libvirt.STORAGE_POOL_CREATE_NORMAL); err != nil {
-		return fmt.Errorf("error creating libvirt storage pool: %s", err)
+		return fmt.Errorf("error creating libvirt storage pool: %w", err)
 	}
 	l.RegisteredPools = append(l.RegisteredPools, poolXMLCopy.Name)
 	return nil
 }
 
-func (l *LibvirtInstance) createBaseImage(ctx context.Context) error {
-	volumeBaseXMLString, err := definitions.VolumeBaseXMLConfig.Marshal()
+func (l *LibvirtInstance) createBootImage(id string, spec config.NodeSpec) error {
+	volumeBootXMLString, err := bootVolumeXML(id, spec)
 	if err != nil {
 		return err
 	}
@@ -47,76 +49,113 @@ func (l *LibvirtInstance) createBaseImage(ctx context.Context) error {
 		return err
 	}
 	defer func() { _ = storagePool.Free() }()
-	l.Log.Info("creating base storage image")
-	volumeBaseObject, err := storagePool.StorageVolCreateXML(volumeBaseXMLString, 0)
+	l.Log.Info("creating storage volume 'boot'")
+	bootVol, err := storagePool.StorageVolCreateXML(volumeBootXMLString, 0)
 	if err != nil {
-		return fmt.Errorf("error creating libvirt storage volume 'base': %s", err)
+		return fmt.Errorf("error creating libvirt storage volume 'boot': %w", err)
 	}
-	defer func() { _ = volumeBaseObject.Free() }()
-	l.RegisteredDisks = append(l.RegisteredDisks, definitions.VolumeBaseXMLConfig.Name)
-
-	l.Log.Info("uploading baseimage to libvirt storage pool")
-	return l.uploadBaseImage(ctx, volumeBaseObject)
+	defer func() { _ = bootVol.Free() }()
+	l.ConnMux.Lock()
+	l.RegisteredDisks = append(l.RegisteredDisks, id)
+	l.ConnMux.Unlock()
+	return nil
 }
 
-func (l *LibvirtInstance) createBootImage(id string) error {
+// bootVolumeXML returns the configuration of a copy-on-write overlay over the base volume.
+func bootVolumeXML(name string, spec config.NodeSpec) (string, error) {
 	volumeBootXMLCopy := definitions.VolumeBootXMLConfig
-	volumeBootXMLCopy.Name = id
-	volumeBootXMLCopy.Target.Path = path.Join(definitions.LibvirtStoragePoolPath, id)
-
-	volumeBootXMLString, err := volumeBootXMLCopy.Marshal()
-	if err != nil {
-		return err
-	}
-	storagePool, err := l.Conn.LookupStoragePoolByTargetPath(definitions.LibvirtStoragePoolPath)
-	if err != nil {
-		return err
+	volumeBootXMLCopy.Name = name
+	volumeBootXMLCopy.Target = &libvirtxml.StorageVolumeTarget{
+		Path:   path.Join(definitions.LibvirtStoragePoolPath, name),
+		Format: definitions.VolumeBootXMLConfig.Target.Format,
 	}
-	defer func() { _ = storagePool.Free() }()
-	l.Log.Info("creating storage volume 'boot'")
-	bootVol, err := storagePool.StorageVolCreateXML(volumeBootXMLString, 0)
-	if err != nil {
-		return fmt.Errorf("error creating libvirt storage volume 'boot': %s", err)
+	volumeBootXMLCopy.Capacity = &libvirtxml.StorageVolumeSize{
+		Unit:  "GiB",
+		Value: spec.DiskGiB,
 	}
-	defer func() { _ = bootVol.Free() }()
-	l.RegisteredDisks = append(l.RegisteredDisks, volumeBootXMLCopy.Name)
-	return nil
+	return volumeBootXMLCopy.Marshal()
 }
 
 func (l *LibvirtInstance) createNetwork() error {
-	networkXMLString, err := definitions.NetworkXMLConfig.Marshal()
+	netConf := l.Config.Infrastructure.Network
+	networkXMLString, err := networkXML(netConf, l.Config.Cluster.NumNodes())
 	if err != nil {
 		return err
 	}
-	l.Log.Info("creating network")
+	l.Log.Info("creating network", zap.String("cidr", netConf.CIDR), zap.String("bridge", netConf.Bridge))
 	network, err := l.Conn.NetworkCreateXML(networkXMLString)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = network.Free() }()
+	l.RegisteredNetworks = append(l.RegisteredNetworks, definitions.NetworkName)
 	return nil
 }
 
-func (l *LibvirtInstance) createDomain(id string) error {
+func (l *LibvirtInstance) createDomain(id string, spec config.NodeSpec, controlPlane bool) error {
+	index, err := nodeIndex(id)
+	if err != nil {
+		return err
+	}
+	ip, err := l.nodeAddress(id)
+	if err != nil {
+		return err
+	}
+	sysInfo, err := l.metadataSysInfo(id, controlPlane)
+	if err != nil {
+		return err
+	}
+	if err := l.reserveAddress(id); err != nil {
+		return err
+	}
 	domainCpy := definitions.DomainXMLConfig
 	domainCpy.Name = id
-	domainCpy.Devices.Disks[0].Source.Volume.Volume = id
-	/* 	domainCpy.Devices.Serials[0].Log = &libvirtxml.DomainChardevLog{
-	   		File: path.Join("/tmp", id),
-	   	}
-	*/
+	domainCpy.SysInfo = []libvirtxml.DomainSysInfo{sysInfo}
+	// The copy is shallow, never modify the pointers of the template.
+	devicesCpy := *domainCpy.Devices
+	devicesCpy.Disks = append([]libvirtxml.DomainDisk(nil), devicesCpy.Disks...)
+	devicesCpy.Disks[0].Source = &libvirtxml.DomainDiskSource{
+		Index: devicesCpy.Disks[0].Source.Index,
+		Volume: &libvirtxml.DomainDiskSourceVolume{
+			Pool:   definitions.DiskPoolName,
+			Volume: id,
+		},
+	}
+	devicesCpy.Interfaces = append([]libvirtxml.DomainInterface(nil), devicesCpy.Interfaces...)
+	// The DHCP server reserves the address of the node for this MAC address.
+	devicesCpy.Interfaces[0].MAC = &libvirtxml.DomainInterfaceMAC{Address: nodeMAC(index)}
+	devicesCpy.Serials = append([]libvirtxml.DomainSerial(nil), devicesCpy.Serials...)
+	// The log starts over with every boot of the domain.
+	devicesCpy.Serials[0].Log = &libvirtxml.DomainChardevLog{
+		File:   path.Join(definitions.LibvirtStoragePoolPath, consoleLogName(id)),
+		Append: "off",
+	}
+	domainCpy.Devices = &devicesCpy
+	domainCpy.Memory = &libvirtxml.DomainMemory{
+		Value: spec.MemoryMiB,
+		Unit:  "MiB",
+	}
+	domainCpy.VCPU = &libvirtxml.DomainVCPU{
+		Placement: "static",
+		Value:     spec.VCPUs,
+	}
+	cpuCpy := *domainCpy.CPU
+	topologyCpy := *cpuCpy.Topology
+	topologyCpy.Cores = int(spec.VCPUs)
+	cpuCpy.Topology = &topologyCpy
+	domainCpy.CPU = &cpuCpy
 	domainXMLString, err := domainCpy.Marshal()
 	if err != nil {
 		return err
 	}
-	l.Log.Info("creating domain")
+	l.Log.Info("creating domain", zap.String("id", id), zap.String("ip", ip))
 	domain, err := l.Conn.DomainCreateXML(domainXMLString, libvirt.DOMAIN_NONE)
 	if err != nil {
-		return fmt.Errorf("error creating libvirt domain: %s", err)
+		return fmt.Errorf("error creating libvirt domain: %w", err)
 	}
 	defer func() { _ = domain.Free() }()
 	l.ConnMux.Lock()
-	l.RegisteredDomains[id] = &DomainInfo{guestAgentReady: false}
+	l.RegisteredDomains[id] = &DomainInfo{guestAgentReady: false, controlPlane: controlPlane, ip: ip}
 	l.ConnMux.Unlock()
 	return nil
 }
@@ -18,10 +18,12 @@ var (
 	BootDiskName = "delegatio-boot"
 	// DiskPoolName is the name of the storage pool in which the drives are organized.
 	DiskPoolName = "delegatio-pool"
+	// DomainPrefix is the prefix of every domain name, the number of each VM is appended.
+	DomainPrefix = "delegatio-"
 	// NetworkName is the name of the network in which the VMs are connected.
 	NetworkName = "delegatio-net"
 
-	// NetworkXMLConfig is the libvirt network configuration.
+	// NetworkXMLConfig is the libvirt network configuration. The bridge and the addresses are taken from the config.
 	NetworkXMLConfig = libvirtxml.Network{
 		Name: NetworkName,
 		Forward: &libvirtxml.NetworkForward{
@@ -36,28 +38,12 @@ var (
 			},
 		},
 		Bridge: &libvirtxml.NetworkBridge{
-			Name:  "virbr1",
 			STP:   "on",
 			Delay: "0",
 		},
 		DNS: &libvirtxml.NetworkDNS{
 			Enable: "yes",
 		},
-		IPs: []libvirtxml.NetworkIP{
-			{
-				Family:  "ipv4",
-				Address: "10.42.0.1",
-				Prefix:  16,
-				DHCP: &libvirtxml.NetworkDHCP{
-					Ranges: []libvirtxml.NetworkDHCPRange{
-						{
-							Start: "10.42.0.2",
-							End:   "10.42.255.254",
-						},
-					},
-				},
-			},
-		},
 	}
 	// PoolXMLConfig is the libvirt storage pool configuration.
 	PoolXMLConfig = libvirtxml.StoragePool{
@@ -209,7 +195,6 @@ var (
 					Source: &libvirtxml.DomainInterfaceSource{
 						Network: &libvirtxml.DomainInterfaceSourceNetwork{
 							Network: NetworkName,
-							Bridge:  "virbr1",
 						},
 					},
 					Alias: &libvirtxml.DomainAlias{
@@ -217,12 +202,11 @@ var (
 					},
 				},
 			},
+			// The serial console is logged to a file, see createDomain.
 			Serials: []libvirtxml.DomainSerial{
 				{
 					Source: &libvirtxml.DomainChardevSource{
-						Pty: &libvirtxml.DomainChardevSourcePty{
-							Path: "/dev/pts/4",
-						},
+						Pty: &libvirtxml.DomainChardevSourcePty{},
 					},
 					Target: &libvirtxml.DomainSerialTarget{
 						Type: "isa-serial",
@@ -235,11 +219,8 @@ var (
 			},
 			Consoles: []libvirtxml.DomainConsole{
 				{
-					TTY: "/dev/pts/4",
 					Source: &libvirtxml.DomainChardevSource{
-						Pty: &libvirtxml.DomainChardevSourcePty{
-							Path: "/dev/pts/4",
-						},
+						Pty: &libvirtxml.DomainChardevSourcePty{},
 					},
 					Target: &libvirtxml.DomainConsoleTarget{
 						Type: "serial",
@@ -6,27 +6,50 @@ package qemu
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
 	"go.uber.org/multierr"
 	"libvirt.org/go/libvirt"
 )
 
 // TerminateInfrastructure deletes all resources created by the infrastructure.
+// The state file is removed once everything is gone.
 func (l *LibvirtInstance) TerminateInfrastructure() error {
 	var err error
 	err = multierr.Append(err, l.deleteNetwork())
 	err = multierr.Append(err, l.deleteDomain())
+	err = multierr.Append(err, l.deleteAllMetadata())
 	err = multierr.Append(err, l.deletePool())
-	return err
+	if err != nil {
+		return err
+	}
+	l.ConnMux.Lock()
+	l.RegisteredDomains = make(map[string]*DomainInfo)
+	l.RegisteredNetworks = nil
+	l.RegisteredPools = nil
+	l.RegisteredDisks = nil
+	l.baseImageDigest = ""
+	l.snapshots = nil
+	l.joinToken = nil
+	l.ConnMux.Unlock()
+	if l.StatePath == "" {
+		return nil
+	}
+	return state.Remove(l.StatePath)
 }
 
 // TerminateConnection closes the libvirt connection.
 func (l *LibvirtInstance) TerminateConnection() error {
+	if l.Conn == nil {
+		return nil
+	}
 	_, err := l.Conn.Close()
 	return err
 }
 
+// deleteNetwork destroys the network of the cluster if it exists.
 func (l *LibvirtInstance) deleteNetwork() error {
 	nets, err := l.Conn.ListAllNetworks(libvirt.CONNECT_LIST_NETWORKS_ACTIVE)
 	if err != nil {
@@ -37,21 +60,25 @@ func (l *LibvirtInstance) deleteNetwork() error {
 			_ = net.Free()
 		}
 	}()
+	var errs error
 	for _, net := range nets {
 		name, err := net.GetName()
 		if err != nil {
-			return err
+			errs = multierr.Append(errs, err)
+			continue
 		}
 		if name != definitions.NetworkName {
 			continue
 		}
 		if err := net.Destroy(); err != nil {
-			return err
+			errs = multierr.Append(errs, fmt.Errorf("destroying network %s: %w", name, err))
 		}
 	}
-	return nil
+	return errs
 }
 
+// deleteDomain destroys all domains of the cluster. A domain which cannot be destroyed
+// does not keep the others alive.
 func (l *LibvirtInstance) deleteDomain() error {
 	doms, err := l.Conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
 	if err != nil {
@@ -62,22 +89,25 @@ func (l *LibvirtInstance) deleteDomain() error {
 			_ = dom.Free()
 		}
 	}()
+	var errs error
 	for _, dom := range doms {
-		/* 		name, err := dom.GetName()
-		   		if err != nil {
-		   			return err
-		   		}
-		   		if name != definitions.DomainName {
-		   			continue
-		   		} */
+		name, err := dom.GetName()
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		// Only touch our own domains, the host might run other VMs as well.
+		if !strings.HasPrefix(name, definitions.DomainPrefix) {
+			continue
+		}
 		if err := dom.Destroy(); err != nil {
-			return err
+			errs = multierr.Append(errs, fmt.Errorf("destroying domain %s: %w", name, err))
 		}
 	}
-	return nil
+	return errs
 }
 
-func (l *LibvirtInstance) deleteVolumesFromPool(pool *libvirt.StoragePool) error {
+func (l *LibvirtInstance) deleteVolumesFromPool(pool StoragePool) error {
 	volumes, err := pool.ListAllStorageVolumes(0)
 	if err != nil {
 		return err
@@ -87,21 +117,18 @@ func (l *LibvirtInstance) deleteVolumesFromPool(pool *libvirt.StoragePool) error
 			_ = volume.Free()
 		}
 	}()
+	var errs error
 	for _, volume := range volumes {
-		/* 		name, err := volume.GetName()
-		   		if err != nil {
-		   			return err
-		   		}
-		   		if !strings.Contains(name, definitions.BaseDiskName) && name != definitions.BaseDiskName {
-		   			continue
-		   		} */
 		if err := volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL); err != nil {
-			return fmt.Errorf("test %w", err)
+			name, _ := volume.GetName()
+			errs = multierr.Append(errs, fmt.Errorf("deleting volume %s: %w", name, err))
 		}
 	}
-	return nil
+	return errs
 }
 
+// deletePool deletes the storage pool of the cluster with all its volumes.
+// Pools which were only defined or failed to start are undefined.
 func (l *LibvirtInstance) deletePool() error {
 	pools, err := l.Conn.ListAllStoragePools(libvirt.CONNECT_LIST_STORAGE_POOLS_DIR)
 	if err != nil {
@@ -125,7 +152,11 @@ func (l *LibvirtInstance) deletePool() error {
 			return err
 		}
 		if active {
-			if err := l.deleteVolumesFromPool(&pool); err != nil {
+			// The console logs and saved domains are files libvirt wrote into the directory of the pool.
+			if err := pool.Refresh(0); err != nil {
+				return err
+			}
+			if err := l.deleteVolumesFromPool(pool); err != nil {
 				return err
 			}
 			if err := pool.Destroy(); err != nil {
@@ -7,230 +7,85 @@ package qemu
 import (
 	"context"
 	"fmt"
-	"net"
 	"os"
 
-	"github.com/benschlueter/delegatio/client/config"
-	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"github.com/benschlueter/delegatio/cli/infrastructure/agent"
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
+	"github.com/benschlueter/delegatio/cli/infrastructure/utils"
 	"go.uber.org/zap"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	"libvirt.org/go/libvirt"
-
-	kubeadm "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm/v1beta3"
 )
 
-// JoinClustergRPC joins a cluster using the gRPC API.
-func (l *LibvirtInstance) JoinClustergRPC(ctx context.Context, id string, joinToken *kubeadm.BootstrapTokenDiscovery) (err error) {
-	domain, err := l.Conn.LookupDomainByName(id)
-	if err != nil {
-		return err
-	}
-	iface, err := domain.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+// dialAgent connects to the agent of a domain. Its certificate from the metadata is
+// issued for the name of the domain.
+func (l *LibvirtInstance) dialAgent(ctx context.Context, id string) (*agent.Client, error) {
+	ip, err := l.nodeAddress(id)
 	if err != nil {
-		return
-	}
-
-	var ip string
-	for _, netInterface := range iface {
-		if netInterface.Name == "lo" {
-			continue
-		}
-		for _, addr := range netInterface.Addrs {
-			if addr.Type == libvirt.IP_ADDR_TYPE_IPV4 {
-				ip = addr.Addr
-			}
-		}
-	}
-	if len(ip) == 0 {
-		return fmt.Errorf("could not find ip addr")
+		return nil, err
 	}
-	l.Log.Info("executing kubeadm join", zap.String("id", id))
+	return agent.Dial(ctx, l.Log.Named("agent").With(zap.String("id", id)), ip, id, l.AgentCredentials)
+}
 
-	conn, err := grpc.DialContext(ctx, net.JoinHostPort(ip, config.PublicAPIport), grpc.WithTransportCredentials(insecure.NewCredentials()))
+// JoinClustergRPC joins a cluster with the recorded join token using the gRPC API.
+// Control planes require the certificate key of the join token.
+func (l *LibvirtInstance) JoinClustergRPC(ctx context.Context, id string, controlPlane bool) error {
+	client, err := l.dialAgent(ctx, id)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	client := vmproto.NewAPIClient(conn)
-	resp, err := client.ExecCommandStream(ctx, &vmproto.ExecCommandStreamRequest{
-		Command: "/usr/bin/kubeadm",
-		Args: []string{
-			"join", joinToken.APIServerEndpoint,
-			"--token", joinToken.Token,
-			"--discovery-token-ca-cert-hash", joinToken.CACertHashes[0],
-		},
-	})
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			data, err := resp.Recv()
-			if err != nil {
-				return err
-			}
-			if len(data.GetOutput()) > 0 {
-				l.Log.Info("kubeadm join succeed", zap.String("id", id))
-				return nil
-			}
-			if len(data.GetLog().GetMessage()) > 0 {
-				fmt.Println(data.GetLog().GetMessage())
-			}
+	defer client.Close()
+	l.Log.Info("executing kubeadm join", zap.String("id", id))
+	if controlPlane {
+		if err := l.executeWriteKubeVIPManifest(ctx, client); err != nil {
+			return err
 		}
 	}
-}
-
-func (l *LibvirtInstance) executeKubeadm(ctx context.Context, client vmproto.APIClient) (output []byte, err error) {
-	l.Log.Info("execute executeKubeadm")
-	resp, err := client.ExecCommandStream(ctx, &vmproto.ExecCommandStreamRequest{
-		Command: "/usr/bin/kubeadm",
-		Args: []string{
-			"init",
-			"--config", "/tmp/kubeadmconf.yaml",
-			"--v=9",
-		},
-	})
-	if err != nil {
-		return
-	}
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-			data, err := resp.Recv()
-			if err != nil {
-				return nil, err
-			}
-			if output := data.GetOutput(); len(output) > 0 {
-				l.Log.Info("kubeadm init response", zap.String("response", string(output)))
-				return output, nil
-			}
-			if log := data.GetLog().GetMessage(); len(log) > 0 {
-				fmt.Println(log)
-			}
-		}
+	if err := client.JoinCluster(ctx, l.joinToken, controlPlane); err != nil {
+		return err
 	}
+	l.Log.Info("kubeadm join succeed", zap.String("id", id))
+	return nil
 }
 
-func (l *LibvirtInstance) executeWriteInitConfiguration(ctx context.Context, client vmproto.APIClient, initConfigKubernetes []byte) (err error) {
-	l.Log.Info("write initconfig", zap.String("config", string(initConfigKubernetes)))
-	_, err = client.WriteFile(ctx, &vmproto.WriteFileRequest{
-		Filepath: "/tmp",
-		Filename: "kubeadmconf.yaml",
-		Content:  initConfigKubernetes,
-	})
-	return err
-}
-
-// InitializeKubernetesgRPC initializes a kubernetes cluster using the gRPC API.
-func (l *LibvirtInstance) InitializeKubernetesgRPC(ctx context.Context, initConfigK8s []byte) (output []byte, err error) {
-	domain, err := l.Conn.LookupDomainByName("delegatio-0")
-	if err != nil {
-		return
-	}
-	defer func() { _ = domain.Free() }()
-	iface, err := domain.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+// executeWriteKubeVIPManifest places the kube-vip static pod on a control plane, which
+// announces the API server VIP. The kubelet starts it together with the other static pods.
+func (l *LibvirtInstance) executeWriteKubeVIPManifest(ctx context.Context, client *agent.Client) error {
+	kubeVIP := utils.KubeVIPConfiguration(l.Config.Cluster.APIServerVIP)
+	manifest, err := utils.MarshalK8SResources(&kubeVIP)
 	if err != nil {
-		return
-	}
-
-	var ip string
-	for _, netInterface := range iface {
-		if netInterface.Name == "lo" {
-			continue
-		}
-		for _, addr := range netInterface.Addrs {
-			if addr.Type == libvirt.IP_ADDR_TYPE_IPV4 {
-				ip = addr.Addr
-			}
-		}
-	}
-	if len(ip) == 0 {
-		return nil, fmt.Errorf("could not find ip addr of domain")
-	}
-	conn, err := grpc.DialContext(ctx, net.JoinHostPort(ip, config.PublicAPIport), grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-	client := vmproto.NewAPIClient(conn)
-	if err := l.executeWriteInitConfiguration(ctx, client, initConfigK8s); err != nil {
-		return nil, err
+		return err
 	}
-	return l.executeKubeadm(ctx, client)
+	l.Log.Info("write kube-vip manifest", zap.String("vip", l.Config.Cluster.APIServerVIP))
+	// the manifest directory is created by kubeadm, which did not run yet.
+	return client.WriteFile(ctx, utils.KubeVIPManifestPath, utils.KubeVIPManifestName, manifest, agent.FileOptions{Mode: 0o600, CreateParents: true})
 }
 
-func (l *LibvirtInstance) getKubeconfgRPC(ctx context.Context) (output []byte, err error) {
-	domain, err := l.Conn.LookupDomainByName("delegatio-0")
-	if err != nil {
-		return
-	}
-	defer func() { _ = domain.Free() }()
-	iface, err := domain.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
-	if err != nil {
-		return
-	}
-
-	var ip string
-	for _, netInterface := range iface {
-		if netInterface.Name == "lo" {
-			continue
-		}
-		for _, addr := range netInterface.Addrs {
-			if addr.Type == libvirt.IP_ADDR_TYPE_IPV4 {
-				ip = addr.Addr
-			}
-		}
-	}
-	if len(ip) == 0 {
-		return nil, fmt.Errorf("could not find ip addr of domain")
-	}
-	conn, err := grpc.DialContext(ctx, net.JoinHostPort(ip, config.PublicAPIport), grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-	client := vmproto.NewAPIClient(conn)
-	resp, err := client.ExecCommandStream(ctx, &vmproto.ExecCommandStreamRequest{
-		Command: "cat",
-		Args:    []string{"/etc/kubernetes/admin.conf"},
-	})
+// InitializeKubernetesgRPC initializes a kubernetes cluster using the gRPC API.
+// It returns the join token, which contains the certificate key for highly available clusters,
+// and the admin kubeconfig. Without initConfigK8s the agent uses the config of its metadata.
+func (l *LibvirtInstance) InitializeKubernetesgRPC(ctx context.Context, initConfigK8s []byte) (*state.JoinToken, []byte, error) {
+	client, err := l.dialAgent(ctx, definitions.DomainPrefix+"0")
 	if err != nil {
-		return
+		return nil, nil, err
 	}
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-			data, err := resp.Recv()
-			if err != nil {
-				return nil, err
-			}
-			if len(data.GetOutput()) > 0 {
-				return data.GetOutput(), nil
-			}
-			if len(data.GetLog().GetMessage()) > 0 {
-				fmt.Println(data.GetLog().GetMessage())
-			}
+	defer client.Close()
+	if l.Config.Cluster.HighAvailability() {
+		if err := l.executeWriteKubeVIPManifest(ctx, client); err != nil {
+			return nil, nil, err
 		}
 	}
+	// The other control planes download the certificates from the cluster when they join.
+	return client.InitCluster(ctx, initConfigK8s, l.Config.Cluster.HighAvailability())
 }
 
 // WriteKubeconfigToDisk writes the kubeconfig to disk.
-func (l *LibvirtInstance) WriteKubeconfigToDisk(ctx context.Context) error {
-	file, err := l.getKubeconfgRPC(ctx)
-	if err != nil {
-		return err
-	}
-	adminConfigFile, err := os.Create("admin.conf")
+func (l *LibvirtInstance) WriteKubeconfigToDisk(kubeconfig []byte) error {
+	adminConfigFile, err := os.OpenFile(l.KubeconfigPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
-		return fmt.Errorf("failed to create admin config file %v: %w", adminConfigFile.Name(), err)
+		return fmt.Errorf("failed to create admin config file %v: %w", l.KubeconfigPath, err)
 	}
 
-	if _, err := adminConfigFile.Write(file); err != nil {
+	if _, err := adminConfigFile.Write(kubeconfig); err != nil {
 		return fmt.Errorf("writing kubeadm init yaml config %v failed: %w", adminConfigFile.Name(), err)
 	}
 	return adminConfigFile.Close()
@@ -31,7 +31,7 @@ type qemuStatusResponse struct {
 	} `json:"return,omitempty"`
 }
 
-func (l *LibvirtInstance) waitForCompletion(ctx context.Context, pid int, domain *libvirt.Domain) (response *qemuStatusResponse, err error) {
+func (l *LibvirtInstance) waitForCompletion(ctx context.Context, pid int, domain Domain) (response *qemuStatusResponse, err error) {
 	response = &qemuStatusResponse{}
 
 	ticker := time.NewTicker(500 * time.Millisecond)
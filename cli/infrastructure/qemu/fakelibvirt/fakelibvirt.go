@@ -0,0 +1,1241 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package fakelibvirt implements the libvirt connection used by the qemu infrastructure in memory.
+// It is meant to be injected as Connector of qemu.LibvirtInstance, to test the qemu backend
+// without a hypervisor. Errors are libvirt.Error values with the codes of the libvirt daemon.
+package fakelibvirt
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// Hypervisor is an in-memory libvirt daemon. Networks and domains are transient,
+// storage pools are persistent and have to be started after they were defined.
+type Hypervisor struct {
+	mux      sync.Mutex
+	pools    map[string]*pool
+	networks map[string]*network
+	domains  map[string]*domain
+	failures map[string]error
+	// files are written by libvirt itself, they become volumes once their pool is refreshed.
+	files map[string]*volume
+	// console is signaled when a console gets output or a console stream ends.
+	console *sync.Cond
+}
+
+// PoolInfo is the state of a storage pool.
+type PoolInfo struct {
+	Name    string
+	Path    string
+	Active  bool
+	Volumes []string
+}
+
+type pool struct {
+	name    string
+	path    string
+	active  bool
+	removed bool
+	volumes map[string]*volume
+}
+
+type volume struct {
+	name     string
+	path     string
+	capacity uint64
+	content  []byte
+	removed  bool
+	// busy is set while a stream transfers data from or to the volume.
+	busy bool
+	// uploaded counts the bytes received by uploads.
+	uploaded uint64
+	// saved is the state of a domain written by SaveFlags, nil for disk volumes.
+	saved *domain
+}
+
+type network struct {
+	name    string
+	def     libvirtxml.Network
+	removed bool
+}
+
+// NetworkInfo is the state of a network.
+type NetworkInfo struct {
+	Name   string
+	Bridge string
+	Domain string
+	// Hosts are the DHCP reservations of all IP elements.
+	Hosts []libvirtxml.NetworkDHCPHost
+}
+
+type domain struct {
+	name    string
+	xml     string
+	paused  bool
+	removed bool
+	// restored is set if the domain was restored from a saved state instead of booted.
+	restored bool
+	// output is everything the domain wrote to its serial console, input everything it received.
+	output []byte
+	input  []byte
+	log    *volume
+	// consoles is the number of streams attached to the console.
+	consoles int
+}
+
+// DomainInfo is the state of a domain.
+type DomainInfo struct {
+	Name     string
+	Paused   bool
+	Restored bool
+	// XML is the configuration the domain was created with.
+	XML string
+}
+
+// New returns a hypervisor without any resources.
+func New() *Hypervisor {
+	h := &Hypervisor{
+		pools:    map[string]*pool{},
+		networks: map[string]*network{},
+		domains:  map[string]*domain{},
+		failures: map[string]error{},
+		files:    map[string]*volume{},
+	}
+	h.console = sync.NewCond(&h.mux)
+	return h
+}
+
+// WriteConsole lets the domain called name write data to its serial console.
+func (h *Hypervisor) WriteConsole(name string, data []byte) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	d, ok := h.domains[name]
+	if !ok {
+		return libvirtError(libvirt.ERR_NO_DOMAIN, libvirt.FROM_DOM, "domain not found: no domain with matching name '%s'", name)
+	}
+	d.output = append(d.output, data...)
+	if d.log != nil {
+		d.log.content = append(d.log.content, data...)
+	}
+	h.console.Broadcast()
+	return nil
+}
+
+// ConsoleInput returns everything the domain called name received on its serial console.
+func (h *Hypervisor) ConsoleInput(name string) []byte {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if d, ok := h.domains[name]; ok {
+		return append([]byte{}, d.input...)
+	}
+	return nil
+}
+
+// startDomain adds the domain and opens the log of its serial console. The caller must hold h.mux.
+func (h *Hypervisor) startDomain(d *domain, def *libvirtxml.Domain) {
+	h.domains[d.name] = d
+	if def.Devices == nil || len(def.Devices.Serials) == 0 || def.Devices.Serials[0].Log == nil {
+		return
+	}
+	log := def.Devices.Serials[0].Log
+	d.log = h.volumeByPath(log.File)
+	if d.log == nil {
+		d.log = h.files[log.File]
+	}
+	if d.log == nil {
+		d.log = &volume{name: filepath.Base(log.File), path: log.File}
+		h.files[log.File] = d.log
+	}
+	if log.Append != "on" {
+		d.log.content = nil
+	}
+}
+
+// stopDomain removes the domain and ends the streams of its console. The caller must hold h.mux.
+func (h *Hypervisor) stopDomain(d *domain) {
+	d.removed = true
+	delete(h.domains, d.name)
+	h.console.Broadcast()
+}
+
+// Connect returns a connection to the hypervisor, the uri is ignored.
+func (h *Hypervisor) Connect(uri string) (qemu.Connection, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if err := h.failure("Connect", uri); err != nil {
+		return nil, err
+	}
+	return &connection{h: h}, nil
+}
+
+// FailOn makes every call of method on the object called name fail with err until
+// ClearFailures is called, i.e. FailOn("Destroy", "delegatio-1", err). Methods of the
+// connection use the name of the object they create or look up, an empty name matches all objects.
+func (h *Hypervisor) FailOn(method, name string, err error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.failures[method+"/"+name] = err
+}
+
+// ClearFailures removes all failures added by FailOn.
+func (h *Hypervisor) ClearFailures() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.failures = map[string]error{}
+}
+
+// Pool returns the state of the storage pool called name.
+func (h *Hypervisor) Pool(name string) (PoolInfo, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	p, ok := h.pools[name]
+	if !ok {
+		return PoolInfo{}, false
+	}
+	info := PoolInfo{Name: p.name, Path: p.path, Active: p.active}
+	for name := range p.volumes {
+		info.Volumes = append(info.Volumes, name)
+	}
+	sort.Strings(info.Volumes)
+	return info, true
+}
+
+// VolumeContent returns the data uploaded to a volume.
+func (h *Hypervisor) VolumeContent(poolName, name string) ([]byte, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	p, ok := h.pools[poolName]
+	if !ok {
+		return nil, false
+	}
+	v, ok := p.volumes[name]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, v.content...), true
+}
+
+// SetVolumeContent replaces the data of a volume, i.e. to simulate an interrupted upload.
+func (h *Hypervisor) SetVolumeContent(poolName, name string, content []byte) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	p, ok := h.pools[poolName]
+	if !ok {
+		return false
+	}
+	v, ok := p.volumes[name]
+	if !ok {
+		return false
+	}
+	v.content = append([]byte{}, content...)
+	return true
+}
+
+// UploadedBytes returns the number of bytes uploaded to a volume.
+func (h *Hypervisor) UploadedBytes(poolName, name string) uint64 {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	p, ok := h.pools[poolName]
+	if !ok {
+		return 0
+	}
+	if v, ok := p.volumes[name]; ok {
+		return v.uploaded
+	}
+	return 0
+}
+
+// Networks returns the names of all networks.
+func (h *Hypervisor) Networks() []string {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return sortedKeys(h.networks)
+}
+
+// Network returns the state of the network called name.
+func (h *Hypervisor) Network(name string) (NetworkInfo, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	n, ok := h.networks[name]
+	if !ok {
+		return NetworkInfo{}, false
+	}
+	info := NetworkInfo{Name: n.name}
+	if n.def.Bridge != nil {
+		info.Bridge = n.def.Bridge.Name
+	}
+	if n.def.Domain != nil {
+		info.Domain = n.def.Domain.Name
+	}
+	for _, ip := range n.def.IPs {
+		if ip.DHCP != nil {
+			info.Hosts = append(info.Hosts, ip.DHCP.Hosts...)
+		}
+	}
+	return info, true
+}
+
+// Domain returns the state of the domain called name.
+func (h *Hypervisor) Domain(name string) (DomainInfo, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	d, ok := h.domains[name]
+	if !ok {
+		return DomainInfo{}, false
+	}
+	return DomainInfo{Name: d.name, Paused: d.paused, Restored: d.restored, XML: d.xml}, true
+}
+
+// Domains returns the names of all domains.
+func (h *Hypervisor) Domains() []string {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return sortedKeys(h.domains)
+}
+
+// failure returns the error registered for method on name. The caller must hold h.mux.
+func (h *Hypervisor) failure(method, name string) error {
+	if err, ok := h.failures[method+"/"+name]; ok {
+		return err
+	}
+	return h.failures[method+"/"]
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func libvirtError(code libvirt.ErrorNumber, domain libvirt.ErrorDomain, format string, args ...any) error {
+	return libvirt.Error{Code: code, Domain: domain, Message: fmt.Sprintf(format, args...), Level: libvirt.ERR_ERROR}
+}
+
+type connection struct {
+	h *Hypervisor
+}
+
+func (c *connection) StoragePoolDefineXML(xmlConfig string, flags libvirt.StoragePoolDefineFlags) (qemu.StoragePool, error) {
+	var def libvirtxml.StoragePool
+	if err := def.Unmarshal(xmlConfig); err != nil {
+		return nil, libvirtError(libvirt.ERR_XML_ERROR, libvirt.FROM_STORAGE, "%v", err)
+	}
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("StoragePoolDefineXML", def.Name); err != nil {
+		return nil, err
+	}
+	// Defining an existing pool updates it.
+	p, ok := c.h.pools[def.Name]
+	if !ok {
+		p = &pool{name: def.Name, volumes: map[string]*volume{}}
+		c.h.pools[def.Name] = p
+	}
+	if def.Target != nil {
+		p.path = def.Target.Path
+	}
+	return &poolHandle{h: c.h, p: p}, nil
+}
+
+func (c *connection) LookupStoragePoolByName(name string) (qemu.StoragePool, error) {
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("LookupStoragePoolByName", name); err != nil {
+		return nil, err
+	}
+	p, ok := c.h.pools[name]
+	if !ok {
+		return nil, libvirtError(libvirt.ERR_NO_STORAGE_POOL, libvirt.FROM_STORAGE, "no storage pool with matching name '%s'", name)
+	}
+	return &poolHandle{h: c.h, p: p}, nil
+}
+
+func (c *connection) LookupStoragePoolByTargetPath(path string) (qemu.StoragePool, error) {
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("LookupStoragePoolByTargetPath", path); err != nil {
+		return nil, err
+	}
+	for _, p := range c.h.pools {
+		if filepath.Clean(p.path) == filepath.Clean(path) {
+			return &poolHandle{h: c.h, p: p}, nil
+		}
+	}
+	return nil, libvirtError(libvirt.ERR_NO_STORAGE_POOL, libvirt.FROM_STORAGE, "no storage pool with matching target path '%s'", path)
+}
+
+func (c *connection) ListAllStoragePools(flags libvirt.ConnectListAllStoragePoolsFlags) ([]qemu.StoragePool, error) {
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("ListAllStoragePools", ""); err != nil {
+		return nil, err
+	}
+	var pools []qemu.StoragePool
+	for _, name := range sortedKeys(c.h.pools) {
+		pools = append(pools, &poolHandle{h: c.h, p: c.h.pools[name]})
+	}
+	return pools, nil
+}
+
+func (c *connection) NetworkCreateXML(xmlConfig string) (qemu.Network, error) {
+	var def libvirtxml.Network
+	if err := def.Unmarshal(xmlConfig); err != nil {
+		return nil, libvirtError(libvirt.ERR_XML_ERROR, libvirt.FROM_NETWORK, "%v", err)
+	}
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("NetworkCreateXML", def.Name); err != nil {
+		return nil, err
+	}
+	if _, ok := c.h.networks[def.Name]; ok {
+		return nil, libvirtError(libvirt.ERR_NETWORK_EXIST, libvirt.FROM_NETWORK, "network '%s' already exists", def.Name)
+	}
+	n := &network{name: def.Name, def: def}
+	c.h.networks[def.Name] = n
+	return &networkHandle{h: c.h, n: n}, nil
+}
+
+func (c *connection) LookupNetworkByName(name string) (qemu.Network, error) {
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("LookupNetworkByName", name); err != nil {
+		return nil, err
+	}
+	n, ok := c.h.networks[name]
+	if !ok {
+		return nil, libvirtError(libvirt.ERR_NO_NETWORK, libvirt.FROM_NETWORK, "network not found: no network with matching name '%s'", name)
+	}
+	return &networkHandle{h: c.h, n: n}, nil
+}
+
+func (c *connection) ListAllNetworks(flags libvirt.ConnectListAllNetworksFlags) ([]qemu.Network, error) {
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("ListAllNetworks", ""); err != nil {
+		return nil, err
+	}
+	var networks []qemu.Network
+	for _, name := range sortedKeys(c.h.networks) {
+		networks = append(networks, &networkHandle{h: c.h, n: c.h.networks[name]})
+	}
+	return networks, nil
+}
+
+func (c *connection) DomainCreateXML(xmlConfig string, flags libvirt.DomainCreateFlags) (qemu.Domain, error) {
+	var def libvirtxml.Domain
+	if err := def.Unmarshal(xmlConfig); err != nil {
+		return nil, libvirtError(libvirt.ERR_XML_ERROR, libvirt.FROM_DOM, "%v", err)
+	}
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("DomainCreateXML", def.Name); err != nil {
+		return nil, err
+	}
+	if _, ok := c.h.domains[def.Name]; ok {
+		return nil, libvirtError(libvirt.ERR_DOM_EXIST, libvirt.FROM_DOM, "domain '%s' already exists", def.Name)
+	}
+	if err := c.h.checkDisks(&def); err != nil {
+		return nil, err
+	}
+	d := &domain{name: def.Name, xml: xmlConfig}
+	c.h.startDomain(d, &def)
+	return &domainHandle{h: c.h, d: d}, nil
+}
+
+// checkDisks fails if a volume of the disks of the domain does not exist, like qemu needs them
+// to start. The caller must hold h.mux.
+func (h *Hypervisor) checkDisks(def *libvirtxml.Domain) error {
+	if def.Devices == nil {
+		return nil
+	}
+	for _, disk := range def.Devices.Disks {
+		if disk.Source == nil || disk.Source.Volume == nil {
+			continue
+		}
+		p, ok := h.pools[disk.Source.Volume.Pool]
+		if !ok || !p.active {
+			return libvirtError(libvirt.ERR_NO_STORAGE_POOL, libvirt.FROM_STORAGE, "storage pool '%s' is not active", disk.Source.Volume.Pool)
+		}
+		if _, ok := p.volumes[disk.Source.Volume.Volume]; !ok {
+			return libvirtError(libvirt.ERR_NO_STORAGE_VOL, libvirt.FROM_STORAGE, "no storage vol with matching name '%s'", disk.Source.Volume.Volume)
+		}
+	}
+	return nil
+}
+
+// DomainRestoreFlags starts the domain saved in srcFile, the file must be a volume of a pool.
+func (c *connection) DomainRestoreFlags(srcFile, xmlConf string, flags libvirt.DomainSaveRestoreFlags) error {
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("DomainRestoreFlags", srcFile); err != nil {
+		return err
+	}
+	v := c.h.volumeByPath(srcFile)
+	if v == nil || v.saved == nil {
+		return libvirtError(libvirt.ERR_OPERATION_FAILED, libvirt.FROM_DOM, "failed to read qemu header from %s", srcFile)
+	}
+	if err := c.h.failure("DomainRestoreFlags", v.saved.name); err != nil {
+		return err
+	}
+	if _, ok := c.h.domains[v.saved.name]; ok {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_DOM, "domain '%s' is already active", v.saved.name)
+	}
+	var def libvirtxml.Domain
+	if err := def.Unmarshal(v.saved.xml); err != nil {
+		return libvirtError(libvirt.ERR_XML_ERROR, libvirt.FROM_DOM, "%v", err)
+	}
+	if err := c.h.checkDisks(&def); err != nil {
+		return err
+	}
+	paused := v.saved.paused
+	switch {
+	case flags&libvirt.DOMAIN_SAVE_PAUSED != 0:
+		paused = true
+	case flags&libvirt.DOMAIN_SAVE_RUNNING != 0:
+		paused = false
+	}
+	c.h.startDomain(&domain{name: v.saved.name, xml: v.saved.xml, paused: paused, restored: true}, &def)
+	return nil
+}
+
+// volumeByPath returns the volume stored at path. The caller must hold h.mux.
+func (h *Hypervisor) volumeByPath(path string) *volume {
+	for _, p := range h.pools {
+		for _, v := range p.volumes {
+			if v.path == path {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func (c *connection) LookupDomainByName(name string) (qemu.Domain, error) {
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("LookupDomainByName", name); err != nil {
+		return nil, err
+	}
+	d, ok := c.h.domains[name]
+	if !ok {
+		return nil, libvirtError(libvirt.ERR_NO_DOMAIN, libvirt.FROM_DOM, "domain not found: no domain with matching name '%s'", name)
+	}
+	return &domainHandle{h: c.h, d: d}, nil
+}
+
+func (c *connection) ListAllDomains(flags libvirt.ConnectListAllDomainsFlags) ([]qemu.Domain, error) {
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("ListAllDomains", ""); err != nil {
+		return nil, err
+	}
+	var domains []qemu.Domain
+	for _, name := range sortedKeys(c.h.domains) {
+		domains = append(domains, &domainHandle{h: c.h, d: c.h.domains[name]})
+	}
+	return domains, nil
+}
+
+func (c *connection) NewStream(flags libvirt.StreamFlags) (qemu.Stream, error) {
+	c.h.mux.Lock()
+	defer c.h.mux.Unlock()
+	if err := c.h.failure("NewStream", ""); err != nil {
+		return nil, err
+	}
+	return &stream{h: c.h}, nil
+}
+
+func (c *connection) Close() (int, error) {
+	return 0, nil
+}
+
+type poolHandle struct {
+	h *Hypervisor
+	p *pool
+}
+
+// check returns the injected failure of method or an error if the pool was undefined.
+// The caller must hold h.mux.
+func (ph *poolHandle) check(method string) error {
+	if err := ph.h.failure(method, ph.p.name); err != nil {
+		return err
+	}
+	if ph.p.removed {
+		return libvirtError(libvirt.ERR_NO_STORAGE_POOL, libvirt.FROM_STORAGE, "no storage pool with matching name '%s'", ph.p.name)
+	}
+	return nil
+}
+
+func (ph *poolHandle) GetName() (string, error) {
+	return ph.p.name, nil
+}
+
+func (ph *poolHandle) IsActive() (bool, error) {
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	if err := ph.check("IsActive"); err != nil {
+		return false, err
+	}
+	return ph.p.active, nil
+}
+
+func (ph *poolHandle) Build(flags libvirt.StoragePoolBuildFlags) error {
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	return ph.check("Build")
+}
+
+func (ph *poolHandle) Create(flags libvirt.StoragePoolCreateFlags) error {
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	if err := ph.check("Create"); err != nil {
+		return err
+	}
+	if ph.p.active {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STORAGE, "storage pool '%s' is already active", ph.p.name)
+	}
+	ph.p.active = true
+	return nil
+}
+
+func (ph *poolHandle) Destroy() error {
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	if err := ph.check("Destroy"); err != nil {
+		return err
+	}
+	if !ph.p.active {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STORAGE, "storage pool '%s' is not active", ph.p.name)
+	}
+	ph.p.active = false
+	return nil
+}
+
+func (ph *poolHandle) Delete(flags libvirt.StoragePoolDeleteFlags) error {
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	if err := ph.check("Delete"); err != nil {
+		return err
+	}
+	if ph.p.active {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STORAGE, "storage pool '%s' is still active", ph.p.name)
+	}
+	notEmpty := len(ph.p.volumes) > 0
+	for path := range ph.h.files {
+		notEmpty = notEmpty || filepath.Dir(path) == filepath.Clean(ph.p.path)
+	}
+	if notEmpty {
+		return libvirtError(libvirt.ERR_SYSTEM_ERROR, libvirt.FROM_STORAGE, "cannot remove directory '%s': Directory not empty", ph.p.path)
+	}
+	return nil
+}
+
+func (ph *poolHandle) Undefine() error {
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	if err := ph.check("Undefine"); err != nil {
+		return err
+	}
+	if ph.p.active {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STORAGE, "storage pool '%s' is still active", ph.p.name)
+	}
+	ph.p.removed = true
+	delete(ph.h.pools, ph.p.name)
+	return nil
+}
+
+func (ph *poolHandle) StorageVolCreateXML(xmlConfig string, flags libvirt.StorageVolCreateFlags) (qemu.StorageVol, error) {
+	var def libvirtxml.StorageVolume
+	if err := def.Unmarshal(xmlConfig); err != nil {
+		return nil, libvirtError(libvirt.ERR_XML_ERROR, libvirt.FROM_STORAGE, "%v", err)
+	}
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	if err := ph.check("StorageVolCreateXML"); err != nil {
+		return nil, err
+	}
+	if err := ph.h.failure("StorageVolCreateXML", def.Name); err != nil {
+		return nil, err
+	}
+	if !ph.p.active {
+		return nil, libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STORAGE, "storage pool '%s' is not active", ph.p.name)
+	}
+	if _, ok := ph.p.volumes[def.Name]; ok {
+		return nil, libvirtError(libvirt.ERR_STORAGE_VOL_EXIST, libvirt.FROM_STORAGE, "storage volume '%s' exists already", def.Name)
+	}
+	v := &volume{name: def.Name, path: filepath.Join(ph.p.path, def.Name)}
+	if def.Capacity != nil {
+		v.capacity = def.Capacity.Value
+	}
+	ph.p.volumes[def.Name] = v
+	return &volumeHandle{h: ph.h, p: ph.p, v: v}, nil
+}
+
+// StorageVolCreateXMLFrom creates a volume with the content of clonevol.
+func (ph *poolHandle) StorageVolCreateXMLFrom(xmlConfig string, clonevol qemu.StorageVol, flags libvirt.StorageVolCreateFlags) (qemu.StorageVol, error) {
+	source, ok := clonevol.(*volumeHandle)
+	if !ok || source.h != ph.h {
+		return nil, libvirtError(libvirt.ERR_INVALID_STORAGE_VOL, libvirt.FROM_STORAGE, "volume belongs to another connection")
+	}
+	created, err := ph.StorageVolCreateXML(xmlConfig, flags)
+	if err != nil {
+		return nil, err
+	}
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	target := created.(*volumeHandle).v
+	if err := ph.h.failure("StorageVolCreateXMLFrom", target.name); err != nil {
+		delete(ph.p.volumes, target.name)
+		return nil, err
+	}
+	if source.v.removed {
+		delete(ph.p.volumes, target.name)
+		return nil, libvirtError(libvirt.ERR_NO_STORAGE_VOL, libvirt.FROM_STORAGE, "no storage vol with matching name '%s'", source.v.name)
+	}
+	target.content = append([]byte{}, source.v.content...)
+	return created, nil
+}
+
+// Refresh adds the files libvirt wrote into the directory of the pool as volumes, i.e. console logs.
+// Saved domains are volumes right away.
+func (ph *poolHandle) Refresh(flags uint32) error {
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	if err := ph.check("Refresh"); err != nil {
+		return err
+	}
+	if !ph.p.active {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STORAGE, "storage pool '%s' is not active", ph.p.name)
+	}
+	for path, f := range ph.h.files {
+		if filepath.Dir(path) == filepath.Clean(ph.p.path) {
+			ph.p.volumes[f.name] = f
+			delete(ph.h.files, path)
+		}
+	}
+	return nil
+}
+
+func (ph *poolHandle) LookupStorageVolByName(name string) (qemu.StorageVol, error) {
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	if err := ph.check("LookupStorageVolByName"); err != nil {
+		return nil, err
+	}
+	v, ok := ph.p.volumes[name]
+	if !ok || !ph.p.active {
+		return nil, libvirtError(libvirt.ERR_NO_STORAGE_VOL, libvirt.FROM_STORAGE, "no storage vol with matching name '%s'", name)
+	}
+	return &volumeHandle{h: ph.h, p: ph.p, v: v}, nil
+}
+
+func (ph *poolHandle) ListAllStorageVolumes(flags uint32) ([]qemu.StorageVol, error) {
+	ph.h.mux.Lock()
+	defer ph.h.mux.Unlock()
+	if err := ph.check("ListAllStorageVolumes"); err != nil {
+		return nil, err
+	}
+	if !ph.p.active {
+		return nil, libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STORAGE, "storage pool '%s' is not active", ph.p.name)
+	}
+	var volumes []qemu.StorageVol
+	for _, name := range sortedKeys(ph.p.volumes) {
+		volumes = append(volumes, &volumeHandle{h: ph.h, p: ph.p, v: ph.p.volumes[name]})
+	}
+	return volumes, nil
+}
+
+func (ph *poolHandle) Free() error {
+	return nil
+}
+
+type volumeHandle struct {
+	h *Hypervisor
+	p *pool
+	v *volume
+}
+
+func (vh *volumeHandle) check(method string) error {
+	if err := vh.h.failure(method, vh.v.name); err != nil {
+		return err
+	}
+	if vh.v.removed {
+		return libvirtError(libvirt.ERR_NO_STORAGE_VOL, libvirt.FROM_STORAGE, "no storage vol with matching name '%s'", vh.v.name)
+	}
+	return nil
+}
+
+func (vh *volumeHandle) GetName() (string, error) {
+	return vh.v.name, nil
+}
+
+func (vh *volumeHandle) Upload(s qemu.Stream, offset, length uint64, flags libvirt.StorageVolUploadFlags) error {
+	vh.h.mux.Lock()
+	defer vh.h.mux.Unlock()
+	if err := vh.check("Upload"); err != nil {
+		return err
+	}
+	fake, err := vh.attach(s)
+	if err != nil {
+		return err
+	}
+	if offset > uint64(len(vh.v.content)) {
+		return libvirtError(libvirt.ERR_INVALID_ARG, libvirt.FROM_STORAGE, "offset %d is behind the end of volume '%s'", offset, vh.v.name)
+	}
+	fake.upload = true
+	fake.offset = offset
+	fake.remaining = length
+	return nil
+}
+
+// Download streams the volume from offset, a length of 0 reads until its end.
+func (vh *volumeHandle) Download(s qemu.Stream, offset, length uint64, flags libvirt.StorageVolDownloadFlags) error {
+	vh.h.mux.Lock()
+	defer vh.h.mux.Unlock()
+	if err := vh.check("Download"); err != nil {
+		return err
+	}
+	fake, err := vh.attach(s)
+	if err != nil {
+		return err
+	}
+	size := uint64(len(vh.v.content))
+	if offset > size {
+		offset = size
+	}
+	if length == 0 || offset+length > size {
+		length = size - offset
+	}
+	fake.offset = offset
+	fake.remaining = length
+	return nil
+}
+
+// GetInfo reports the size of the content as allocation, the capacity is at least as large.
+func (vh *volumeHandle) GetInfo() (*libvirt.StorageVolInfo, error) {
+	vh.h.mux.Lock()
+	defer vh.h.mux.Unlock()
+	if err := vh.check("GetInfo"); err != nil {
+		return nil, err
+	}
+	capacity := vh.v.capacity
+	if size := uint64(len(vh.v.content)); capacity < size {
+		capacity = size
+	}
+	return &libvirt.StorageVolInfo{Type: libvirt.STORAGE_VOL_FILE, Capacity: capacity, Allocation: uint64(len(vh.v.content))}, nil
+}
+
+// attach connects the stream to the volume. The caller must hold vh.h.mux.
+func (vh *volumeHandle) attach(s qemu.Stream) (*stream, error) {
+	fake, ok := s.(*stream)
+	if !ok || fake.h != vh.h {
+		return nil, libvirtError(libvirt.ERR_INVALID_STREAM, libvirt.FROM_STREAMS, "stream belongs to another connection")
+	}
+	if fake.target != nil {
+		return nil, libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STREAMS, "stream is already in use")
+	}
+	if vh.v.busy {
+		return nil, libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STORAGE, "volume '%s' is still in use", vh.v.name)
+	}
+	vh.v.busy = true
+	fake.target = vh.v
+	return fake, nil
+}
+
+func (vh *volumeHandle) Delete(flags libvirt.StorageVolDeleteFlags) error {
+	vh.h.mux.Lock()
+	defer vh.h.mux.Unlock()
+	if err := vh.check("Delete"); err != nil {
+		return err
+	}
+	vh.v.removed = true
+	delete(vh.p.volumes, vh.v.name)
+	return nil
+}
+
+func (vh *volumeHandle) Free() error {
+	return nil
+}
+
+// stream transfers data directly from or to the volume. Like the streams of libvirt,
+// uploads are truncated to the announced length and fail once it is reached. The volume
+// stays busy until the stream is finished or aborted.
+type stream struct {
+	h         *Hypervisor
+	target    *volume
+	console   *domain
+	upload    bool
+	offset    uint64
+	remaining uint64
+	finished  bool
+	aborted   bool
+}
+
+func (s *stream) Send(p []byte) (int, error) {
+	s.h.mux.Lock()
+	defer s.h.mux.Unlock()
+	if err := s.h.failure("Send", ""); err != nil {
+		return 0, err
+	}
+	if s.console != nil && !s.finished && !s.aborted {
+		if s.console.removed {
+			return 0, libvirtError(libvirt.ERR_OPERATION_FAILED, libvirt.FROM_STREAMS, "domain '%s' is not running", s.console.name)
+		}
+		s.console.input = append(s.console.input, p...)
+		return len(p), nil
+	}
+	if s.target == nil || !s.upload || s.finished || s.aborted {
+		return 0, libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STREAMS, "stream is not open for writing")
+	}
+	if s.remaining == 0 {
+		return 0, libvirtError(libvirt.ERR_SYSTEM_ERROR, libvirt.FROM_STREAMS, "cannot write to stream: No space left on device")
+	}
+	if uint64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	if end := s.offset + uint64(len(p)); uint64(len(s.target.content)) < end {
+		s.target.content = append(s.target.content, make([]byte, end-uint64(len(s.target.content)))...)
+	}
+	copy(s.target.content[s.offset:], p)
+	s.offset += uint64(len(p))
+	s.remaining -= uint64(len(p))
+	s.target.uploaded += uint64(len(p))
+	return len(p), nil
+}
+
+// Recv returns io.EOF at the end of the download, like libvirt.Stream.
+func (s *stream) Recv(p []byte) (int, error) {
+	s.h.mux.Lock()
+	defer s.h.mux.Unlock()
+	if err := s.h.failure("Recv", ""); err != nil {
+		return 0, err
+	}
+	if s.console != nil {
+		return s.recvConsole(p)
+	}
+	if s.target == nil || s.upload || s.finished || s.aborted {
+		return 0, libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STREAMS, "stream is not open for reading")
+	}
+	if s.remaining == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n := copy(p, s.target.content[s.offset:])
+	s.offset += uint64(n)
+	s.remaining -= uint64(n)
+	return n, nil
+}
+
+// recvConsole blocks until the domain writes to its console. It returns io.EOF once the domain
+// stopped. The caller must hold s.h.mux.
+func (s *stream) recvConsole(p []byte) (int, error) {
+	for {
+		if s.finished || s.aborted {
+			return 0, libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STREAMS, "stream is not open for reading")
+		}
+		if s.offset < uint64(len(s.console.output)) {
+			n := copy(p, s.console.output[s.offset:])
+			s.offset += uint64(n)
+			return n, nil
+		}
+		if s.console.removed {
+			return 0, io.EOF
+		}
+		s.h.console.Wait()
+	}
+}
+
+// Finish fails if an upload did not send the announced length, the data which was sent is kept.
+func (s *stream) Finish() error {
+	s.h.mux.Lock()
+	defer s.h.mux.Unlock()
+	if err := s.h.failure("Finish", ""); err != nil {
+		return err
+	}
+	if s.console != nil {
+		s.finished = true
+		s.console.consoles--
+		s.h.console.Broadcast()
+		return nil
+	}
+	if s.target == nil || s.finished || s.aborted {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STREAMS, "stream is not open")
+	}
+	s.finished = true
+	s.target.busy = false
+	if s.upload && s.remaining > 0 {
+		return libvirtError(libvirt.ERR_INTERNAL_ERROR, libvirt.FROM_STREAMS, "stream finished with %d bytes missing", s.remaining)
+	}
+	return nil
+}
+
+func (s *stream) Abort() error {
+	s.h.mux.Lock()
+	defer s.h.mux.Unlock()
+	if s.target != nil && !s.finished {
+		s.target.busy = false
+	}
+	if s.console != nil && !s.finished && !s.aborted {
+		s.console.consoles--
+		s.h.console.Broadcast()
+	}
+	s.aborted = true
+	return nil
+}
+
+func (s *stream) Free() error {
+	return nil
+}
+
+type networkHandle struct {
+	h *Hypervisor
+	n *network
+}
+
+func (nh *networkHandle) GetName() (string, error) {
+	return nh.n.name, nil
+}
+
+// Destroy removes the network, it is transient.
+func (nh *networkHandle) Destroy() error {
+	nh.h.mux.Lock()
+	defer nh.h.mux.Unlock()
+	if err := nh.h.failure("Destroy", nh.n.name); err != nil {
+		return err
+	}
+	if nh.n.removed {
+		return libvirtError(libvirt.ERR_NO_NETWORK, libvirt.FROM_NETWORK, "network not found: no network with matching name '%s'", nh.n.name)
+	}
+	nh.n.removed = true
+	delete(nh.h.networks, nh.n.name)
+	return nil
+}
+
+// Update changes the DHCP reservations of the network, other sections are not supported.
+func (nh *networkHandle) Update(cmd libvirt.NetworkUpdateCommand, section libvirt.NetworkUpdateSection, parentIndex int, xml string, flags libvirt.NetworkUpdateFlags) error {
+	nh.h.mux.Lock()
+	defer nh.h.mux.Unlock()
+	if err := nh.h.failure("Update", nh.n.name); err != nil {
+		return err
+	}
+	if nh.n.removed {
+		return libvirtError(libvirt.ERR_NO_NETWORK, libvirt.FROM_NETWORK, "network not found: no network with matching name '%s'", nh.n.name)
+	}
+	if section != libvirt.NETWORK_SECTION_IP_DHCP_HOST {
+		return libvirtError(libvirt.ERR_NO_SUPPORT, libvirt.FROM_NETWORK, "can't update section %d of network '%s'", section, nh.n.name)
+	}
+	var host libvirtxml.NetworkDHCPHost
+	if err := host.Unmarshal(xml); err != nil {
+		return libvirtError(libvirt.ERR_XML_ERROR, libvirt.FROM_NETWORK, "%v", err)
+	}
+	if parentIndex < 0 || parentIndex >= len(nh.n.def.IPs) || nh.n.def.IPs[parentIndex].DHCP == nil {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_NETWORK, "couldn't locate ip element %d with dhcp in network '%s'", parentIndex, nh.n.name)
+	}
+	dhcp := nh.n.def.IPs[parentIndex].DHCP
+	match := -1
+	for i, existing := range dhcp.Hosts {
+		if (host.MAC != "" && existing.MAC == host.MAC) || (host.Name != "" && existing.Name == host.Name) || existing.IP == host.IP {
+			match = i
+			break
+		}
+	}
+	switch cmd {
+	case libvirt.NETWORK_UPDATE_COMMAND_ADD_FIRST, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST:
+		if match >= 0 {
+			return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_NETWORK, "there is an existing dhcp host entry in network '%s' that matches", nh.n.name)
+		}
+		if cmd == libvirt.NETWORK_UPDATE_COMMAND_ADD_FIRST {
+			dhcp.Hosts = append([]libvirtxml.NetworkDHCPHost{host}, dhcp.Hosts...)
+		} else {
+			dhcp.Hosts = append(dhcp.Hosts, host)
+		}
+	case libvirt.NETWORK_UPDATE_COMMAND_DELETE:
+		if match < 0 {
+			return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_NETWORK, "couldn't locate a matching dhcp host entry in network '%s'", nh.n.name)
+		}
+		dhcp.Hosts = append(dhcp.Hosts[:match], dhcp.Hosts[match+1:]...)
+	default:
+		return libvirtError(libvirt.ERR_NO_SUPPORT, libvirt.FROM_NETWORK, "unsupported network update command %d", cmd)
+	}
+	return nil
+}
+
+func (nh *networkHandle) Free() error {
+	return nil
+}
+
+type domainHandle struct {
+	h *Hypervisor
+	d *domain
+}
+
+func (dh *domainHandle) GetName() (string, error) {
+	return dh.d.name, nil
+}
+
+// Destroy removes the domain, it is transient.
+func (dh *domainHandle) Destroy() error {
+	dh.h.mux.Lock()
+	defer dh.h.mux.Unlock()
+	if err := dh.h.failure("Destroy", dh.d.name); err != nil {
+		return err
+	}
+	if dh.d.removed {
+		return libvirtError(libvirt.ERR_NO_DOMAIN, libvirt.FROM_DOM, "domain not found: no domain with matching name '%s'", dh.d.name)
+	}
+	dh.h.stopDomain(dh.d)
+	return nil
+}
+
+func (dh *domainHandle) check(method string) error {
+	if err := dh.h.failure(method, dh.d.name); err != nil {
+		return err
+	}
+	if dh.d.removed {
+		return libvirtError(libvirt.ERR_NO_DOMAIN, libvirt.FROM_DOM, "domain not found: no domain with matching name '%s'", dh.d.name)
+	}
+	return nil
+}
+
+func (dh *domainHandle) Suspend() error {
+	dh.h.mux.Lock()
+	defer dh.h.mux.Unlock()
+	if err := dh.check("Suspend"); err != nil {
+		return err
+	}
+	dh.d.paused = true
+	return nil
+}
+
+func (dh *domainHandle) Resume() error {
+	dh.h.mux.Lock()
+	defer dh.h.mux.Unlock()
+	if err := dh.check("Resume"); err != nil {
+		return err
+	}
+	if !dh.d.paused {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_DOM, "domain is not paused")
+	}
+	dh.d.paused = false
+	return nil
+}
+
+// SaveFlags writes the state of the domain to destFile and stops it. The file must be in the
+// directory of a pool, it is a volume of the pool afterwards.
+func (dh *domainHandle) SaveFlags(destFile, destXML string, flags libvirt.DomainSaveRestoreFlags) error {
+	dh.h.mux.Lock()
+	defer dh.h.mux.Unlock()
+	if err := dh.check("SaveFlags"); err != nil {
+		return err
+	}
+	var p *pool
+	for _, candidate := range dh.h.pools {
+		if candidate.active && filepath.Clean(candidate.path) == filepath.Dir(destFile) {
+			p = candidate
+		}
+	}
+	if p == nil {
+		return libvirtError(libvirt.ERR_SYSTEM_ERROR, libvirt.FROM_DOM, "failed to create file '%s': No such file or directory", destFile)
+	}
+	name := filepath.Base(destFile)
+	if v, ok := p.volumes[name]; ok && v.busy {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STORAGE, "volume '%s' is still in use", name)
+	}
+	saved := domain{name: dh.d.name, xml: dh.d.xml, paused: dh.d.paused}
+	p.volumes[name] = &volume{name: name, path: destFile, content: []byte("saved state of " + dh.d.name), saved: &saved}
+	dh.h.stopDomain(dh.d)
+	return nil
+}
+
+// OpenConsole attaches the stream to the serial console, it receives the output written afterwards.
+// Like with DOMAIN_CONSOLE_SAFE, only one stream can be attached at a time.
+func (dh *domainHandle) OpenConsole(devname string, s qemu.Stream, flags libvirt.DomainConsoleFlags) error {
+	dh.h.mux.Lock()
+	defer dh.h.mux.Unlock()
+	if err := dh.check("OpenConsole"); err != nil {
+		return err
+	}
+	fake, ok := s.(*stream)
+	if !ok || fake.h != dh.h {
+		return libvirtError(libvirt.ERR_INVALID_STREAM, libvirt.FROM_STREAMS, "stream belongs to another connection")
+	}
+	if fake.target != nil || fake.console != nil {
+		return libvirtError(libvirt.ERR_OPERATION_INVALID, libvirt.FROM_STREAMS, "stream is already in use")
+	}
+	if dh.d.consoles > 0 && flags&libvirt.DOMAIN_CONSOLE_FORCE == 0 {
+		return libvirtError(libvirt.ERR_OPERATION_FAILED, libvirt.FROM_DOM, "Active console session exists for this domain")
+	}
+	dh.d.consoles++
+	fake.console = dh.d
+	fake.offset = uint64(len(dh.d.output))
+	return nil
+}
+
+// ListAllInterfaceAddresses reports the leases of the domain. A domain gets a lease as soon as it
+// was created if its network reserves an address for it, IPv4 by its MAC and IPv6 by its name.
+func (dh *domainHandle) ListAllInterfaceAddresses(src libvirt.DomainInterfaceAddressesSource) ([]libvirt.DomainInterface, error) {
+	dh.h.mux.Lock()
+	defer dh.h.mux.Unlock()
+	if err := dh.h.failure("ListAllInterfaceAddresses", dh.d.name); err != nil {
+		return nil, err
+	}
+	if dh.d.removed {
+		return nil, libvirtError(libvirt.ERR_NO_DOMAIN, libvirt.FROM_DOM, "domain not found: no domain with matching name '%s'", dh.d.name)
+	}
+	var def libvirtxml.Domain
+	if err := def.Unmarshal(dh.d.xml); err != nil || def.Devices == nil {
+		return nil, nil
+	}
+	var result []libvirt.DomainInterface
+	for i, iface := range def.Devices.Interfaces {
+		if iface.MAC == nil || iface.Source == nil || iface.Source.Network == nil {
+			continue
+		}
+		n, ok := dh.h.networks[iface.Source.Network.Network]
+		if !ok {
+			continue
+		}
+		leased := libvirt.DomainInterface{Name: fmt.Sprintf("vnet%d", i), Hwaddr: iface.MAC.Address}
+		for _, ip := range n.def.IPs {
+			if ip.DHCP == nil {
+				continue
+			}
+			for _, host := range ip.DHCP.Hosts {
+				if ip.Family == "ipv6" && host.Name == dh.d.name {
+					leased.Addrs = append(leased.Addrs, libvirt.DomainIPAddress{Type: libvirt.IP_ADDR_TYPE_IPV6, Addr: host.IP, Prefix: ip.Prefix})
+				}
+				if ip.Family != "ipv6" && host.MAC == iface.MAC.Address {
+					leased.Addrs = append(leased.Addrs, libvirt.DomainIPAddress{Type: libvirt.IP_ADDR_TYPE_IPV4, Addr: host.IP, Prefix: ip.Prefix})
+				}
+			}
+		}
+		if len(leased.Addrs) > 0 {
+			result = append(result, leased)
+		}
+	}
+	return result, nil
+}
+
+// QemuAgentCommand fails, the domains run no guest agent.
+func (dh *domainHandle) QemuAgentCommand(command string, timeout libvirt.DomainQemuAgentCommandTimeout, flags uint32) (string, error) {
+	return "", libvirtError(libvirt.ERR_AGENT_UNRESPONSIVE, libvirt.FROM_DOM, "QEMU guest agent is not connected")
+}
+
+func (dh *domainHandle) Free() error {
+	return nil
+}
@@ -0,0 +1,268 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/benschlueter/delegatio/cli/infrastructure/image"
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"libvirt.org/go/libvirt"
+)
+
+// uploadChunkSize is the size of the chunks the image is streamed in.
+const uploadChunkSize = 4 * 1024 * 1024
+
+// createBaseImage verifies the image and uploads it into the base volume.
+// A base volume with the digest of the image is reused, an interrupted upload is resumed.
+func (l *LibvirtInstance) createBaseImage(ctx context.Context) (err error) {
+	infra := l.Config.Infrastructure
+	l.Log.Info("verifying image", zap.String("path", infra.ImagePath))
+	digest, err := image.Verify(infra.ImagePath, infra.ImageChecksums, infra.ImageSigningKey)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(infra.ImagePath)
+	if err != nil {
+		return fmt.Errorf("error while opening %s: %w", infra.ImagePath, err)
+	}
+	defer func() {
+		err = multierr.Append(err, file.Close())
+	}()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(fi.Size())
+
+	storagePool, err := l.Conn.LookupStoragePoolByTargetPath(definitions.LibvirtStoragePoolPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = storagePool.Free() }()
+	volume, err := storagePool.LookupStorageVolByName(definitions.BaseDiskName)
+	var offset uint64
+	switch {
+	case isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL):
+		if volume, err = l.createBaseVolume(storagePool); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		var got string
+		var length uint64
+		got, offset, length, err = l.compareBaseVolume(ctx, volume, file)
+		if err != nil {
+			_ = volume.Free()
+			return err
+		}
+		if got == digest {
+			l.Log.Info("base image is already uploaded", zap.String("sha256", digest))
+			_ = volume.Free()
+			l.registerBaseImage(digest)
+			return nil
+		}
+		// Uploads only overwrite the volume, data behind the image would remain.
+		if length > size {
+			l.Log.Info("base volume does not match the image, recreating it")
+			offset = 0
+			err = volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+			_ = volume.Free()
+			if err != nil {
+				return fmt.Errorf("deleting base volume: %w", err)
+			}
+			if volume, err = l.createBaseVolume(storagePool); err != nil {
+				return err
+			}
+		}
+	}
+	defer func() { _ = volume.Free() }()
+	// The digest is only recorded once the upload was verified.
+	l.registerBaseImage("")
+
+	if offset > 0 {
+		l.Log.Info("resuming image upload", zap.Uint64("offset", offset), zap.Uint64("size", size))
+	} else {
+		l.Log.Info("uploading baseimage to libvirt storage pool", zap.Uint64("size", size))
+	}
+	if err := l.uploadBaseImage(ctx, volume, file, offset, size); err != nil {
+		return err
+	}
+	got, _, _, err := l.compareBaseVolume(ctx, volume, nil)
+	if err != nil {
+		return fmt.Errorf("verifying uploaded image: %w", err)
+	}
+	if got != digest {
+		return fmt.Errorf("uploaded image: %w, got %s, want %s", image.ErrDigestMismatch, got, digest)
+	}
+	l.Log.Info("image upload successful", zap.String("sha256", digest))
+	l.registerBaseImage(digest)
+	return nil
+}
+
+func (l *LibvirtInstance) createBaseVolume(storagePool StoragePool) (StorageVol, error) {
+	volumeBaseXMLString, err := definitions.VolumeBaseXMLConfig.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	l.Log.Info("creating base storage image")
+	volume, err := storagePool.StorageVolCreateXML(volumeBaseXMLString, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error creating libvirt storage volume 'base': %w", err)
+	}
+	return volume, nil
+}
+
+// registerBaseImage records the base volume and the digest of its content.
+func (l *LibvirtInstance) registerBaseImage(digest string) {
+	l.ConnMux.Lock()
+	defer l.ConnMux.Unlock()
+	if !l.diskRegisteredLocked(definitions.BaseDiskName) {
+		l.RegisteredDisks = append(l.RegisteredDisks, definitions.BaseDiskName)
+	}
+	l.baseImageDigest = digest
+}
+
+// uploadBaseImage streams the image from offset to size into the volume.
+func (l *LibvirtInstance) uploadBaseImage(ctx context.Context, volume StorageVol, file io.ReadSeeker, offset, size uint64) (err error) {
+	if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	// The stream is blocking, Send returns once the chunk was accepted by libvirt.
+	stream, err := l.Conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stream.Free() }()
+	if err := volume.Upload(stream, offset, size-offset, 0); err != nil {
+		return err
+	}
+	// An unfinished stream must be aborted, otherwise libvirt keeps the volume busy.
+	defer func() {
+		if err != nil {
+			_ = stream.Abort()
+		}
+	}()
+
+	progress := image.NewProgress(l.Log, int64(offset), int64(size))
+	transferredBytes := offset
+	buffer := make([]byte, uploadChunkSize)
+	for transferredBytes < size {
+		// Since this can take long we must make this interruptable in case of a context cancellation.
+		if err := ctx.Err(); err != nil {
+			l.Log.Info("context cancel during image upload")
+			return err
+		}
+		n, err := file.Read(buffer)
+		if n > 0 {
+			if err := sendAll(stream, buffer[:n]); err != nil {
+				return fmt.Errorf("sending image: %w", err)
+			}
+			transferredBytes += uint64(n)
+			progress.Add(n)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if transferredBytes != size {
+		return fmt.Errorf("sent %d out of %d bytes, the image changed during the upload", transferredBytes, size)
+	}
+	if err := stream.Finish(); err != nil {
+		return fmt.Errorf("finishing image upload: %w", err)
+	}
+	return nil
+}
+
+// sendAll sends p completely, Send may accept less than p.
+func sendAll(stream Stream, p []byte) error {
+	for len(p) > 0 {
+		n, err := stream.Send(p)
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// compareBaseVolume downloads the volume and returns its digest and length. If file is set, the length
+// of the prefix which matches the file is returned as well, the upload can be resumed from there.
+func (l *LibvirtInstance) compareBaseVolume(ctx context.Context, volume StorageVol, file io.ReadSeeker) (digest string, matching, length uint64, err error) {
+	stream, err := l.Conn.NewStream(0)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer func() { _ = stream.Free() }()
+	if err := volume.Download(stream, 0, 0, 0); err != nil {
+		return "", 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = stream.Abort()
+		}
+	}()
+	if file != nil {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", 0, 0, err
+		}
+	}
+
+	hash := sha256.New()
+	buffer := make([]byte, uploadChunkSize)
+	expected := make([]byte, uploadChunkSize)
+	matches := file != nil
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", 0, 0, err
+		}
+		n, err := stream.Recv(buffer)
+		if n > 0 {
+			hash.Write(buffer[:n])
+			length += uint64(n)
+			if matches {
+				read, _ := io.ReadFull(file, expected[:n])
+				same := commonPrefix(buffer[:read], expected[:read])
+				matching += uint64(same)
+				matches = same == n
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("downloading base volume: %w", err)
+		}
+	}
+	if err := stream.Finish(); err != nil {
+		return "", 0, 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), matching, length, nil
+}
+
+func commonPrefix(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return len(a)
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return len(a)
+}
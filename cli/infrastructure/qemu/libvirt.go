@@ -0,0 +1,264 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package qemu
+
+import (
+	"libvirt.org/go/libvirt"
+)
+
+// Connection is the subset of libvirt.Connect used by the infrastructure.
+// It is an interface to run the infrastructure against a fake hypervisor in tests.
+type Connection interface {
+	StoragePoolDefineXML(xmlConfig string, flags libvirt.StoragePoolDefineFlags) (StoragePool, error)
+	LookupStoragePoolByName(name string) (StoragePool, error)
+	LookupStoragePoolByTargetPath(path string) (StoragePool, error)
+	ListAllStoragePools(flags libvirt.ConnectListAllStoragePoolsFlags) ([]StoragePool, error)
+	NetworkCreateXML(xmlConfig string) (Network, error)
+	LookupNetworkByName(name string) (Network, error)
+	ListAllNetworks(flags libvirt.ConnectListAllNetworksFlags) ([]Network, error)
+	DomainCreateXML(xmlConfig string, flags libvirt.DomainCreateFlags) (Domain, error)
+	DomainRestoreFlags(srcFile, xmlConf string, flags libvirt.DomainSaveRestoreFlags) error
+	LookupDomainByName(name string) (Domain, error)
+	ListAllDomains(flags libvirt.ConnectListAllDomainsFlags) ([]Domain, error)
+	NewStream(flags libvirt.StreamFlags) (Stream, error)
+	Close() (int, error)
+}
+
+// StoragePool is the subset of libvirt.StoragePool used by the infrastructure.
+type StoragePool interface {
+	GetName() (string, error)
+	IsActive() (bool, error)
+	Build(flags libvirt.StoragePoolBuildFlags) error
+	Create(flags libvirt.StoragePoolCreateFlags) error
+	Destroy() error
+	Delete(flags libvirt.StoragePoolDeleteFlags) error
+	Undefine() error
+	StorageVolCreateXML(xmlConfig string, flags libvirt.StorageVolCreateFlags) (StorageVol, error)
+	StorageVolCreateXMLFrom(xmlConfig string, clonevol StorageVol, flags libvirt.StorageVolCreateFlags) (StorageVol, error)
+	Refresh(flags uint32) error
+	LookupStorageVolByName(name string) (StorageVol, error)
+	ListAllStorageVolumes(flags uint32) ([]StorageVol, error)
+	Free() error
+}
+
+// StorageVol is the subset of libvirt.StorageVol used by the infrastructure.
+type StorageVol interface {
+	GetName() (string, error)
+	Upload(stream Stream, offset, length uint64, flags libvirt.StorageVolUploadFlags) error
+	Download(stream Stream, offset, length uint64, flags libvirt.StorageVolDownloadFlags) error
+	GetInfo() (*libvirt.StorageVolInfo, error)
+	Delete(flags libvirt.StorageVolDeleteFlags) error
+	Free() error
+}
+
+// Stream is the subset of libvirt.Stream used by the infrastructure.
+type Stream interface {
+	Send(p []byte) (int, error)
+	Recv(p []byte) (int, error)
+	Finish() error
+	Abort() error
+	Free() error
+}
+
+// Network is the subset of libvirt.Network used by the infrastructure.
+type Network interface {
+	GetName() (string, error)
+	Update(cmd libvirt.NetworkUpdateCommand, section libvirt.NetworkUpdateSection, parentIndex int, xml string, flags libvirt.NetworkUpdateFlags) error
+	Destroy() error
+	Free() error
+}
+
+// Domain is the subset of libvirt.Domain used by the infrastructure.
+type Domain interface {
+	GetName() (string, error)
+	Destroy() error
+	Suspend() error
+	Resume() error
+	SaveFlags(destFile, destXML string, flags libvirt.DomainSaveRestoreFlags) error
+	OpenConsole(devname string, stream Stream, flags libvirt.DomainConsoleFlags) error
+	ListAllInterfaceAddresses(src libvirt.DomainInterfaceAddressesSource) ([]libvirt.DomainInterface, error)
+	QemuAgentCommand(command string, timeout libvirt.DomainQemuAgentCommandTimeout, flags uint32) (string, error)
+	Free() error
+}
+
+// ConnectLibvirt opens a connection to the libvirt daemon at uri.
+func ConnectLibvirt(uri string) (Connection, error) {
+	conn, err := libvirt.NewConnect(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtConnection{conn}, nil
+}
+
+// The wrappers below only convert the libvirt types to the interfaces,
+// a nil pointer is never returned as non-nil interface.
+
+type libvirtConnection struct {
+	*libvirt.Connect
+}
+
+func (c *libvirtConnection) StoragePoolDefineXML(xmlConfig string, flags libvirt.StoragePoolDefineFlags) (StoragePool, error) {
+	pool, err := c.Connect.StoragePoolDefineXML(xmlConfig, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStoragePool{pool}, nil
+}
+
+func (c *libvirtConnection) LookupStoragePoolByName(name string) (StoragePool, error) {
+	pool, err := c.Connect.LookupStoragePoolByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStoragePool{pool}, nil
+}
+
+func (c *libvirtConnection) LookupStoragePoolByTargetPath(path string) (StoragePool, error) {
+	pool, err := c.Connect.LookupStoragePoolByTargetPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStoragePool{pool}, nil
+}
+
+func (c *libvirtConnection) ListAllStoragePools(flags libvirt.ConnectListAllStoragePoolsFlags) ([]StoragePool, error) {
+	pools, err := c.Connect.ListAllStoragePools(flags)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]StoragePool, len(pools))
+	for i := range pools {
+		result[i] = &libvirtStoragePool{&pools[i]}
+	}
+	return result, nil
+}
+
+func (c *libvirtConnection) NetworkCreateXML(xmlConfig string) (Network, error) {
+	network, err := c.Connect.NetworkCreateXML(xmlConfig)
+	if err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+func (c *libvirtConnection) LookupNetworkByName(name string) (Network, error) {
+	network, err := c.Connect.LookupNetworkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+func (c *libvirtConnection) ListAllNetworks(flags libvirt.ConnectListAllNetworksFlags) ([]Network, error) {
+	networks, err := c.Connect.ListAllNetworks(flags)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Network, len(networks))
+	for i := range networks {
+		result[i] = &networks[i]
+	}
+	return result, nil
+}
+
+func (c *libvirtConnection) DomainCreateXML(xmlConfig string, flags libvirt.DomainCreateFlags) (Domain, error) {
+	domain, err := c.Connect.DomainCreateXML(xmlConfig, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtDomain{domain}, nil
+}
+
+func (c *libvirtConnection) LookupDomainByName(name string) (Domain, error) {
+	domain, err := c.Connect.LookupDomainByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtDomain{domain}, nil
+}
+
+func (c *libvirtConnection) ListAllDomains(flags libvirt.ConnectListAllDomainsFlags) ([]Domain, error) {
+	domains, err := c.Connect.ListAllDomains(flags)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Domain, len(domains))
+	for i := range domains {
+		result[i] = &libvirtDomain{&domains[i]}
+	}
+	return result, nil
+}
+
+func (c *libvirtConnection) NewStream(flags libvirt.StreamFlags) (Stream, error) {
+	stream, err := c.Connect.NewStream(flags)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+type libvirtStoragePool struct {
+	*libvirt.StoragePool
+}
+
+func (p *libvirtStoragePool) StorageVolCreateXML(xmlConfig string, flags libvirt.StorageVolCreateFlags) (StorageVol, error) {
+	volume, err := p.StoragePool.StorageVolCreateXML(xmlConfig, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStorageVol{volume}, nil
+}
+
+// StorageVolCreateXMLFrom only accepts volumes of the same connection.
+func (p *libvirtStoragePool) StorageVolCreateXMLFrom(xmlConfig string, clonevol StorageVol, flags libvirt.StorageVolCreateFlags) (StorageVol, error) {
+	volume, err := p.StoragePool.StorageVolCreateXMLFrom(xmlConfig, clonevol.(*libvirtStorageVol).StorageVol, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStorageVol{volume}, nil
+}
+
+func (p *libvirtStoragePool) LookupStorageVolByName(name string) (StorageVol, error) {
+	volume, err := p.StoragePool.LookupStorageVolByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtStorageVol{volume}, nil
+}
+
+func (p *libvirtStoragePool) ListAllStorageVolumes(flags uint32) ([]StorageVol, error) {
+	volumes, err := p.StoragePool.ListAllStorageVolumes(flags)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]StorageVol, len(volumes))
+	for i := range volumes {
+		result[i] = &libvirtStorageVol{&volumes[i]}
+	}
+	return result, nil
+}
+
+type libvirtStorageVol struct {
+	*libvirt.StorageVol
+}
+
+// Upload only accepts streams of the same connection.
+func (v *libvirtStorageVol) Upload(stream Stream, offset, length uint64, flags libvirt.StorageVolUploadFlags) error {
+	return v.StorageVol.Upload(stream.(*libvirt.Stream), offset, length, flags)
+}
+
+// Download only accepts streams of the same connection.
+func (v *libvirtStorageVol) Download(stream Stream, offset, length uint64, flags libvirt.StorageVolDownloadFlags) error {
+	return v.StorageVol.Download(stream.(*libvirt.Stream), offset, length, flags)
+}
+
+type libvirtDomain struct {
+	*libvirt.Domain
+}
+
+// OpenConsole only accepts streams of the same connection.
+func (d *libvirtDomain) OpenConsole(devname string, stream Stream, flags libvirt.DomainConsoleFlags) error {
+	return d.Domain.OpenConsole(devname, stream.(*libvirt.Stream), flags)
+}
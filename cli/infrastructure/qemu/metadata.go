@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package qemu
+
+import (
+	"fmt"
+
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"github.com/benschlueter/delegatio/client/metadata"
+	"github.com/benschlueter/delegatio/client/pki"
+	"go.uber.org/multierr"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// metadataVolumeName returns the name of the volume with the metadata of a node.
+// The metadata contains the private key of the agent, it must never end up in the
+// domain XML or the command line of qemu, which every user of the host can read.
+func metadataVolumeName(name string) string {
+	return name + ".metadata.json"
+}
+
+// metadataSysInfo writes the metadata of the node called name into a volume and returns
+// the fw_cfg entry which passes the volume to the node.
+// Every node gets its own agent certificate, issued by the CA of the CLI.
+func (l *LibvirtInstance) metadataSysInfo(name string, controlPlane bool) (libvirtxml.DomainSysInfo, error) {
+	caPEM, certPEM, keyPEM, err := pki.IssueAgentCertificate(l.Config.Infrastructure.PKIDir, name)
+	if err != nil {
+		return libvirtxml.DomainSysInfo{}, fmt.Errorf("issuing the agent certificate of %s: %w", name, err)
+	}
+	md := &metadata.Metadata{
+		Version:   metadata.Version,
+		Hostname:  name,
+		Role:      metadata.RoleWorker,
+		CACert:    caPEM,
+		AgentCert: certPEM,
+		AgentKey:  keyPEM,
+	}
+	if controlPlane {
+		md.Role = metadata.RoleControlPlane
+	}
+	// Only the first control plane runs kubeadm init.
+	if name == definitions.DomainPrefix+"0" {
+		md.KubeadmConfig = l.kubeadmConfig
+	}
+	data, err := md.Marshal()
+	if err != nil {
+		return libvirtxml.DomainSysInfo{}, err
+	}
+	path, err := l.uploadMetadata(name, data)
+	if err != nil {
+		return libvirtxml.DomainSysInfo{}, fmt.Errorf("writing the metadata of %s: %w", name, err)
+	}
+	return libvirtxml.DomainSysInfo{
+		FWCfg: &libvirtxml.DomainSysInfoFWCfg{
+			Entry: []libvirtxml.DomainSysInfoEntry{{Name: metadata.FWCfgName, File: path}},
+		},
+	}, nil
+}
+
+// uploadMetadata replaces the metadata volume of a node with data and returns its path.
+// Only the owner may read the volume, libvirt hands it to qemu when the domain starts.
+func (l *LibvirtInstance) uploadMetadata(name string, data []byte) (path string, err error) {
+	storagePool, err := l.Conn.LookupStoragePoolByTargetPath(definitions.LibvirtStoragePoolPath)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = storagePool.Free() }()
+	// A node which is created again, i.e. from a snapshot, gets new metadata.
+	if err := deleteVolume(storagePool, metadataVolumeName(name)); err != nil {
+		return "", err
+	}
+	path = definitions.LibvirtStoragePoolPath + metadataVolumeName(name)
+	volumeXML, err := (&libvirtxml.StorageVolume{
+		Type: "file",
+		Name: metadataVolumeName(name),
+		Target: &libvirtxml.StorageVolumeTarget{
+			Path:        path,
+			Format:      &libvirtxml.StorageVolumeTargetFormat{Type: "raw"},
+			Permissions: &libvirtxml.StorageVolumeTargetPermissions{Mode: "0600"},
+		},
+		Capacity: &libvirtxml.StorageVolumeSize{Unit: "bytes", Value: uint64(len(data))},
+	}).Marshal()
+	if err != nil {
+		return "", err
+	}
+	volume, err := storagePool.StorageVolCreateXML(volumeXML, 0)
+	if err != nil {
+		return "", fmt.Errorf("creating libvirt storage volume %s: %w", metadataVolumeName(name), err)
+	}
+	defer func() { _ = volume.Free() }()
+	stream, err := l.Conn.NewStream(0)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = stream.Free() }()
+	if err := volume.Upload(stream, 0, uint64(len(data)), 0); err != nil {
+		return "", err
+	}
+	if err := sendAll(stream, data); err != nil {
+		_ = stream.Abort()
+		return "", err
+	}
+	if err := stream.Finish(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// deleteMetadata removes the metadata volume of a node if it exists.
+func (l *LibvirtInstance) deleteMetadata(name string) error {
+	storagePool, err := l.Conn.LookupStoragePoolByTargetPath(definitions.LibvirtStoragePoolPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = storagePool.Free() }()
+	return deleteVolume(storagePool, metadataVolumeName(name))
+}
+
+// deleteAllMetadata removes the metadata volumes of all registered nodes. Nothing is left to
+// remove if the storage pool is already gone.
+func (l *LibvirtInstance) deleteAllMetadata() error {
+	l.ConnMux.Lock()
+	defer l.ConnMux.Unlock()
+	var errs error
+	for name := range l.RegisteredDomains {
+		err := l.deleteMetadata(name)
+		if isLibvirtError(err, libvirt.ERR_NO_STORAGE_POOL) {
+			return nil
+		}
+		errs = multierr.Append(errs, err)
+	}
+	return errs
+}
+
+// deleteVolume deletes the volume called name from the pool if it exists.
+func deleteVolume(storagePool StoragePool, name string) error {
+	volume, err := storagePool.LookupStorageVolByName(name)
+	if isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = volume.Free() }()
+	return volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+}
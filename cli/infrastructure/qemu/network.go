@@ -0,0 +1,190 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package qemu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"go.uber.org/zap"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// The indices of the IP elements of the network, the DHCP hosts are added to them.
+const (
+	ipv4Index = 0
+	ipv6Index = 1
+)
+
+// networkXML returns the configuration of the network of the cluster. The addresses of the
+// nodes of the configured topology are reserved right away, added workers are reserved later.
+func networkXML(netConf config.NetworkConfig, numNodes int) (string, error) {
+	gateway, prefix, err := netConf.Gateway()
+	if err != nil {
+		return "", err
+	}
+	networkXMLCopy := definitions.NetworkXMLConfig
+	networkXMLCopy.Bridge = &libvirtxml.NetworkBridge{
+		Name:  netConf.Bridge,
+		STP:   definitions.NetworkXMLConfig.Bridge.STP,
+		Delay: definitions.NetworkXMLConfig.Bridge.Delay,
+	}
+	if netConf.Domain != "" {
+		// Names inside the domain are never forwarded to the DNS servers of the host.
+		networkXMLCopy.Domain = &libvirtxml.NetworkDomain{Name: netConf.Domain, LocalOnly: "yes"}
+	}
+	ipv4 := libvirtxml.NetworkIP{
+		Family:  "ipv4",
+		Address: gateway,
+		Prefix:  prefix,
+		DHCP: &libvirtxml.NetworkDHCP{
+			Ranges: []libvirtxml.NetworkDHCPRange{
+				{
+					Start: netConf.DHCPStart,
+					End:   netConf.DHCPEnd,
+				},
+			},
+		},
+	}
+	var ipv6 *libvirtxml.NetworkIP
+	if netConf.IPv6CIDR != "" {
+		gateway, prefix, err := netConf.GatewayIPv6()
+		if err != nil {
+			return "", err
+		}
+		ipv6 = &libvirtxml.NetworkIP{
+			Family:  "ipv6",
+			Address: gateway,
+			Prefix:  prefix,
+			DHCP:    &libvirtxml.NetworkDHCP{},
+		}
+	}
+	for i := 0; i < numNodes; i++ {
+		name := definitions.DomainPrefix + strconv.Itoa(i)
+		hostV4, hostV6, err := dhcpHosts(netConf, name)
+		if err != nil {
+			return "", err
+		}
+		ipv4.DHCP.Hosts = append(ipv4.DHCP.Hosts, *hostV4)
+		if ipv6 != nil {
+			ipv6.DHCP.Hosts = append(ipv6.DHCP.Hosts, *hostV6)
+		}
+	}
+	networkXMLCopy.IPs = []libvirtxml.NetworkIP{ipv4}
+	if ipv6 != nil {
+		networkXMLCopy.IPs = append(networkXMLCopy.IPs, *ipv6)
+	}
+	return networkXMLCopy.Marshal()
+}
+
+// dhcpHosts returns the DHCP reservations of a node. The IPv4 address is bound to the MAC address,
+// DHCPv6 clients do not send it and are matched by their hostname. hostV6 is nil without IPv6.
+func dhcpHosts(netConf config.NetworkConfig, name string) (hostV4, hostV6 *libvirtxml.NetworkDHCPHost, err error) {
+	index, err := nodeIndex(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	ip, err := netConf.NodeAddress(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostV4 = &libvirtxml.NetworkDHCPHost{MAC: nodeMAC(index), Name: name, IP: ip}
+	if netConf.IPv6CIDR == "" {
+		return hostV4, nil, nil
+	}
+	ip, err = netConf.NodeAddressIPv6(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hostV4, &libvirtxml.NetworkDHCPHost{Name: name, IP: ip}, nil
+}
+
+// reserveAddress adds the DHCP reservations of a node to the running network.
+// Reservations which already exist, i.e. of the nodes of the configured topology, are kept.
+func (l *LibvirtInstance) reserveAddress(name string) error {
+	hostV4, hostV6, err := dhcpHosts(l.Config.Infrastructure.Network, name)
+	if err != nil {
+		return err
+	}
+	network, err := l.Conn.LookupNetworkByName(definitions.NetworkName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = network.Free() }()
+	reservations := []struct {
+		index int
+		host  *libvirtxml.NetworkDHCPHost
+	}{{ipv4Index, hostV4}, {ipv6Index, hostV6}}
+	for _, reservation := range reservations {
+		if reservation.host == nil {
+			continue
+		}
+		hostXML, err := reservation.host.Marshal()
+		if err != nil {
+			return err
+		}
+		err = network.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_HOST,
+			reservation.index, hostXML, libvirt.NETWORK_UPDATE_AFFECT_LIVE)
+		// libvirt rejects a host which matches an existing one.
+		if isLibvirtError(err, libvirt.ERR_OPERATION_INVALID) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reserving address %s for %s: %w", reservation.host.IP, name, err)
+		}
+		l.Log.Debug("reserved address", zap.String("id", name), zap.String("ip", reservation.host.IP))
+	}
+	return nil
+}
+
+// nodeAddress returns the address the CLI reaches a node under. It is reserved for the node
+// and does not change, all connections to the agents use it.
+func (l *LibvirtInstance) nodeAddress(name string) (string, error) {
+	index, err := nodeIndex(name)
+	if err != nil {
+		return "", err
+	}
+	return l.Config.Infrastructure.Network.NodeAddress(index)
+}
+
+// leasedAddresses returns the addresses the DHCP server leased to the domain.
+func (l *LibvirtInstance) leasedAddresses(name string) ([]string, error) {
+	domain, err := l.Conn.LookupDomainByName(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = domain.Free() }()
+	ifaces, err := domain.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, iface := range ifaces {
+		for _, addr := range iface.Addrs {
+			addrs = append(addrs, addr.Addr)
+		}
+	}
+	return addrs, nil
+}
+
+// nodeIndex returns the number of a node, i.e. 2 for delegatio-2.
+func nodeIndex(name string) (int, error) {
+	index, err := strconv.Atoi(strings.TrimPrefix(name, definitions.DomainPrefix))
+	if err != nil || !strings.HasPrefix(name, definitions.DomainPrefix) || index < 0 {
+		return 0, fmt.Errorf("%s is not the name of a node", name)
+	}
+	return index, nil
+}
+
+// nodeMAC returns the MAC address of a node. It is derived from the number of the node,
+// such that the DHCP server always hands out the same address.
+func nodeMAC(index int) string {
+	// 52:54:00 is the prefix libvirt uses for its generated addresses.
+	return fmt.Sprintf("52:54:00:42:%02x:%02x", (index>>8)&0xff, index&0xff)
+}
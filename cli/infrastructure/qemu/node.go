@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package qemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"go.uber.org/zap"
+	"libvirt.org/go/libvirt"
+)
+
+// AddNode creates a new worker and joins it into the running cluster.
+// It returns the name of the new node.
+func (l *LibvirtInstance) AddNode(ctx context.Context) (string, error) {
+	if l.joinToken == nil {
+		return "", errors.New("the cluster is not initialized, run create first")
+	}
+	id := l.nextWorkerID()
+	name := definitions.DomainPrefix + strconv.Itoa(id)
+	l.Log.Info("adding worker", zap.String("id", name))
+	if err := l.CreateInstance(strconv.Itoa(id), l.Config.Cluster.Worker, false); err != nil {
+		return "", err
+	}
+	if err := l.blockUntilNodesAreReady(ctx, []string{name}); err != nil {
+		return "", err
+	}
+	// The token of kubeadm init is only valid for a day, the cluster usually lives longer.
+	if err := l.refreshJoinToken(ctx, false); err != nil {
+		return "", err
+	}
+	if err := l.JoinClustergRPC(ctx, name, false); err != nil {
+		return "", err
+	}
+	return name, l.markJoined(name)
+}
+
+// RemoveNode resets Kubernetes on a worker and deletes its domain and boot disk.
+// The node must be drained beforehand.
+func (l *LibvirtInstance) RemoveNode(ctx context.Context, name string) error {
+	l.ConnMux.Lock()
+	info, ok := l.RegisteredDomains[name]
+	l.ConnMux.Unlock()
+	if !ok {
+		return fmt.Errorf("node %s does not exist", name)
+	}
+	if info.controlPlane {
+		return fmt.Errorf("node %s is a control plane, only workers can be removed", name)
+	}
+	if info.joined {
+		if err := l.resetNodegRPC(ctx, name); err != nil {
+			return fmt.Errorf("resetting node %s: %w", name, err)
+		}
+	}
+	if err := l.deleteNode(name); err != nil {
+		return err
+	}
+	l.Log.Info("node removed", zap.String("id", name))
+	return l.saveState()
+}
+
+// deleteNode destroys the domain and deletes its boot disk and console log.
+func (l *LibvirtInstance) deleteNode(name string) error {
+	l.ConnMux.Lock()
+	defer l.ConnMux.Unlock()
+	domain, err := l.Conn.LookupDomainByName(name)
+	switch {
+	case isLibvirtError(err, libvirt.ERR_NO_DOMAIN):
+	case err != nil:
+		return err
+	default:
+		defer func() { _ = domain.Free() }()
+		// The domains are transient, they are gone once destroyed.
+		if err := domain.Destroy(); err != nil {
+			return err
+		}
+	}
+	delete(l.RegisteredDomains, name)
+	if err := l.deleteConsoleLog(name); err != nil {
+		return err
+	}
+	if err := l.deleteMetadata(name); err != nil {
+		return err
+	}
+	return l.deleteRegisteredDisk(name)
+}
+
+// refreshJoinToken creates a new bootstrap token on the first control plane and records it.
+// If uploadCerts is set, the control plane certificates are uploaded again with a new key.
+func (l *LibvirtInstance) refreshJoinToken(ctx context.Context, uploadCerts bool) error {
+	client, err := l.dialAgent(ctx, definitions.DomainPrefix+"0")
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	joinToken, err := client.CreateJoinToken(ctx, uploadCerts)
+	if err != nil {
+		return err
+	}
+	// The certificates uploaded before are still valid until their key expires.
+	if !uploadCerts && l.joinToken != nil {
+		joinToken.CertificateKey = l.joinToken.CertificateKey
+		joinToken.CertificateKeyExpiry = l.joinToken.CertificateKeyExpiry
+	}
+	l.joinToken = joinToken
+	return l.saveState()
+}
+
+// resetNodegRPC reverts the changes of kubeadm join on a node.
+func (l *LibvirtInstance) resetNodegRPC(ctx context.Context, id string) error {
+	client, err := l.dialAgent(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	l.Log.Info("executing kubeadm reset", zap.String("id", id))
+	return client.ResetNode(ctx)
+}
+
+// nextWorkerID returns the smallest free number after the control planes.
+func (l *LibvirtInstance) nextWorkerID() int {
+	l.ConnMux.Lock()
+	defer l.ConnMux.Unlock()
+	id := l.Config.Cluster.ControlPlane.Count
+	for {
+		if _, ok := l.RegisteredDomains[definitions.DomainPrefix+strconv.Itoa(id)]; !ok {
+			return id
+		}
+		id++
+	}
+}
@@ -6,81 +6,133 @@ package qemu
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
-	"libvirt.org/go/libvirt"
+	"google.golang.org/grpc/credentials"
 )
 
-const numNodes = 3
-
 // LibvirtInstance is a wrapper around libvirt.
 type LibvirtInstance struct {
-	ConnMux            sync.Mutex
-	Conn               *libvirt.Connect
+	ConnMux sync.Mutex
+	Conn    Connection
+	// Connector opens the connection to libvirt, ConnectLibvirt is used if it is nil.
+	Connector          func(uri string) (Connection, error)
 	Log                *zap.Logger
-	ImagePath          string
+	StatePath          string
+	KubeconfigPath     string
+	Config             *config.Config
+	AgentCredentials   credentials.TransportCredentials
 	RegisteredDomains  map[string]*DomainInfo
 	RegisteredNetworks []string
 	RegisteredPools    []string
 	RegisteredDisks    []string
 	CancelMux          sync.Mutex
 	CanelChannels      []chan struct{}
+	joinToken          *state.JoinToken
+	// saveMux orders the writes of the state file, a snapshot must not overwrite a newer one.
+	saveMux   sync.Mutex
+	snapshots []*state.Snapshot
+	// baseImageDigest is the SHA-256 digest of the base volume, it is set once the upload was verified.
+	baseImageDigest string
+	// kubeadmConfig is passed to the first control plane with its metadata.
+	kubeadmConfig []byte
 }
 
 // DomainInfo contains information about a domain.
 type DomainInfo struct {
 	guestAgentReady bool
+	controlPlane    bool
+	ip              string
+	joined          bool
 }
 
-// ConnectWithInfrastructureService connects to the libvirt instance.
+// ConnectWithInfrastructureService connects to the libvirt instance and re-attaches
+// to the resources recorded in the state file.
 func (l *LibvirtInstance) ConnectWithInfrastructureService(ctx context.Context, url string) error {
-	conn, err := libvirt.NewConnect(url)
+	connect := l.Connector
+	if connect == nil {
+		connect = ConnectLibvirt
+	}
+	conn, err := connect(url)
 	if err != nil {
-		l.Log.With(zap.Error(err)).DPanic("Failed to connect to libvirt")
+		return fmt.Errorf("connecting to libvirt at %s: %w", url, err)
 	}
 	l.Conn = conn
-	return nil
+	return l.loadState()
 }
 
 // InitializeInfrastructure initializes the infrastructure.
+// Resources recorded in the state file are reused.
 func (l *LibvirtInstance) InitializeInfrastructure(ctx context.Context) (err error) {
-	// sanity check
-	if err := l.TerminateInfrastructure(); err != nil {
-		return err
-	}
-	if err := l.createStoragePool(); err != nil {
-		return err
+	if len(l.RegisteredPools) == 0 {
+		if err := l.createStoragePool(); err != nil {
+			return err
+		}
+		if err := l.saveState(); err != nil {
+			return err
+		}
 	}
-	if err := l.createBaseImage(ctx); err != nil {
-		return err
+	if l.baseImageDigest == "" {
+		if err := l.createBaseImage(ctx); err != nil {
+			return err
+		}
+		if err := l.saveState(); err != nil {
+			return err
+		}
 	}
-	if err := l.createNetwork(); err != nil {
-		return err
+	if len(l.RegisteredNetworks) == 0 {
+		if err := l.createNetwork(); err != nil {
+			return err
+		}
+		if err := l.saveState(); err != nil {
+			return err
+		}
 	}
 	return err
 }
 
 // CreateInstance creates a new instance. The instance consists of a boot image and a domain.
-func (l *LibvirtInstance) CreateInstance(id string) (err error) {
-	if err := l.createBootImage("delegatio-" + id); err != nil {
+func (l *LibvirtInstance) CreateInstance(id string, spec config.NodeSpec, controlPlane bool) (err error) {
+	// Nodes without an address in the network are rejected before anything is created.
+	if _, err := l.nodeAddress(definitions.DomainPrefix + id); err != nil {
 		return err
 	}
-	if err := l.createDomain("delegatio-" + id); err != nil {
+	if err := l.createBootImage(definitions.DomainPrefix+id, spec); err != nil {
 		return err
 	}
-	return nil
+	if err := l.createDomain(definitions.DomainPrefix+id, spec, controlPlane); err != nil {
+		return err
+	}
+	return l.saveState()
 }
 
 // InitializeKubernetes initializes kubernetes on the infrastructure.
+// Nodes which already joined the cluster according to the state file are skipped.
 func (l *LibvirtInstance) InitializeKubernetes(ctx context.Context, k8sConfig []byte) (err error) {
+	l.kubeadmConfig = k8sConfig
+	// The goroutines register the domains they create, the skipped nodes are decided before.
+	registered := l.registeredDomains()
 	g, ctxGo := errgroup.WithContext(ctx)
-	for i := 0; i < numNodes; i++ {
+	// The first nodes are the control planes, the remaining ones are workers.
+	for i := 0; i < l.Config.Cluster.NumNodes(); i++ {
+		if _, ok := registered[definitions.DomainPrefix+strconv.Itoa(i)]; ok {
+			continue
+		}
 		func(id int) {
 			g.Go(func() error {
-				return l.CreateInstance(strconv.Itoa(id))
+				if id < l.Config.Cluster.ControlPlane.Count {
+					return l.CreateInstance(strconv.Itoa(id), l.Config.Cluster.ControlPlane, true)
+				}
+				return l.CreateInstance(strconv.Itoa(id), l.Config.Cluster.Worker, false)
 			})
 		}(i)
 	}
@@ -88,43 +140,129 @@ func (l *LibvirtInstance) InitializeKubernetes(ctx context.Context, k8sConfig []
 		return err
 	}
 
-	if err := l.blockUntilNetworkIsReady(ctx); err != nil {
-		return err
+	// The first control plane creates the join tokens, it is needed even if it already joined.
+	waitFor := []string{definitions.DomainPrefix + "0"}
+	joined := l.registeredDomains()
+	for i := 1; i < l.Config.Cluster.NumNodes(); i++ {
+		if id := definitions.DomainPrefix + strconv.Itoa(i); !joined[id] {
+			waitFor = append(waitFor, id)
+		}
 	}
-	l.Log.Info("network is ready")
-	if err := l.blockUntilDelegatioAgentIsReady(ctx); err != nil {
+	if err := l.blockUntilNodesAreReady(ctx, waitFor); err != nil {
 		return err
 	}
-	l.Log.Info("delegatio-agent is ready")
-	output, err := l.InitializeKubernetesgRPC(ctx, k8sConfig)
-	if err != nil {
-		return err
+	l.Log.Info("delegatio-agent is ready", zap.Strings("nodes", waitFor))
+
+	if l.joinToken == nil {
+		if err := l.initializeFirstControlPlane(ctx); err != nil {
+			return err
+		}
+	} else {
+		l.Log.Info("kubernetes is already initialized")
 	}
-	l.Log.Info("kubernetes init successful")
-	if err := l.WriteKubeconfigToDisk(ctx); err != nil {
-		return err
+	if l.joinToken.Expired(time.Now()) && !l.allNodesJoined() {
+		l.Log.Info("join token expired, creating a new one", zap.Time("expiry", l.joinToken.Expiry))
+		if err := l.refreshJoinToken(ctx, false); err != nil {
+			return err
+		}
+	}
+
+	// Control planes join one after another, etcd only accepts one new member at a time.
+	for i := 0; i < l.Config.Cluster.ControlPlane.Count; i++ {
+		id := definitions.DomainPrefix + strconv.Itoa(i)
+		if joined[id] {
+			continue
+		}
+		if !l.Config.Cluster.HighAvailability() {
+			return fmt.Errorf("the only control plane %s was lost, the cluster must be destroyed", id)
+		}
+		// kubeadm deletes the uploaded certificates after two hours.
+		if l.joinToken.CertificateKey == "" || !time.Now().Before(l.joinToken.CertificateKeyExpiry) {
+			l.Log.Info("certificate key expired, uploading the certificates again", zap.Time("expiry", l.joinToken.CertificateKeyExpiry))
+			if err := l.refreshJoinToken(ctx, true); err != nil {
+				return err
+			}
+		}
+		if err := l.JoinClustergRPC(ctx, id, true); err != nil {
+			return err
+		}
+		if err := l.markJoined(id); err != nil {
+			return err
+		}
+	}
+
+	g, ctxGo = errgroup.WithContext(ctx)
+	for i := l.Config.Cluster.ControlPlane.Count; i < l.Config.Cluster.NumNodes(); i++ {
+		id := definitions.DomainPrefix + strconv.Itoa(i)
+		if joined[id] {
+			continue
+		}
+		g.Go(func() error {
+			if err := l.JoinClustergRPC(ctxGo, id, false); err != nil {
+				return err
+			}
+			return l.markJoined(id)
+		})
 	}
-	l.Log.Info("admin.conf written to disk")
-	joinToken, err := l.parseKubeadmOutput(output)
+	return g.Wait()
+}
+
+// initializeFirstControlPlane runs kubeadm init on the first control plane and records the join token.
+// The node received the kubeadm config with its metadata.
+func (l *LibvirtInstance) initializeFirstControlPlane(ctx context.Context) error {
+	joinToken, kubeconfig, err := l.InitializeKubernetesgRPC(ctx, nil)
 	if err != nil {
 		return err
 	}
-	kubeadmJoinToken, err := l.parseJoinCommand(joinToken)
-	if err != nil {
+	l.Log.Info("kubernetes init successful")
+	if err := l.WriteKubeconfigToDisk(kubeconfig); err != nil {
 		return err
 	}
+	l.Log.Info("admin.conf written to disk", zap.String("path", l.KubeconfigPath))
+	if l.Config.Cluster.HighAvailability() && joinToken.CertificateKey == "" {
+		return errors.New("kubeadm init did not return a certificate key for the control planes")
+	}
+	l.joinToken = joinToken
+	return l.markJoined(definitions.DomainPrefix + "0")
+}
 
-	g, ctxGo = errgroup.WithContext(ctx)
-	for i := 1; i < numNodes; i++ {
-		func(id int) {
-			g.Go(func() error {
-				return l.JoinClustergRPC(ctxGo, "delegatio-"+strconv.Itoa(id), kubeadmJoinToken)
-			})
-		}(i)
+// markJoined records that a node is part of the cluster.
+func (l *LibvirtInstance) markJoined(id string) error {
+	l.ConnMux.Lock()
+	l.RegisteredDomains[id].joined = true
+	l.ConnMux.Unlock()
+	return l.saveState()
+}
+
+// registeredDomains returns the names of the registered domains and whether they joined the
+// cluster. The copy can be read while goroutines register domains.
+func (l *LibvirtInstance) registeredDomains() map[string]bool {
+	l.ConnMux.Lock()
+	defer l.ConnMux.Unlock()
+	domains := make(map[string]bool, len(l.RegisteredDomains))
+	for name, info := range l.RegisteredDomains {
+		domains[name] = info.joined
 	}
-	if err := g.Wait(); err != nil {
-		return err
+	return domains
+}
+
+func (l *LibvirtInstance) allNodesJoined() bool {
+	l.ConnMux.Lock()
+	defer l.ConnMux.Unlock()
+	for _, info := range l.RegisteredDomains {
+		if !info.joined {
+			return false
+		}
 	}
+	return true
+}
 
-	return err
+// diskRegisteredLocked reports whether the volume is registered. The caller must hold l.ConnMux.
+func (l *LibvirtInstance) diskRegisteredLocked(name string) bool {
+	for _, disk := range l.RegisteredDisks {
+		if disk == name {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,997 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package qemu_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure/image"
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu"
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/fakelibvirt"
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
+	"github.com/benschlueter/delegatio/client/metadata"
+	"github.com/benschlueter/delegatio/client/pki"
+	"go.uber.org/multierr"
+	"go.uber.org/zap/zaptest"
+	"libvirt.org/go/libvirtxml"
+)
+
+var testImage = []byte("not really a disk image")
+
+func newInstance(t *testing.T, hv *fakelibvirt.Hypervisor, statePath string) *qemu.LibvirtInstance {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Infrastructure.ImagePath = filepath.Join(filepath.Dir(statePath), "image.qcow2")
+	writeImage(t, cfg.Infrastructure.ImagePath, testImage)
+	cfg.Infrastructure.PKIDir = filepath.Join(filepath.Dir(statePath), "pki")
+	// Instances of the same state share the CA.
+	if _, err := os.Stat(filepath.Join(cfg.Infrastructure.PKIDir, pki.CACertFilename)); errors.Is(err, os.ErrNotExist) {
+		if err := pki.Generate(cfg.Infrastructure.PKIDir, filepath.Join(filepath.Dir(statePath), "agent-pki")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	instance := &qemu.LibvirtInstance{
+		Connector:         hv.Connect,
+		Log:               zaptest.NewLogger(t),
+		StatePath:         statePath,
+		KubeconfigPath:    filepath.Join(filepath.Dir(statePath), "admin.conf"),
+		Config:            cfg,
+		RegisteredDomains: make(map[string]*qemu.DomainInfo),
+	}
+	if err := instance.ConnectWithInfrastructureService(context.Background(), "test:///default"); err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	return instance
+}
+
+// writeImage writes the image and its SHA256SUMS manifest.
+func writeImage(t *testing.T, path string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(content)
+	manifest := fmt.Sprintf("%x *%s\n", digest, filepath.Base(path))
+	if err := os.WriteFile(filepath.Join(filepath.Dir(path), image.ChecksumsName), []byte(manifest), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createNodes creates the domains of the default cluster, one control plane and two workers.
+func createNodes(instance *qemu.LibvirtInstance) error {
+	cluster := instance.Config.Cluster
+	if err := instance.CreateInstance("0", cluster.ControlPlane, true); err != nil {
+		return err
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := instance.CreateInstance(id, cluster.Worker, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addForeignResources creates resources which do not belong to delegatio, they must survive its cleanup.
+func addForeignResources(t *testing.T, hv *fakelibvirt.Hypervisor) {
+	t.Helper()
+	conn, err := hv.Connect("test:///default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.NetworkCreateXML("<network><name>default</name></network>"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.DomainCreateXML("<domain type=\"kvm\"><name>other-vm</name></domain>", 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertOnlyForeignResources fails if any resource of delegatio is left.
+func assertOnlyForeignResources(t *testing.T, hv *fakelibvirt.Hypervisor) {
+	t.Helper()
+	if domains := hv.Domains(); !reflect.DeepEqual(domains, []string{"other-vm"}) {
+		t.Errorf("got domains %v, want only other-vm", domains)
+	}
+	if networks := hv.Networks(); !reflect.DeepEqual(networks, []string{"default"}) {
+		t.Errorf("got networks %v, want only default", networks)
+	}
+	if pool, ok := hv.Pool(definitions.DiskPoolName); ok {
+		t.Errorf("storage pool left behind: %+v", pool)
+	}
+}
+
+func TestCreateAndTerminate(t *testing.T) {
+	hv := fakelibvirt.New()
+	addForeignResources(t, hv)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	instance := newInstance(t, hv, statePath)
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatalf("initializing infrastructure: %v", err)
+	}
+	if err := createNodes(instance); err != nil {
+		t.Fatalf("creating nodes: %v", err)
+	}
+
+	pool, ok := hv.Pool(definitions.DiskPoolName)
+	if !ok || !pool.Active {
+		t.Fatalf("storage pool not running: %+v", pool)
+	}
+	wantVolumes := []string{definitions.BaseDiskName, "delegatio-0", "delegatio-0.metadata.json", "delegatio-1", "delegatio-1.metadata.json", "delegatio-2", "delegatio-2.metadata.json"}
+	if !reflect.DeepEqual(pool.Volumes, wantVolumes) {
+		t.Errorf("got volumes %v, want %v", pool.Volumes, wantVolumes)
+	}
+	if content, _ := hv.VolumeContent(definitions.DiskPoolName, definitions.BaseDiskName); !bytes.Equal(content, testImage) {
+		t.Errorf("got base image %q, want %q", content, testImage)
+	}
+	if domains := hv.Domains(); !reflect.DeepEqual(domains, []string{"delegatio-0", "delegatio-1", "delegatio-2", "other-vm"}) {
+		t.Errorf("got domains %v", domains)
+	}
+	s, err := state.Load(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Network != definitions.NetworkName || len(s.Pools) != 1 || len(s.Volumes) != 4 || len(s.Nodes) != 3 {
+		t.Errorf("resources not recorded: %+v", s)
+	}
+	wantCounts := &state.NodeCounts{ControlPlanes: instance.Config.Cluster.ControlPlane.Count, Workers: instance.Config.Cluster.Worker.Count}
+	if !reflect.DeepEqual(s.NodeCounts, wantCounts) {
+		t.Errorf("got node counts %+v, want %+v", s.NodeCounts, wantCounts)
+	}
+
+	// A new CLI invocation re-attaches to the resources instead of creating new ones.
+	instance = newInstance(t, hv, statePath)
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatalf("re-attaching: %v", err)
+	}
+
+	if err := instance.TerminateInfrastructure(); err != nil {
+		t.Fatalf("terminating: %v", err)
+	}
+	assertOnlyForeignResources(t, hv)
+	if _, err := os.Stat(statePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("state file not removed: %v", err)
+	}
+	if err := instance.TerminateInfrastructure(); err != nil {
+		t.Errorf("terminating twice: %v", err)
+	}
+}
+
+func TestTerminateHalfCreated(t *testing.T) {
+	errInjected := errors.New("injected failure")
+	testCases := map[string]struct {
+		failMethod string
+		failName   string
+		// createNodes is set if the failure hits the creation of the domains.
+		createNodes bool
+	}{
+		"storage pool does not start": {
+			failMethod: "Create",
+			failName:   definitions.DiskPoolName,
+		},
+		"image upload fails": {
+			failMethod: "Send",
+		},
+		"network creation fails": {
+			failMethod: "NetworkCreateXML",
+			failName:   definitions.NetworkName,
+		},
+		"boot volume creation fails": {
+			failMethod:  "StorageVolCreateXML",
+			failName:    "delegatio-1",
+			createNodes: true,
+		},
+		"domain creation fails": {
+			failMethod:  "DomainCreateXML",
+			failName:    "delegatio-2",
+			createNodes: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			hv := fakelibvirt.New()
+			addForeignResources(t, hv)
+			statePath := filepath.Join(t.TempDir(), "state.json")
+			instance := newInstance(t, hv, statePath)
+
+			hv.FailOn(tc.failMethod, tc.failName, errInjected)
+			err := instance.InitializeInfrastructure(context.Background())
+			if tc.createNodes {
+				if err != nil {
+					t.Fatalf("initializing infrastructure: %v", err)
+				}
+				err = createNodes(instance)
+			}
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("got error %v, want the injected failure", err)
+			}
+			hv.ClearFailures()
+
+			// The next invocation of the CLI cleans up with the state of the failed one.
+			instance = newInstance(t, hv, statePath)
+			if err := instance.TerminateInfrastructure(); err != nil {
+				t.Fatalf("terminating: %v", err)
+			}
+			assertOnlyForeignResources(t, hv)
+			if _, err := os.Stat(statePath); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("state file not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestTerminateAggregatesErrors(t *testing.T) {
+	hv := fakelibvirt.New()
+	addForeignResources(t, hv)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	instance := newInstance(t, hv, statePath)
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatalf("initializing infrastructure: %v", err)
+	}
+	if err := createNodes(instance); err != nil {
+		t.Fatalf("creating nodes: %v", err)
+	}
+
+	errDomain, errNetwork := errors.New("domain failure"), errors.New("network failure")
+	hv.FailOn("Destroy", "delegatio-1", errDomain)
+	hv.FailOn("Destroy", definitions.NetworkName, errNetwork)
+	err := instance.TerminateInfrastructure()
+	if len(multierr.Errors(err)) != 2 || !errors.Is(err, errDomain) || !errors.Is(err, errNetwork) {
+		t.Fatalf("got error %v, want both injected failures", err)
+	}
+	// A failing domain does not keep the others alive.
+	if domains := hv.Domains(); !reflect.DeepEqual(domains, []string{"delegatio-1", "other-vm"}) {
+		t.Errorf("got domains %v, want delegatio-1 and other-vm", domains)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Errorf("state file removed although resources are left: %v", err)
+	}
+
+	hv.ClearFailures()
+	if err := instance.TerminateInfrastructure(); err != nil {
+		t.Fatalf("terminating again: %v", err)
+	}
+	assertOnlyForeignResources(t, hv)
+}
+
+func TestConnectFailure(t *testing.T) {
+	hv := fakelibvirt.New()
+	errConnect := errors.New("connection refused")
+	hv.FailOn("Connect", "", errConnect)
+	instance := &qemu.LibvirtInstance{
+		Connector:         hv.Connect,
+		Log:               zaptest.NewLogger(t),
+		Config:            config.Default(),
+		RegisteredDomains: make(map[string]*qemu.DomainInfo),
+	}
+	if err := instance.ConnectWithInfrastructureService(context.Background(), "test:///default"); !errors.Is(err, errConnect) {
+		t.Fatalf("got error %v, want the connection failure", err)
+	}
+}
+
+func TestBaseImageUpload(t *testing.T) {
+	// larger than one chunk of the upload, the last chunk is short.
+	largeImage := bytes.Repeat([]byte("0123456789abcdef"), 600*1024)
+	largeImage = append(largeImage, "tail"...)
+	testCases := map[string]struct {
+		// volume replaces the content of the base volume after the first upload, nil keeps it.
+		volume       []byte
+		wantUploaded int
+		// wantRecreated is set if the base volume has to be replaced.
+		wantRecreated bool
+	}{
+		"already uploaded": {
+			wantUploaded: 0,
+		},
+		"interrupted upload": {
+			volume:       largeImage[:5*1024*1024+7],
+			wantUploaded: len(largeImage) - (5*1024*1024 + 7),
+		},
+		"corrupted upload": {
+			volume: func() []byte {
+				volume := append([]byte{}, largeImage[:len(largeImage)-100]...)
+				volume[3*1024*1024] ^= 0xff
+				return volume
+			}(),
+			wantUploaded: len(largeImage) - 3*1024*1024,
+		},
+		"volume longer than the image": {
+			volume:        append(append([]byte{}, largeImage...), "garbage"...),
+			wantUploaded:  len(largeImage),
+			wantRecreated: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			hv := fakelibvirt.New()
+			statePath := filepath.Join(t.TempDir(), "state.json")
+			instance := newInstance(t, hv, statePath)
+			writeImage(t, instance.Config.Infrastructure.ImagePath, largeImage)
+			if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+				t.Fatalf("initializing infrastructure: %v", err)
+			}
+			if content, _ := hv.VolumeContent(definitions.DiskPoolName, definitions.BaseDiskName); !bytes.Equal(content, largeImage) {
+				t.Fatalf("got base image of %d bytes, want %d bytes", len(content), len(largeImage))
+			}
+
+			if tc.volume != nil {
+				hv.SetVolumeContent(definitions.DiskPoolName, definitions.BaseDiskName, tc.volume)
+			}
+			// The CLI exited before the upload was verified.
+			s, err := state.Load(statePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Image = ""
+			if err := s.Save(statePath); err != nil {
+				t.Fatal(err)
+			}
+			var uploaded uint64
+			if !tc.wantRecreated {
+				uploaded = hv.UploadedBytes(definitions.DiskPoolName, definitions.BaseDiskName)
+			}
+
+			instance = newInstance(t, hv, statePath)
+			writeImage(t, instance.Config.Infrastructure.ImagePath, largeImage)
+			if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+				t.Fatalf("initializing infrastructure again: %v", err)
+			}
+			if content, _ := hv.VolumeContent(definitions.DiskPoolName, definitions.BaseDiskName); !bytes.Equal(content, largeImage) {
+				t.Errorf("got base image of %d bytes, want %d bytes", len(content), len(largeImage))
+			}
+			if got := hv.UploadedBytes(definitions.DiskPoolName, definitions.BaseDiskName) - uploaded; got != uint64(tc.wantUploaded) {
+				t.Errorf("uploaded %d bytes, want %d", got, tc.wantUploaded)
+			}
+			if s, err := state.Load(statePath); err != nil || s.Image == "" {
+				t.Errorf("digest of the base image not recorded: %v", err)
+			}
+		})
+	}
+}
+
+func TestBaseImageVerification(t *testing.T) {
+	testCases := map[string]struct {
+		// tamper modifies the image or the manifest after it was written.
+		tamper  func(t *testing.T, imagePath string)
+		failOn  string
+		wantErr error
+	}{
+		"image does not match the manifest": {
+			tamper: func(t *testing.T, imagePath string) {
+				if err := os.WriteFile(imagePath, []byte("tampered"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: image.ErrDigestMismatch,
+		},
+		"missing manifest": {
+			tamper: func(t *testing.T, imagePath string) {
+				if err := os.Remove(filepath.Join(filepath.Dir(imagePath), image.ChecksumsName)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: os.ErrNotExist,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			hv := fakelibvirt.New()
+			statePath := filepath.Join(t.TempDir(), "state.json")
+			instance := newInstance(t, hv, statePath)
+			tc.tamper(t, instance.Config.Infrastructure.ImagePath)
+			err := instance.InitializeInfrastructure(context.Background())
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+			// Nothing is uploaded before the image is verified.
+			if pool, _ := hv.Pool(definitions.DiskPoolName); len(pool.Volumes) != 0 {
+				t.Errorf("got volumes %v, want none", pool.Volumes)
+			}
+		})
+	}
+}
+
+func TestBaseImageUploadFinish(t *testing.T) {
+	hv := fakelibvirt.New()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	instance := newInstance(t, hv, statePath)
+	errFinish := errors.New("finish failed")
+	hv.FailOn("Finish", "", errFinish)
+	if err := instance.InitializeInfrastructure(context.Background()); !errors.Is(err, errFinish) {
+		t.Fatalf("got error %v, want the failure of Finish", err)
+	}
+	// The aborted stream releases the volume, the next invocation resumes the upload.
+	hv.ClearFailures()
+	instance = newInstance(t, hv, statePath)
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatalf("initializing infrastructure again: %v", err)
+	}
+	if content, _ := hv.VolumeContent(definitions.DiskPoolName, definitions.BaseDiskName); !bytes.Equal(content, testImage) {
+		t.Errorf("got base image %q, want %q", content, testImage)
+	}
+}
+
+func TestSnapshotRollback(t *testing.T) {
+	testCases := map[string]struct {
+		memory bool
+	}{
+		"disks only":       {},
+		"disks and memory": {memory: true},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			hv := fakelibvirt.New()
+			addForeignResources(t, hv)
+			statePath := filepath.Join(t.TempDir(), "state.json")
+			instance := newInstance(t, hv, statePath)
+			if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+				t.Fatalf("initializing infrastructure: %v", err)
+			}
+			if err := createNodes(instance); err != nil {
+				t.Fatalf("creating nodes: %v", err)
+			}
+			for _, node := range []string{"delegatio-0", "delegatio-1", "delegatio-2"} {
+				hv.SetVolumeContent(definitions.DiskPoolName, node, []byte("known-good "+node))
+			}
+
+			if err := instance.CreateSnapshot(context.Background(), "semester-start", tc.memory); err != nil {
+				t.Fatalf("creating snapshot: %v", err)
+			}
+			for _, node := range hv.Domains() {
+				if info, _ := hv.Domain(node); info.Paused {
+					t.Errorf("domain %s is still paused", node)
+				}
+			}
+			s, err := state.Load(statePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot := s.Snapshot("semester-start"); snapshot == nil || len(snapshot.Nodes) != 3 || snapshot.Memory != tc.memory {
+				t.Fatalf("snapshot not recorded: %+v", s.Snapshots)
+			}
+			if err := instance.CreateSnapshot(context.Background(), "semester-start", tc.memory); err == nil {
+				t.Error("creating a snapshot with the same name succeeded")
+			}
+
+			// A bad upgrade breaks a node, a node is added and one is removed.
+			hv.SetVolumeContent(definitions.DiskPoolName, "delegatio-0", []byte("broken"))
+			if err := instance.CreateInstance("3", instance.Config.Cluster.Worker, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := instance.RemoveNode(context.Background(), "delegatio-2"); err != nil {
+				t.Fatal(err)
+			}
+
+			// The next invocation of the CLI rolls back.
+			instance = newInstance(t, hv, statePath)
+			if err := instance.RollbackSnapshot(context.Background(), "semester-start"); err != nil {
+				t.Fatalf("rolling back: %v", err)
+			}
+			if domains := hv.Domains(); !reflect.DeepEqual(domains, []string{"delegatio-0", "delegatio-1", "delegatio-2", "other-vm"}) {
+				t.Errorf("got domains %v", domains)
+			}
+			for _, node := range []string{"delegatio-0", "delegatio-1", "delegatio-2"} {
+				if content, _ := hv.VolumeContent(definitions.DiskPoolName, node); string(content) != "known-good "+node {
+					t.Errorf("got disk %q of %s, want the known-good state", content, node)
+				}
+				info, _ := hv.Domain(node)
+				if info.Paused || info.Restored != tc.memory {
+					t.Errorf("got domain %+v, want running and restored from memory %t", info, tc.memory)
+				}
+			}
+			if pool, _ := hv.Pool(definitions.DiskPoolName); contains(pool.Volumes, "delegatio-3") || contains(pool.Volumes, "delegatio-3.console.log") || contains(pool.Volumes, "delegatio-3.metadata.json") {
+				t.Errorf("the disk of the node created after the snapshot is left: %v", pool.Volumes)
+			}
+			if s, err = state.Load(statePath); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := s.Nodes["delegatio-3"]; ok || len(s.Nodes) != 3 || s.Snapshot("semester-start") == nil {
+				t.Errorf("state not rolled back: %+v", s)
+			}
+
+			// A rollback can be repeated, the snapshot is not consumed.
+			if err := instance.RollbackSnapshot(context.Background(), "semester-start"); err != nil {
+				t.Fatalf("rolling back again: %v", err)
+			}
+			if err := instance.DeleteSnapshot(context.Background(), "semester-start"); err != nil {
+				t.Fatalf("deleting snapshot: %v", err)
+			}
+			pool, _ := hv.Pool(definitions.DiskPoolName)
+			wantVolumes := []string{definitions.BaseDiskName, "delegatio-0", "delegatio-0.metadata.json", "delegatio-1", "delegatio-1.metadata.json", "delegatio-2", "delegatio-2.metadata.json"}
+			if volumes := withoutConsoleLogs(pool.Volumes); !reflect.DeepEqual(volumes, wantVolumes) {
+				t.Errorf("got volumes %v after deleting the snapshot, want %v", volumes, wantVolumes)
+			}
+			if err := instance.TerminateInfrastructure(); err != nil {
+				t.Fatalf("terminating: %v", err)
+			}
+			assertOnlyForeignResources(t, hv)
+		})
+	}
+}
+
+func TestSnapshotFailure(t *testing.T) {
+	errInjected := errors.New("injected failure")
+	testCases := map[string]struct {
+		memory     bool
+		failMethod string
+		failName   string
+	}{
+		"disk copy fails": {
+			failMethod: "StorageVolCreateXMLFrom",
+			failName:   "delegatio-2@snap",
+		},
+		"pausing fails": {
+			failMethod: "Suspend",
+			failName:   "delegatio-1",
+		},
+		"saving memory fails": {
+			memory:     true,
+			failMethod: "SaveFlags",
+			failName:   "delegatio-2",
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			hv := fakelibvirt.New()
+			statePath := filepath.Join(t.TempDir(), "state.json")
+			instance := newInstance(t, hv, statePath)
+			if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+				t.Fatalf("initializing infrastructure: %v", err)
+			}
+			if err := createNodes(instance); err != nil {
+				t.Fatalf("creating nodes: %v", err)
+			}
+			hv.FailOn(tc.failMethod, tc.failName, errInjected)
+			if err := instance.CreateSnapshot(context.Background(), "snap", tc.memory); !errors.Is(err, errInjected) {
+				t.Fatalf("got error %v, want the injected failure", err)
+			}
+			// The cluster keeps running without a partial snapshot.
+			if domains := hv.Domains(); !reflect.DeepEqual(domains, []string{"delegatio-0", "delegatio-1", "delegatio-2"}) {
+				t.Errorf("got domains %v", domains)
+			}
+			for _, node := range hv.Domains() {
+				if info, _ := hv.Domain(node); info.Paused {
+					t.Errorf("domain %s is still paused", node)
+				}
+			}
+			pool, _ := hv.Pool(definitions.DiskPoolName)
+			wantVolumes := []string{definitions.BaseDiskName, "delegatio-0", "delegatio-0.metadata.json", "delegatio-1", "delegatio-1.metadata.json", "delegatio-2", "delegatio-2.metadata.json"}
+			if !reflect.DeepEqual(pool.Volumes, wantVolumes) {
+				t.Errorf("got volumes %v, want %v", pool.Volumes, wantVolumes)
+			}
+			if err := instance.RollbackSnapshot(context.Background(), "snap"); err == nil {
+				t.Error("rolling back to the failed snapshot succeeded")
+			}
+		})
+	}
+}
+
+// withoutConsoleLogs removes the console logs from a list of volumes, they are volumes once the pool was refreshed.
+func withoutConsoleLogs(volumes []string) []string {
+	var disks []string
+	for _, volume := range volumes {
+		if !strings.HasSuffix(volume, ".console.log") {
+			disks = append(disks, volume)
+		}
+	}
+	return disks
+}
+
+func contains(list []string, item string) bool {
+	for _, element := range list {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStaticAddresses(t *testing.T) {
+	testCases := map[string]struct {
+		ipv6CIDR string
+		wantIPv6 map[string]string
+	}{
+		"ipv4 only": {},
+		"dual stack": {
+			ipv6CIDR: "fd42:42::/64",
+			wantIPv6: map[string]string{
+				"delegatio-0": "fd42:42::100",
+				"delegatio-1": "fd42:42::101",
+				"delegatio-2": "fd42:42::102",
+				"delegatio-5": "fd42:42::105",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			hv := fakelibvirt.New()
+			statePath := filepath.Join(t.TempDir(), "state.json")
+			instance := newInstance(t, hv, statePath)
+			instance.Config.Infrastructure.Network.CIDR = "192.168.42.0/24"
+			instance.Config.Infrastructure.Network.DHCPStart = "192.168.42.10"
+			instance.Config.Infrastructure.Network.DHCPEnd = "192.168.42.200"
+			instance.Config.Infrastructure.Network.Bridge = "virbr42"
+			instance.Config.Infrastructure.Network.IPv6CIDR = tc.ipv6CIDR
+			if err := instance.Config.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+				t.Fatalf("initializing infrastructure: %v", err)
+			}
+			network, ok := hv.Network(definitions.NetworkName)
+			if !ok {
+				t.Fatal("network was not created")
+			}
+			if network.Bridge != "virbr42" || network.Domain != "delegatio.internal" {
+				t.Errorf("got bridge %q and domain %q", network.Bridge, network.Domain)
+			}
+			perNode := 1
+			if tc.ipv6CIDR != "" {
+				perNode = 2
+			}
+			// The nodes of the configured topology are reserved with the network.
+			if want := 3 * perNode; len(network.Hosts) != want {
+				t.Errorf("got %d reservations, want %d: %+v", len(network.Hosts), want, network.Hosts)
+			}
+
+			if err := createNodes(instance); err != nil {
+				t.Fatalf("creating nodes: %v", err)
+			}
+			// An added worker is reserved once its domain is created.
+			if err := instance.CreateInstance("5", instance.Config.Cluster.Worker, false); err != nil {
+				t.Fatal(err)
+			}
+			wantIPv4 := map[string]string{
+				"delegatio-0": "192.168.42.10",
+				"delegatio-1": "192.168.42.11",
+				"delegatio-2": "192.168.42.12",
+				"delegatio-5": "192.168.42.15",
+			}
+			s, err := state.Load(statePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := hv.Connect("test:///default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for node, want := range wantIPv4 {
+				if got := s.Nodes[node].IP; got != want {
+					t.Errorf("got address %s for %s in the state, want %s", got, node, want)
+				}
+				domain, err := conn.LookupDomainByName(node)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ifaces, err := domain.ListAllInterfaceAddresses(0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var leased []string
+				for _, iface := range ifaces {
+					for _, addr := range iface.Addrs {
+						leased = append(leased, addr.Addr)
+					}
+				}
+				wantLeased := []string{want}
+				if tc.wantIPv6 != nil {
+					wantLeased = append(wantLeased, tc.wantIPv6[node])
+				}
+				if !reflect.DeepEqual(leased, wantLeased) {
+					t.Errorf("got leases %v for %s, want %v", leased, node, wantLeased)
+				}
+			}
+
+			// Recreating a node keeps its reservation.
+			if err := instance.RemoveNode(context.Background(), "delegatio-5"); err != nil {
+				t.Fatal(err)
+			}
+			if err := instance.CreateInstance("5", instance.Config.Cluster.Worker, false); err != nil {
+				t.Fatalf("recreating node: %v", err)
+			}
+			network, _ = hv.Network(definitions.NetworkName)
+			if want := 4 * perNode; len(network.Hosts) != want {
+				t.Errorf("got %d reservations, want %d: %+v", len(network.Hosts), want, network.Hosts)
+			}
+		})
+	}
+}
+
+func TestStaticAddressesExhausted(t *testing.T) {
+	hv := fakelibvirt.New()
+	instance := newInstance(t, hv, filepath.Join(t.TempDir(), "state.json"))
+	instance.Config.Infrastructure.Network.DHCPEnd = "10.42.1.2"
+	if err := instance.InitializeInfrastructure(context.Background()); err == nil {
+		t.Fatal("created a network without addresses for all nodes")
+	}
+	instance.Config.Infrastructure.Network.DHCPEnd = "10.42.1.3"
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatalf("initializing infrastructure: %v", err)
+	}
+	if err := createNodes(instance); err != nil {
+		t.Fatalf("creating nodes: %v", err)
+	}
+	if err := instance.CreateInstance("3", instance.Config.Cluster.Worker, false); err == nil {
+		t.Error("created a node outside of the DHCP range")
+	}
+	if domains := hv.Domains(); !reflect.DeepEqual(domains, []string{"delegatio-0", "delegatio-1", "delegatio-2"}) {
+		t.Errorf("got domains %v", domains)
+	}
+	if pool, _ := hv.Pool(definitions.DiskPoolName); contains(pool.Volumes, "delegatio-3") {
+		t.Errorf("created the disk of a node without address: %v", pool.Volumes)
+	}
+}
+
+// syncBuffer is a bytes.Buffer which can be written and read concurrently.
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+// eventually fails the test if condition does not become true within a few seconds.
+func eventually(t *testing.T, condition func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConsoleLog(t *testing.T) {
+	hv := fakelibvirt.New()
+	instance := newInstance(t, hv, filepath.Join(t.TempDir(), "state.json"))
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatalf("initializing infrastructure: %v", err)
+	}
+	if err := createNodes(instance); err != nil {
+		t.Fatalf("creating nodes: %v", err)
+	}
+	var boot strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&boot, "boot message %d\n", i)
+	}
+	if err := hv.WriteConsole("delegatio-1", []byte(boot.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	var tail bytes.Buffer
+	if err := instance.ConsoleLog(context.Background(), "delegatio-1", 3, false, &tail); err != nil {
+		t.Fatalf("reading console log: %v", err)
+	}
+	if want := "boot message 98\nboot message 99\nboot message 100\n"; tail.String() != want {
+		t.Errorf("got %q, want %q", tail.String(), want)
+	}
+	tail.Reset()
+	if err := instance.ConsoleLog(context.Background(), "delegatio-2", 3, false, &tail); err != nil || tail.Len() != 0 {
+		t.Errorf("got %q and error %v for a node without output, want nothing", tail.String(), err)
+	}
+	if err := instance.ConsoleLog(context.Background(), "delegatio-7", 3, false, &tail); err == nil {
+		t.Error("read the console log of a node which does not exist")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var followed syncBuffer
+	done := make(chan error, 1)
+	go func() {
+		done <- instance.ConsoleLog(ctx, "delegatio-1", 1, true, &followed)
+	}()
+	eventually(t, func() bool { return followed.String() == "boot message 100\n" }, "got %q before new output", followed.String())
+	if err := hv.WriteConsole("delegatio-1", []byte("login: ")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return strings.HasSuffix(followed.String(), "login: ") }, "new output was not followed: %q", followed.String())
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("following the console log: %v", err)
+	}
+
+	// The console log is deleted with the node.
+	if err := instance.RemoveNode(context.Background(), "delegatio-1"); err != nil {
+		t.Fatal(err)
+	}
+	if pool, _ := hv.Pool(definitions.DiskPoolName); contains(pool.Volumes, "delegatio-1.console.log") {
+		t.Errorf("console log of the removed node is left: %v", pool.Volumes)
+	}
+	// Logs which were never read do not keep the pool from being deleted.
+	if err := instance.TerminateInfrastructure(); err != nil {
+		t.Fatalf("terminating: %v", err)
+	}
+}
+
+func TestAttachConsole(t *testing.T) {
+	hv := fakelibvirt.New()
+	instance := newInstance(t, hv, filepath.Join(t.TempDir(), "state.json"))
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatalf("initializing infrastructure: %v", err)
+	}
+	if err := createNodes(instance); err != nil {
+		t.Fatalf("creating nodes: %v", err)
+	}
+
+	attach := func(name string) (*io.PipeWriter, *syncBuffer, chan error) {
+		in, inWriter := io.Pipe()
+		out := &syncBuffer{}
+		done := make(chan error, 1)
+		go func() {
+			done <- instance.AttachConsole(context.Background(), name, in, out)
+		}()
+		return inWriter, out, done
+	}
+
+	in, out, done := attach("delegatio-0")
+	if _, err := in.Write([]byte("root\n")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return string(hv.ConsoleInput("delegatio-0")) == "root\n" }, "input did not reach the console")
+	if err := instance.AttachConsole(context.Background(), "delegatio-0", strings.NewReader(""), io.Discard); err == nil {
+		t.Error("attached a second session to the console")
+	}
+	if err := hv.WriteConsole("delegatio-0", []byte("Password: ")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return out.String() == "Password: " }, "got output %q", out.String())
+	// Closing the input detaches from the console.
+	if err := in.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("detaching: %v", err)
+	}
+
+	// The session ends when the domain stops.
+	in, _, done = attach("delegatio-1")
+	defer in.Close()
+	if _, err := in.Write([]byte("\n")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return len(hv.ConsoleInput("delegatio-1")) > 0 }, "input did not reach the console")
+	if err := instance.RemoveNode(context.Background(), "delegatio-1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("console of the stopped domain: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("console session did not end with the domain")
+	}
+}
+
+func TestNodeMetadata(t *testing.T) {
+	hv := fakelibvirt.New()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	instance := newInstance(t, hv, statePath)
+	if err := instance.InitializeInfrastructure(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	kubeadmConfig := []byte("kind: InitConfiguration")
+	// The nodes are created before the CLI waits for their agents, which never come up.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := instance.InitializeKubernetes(ctx, kubeadmConfig); err == nil {
+		t.Fatal("kubernetes was initialized without agents")
+	}
+
+	caPEM, err := os.ReadFile(filepath.Join(instance.Config.Infrastructure.PKIDir, pki.CACertFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	testCases := map[string]struct {
+		wantRole          metadata.Role
+		wantKubeadmConfig []byte
+	}{
+		"delegatio-0": {wantRole: metadata.RoleControlPlane, wantKubeadmConfig: kubeadmConfig},
+		"delegatio-1": {wantRole: metadata.RoleWorker},
+		"delegatio-2": {wantRole: metadata.RoleWorker},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			info, ok := hv.Domain(name)
+			if !ok {
+				t.Fatal("domain not found")
+			}
+			var def libvirtxml.Domain
+			if err := def.Unmarshal(info.XML); err != nil {
+				t.Fatal(err)
+			}
+			if len(def.SysInfo) != 1 || def.SysInfo[0].FWCfg == nil || len(def.SysInfo[0].FWCfg.Entry) != 1 {
+				t.Fatalf("domain has no fw_cfg entry: %+v", def.SysInfo)
+			}
+			entry := def.SysInfo[0].FWCfg.Entry[0]
+			if entry.Name != metadata.FWCfgName {
+				t.Errorf("fw_cfg entry %q, want %q", entry.Name, metadata.FWCfgName)
+			}
+			// The key of the agent must not show up in the domain XML.
+			if entry.Value != "" || entry.File != definitions.LibvirtStoragePoolPath+name+".metadata.json" {
+				t.Errorf("fw_cfg entry %+v does not reference the metadata volume", entry)
+			}
+			data, ok := hv.VolumeContent(definitions.DiskPoolName, name+".metadata.json")
+			if !ok {
+				t.Fatal("metadata volume not found")
+			}
+			md, err := metadata.Unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if md.Hostname != name || md.Role != tc.wantRole {
+				t.Errorf("hostname %q with role %q, want %q with %q", md.Hostname, md.Role, name, tc.wantRole)
+			}
+			if !bytes.Equal(md.KubeadmConfig, tc.wantKubeadmConfig) {
+				t.Errorf("kubeadm config %q, want %q", md.KubeadmConfig, tc.wantKubeadmConfig)
+			}
+			if !bytes.Equal(md.CACert, caPEM) {
+				t.Error("the metadata does not contain the CA of the CLI")
+			}
+
+			pair, err := tls.X509KeyPair(md.AgentCert, md.AgentKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := x509.ParseCertificate(pair.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cert.Verify(x509.VerifyOptions{
+				DNSName:   name,
+				Roots:     roots,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}); err != nil {
+				t.Errorf("agent certificate is not valid for %s: %v", name, err)
+			}
+			if err := cert.VerifyHostname(pki.AgentServerName); err == nil {
+				t.Errorf("agent certificate is valid for %s", pki.AgentServerName)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package qemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"libvirt.org/go/libvirt"
+)
+
+// snapshotNameRegexp restricts the names of snapshots, they are part of the names of volumes.
+var snapshotNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// snapshotDisk returns the name of the volume which holds the disk of a node in a snapshot.
+func snapshotDisk(node, snapshot string) string {
+	return node + "@" + snapshot
+}
+
+// snapshotMemory returns the name of the volume which holds the saved memory of a node in a snapshot.
+func snapshotMemory(node, snapshot string) string {
+	return node + "@" + snapshot + ".save"
+}
+
+// CreateSnapshot checkpoints the disks of all nodes under name. If memory is set, the memory of the
+// nodes is saved as well. The nodes are paused meanwhile, such that the disks of all nodes are consistent.
+func (l *LibvirtInstance) CreateSnapshot(ctx context.Context, name string, memory bool) (err error) {
+	if !snapshotNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q, only lower case letters, digits and dashes are allowed", name)
+	}
+	if l.snapshot(name) != nil {
+		return fmt.Errorf("snapshot %s already exists", name)
+	}
+	snapshot := &state.Snapshot{
+		Name:      name,
+		Created:   time.Now().UTC(),
+		Memory:    memory,
+		Nodes:     map[string]*state.Node{},
+		JoinToken: l.joinToken,
+	}
+	l.ConnMux.Lock()
+	for node, info := range l.RegisteredDomains {
+		snapshot.Nodes[node] = &state.Node{ControlPlane: info.controlPlane, IP: info.ip, Volume: node, Joined: info.joined}
+	}
+	l.ConnMux.Unlock()
+	if len(snapshot.Nodes) == 0 {
+		return errors.New("the cluster has no nodes")
+	}
+	nodes := sortedNodes(snapshot.Nodes)
+	pool, err := l.Conn.LookupStoragePoolByName(definitions.DiskPoolName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = pool.Free() }()
+
+	// The nodes are resumed and the partial snapshot is removed in any case.
+	var suspended, saved, created []string
+	defer func() {
+		for _, node := range saved {
+			err = multierr.Append(err, l.restoreDomain(snapshotMemory(node, name)))
+		}
+		for _, node := range suspended {
+			err = multierr.Append(err, l.resumeDomain(node))
+		}
+		if err != nil {
+			err = multierr.Append(err, l.deleteVolumes(pool, created))
+		}
+	}()
+
+	l.Log.Info("pausing nodes", zap.Strings("nodes", nodes))
+	for _, node := range nodes {
+		if err := l.suspendDomain(node); err != nil {
+			return err
+		}
+		suspended = append(suspended, node)
+	}
+	for _, node := range nodes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l.Log.Info("copying disk", zap.String("node", node))
+		spec := l.nodeSpec(snapshot.Nodes[node].ControlPlane)
+		if err := l.cloneVolume(pool, node, snapshotDisk(node, name), spec); err != nil {
+			return err
+		}
+		created = append(created, snapshotDisk(node, name))
+	}
+	if memory {
+		for _, node := range nodes {
+			l.Log.Info("saving memory", zap.String("node", node))
+			if err := l.saveDomain(node, path.Join(definitions.LibvirtStoragePoolPath, snapshotMemory(node, name))); err != nil {
+				return err
+			}
+			saved = append(saved, node)
+			created = append(created, snapshotMemory(node, name))
+		}
+		// The saved memory is written by the daemon, the pool only knows the file after a refresh.
+		if err := pool.Refresh(0); err != nil {
+			return err
+		}
+	}
+
+	l.ConnMux.Lock()
+	l.snapshots = append(l.snapshots, snapshot)
+	l.ConnMux.Unlock()
+	l.Log.Info("snapshot created", zap.String("name", name), zap.Bool("memory", memory))
+	return l.saveState()
+}
+
+// RollbackSnapshot restores the disks of all nodes from the snapshot. Nodes which were created after the
+// snapshot are deleted, nodes which were removed are recreated. If the snapshot contains the memory of
+// the nodes, they resume where they were, otherwise they boot.
+func (l *LibvirtInstance) RollbackSnapshot(ctx context.Context, name string) error {
+	snapshot := l.snapshot(name)
+	if snapshot == nil {
+		return fmt.Errorf("snapshot %s does not exist", name)
+	}
+	pool, err := l.Conn.LookupStoragePoolByName(definitions.DiskPoolName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = pool.Free() }()
+	nodes := sortedNodes(snapshot.Nodes)
+	// The cluster is only touched if the snapshot is complete.
+	for _, node := range nodes {
+		volumes := []string{snapshotDisk(node, name)}
+		if snapshot.Memory {
+			volumes = append(volumes, snapshotMemory(node, name))
+		}
+		for _, volume := range volumes {
+			vol, err := pool.LookupStorageVolByName(volume)
+			if err != nil {
+				return fmt.Errorf("snapshot %s is incomplete: %w", name, err)
+			}
+			_ = vol.Free()
+		}
+	}
+
+	l.Log.Info("rolling back the cluster", zap.String("snapshot", name), zap.Time("created", snapshot.Created))
+	l.ConnMux.Lock()
+	current := make([]string, 0, len(l.RegisteredDomains))
+	for node := range l.RegisteredDomains {
+		current = append(current, node)
+	}
+	l.ConnMux.Unlock()
+	sort.Strings(current)
+	for _, node := range current {
+		if err := l.destroyDomain(node); err != nil {
+			return err
+		}
+		if _, ok := snapshot.Nodes[node]; ok {
+			continue
+		}
+		// The node did not exist when the snapshot was taken.
+		if err := l.deleteNode(node); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range nodes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info := snapshot.Nodes[node]
+		l.ConnMux.Lock()
+		err := l.deleteRegisteredDisk(node)
+		l.ConnMux.Unlock()
+		if err != nil {
+			return err
+		}
+		l.Log.Info("restoring disk", zap.String("node", node))
+		if err := l.cloneVolume(pool, snapshotDisk(node, name), node, l.nodeSpec(info.ControlPlane)); err != nil {
+			return err
+		}
+		l.ConnMux.Lock()
+		l.RegisteredDisks = append(l.RegisteredDisks, node)
+		// The address of a node is reserved for it, the domains get it again.
+		l.RegisteredDomains[node] = &DomainInfo{controlPlane: info.ControlPlane, ip: info.IP, joined: info.Joined}
+		l.ConnMux.Unlock()
+	}
+	l.joinToken = snapshot.JoinToken
+	if err := l.saveState(); err != nil {
+		return err
+	}
+
+	if !snapshot.Memory {
+		for _, node := range nodes {
+			if err := l.createDomain(node, l.nodeSpec(snapshot.Nodes[node].ControlPlane), snapshot.Nodes[node].ControlPlane); err != nil {
+				return err
+			}
+		}
+		l.Log.Info("rollback successful, the nodes are booting", zap.String("snapshot", name))
+		return nil
+	}
+	// All nodes continue at the same time, like they were paused at the same time.
+	for _, node := range nodes {
+		// The network loses the reservations of added workers if the host rebooted.
+		if err := l.reserveAddress(node); err != nil {
+			return err
+		}
+		// The saved domain passes the metadata volume to qemu, it is gone if the node was removed.
+		if _, err := l.metadataSysInfo(node, snapshot.Nodes[node].ControlPlane); err != nil {
+			return err
+		}
+		if err := l.restoreDomain(snapshotMemory(node, name)); err != nil {
+			return err
+		}
+	}
+	for _, node := range nodes {
+		if err := l.resumeDomain(node); err != nil {
+			return err
+		}
+	}
+	l.Log.Info("rollback successful", zap.String("snapshot", name))
+	return nil
+}
+
+// DeleteSnapshot deletes the volumes of the snapshot and its record.
+func (l *LibvirtInstance) DeleteSnapshot(ctx context.Context, name string) error {
+	snapshot := l.snapshot(name)
+	if snapshot == nil {
+		return fmt.Errorf("snapshot %s does not exist", name)
+	}
+	pool, err := l.Conn.LookupStoragePoolByName(definitions.DiskPoolName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = pool.Free() }()
+	var volumes []string
+	for _, node := range sortedNodes(snapshot.Nodes) {
+		volumes = append(volumes, snapshotDisk(node, name))
+		if snapshot.Memory {
+			volumes = append(volumes, snapshotMemory(node, name))
+		}
+	}
+	if err := l.deleteVolumes(pool, volumes); err != nil {
+		return err
+	}
+	l.ConnMux.Lock()
+	for i, s := range l.snapshots {
+		if s.Name == name {
+			l.snapshots = append(l.snapshots[:i], l.snapshots[i+1:]...)
+			break
+		}
+	}
+	l.ConnMux.Unlock()
+	l.Log.Info("snapshot deleted", zap.String("name", name))
+	return l.saveState()
+}
+
+func (l *LibvirtInstance) snapshot(name string) *state.Snapshot {
+	l.ConnMux.Lock()
+	defer l.ConnMux.Unlock()
+	for _, snapshot := range l.snapshots {
+		if snapshot.Name == name {
+			return snapshot
+		}
+	}
+	return nil
+}
+
+// nodeSpec returns the size of the nodes of a role.
+func (l *LibvirtInstance) nodeSpec(controlPlane bool) config.NodeSpec {
+	if controlPlane {
+		return l.Config.Cluster.ControlPlane
+	}
+	return l.Config.Cluster.Worker
+}
+
+// cloneVolume copies the volume source into a new overlay over the base volume called target.
+func (l *LibvirtInstance) cloneVolume(pool StoragePool, source, target string, spec config.NodeSpec) error {
+	sourceVol, err := pool.LookupStorageVolByName(source)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = sourceVol.Free() }()
+	volumeXML, err := bootVolumeXML(target, spec)
+	if err != nil {
+		return err
+	}
+	targetVol, err := pool.StorageVolCreateXMLFrom(volumeXML, sourceVol, 0)
+	if err != nil {
+		return fmt.Errorf("copying volume %s to %s: %w", source, target, err)
+	}
+	return targetVol.Free()
+}
+
+// deleteVolumes deletes the volumes from the pool, missing volumes are ignored.
+func (l *LibvirtInstance) deleteVolumes(pool StoragePool, names []string) error {
+	var errs error
+	for _, name := range names {
+		volume, err := pool.LookupStorageVolByName(name)
+		if isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+			continue
+		}
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		if err := volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("deleting volume %s: %w", name, err))
+		}
+		_ = volume.Free()
+	}
+	return errs
+}
+
+func (l *LibvirtInstance) suspendDomain(name string) error {
+	domain, err := l.Conn.LookupDomainByName(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = domain.Free() }()
+	if err := domain.Suspend(); err != nil {
+		return fmt.Errorf("pausing domain %s: %w", name, err)
+	}
+	return nil
+}
+
+func (l *LibvirtInstance) resumeDomain(name string) error {
+	domain, err := l.Conn.LookupDomainByName(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = domain.Free() }()
+	if err := domain.Resume(); err != nil {
+		return fmt.Errorf("resuming domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// saveDomain writes the memory of the paused domain to file and stops it.
+func (l *LibvirtInstance) saveDomain(name, file string) error {
+	domain, err := l.Conn.LookupDomainByName(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = domain.Free() }()
+	if err := domain.SaveFlags(file, "", libvirt.DOMAIN_SAVE_PAUSED); err != nil {
+		return fmt.Errorf("saving domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// restoreDomain starts the domain saved in the volume, it stays paused until it is resumed.
+func (l *LibvirtInstance) restoreDomain(volume string) error {
+	file := path.Join(definitions.LibvirtStoragePoolPath, volume)
+	if err := l.Conn.DomainRestoreFlags(file, "", libvirt.DOMAIN_SAVE_PAUSED); err != nil {
+		return fmt.Errorf("restoring domain from %s: %w", file, err)
+	}
+	return nil
+}
+
+// destroyDomain stops a domain, domains which do not run are ignored.
+func (l *LibvirtInstance) destroyDomain(name string) error {
+	domain, err := l.Conn.LookupDomainByName(name)
+	if isLibvirtError(err, libvirt.ERR_NO_DOMAIN) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = domain.Free() }()
+	// The domains are transient, they are gone once destroyed.
+	return domain.Destroy()
+}
+
+func sortedNodes(nodes map[string]*state.Node) []string {
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,175 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/benschlueter/delegatio/cli/infrastructure/qemu/definitions"
+	"github.com/benschlueter/delegatio/cli/infrastructure/state"
+	"go.uber.org/zap"
+	"libvirt.org/go/libvirt"
+)
+
+// loadState re-attaches to the resources recorded in the state file.
+func (l *LibvirtInstance) loadState() error {
+	if l.StatePath == "" {
+		return nil
+	}
+	s, err := state.Load(l.StatePath)
+	if err != nil {
+		return err
+	}
+	if s.Provider != "" {
+		return fmt.Errorf("the state file %s belongs to the %s provider", l.StatePath, s.Provider)
+	}
+	l.ConnMux.Lock()
+	if s.Network != "" {
+		l.RegisteredNetworks = []string{s.Network}
+	}
+	l.RegisteredPools = s.Pools
+	l.RegisteredDisks = s.Volumes
+	l.baseImageDigest = s.Image
+	for name, node := range s.Nodes {
+		l.RegisteredDomains[name] = &DomainInfo{
+			controlPlane: node.ControlPlane,
+			ip:           node.IP,
+			joined:       node.Joined,
+		}
+	}
+	l.joinToken = s.JoinToken
+	l.snapshots = s.Snapshots
+	l.ConnMux.Unlock()
+	if !s.Empty() {
+		l.Log.Info("re-attaching to existing infrastructure", zap.String("state", l.StatePath))
+	}
+	return l.pruneState()
+}
+
+// saveState writes the currently registered resources to the state file.
+func (l *LibvirtInstance) saveState() error {
+	if l.StatePath == "" {
+		return nil
+	}
+	l.saveMux.Lock()
+	defer l.saveMux.Unlock()
+	s := state.New()
+	s.NodeCounts = &state.NodeCounts{
+		ControlPlanes: l.Config.Cluster.ControlPlane.Count,
+		Workers:       l.Config.Cluster.Worker.Count,
+	}
+	l.ConnMux.Lock()
+	if len(l.RegisteredNetworks) > 0 {
+		s.Network = l.RegisteredNetworks[0]
+	}
+	s.Pools = append(s.Pools, l.RegisteredPools...)
+	s.Volumes = append(s.Volumes, l.RegisteredDisks...)
+	s.Image = l.baseImageDigest
+	for name, info := range l.RegisteredDomains {
+		s.Nodes[name] = &state.Node{
+			ControlPlane: info.controlPlane,
+			IP:           info.ip,
+			Volume:       name,
+			Joined:       info.joined,
+		}
+	}
+	s.JoinToken = l.joinToken
+	s.Snapshots = append(s.Snapshots, l.snapshots...)
+	l.ConnMux.Unlock()
+	if l.joinToken != nil {
+		kubeconfigPath, err := filepath.Abs(l.KubeconfigPath)
+		if err != nil {
+			return err
+		}
+		s.KubeconfigPath = kubeconfigPath
+	}
+	return s.Save(l.StatePath)
+}
+
+// pruneState drops recorded resources which no longer exist in libvirt.
+// Networks and domains are transient and vanish when the host reboots.
+func (l *LibvirtInstance) pruneState() error {
+	l.ConnMux.Lock()
+	defer l.ConnMux.Unlock()
+	if len(l.RegisteredNetworks) > 0 {
+		network, err := l.Conn.LookupNetworkByName(l.RegisteredNetworks[0])
+		switch {
+		case isLibvirtError(err, libvirt.ERR_NO_NETWORK):
+			l.Log.Info("recorded network vanished", zap.String("name", l.RegisteredNetworks[0]))
+			l.RegisteredNetworks = nil
+		case err != nil:
+			return err
+		default:
+			_ = network.Free()
+		}
+	}
+	if len(l.RegisteredPools) > 0 {
+		pool, err := l.Conn.LookupStoragePoolByName(l.RegisteredPools[0])
+		switch {
+		case isLibvirtError(err, libvirt.ERR_NO_STORAGE_POOL):
+			l.Log.Info("recorded storage pool vanished", zap.String("name", l.RegisteredPools[0]))
+			l.RegisteredPools = nil
+			l.RegisteredDisks = nil
+			l.baseImageDigest = ""
+			l.snapshots = nil
+		case err != nil:
+			return err
+		default:
+			_ = pool.Free()
+		}
+	}
+	for name := range l.RegisteredDomains {
+		domain, err := l.Conn.LookupDomainByName(name)
+		if isLibvirtError(err, libvirt.ERR_NO_DOMAIN) {
+			l.Log.Info("recorded domain vanished", zap.String("name", name))
+			delete(l.RegisteredDomains, name)
+			// The boot disk contains the state of the old node, it must be recreated.
+			if err := l.deleteRegisteredDisk(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_ = domain.Free()
+	}
+	return nil
+}
+
+// deleteRegisteredDisk deletes a volume from the storage pool and the registry.
+// The caller must hold l.ConnMux.
+func (l *LibvirtInstance) deleteRegisteredDisk(name string) error {
+	for i, disk := range l.RegisteredDisks {
+		if disk != name {
+			continue
+		}
+		pool, err := l.Conn.LookupStoragePoolByName(definitions.DiskPoolName)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = pool.Free() }()
+		volume, err := pool.LookupStorageVolByName(name)
+		if err != nil && !isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+			return err
+		}
+		if err == nil {
+			defer func() { _ = volume.Free() }()
+			if err := volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL); err != nil {
+				return err
+			}
+		}
+		l.RegisteredDisks = append(l.RegisteredDisks[:i], l.RegisteredDisks[i+1:]...)
+		return nil
+	}
+	return nil
+}
+
+func isLibvirtError(err error, code libvirt.ErrorNumber) bool {
+	var libvirtErr libvirt.Error
+	return errors.As(err, &libvirtErr) && libvirtErr.Code == code
+}
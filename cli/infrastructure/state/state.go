@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version is the version of the state file format.
+const Version = 1
+
+// State is the persisted view of the infrastructure of a cluster.
+// It is written after every change, such that the CLI can re-attach to the cluster
+// after it exited or crashed.
+type State struct {
+	Version int `json:"version"`
+	// Provider is the infrastructure backend which created the resources, empty for qemu.
+	Provider       string           `json:"provider,omitempty"`
+	Network        string           `json:"network,omitempty"`
+	Image          string           `json:"image,omitempty"`
+	Pools          []string         `json:"pools,omitempty"`
+	Volumes        []string         `json:"volumes,omitempty"`
+	Nodes          map[string]*Node `json:"nodes,omitempty"`
+	KubeconfigPath string           `json:"kubeconfigPath,omitempty"`
+	JoinToken      *JoinToken       `json:"joinToken,omitempty"`
+	Snapshots      []*Snapshot      `json:"snapshots,omitempty"`
+	// NodeCounts are the numbers of nodes the cluster was created with. They take precedence
+	// over the config, such that later commands see the same cluster as create.
+	NodeCounts *NodeCounts `json:"nodeCounts,omitempty"`
+}
+
+// NodeCounts are the numbers of control plane and worker nodes of a cluster.
+type NodeCounts struct {
+	ControlPlanes int `json:"controlPlanes"`
+	Workers       int `json:"workers"`
+}
+
+// Snapshot is a checkpoint of all nodes of the cluster the cluster can be rolled back to.
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Memory is set if the memory of the nodes was saved, they resume instead of booting after a rollback.
+	Memory    bool             `json:"memory"`
+	Nodes     map[string]*Node `json:"nodes"`
+	JoinToken *JoinToken       `json:"joinToken,omitempty"`
+}
+
+// Node is a single VM of the cluster.
+type Node struct {
+	// ID is the identifier of the VM at a cloud provider.
+	ID           string `json:"id,omitempty"`
+	ControlPlane bool   `json:"controlPlane"`
+	IP           string `json:"ip,omitempty"`
+	// PublicIP is the address the CLI uses to reach the node, if it differs from IP.
+	PublicIP string `json:"publicIP,omitempty"`
+	Volume   string `json:"volume,omitempty"`
+	Joined   bool   `json:"joined"`
+}
+
+// Address returns the address under which the CLI reaches the node.
+func (n *Node) Address() string {
+	if n.PublicIP != "" {
+		return n.PublicIP
+	}
+	return n.IP
+}
+
+// JoinToken contains the information required to join a node into the cluster.
+type JoinToken struct {
+	APIServerEndpoint    string    `json:"apiServerEndpoint"`
+	Token                string    `json:"token"`
+	CACertHash           string    `json:"caCertHash"`
+	Expiry               time.Time `json:"expiry"`
+	CertificateKey       string    `json:"certificateKey,omitempty"`
+	CertificateKeyExpiry time.Time `json:"certificateKeyExpiry,omitempty"`
+}
+
+// Expired returns true if the bootstrap token can no longer be used.
+func (j *JoinToken) Expired(now time.Time) bool {
+	return !now.Before(j.Expiry)
+}
+
+// New returns an empty state.
+func New() *State {
+	return &State{
+		Version: Version,
+		Nodes:   map[string]*Node{},
+	}
+}
+
+// Load reads the state from path. If the file does not exist, an empty state is returned.
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := New()
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parsing state file %s: %w", path, err)
+	}
+	if s.Version != Version {
+		return nil, fmt.Errorf("unsupported state file version %d, expected %d", s.Version, Version)
+	}
+	if s.Nodes == nil {
+		s.Nodes = map[string]*Node{}
+	}
+	return s, nil
+}
+
+// Save writes the state to path. The file is replaced atomically, such that a crash
+// never leaves a truncated state behind.
+func (s *State) Save(path string) (err error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	// the state contains the join token, keep it private.
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Remove deletes the state file at path. A missing file is not an error.
+func Remove(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Snapshot returns the snapshot called name, or nil if there is none.
+func (s *State) Snapshot(name string) *Snapshot {
+	for _, snapshot := range s.Snapshots {
+		if snapshot.Name == name {
+			return snapshot
+		}
+	}
+	return nil
+}
+
+// Empty returns true if no resources are recorded in the state.
+func (s *State) Empty() bool {
+	return s.Network == "" && s.Image == "" && len(s.Pools) == 0 && len(s.Volumes) == 0 && len(s.Nodes) == 0
+}
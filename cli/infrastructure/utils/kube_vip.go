@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package utils
+
+import (
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// KubeVIPManifestPath is the location of the kube-vip static pod on the control planes.
+	KubeVIPManifestPath = "/etc/kubernetes/manifests"
+	// KubeVIPManifestName is the filename of the kube-vip static pod.
+	KubeVIPManifestName = "kube-vip.yaml"
+	kubeVIPImage        = "ghcr.io/kube-vip/kube-vip:v0.5.7"
+	// the name predictable network interface naming assigns to the virtio NIC of our q35 VMs.
+	kubeVIPInterface = "enp1s0"
+)
+
+// KubeVIPYAML contains the static pod which announces the API server VIP via ARP.
+type KubeVIPYAML struct {
+	Pod coreAPI.Pod
+}
+
+// KubeVIPConfiguration returns the kube-vip static pod for the given virtual IP.
+// kube-vip uses leader election through the local API server, such that only one control plane
+// answers ARP requests for the VIP at a time.
+func KubeVIPConfiguration(vip string) KubeVIPYAML {
+	hostPathFile := coreAPI.HostPathFile
+	return KubeVIPYAML{
+		Pod: coreAPI.Pod{
+			TypeMeta: metaAPI.TypeMeta{
+				Kind:       "Pod",
+				APIVersion: coreAPI.SchemeGroupVersion.Version,
+			},
+			ObjectMeta: metaAPI.ObjectMeta{
+				Name:      "kube-vip",
+				Namespace: "kube-system",
+			},
+			Spec: coreAPI.PodSpec{
+				HostNetwork: true,
+				Containers: []coreAPI.Container{
+					{
+						Name:  "kube-vip",
+						Image: kubeVIPImage,
+						Args:  []string{"manager"},
+						Env: []coreAPI.EnvVar{
+							{Name: "address", Value: vip},
+							{Name: "port", Value: "6443"},
+							{Name: "vip_arp", Value: "true"},
+							{Name: "vip_interface", Value: kubeVIPInterface},
+							{Name: "vip_cidr", Value: "32"},
+							{Name: "cp_enable", Value: "true"},
+							{Name: "cp_namespace", Value: "kube-system"},
+							{Name: "vip_leaderelection", Value: "true"},
+							{Name: "vip_leaseduration", Value: "5"},
+							{Name: "vip_renewdeadline", Value: "3"},
+							{Name: "vip_retryperiod", Value: "1"},
+						},
+						SecurityContext: &coreAPI.SecurityContext{
+							Capabilities: &coreAPI.Capabilities{
+								Add: []coreAPI.Capability{
+									"NET_ADMIN",
+									"NET_RAW",
+								},
+							},
+						},
+						VolumeMounts: []coreAPI.VolumeMount{
+							{
+								Name:      "kubeconfig",
+								MountPath: "/etc/kubernetes/admin.conf",
+							},
+						},
+					},
+				},
+				Volumes: []coreAPI.Volume{
+					{
+						Name: "kubeconfig",
+						VolumeSource: coreAPI.VolumeSource{
+							HostPath: &coreAPI.HostPathVolumeSource{
+								Path: "/etc/kubernetes/admin.conf",
+								Type: &hostPathFile,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
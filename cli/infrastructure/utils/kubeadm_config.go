@@ -6,6 +6,9 @@
 package utils
 
 import (
+	"net"
+	"strconv"
+
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubeletconf "k8s.io/kubelet/config/v1beta1"
 	kubeadm "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm/v1beta3"
@@ -62,3 +65,22 @@ func InitConfiguration() KubeadmInitYAML {
 		},
 	}
 }
+
+// SetControlPlaneEndpoint sets the shared endpoint of all control planes and adds it to the
+// certificate SANs of the API server.
+func (k *KubeadmInitYAML) SetControlPlaneEndpoint(host string) {
+	port := strconv.Itoa(int(k.InitConfiguration.LocalAPIEndpoint.BindPort))
+	k.ClusterConfiguration.ControlPlaneEndpoint = net.JoinHostPort(host, port)
+	k.ClusterConfiguration.APIServer.CertSANs = append(k.ClusterConfiguration.APIServer.CertSANs, host)
+}
+
+// SetKubernetesVersion sets the version of the control plane. kubeadm uses its own version if it is empty.
+func (k *KubeadmInitYAML) SetKubernetesVersion(version string) {
+	k.ClusterConfiguration.KubernetesVersion = version
+}
+
+// SetNetworking sets the subnets of the pods and services. Empty subnets keep the kubeadm defaults.
+func (k *KubeadmInitYAML) SetNetworking(podSubnet, serviceSubnet string) {
+	k.ClusterConfiguration.Networking.PodSubnet = podSubnet
+	k.ClusterConfiguration.Networking.ServiceSubnet = serviceSubnet
+}
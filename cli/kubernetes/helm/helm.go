@@ -2,6 +2,7 @@ package helm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,17 +10,17 @@ import (
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/storage/driver"
 )
 
-// Install installs the given helm chart.
-func Install(ctx context.Context, logger *zap.Logger, name string) error {
-	chartPath := "/home/bschlueter/University/Github/delegatio/cli/kubernetes/helm/charts/" + name
+// Install installs the helm chart at chartPath as release name. Nothing is done if the release already exists.
+func Install(ctx context.Context, logger *zap.Logger, name, chartPath, kubeconfigPath string) error {
 	chart, err := loader.Load(chartPath)
 	if err != nil {
 		return err
 	}
 	settings := cli.New()
-	settings.KubeConfig = "admin.conf"
+	settings.KubeConfig = kubeconfigPath
 
 	actionConfig := new(action.Configuration)
 	if err := actionConfig.Init(settings.RESTClientGetter(), "kube-system", "secret", func(format string, v ...interface{}) {
@@ -28,10 +29,20 @@ func Install(ctx context.Context, logger *zap.Logger, name string) error {
 		return err
 	}
 
+	// the CLI re-attaches to existing clusters, the chart might be installed already.
+	history, err := action.NewHistory(actionConfig).Run(name)
+	if err != nil && !errors.Is(err, driver.ErrReleaseNotFound) {
+		return err
+	}
+	if len(history) > 0 {
+		logger.Info("helm release already installed", zap.String("name", history[len(history)-1].Name))
+		return nil
+	}
+
 	iCli := action.NewInstall(actionConfig)
 	iCli.Timeout = 2 * time.Minute
-	iCli.ReleaseName = "cilium"
-	iCli.Namespace = "cilium"
+	iCli.ReleaseName = name
+	iCli.Namespace = name
 	iCli.CreateNamespace = true
 	rel, err := iCli.RunWithContext(ctx, chart, nil)
 	if err != nil {
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	coreAPI "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAddDataToConfigMap(t *testing.T) {
+	configMap := func(data map[string]string) *coreAPI.ConfigMap {
+		return &coreAPI.ConfigMap{
+			ObjectMeta: metaAPI.ObjectMeta{Name: "tcp-services", Namespace: "ingress-nginx"},
+			Data:       data,
+		}
+	}
+	testCases := map[string]struct {
+		existing  *coreAPI.ConfigMap
+		updateErr error
+		wantData  map[string]string
+		wantErr   func(error) bool
+	}{
+		"empty config map": {
+			existing: configMap(nil),
+			wantData: map[string]string{"22": "user"},
+		},
+		"existing data is kept": {
+			existing: configMap(map[string]string{"80": "web"}),
+			wantData: map[string]string{"22": "user", "80": "web"},
+		},
+		"existing key is replaced": {
+			existing: configMap(map[string]string{"22": "other"}),
+			wantData: map[string]string{"22": "user"},
+		},
+		"config map not found": {
+			wantErr: errors.IsNotFound,
+		},
+		"update conflicts": {
+			existing:  configMap(map[string]string{"80": "web"}),
+			updateErr: errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "tcp-services", nil),
+			wantData:  map[string]string{"80": "web"},
+			wantErr:   errors.IsConflict,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tc.existing != nil {
+				objects = append(objects, tc.existing)
+			}
+			client, clientset := newTestClient(t, objects...)
+			if tc.updateErr != nil {
+				clientset.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tc.updateErr
+				})
+			}
+			ctx := context.Background()
+			err := client.AddDataToConfigMap(ctx, "tcp-services", "ingress-nginx", "22", "user")
+			if tc.wantErr != nil {
+				if !tc.wantErr(err) {
+					t.Fatalf("got unexpected error %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if tc.existing == nil {
+				return
+			}
+			got, err := clientset.CoreV1().ConfigMaps("ingress-nginx").Get(ctx, "tcp-services", metaAPI.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Data, tc.wantData) {
+				t.Errorf("got data %v, want %v", got.Data, tc.wantData)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapio"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubectl/pkg/drain"
+)
+
+// DrainNode cordons the node and evicts all pods except the ones of daemonsets, like kubectl drain.
+func (k *Client) DrainNode(ctx context.Context, nodeName string, timeout time.Duration) error {
+	node, err := k.client.CoreV1().Nodes().Get(ctx, nodeName, metaAPI.GetOptions{})
+	if err != nil {
+		return err
+	}
+	out := &zapio.Writer{Log: k.logger, Level: zap.InfoLevel}
+	defer out.Close()
+	helper := &drain.Helper{
+		Ctx:    ctx,
+		Client: k.client,
+		// the students' statefulsets are recreated on another node.
+		Force:               true,
+		GracePeriodSeconds:  -1,
+		IgnoreAllDaemonSets: true,
+		DeleteEmptyDirData:  true,
+		Timeout:             timeout,
+		Out:                 out,
+		ErrOut:              out,
+	}
+	if err := drain.RunCordonOrUncordon(helper, node, true); err != nil {
+		return err
+	}
+	k.logger.Info("node cordoned", zap.String("node", nodeName))
+	return drain.RunNodeDrain(helper, nodeName)
+}
+
+// DeleteNode removes the node object from the cluster.
+func (k *Client) DeleteNode(ctx context.Context, nodeName string) error {
+	return k.client.CoreV1().Nodes().Delete(ctx, nodeName, metaAPI.DeleteOptions{})
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 
 	networkAPI "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -64,10 +65,11 @@ func (k *Client) CreateIngress(ctx context.Context, namespace, userID string) er
 			IngressClassName: &className,
 		},
 	}
-	if err := k.CreateNamespace(ctx, "ingress-nginx"); err != nil {
+	// The namespace and the configmap of the ingress controller are shared by all users.
+	if err := k.CreateNamespace(ctx, "ingress-nginx"); err != nil && !errors.IsAlreadyExists(err) {
 		return err
 	}
-	if err := k.CreateConfigMap(ctx, "tcp-services", "ingress-nginx"); err != nil {
+	if err := k.CreateConfigMap(ctx, "tcp-services", "ingress-nginx"); err != nil && !errors.IsAlreadyExists(err) {
 		return err
 	}
 	if err := k.AddDataToConfigMap(ctx, "tcp-services", "ingress-nginx", "22", namespace+"/"+userID+"-service"+":"+"22"); err != nil {
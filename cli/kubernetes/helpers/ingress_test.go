@@ -0,0 +1,51 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers_test
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCreateIngress(t *testing.T) {
+	client, clientset := newTestClient(t)
+	ctx := context.Background()
+	if err := client.CreateIngress(ctx, "testchallenge1", "user1"); err != nil {
+		t.Fatalf("creating the first ingress: %v", err)
+	}
+	ingress, err := clientset.NetworkingV1().Ingresses("testchallenge1").Get(ctx, "ingressuser1", metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatalf("ingress not created: %v", err)
+	}
+	if class := ingress.Spec.IngressClassName; class == nil || *class != "nginx" {
+		t.Errorf("got ingress class %v, want nginx", class)
+	}
+	backend := ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service
+	if backend.Name != "user1-service" || backend.Port.Number != 22 {
+		t.Errorf("got backend %+v, want port 22 of user1-service", backend)
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("ingress-nginx").Get(ctx, "tcp-services", metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatalf("tcp services not configured: %v", err)
+	}
+	if got, want := cm.Data["22"], "testchallenge1/user1-service:22"; got != want {
+		t.Errorf("got tcp service %q, want %q", got, want)
+	}
+
+	// The namespace and the config map of the ingress controller already exist for the second user.
+	if err := client.CreateIngress(ctx, "testchallenge1", "user2"); err != nil {
+		t.Fatalf("creating the second ingress: %v", err)
+	}
+	if _, err := clientset.NetworkingV1().Ingresses("testchallenge1").Get(ctx, "ingressuser2", metaAPI.GetOptions{}); err != nil {
+		t.Fatalf("second ingress not created: %v", err)
+	}
+
+	if err := client.CreateIngress(ctx, "testchallenge1", "user1"); !errors.IsAlreadyExists(err) {
+		t.Fatalf("creating an ingress twice: got %v, want AlreadyExists", err)
+	}
+}
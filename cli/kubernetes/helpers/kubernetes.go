@@ -8,6 +8,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/benschlueter/delegatio/cli/config"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
 	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -21,25 +22,42 @@ type Client struct {
 	client     kubernetes.Interface
 	logger     *zap.Logger
 	restClient *rest.Config
+	config     *config.Config
 }
 
-// NewClient returns a new kuberenetes client-go wrapper.
-func NewClient(kubeconfigPath string, logger *zap.Logger) (*Client, error) {
-	// use the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+// NewClient returns a new kuberenetes client-go wrapper. Without kubeconfigPath the client uses
+// the service account of the pod it runs in.
+func NewClient(kubeconfigPath string, cfg *config.Config, logger *zap.Logger) (*Client, error) {
+	restConfig, err := restConfig(kubeconfigPath)
 	if err != nil {
 		return nil, err
 	}
 	// create the clientset
-	client, err := kubernetes.NewForConfig(config)
+	client, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
 		return nil, err
 	}
+	k := NewClientWithInterface(client, cfg, logger)
+	k.restClient = restConfig
+	return k, nil
+}
+
+func restConfig(kubeconfigPath string) (*rest.Config, error) {
+	if kubeconfigPath == "" {
+		return rest.InClusterConfig()
+	}
+	// use the current context in kubeconfig
+	return clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+}
+
+// NewClientWithInterface returns a kubernetes client-go wrapper around an existing clientset,
+// i.e. the fake clientset of client-go. Shells in pods are not supported without a rest config.
+func NewClientWithInterface(client kubernetes.Interface, cfg *config.Config, logger *zap.Logger) *Client {
 	return &Client{
-		client:     client,
-		logger:     logger,
-		restClient: config,
-	}, nil
+		client: client,
+		logger: logger,
+		config: cfg,
+	}
 }
 
 // GetClient returns the kubernetes client.
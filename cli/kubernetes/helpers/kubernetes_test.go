@@ -0,0 +1,35 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/kubernetes/helpers"
+	"go.uber.org/zap/zaptest"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestClient returns a client backed by a fake clientset which contains objects.
+func newTestClient(t *testing.T, objects ...runtime.Object) (*helpers.Client, *fake.Clientset) {
+	t.Helper()
+	clientset := fake.NewSimpleClientset(objects...)
+	return helpers.NewClientWithInterface(clientset, config.Default(), zaptest.NewLogger(t)), clientset
+}
+
+func TestNewClientWithInterface(t *testing.T) {
+	client, clientset := newTestClient(t)
+	if client.GetClient() != clientset {
+		t.Fatal("the client does not use the given clientset")
+	}
+	var stdout, stderr bytes.Buffer
+	if err := client.CreatePodShell(context.Background(), "default", "pod", nil, &stdout, &stderr, nil); err == nil {
+		t.Fatal("a shell was created without a rest config")
+	}
+}
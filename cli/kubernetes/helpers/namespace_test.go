@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers_test
+
+import (
+	"context"
+	"testing"
+
+	coreAPI "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCreateNamespace(t *testing.T) {
+	client, clientset := newTestClient(t)
+	ctx := context.Background()
+	if err := client.CreateNamespace(ctx, "testchallenge1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().Namespaces().Get(ctx, "testchallenge1", metaAPI.GetOptions{}); err != nil {
+		t.Fatalf("namespace not created: %v", err)
+	}
+	if err := client.CreateNamespace(ctx, "testchallenge1"); !errors.IsAlreadyExists(err) {
+		t.Fatalf("creating the namespace twice: got %v, want AlreadyExists", err)
+	}
+}
+
+func TestNamespaceExists(t *testing.T) {
+	existing := &coreAPI.Namespace{ObjectMeta: metaAPI.ObjectMeta{Name: "testchallenge1"}}
+	testCases := map[string]struct {
+		namespace  string
+		getErr     error
+		wantExists bool
+		wantErr    bool
+	}{
+		"exists": {
+			namespace:  "testchallenge1",
+			wantExists: true,
+		},
+		"not found": {
+			namespace: "testchallenge2",
+		},
+		"api error": {
+			namespace: "testchallenge1",
+			getErr:    errors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "testchallenge1", nil),
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			client, clientset := newTestClient(t, existing)
+			if tc.getErr != nil {
+				clientset.PrependReactor("get", "namespaces", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tc.getErr
+				})
+			}
+			exists, err := client.NamespaceExists(context.Background(), tc.namespace)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if exists != tc.wantExists {
+				t.Errorf("got exists %v, want %v", exists, tc.wantExists)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers
+
+import (
+	"context"
+	"fmt"
+
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ListNodes returns all nodes of the cluster.
+func (k *Client) ListNodes(ctx context.Context) ([]coreAPI.Node, error) {
+	nodeList, err := k.client.CoreV1().Nodes().List(ctx, metaAPI.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return nodeList.Items, nil
+}
+
+// GetNodeByInternalIP returns the node with the given address. The nodes are named after
+// the random hostnames of the VMs, the address is the only link to the infrastructure.
+func (k *Client) GetNodeByInternalIP(ctx context.Context, ip string) (*coreAPI.Node, error) {
+	nodes, err := k.ListNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range nodes {
+		for _, addr := range nodes[i].Status.Addresses {
+			if addr.Type == coreAPI.NodeInternalIP && addr.Address == ip {
+				return &nodes[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no node with address %s", ip)
+}
@@ -15,6 +15,10 @@ import (
 // CreatePersistentVolume creates a persistent volume.
 func (k *Client) CreatePersistentVolume(ctx context.Context, namespace, name string) error {
 	secretNamespace := "default"
+	storageSize, err := resource.ParseQuantity(k.config.Storage.Size)
+	if err != nil {
+		return err
+	}
 	pVolume := coreAPI.PersistentVolume{
 		TypeMeta: v1.TypeMeta{
 			Kind:       "PersistentVolume",
@@ -26,9 +30,9 @@ func (k *Client) CreatePersistentVolume(ctx context.Context, namespace, name str
 		},
 		Spec: coreAPI.PersistentVolumeSpec{
 			Capacity: coreAPI.ResourceList{
-				coreAPI.ResourceStorage: resource.MustParse("5Gi"),
+				coreAPI.ResourceStorage: storageSize,
 			},
-			StorageClassName: "azurefile-csi",
+			StorageClassName: k.config.Storage.StorageClass,
 			AccessModes: []coreAPI.PersistentVolumeAccessMode{
 				coreAPI.ReadWriteMany,
 			},
@@ -44,7 +48,7 @@ func (k *Client) CreatePersistentVolume(ctx context.Context, namespace, name str
 		},
 	}
 
-	_, err := k.client.CoreV1().PersistentVolumes().Create(ctx, &pVolume, v1.CreateOptions{})
+	_, err = k.client.CoreV1().PersistentVolumes().Create(ctx, &pVolume, v1.CreateOptions{})
 	if err != nil {
 		return err
 	}
@@ -14,7 +14,11 @@ import (
 
 // CreatePersistentVolumeClaim creates a persistent volume claim.
 func (k *Client) CreatePersistentVolumeClaim(ctx context.Context, namespace, name string) error {
-	stclass := "azurefile-csi"
+	stclass := k.config.Storage.StorageClass
+	storageSize, err := resource.ParseQuantity(k.config.Storage.Size)
+	if err != nil {
+		return err
+	}
 	pVolumeClaim := coreAPI.PersistentVolumeClaim{
 		TypeMeta: v1.TypeMeta{
 			Kind:       "PersistentVolumeClaim",
@@ -32,13 +36,13 @@ func (k *Client) CreatePersistentVolumeClaim(ctx context.Context, namespace, nam
 			StorageClassName: &stclass,
 			Resources: coreAPI.ResourceRequirements{
 				Requests: coreAPI.ResourceList{
-					coreAPI.ResourceStorage: resource.MustParse("5Gi"),
+					coreAPI.ResourceStorage: storageSize,
 				},
 			},
 		},
 	}
 
-	_, err := k.client.CoreV1().PersistentVolumeClaims(namespace).Create(ctx, &pVolumeClaim, v1.CreateOptions{})
+	_, err = k.client.CoreV1().PersistentVolumeClaims(namespace).Create(ctx, &pVolumeClaim, v1.CreateOptions{})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coreAPI "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/kubernetes/pkg/client/conditions"
+)
+
+func TestWaitForPodRunning(t *testing.T) {
+	pod := func(phase coreAPI.PodPhase) *coreAPI.Pod {
+		return &coreAPI.Pod{
+			ObjectMeta: metaAPI.ObjectMeta{Name: "user1-statefulset-0", Namespace: "testchallenge1"},
+			Status:     coreAPI.PodStatus{Phase: phase},
+		}
+	}
+	testCases := map[string]struct {
+		existing *coreAPI.Pod
+		getErr   error
+		wantErr  error
+	}{
+		"running": {
+			existing: pod(coreAPI.PodRunning),
+		},
+		"pending": {
+			existing: pod(coreAPI.PodPending),
+			wantErr:  wait.ErrWaitTimeout,
+		},
+		"not found": {
+			wantErr: wait.ErrWaitTimeout,
+		},
+		"failed": {
+			existing: pod(coreAPI.PodFailed),
+			wantErr:  conditions.ErrPodCompleted,
+		},
+		"completed": {
+			existing: pod(coreAPI.PodSucceeded),
+			wantErr:  conditions.ErrPodCompleted,
+		},
+		"api error": {
+			getErr:  errors.NewForbidden(schema.GroupResource{Resource: "pods"}, "user1-statefulset-0", nil),
+			wantErr: errors.NewForbidden(schema.GroupResource{Resource: "pods"}, "user1-statefulset-0", nil),
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tc.existing != nil {
+				objects = append(objects, tc.existing)
+			}
+			client, clientset := newTestClient(t, objects...)
+			if tc.getErr != nil {
+				clientset.PrependReactor("get", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tc.getErr
+				})
+			}
+			err := client.WaitForPodRunning(context.Background(), "testchallenge1", "user1", 10*time.Millisecond)
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantErr.Error() {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"go.uber.org/zap"
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	rbacAPI "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// RelayName is the name of the deployment, the service and the service account of the relay.
+	RelayName = "ssh-relay"
+	// relayClusterRole grants the relay access to the challenges, it is cluster wide because
+	// the relay creates the namespaces of the challenges.
+	relayClusterRole = "delegatio-ssh-relay"
+	// RelayConfigKey is the key of the config file in the config map of the relay.
+	RelayConfigKey = "delegatio.yaml"
+	// RelayHostKeySecret contains the host key of the relay, it is kept across deployments.
+	RelayHostKeySecret = "ssh-relay-host-key"
+	// RelayHostKeyKey is the key of the host key in RelayHostKeySecret.
+	RelayHostKeyKey = "ssh_host_ed25519_key"
+	// RelayStoreTLSSecret contains the client certificate of the relays for the store.
+	RelayStoreTLSSecret = "ssh-relay-store-tls"
+	// relayConfigChecksum is the annotation which restarts the relays if their config changes.
+	relayConfigChecksum = "delegatio/config-checksum"
+	relayConfigDir      = "/etc/delegatio/config"
+	relayHostKeyDir     = "/etc/delegatio/ssh"
+	relayStoreTLSDir    = "/etc/delegatio/store"
+	// relayUser is the nonroot user of the distroless image of the relay.
+	relayUser = 65532
+	// relayServicePort is the port of the service in front of the relays.
+	relayServicePort = 22
+)
+
+// DeployRelay runs the ssh relay inside of the cluster as described by ssh.deployment of the
+// config. It creates the namespace, the service account and its roles, the host key, the
+// config, the deployment and the service of the relay. Existing resources are updated, an
+// existing host key is kept.
+func (k *Client) DeployRelay(ctx context.Context) error {
+	d := k.config.SSH.Deployment
+	_, portString, err := net.SplitHostPort(k.config.SSH.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("ssh.listenAddress: %w", err)
+	}
+	port, err := strconv.ParseInt(portString, 10, 32)
+	if err != nil {
+		return fmt.Errorf("ssh.listenAddress: %w", err)
+	}
+	relayConfig, err := k.relayConfig()
+	if err != nil {
+		return err
+	}
+	storeTLS, err := relayStoreTLS(k.config.SSH.Store)
+	if err != nil {
+		return fmt.Errorf("reading the certificates of the store: %w", err)
+	}
+
+	exists, err := k.NamespaceExists(ctx, d.Namespace)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := k.CreateNamespace(ctx, d.Namespace); err != nil {
+			return err
+		}
+	}
+	if err := k.applyRelayRBAC(ctx); err != nil {
+		return fmt.Errorf("creating the roles of the relay: %w", err)
+	}
+	if err := k.createRelayHostKey(ctx); err != nil {
+		return fmt.Errorf("creating the host key of the relay: %w", err)
+	}
+	if err := k.applyConfigMap(ctx, &coreAPI.ConfigMap{
+		ObjectMeta: relayMeta(RelayName+"-config", d.Namespace),
+		Data:       map[string]string{RelayConfigKey: string(relayConfig)},
+	}); err != nil {
+		return fmt.Errorf("creating the config of the relay: %w", err)
+	}
+	checksum := sha256.New()
+	checksum.Write(relayConfig)
+	if storeTLS != nil {
+		if err := k.applySecret(ctx, &coreAPI.Secret{
+			ObjectMeta: relayMeta(RelayStoreTLSSecret, d.Namespace),
+			Type:       coreAPI.SecretTypeOpaque,
+			Data:       storeTLS,
+		}); err != nil {
+			return fmt.Errorf("creating the store certificates of the relay: %w", err)
+		}
+		// A new certificate restarts the relays as well.
+		for _, key := range []string{relayStoreCAKey, relayStoreCertKey, relayStoreKeyKey} {
+			checksum.Write(storeTLS[key])
+		}
+	}
+	if err := k.applyDeployment(ctx, relayDeployment(d, int32(port), hex.EncodeToString(checksum.Sum(nil)), storeTLS != nil)); err != nil {
+		return fmt.Errorf("creating the deployment of the relay: %w", err)
+	}
+	service, err := k.applyRelayService(ctx, int32(port))
+	if err != nil {
+		return fmt.Errorf("creating the service of the relay: %w", err)
+	}
+	k.logger.Info("ssh relay deployed",
+		zap.String("namespace", d.Namespace),
+		zap.String("serviceType", string(service.Spec.Type)),
+		zap.Int32("nodePort", service.Spec.Ports[0].NodePort),
+	)
+	return nil
+}
+
+// The keys of the files in RelayStoreTLSSecret.
+const (
+	relayStoreCAKey   = "ca.crt"
+	relayStoreCertKey = "tls.crt"
+	relayStoreKeyKey  = "tls.key"
+)
+
+// relayConfig returns the config file of the relays inside of the cluster. They use their
+// service account and the host key and store certificates of the secrets.
+func (k *Client) relayConfig() ([]byte, error) {
+	cfg := *k.config
+	cfg.SSH.KubeconfigPath = ""
+	cfg.SSH.HostKeyPath = path.Join(relayHostKeyDir, RelayHostKeyKey)
+	if cfg.SSH.Store.Enabled() {
+		cfg.SSH.Store.ClientTLS = config.TLSFiles{
+			CACert: path.Join(relayStoreTLSDir, relayStoreCAKey),
+			Cert:   path.Join(relayStoreTLSDir, relayStoreCertKey),
+			Key:    path.Join(relayStoreTLSDir, relayStoreKeyKey),
+		}
+	}
+	return yaml.Marshal(cfg)
+}
+
+// relayStoreTLS reads the client certificate of the relays for the store, it returns nil if
+// the relays do not use a store.
+func relayStoreTLS(store config.StoreConfig) (map[string][]byte, error) {
+	if !store.Enabled() {
+		return nil, nil
+	}
+	data := make(map[string][]byte, 3)
+	for key, file := range map[string]string{
+		relayStoreCAKey:   store.ClientTLS.CACert,
+		relayStoreCertKey: store.ClientTLS.Cert,
+		relayStoreKeyKey:  store.ClientTLS.Key,
+	} {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		data[key] = content
+	}
+	return data, nil
+}
+
+func relayMeta(name, namespace string) metaAPI.ObjectMeta {
+	return metaAPI.ObjectMeta{
+		Name:      name,
+		Namespace: namespace,
+		Labels: map[string]string{
+			"app.kubernetes.io/name":       RelayName,
+			"app.kubernetes.io/managed-by": "delegatio",
+		},
+	}
+}
+
+// relayRules are the permissions the relay needs to create the resources of a student and
+// to open a shell in their pod.
+func relayRules() []rbacAPI.PolicyRule {
+	return []rbacAPI.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"get", "create"}},
+		{APIGroups: []string{""}, Resources: []string{"services"}, Verbs: []string{"create"}},
+		{APIGroups: []string{"apps"}, Resources: []string{"statefulsets"}, Verbs: []string{"get", "create"}},
+		{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}},
+		// The SPDY executor opens shells with a POST.
+		{APIGroups: []string{""}, Resources: []string{"pods/exec"}, Verbs: []string{"create"}},
+	}
+}
+
+// applyRelayRBAC creates the service account of the relay and binds it to its roles. With the
+// kubernetes user source the relay may additionally read and watch the users config map.
+func (k *Client) applyRelayRBAC(ctx context.Context) error {
+	namespace := k.config.SSH.Deployment.Namespace
+	serviceAccount := &coreAPI.ServiceAccount{ObjectMeta: relayMeta(RelayName, namespace)}
+	if _, err := k.client.CoreV1().ServiceAccounts(namespace).Create(ctx, serviceAccount, metaAPI.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	subjects := []rbacAPI.Subject{{Kind: rbacAPI.ServiceAccountKind, Name: RelayName, Namespace: namespace}}
+
+	clusterRole := &rbacAPI.ClusterRole{ObjectMeta: relayMeta(relayClusterRole, ""), Rules: relayRules()}
+	if _, err := k.client.RbacV1().ClusterRoles().Create(ctx, clusterRole, metaAPI.CreateOptions{}); errors.IsAlreadyExists(err) {
+		_, err = k.client.RbacV1().ClusterRoles().Update(ctx, clusterRole, metaAPI.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	clusterRoleBinding := &rbacAPI.ClusterRoleBinding{
+		ObjectMeta: relayMeta(relayClusterRole, ""),
+		RoleRef:    rbacAPI.RoleRef{APIGroup: rbacAPI.GroupName, Kind: "ClusterRole", Name: relayClusterRole},
+		Subjects:   subjects,
+	}
+	if _, err := k.client.RbacV1().ClusterRoleBindings().Create(ctx, clusterRoleBinding, metaAPI.CreateOptions{}); errors.IsAlreadyExists(err) {
+		_, err = k.client.RbacV1().ClusterRoleBindings().Update(ctx, clusterRoleBinding, metaAPI.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	users := k.config.SSH.Users
+	if users.Source != config.UserSourceKubernetes {
+		return nil
+	}
+	role := &rbacAPI.Role{
+		ObjectMeta: relayMeta(RelayName+"-users", users.Namespace),
+		Rules: []rbacAPI.PolicyRule{{
+			APIGroups:     []string{""},
+			Resources:     []string{"configmaps"},
+			ResourceNames: []string{users.ConfigMap},
+			Verbs:         []string{"get", "list", "watch"},
+		}},
+	}
+	if _, err := k.client.RbacV1().Roles(users.Namespace).Create(ctx, role, metaAPI.CreateOptions{}); errors.IsAlreadyExists(err) {
+		_, err = k.client.RbacV1().Roles(users.Namespace).Update(ctx, role, metaAPI.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	roleBinding := &rbacAPI.RoleBinding{
+		ObjectMeta: relayMeta(RelayName+"-users", users.Namespace),
+		RoleRef:    rbacAPI.RoleRef{APIGroup: rbacAPI.GroupName, Kind: "Role", Name: RelayName + "-users"},
+		Subjects:   subjects,
+	}
+	if _, err := k.client.RbacV1().RoleBindings(users.Namespace).Create(ctx, roleBinding, metaAPI.CreateOptions{}); errors.IsAlreadyExists(err) {
+		_, err = k.client.RbacV1().RoleBindings(users.Namespace).Update(ctx, roleBinding, metaAPI.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// createRelayHostKey generates the host key of the relay unless the secret exists, so the
+// students do not see a new host key after a redeployment.
+func (k *Client) createRelayHostKey(ctx context.Context) error {
+	namespace := k.config.SSH.Deployment.Namespace
+	_, err := k.client.CoreV1().Secrets(namespace).Get(ctx, RelayHostKeySecret, metaAPI.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	secret := &coreAPI.Secret{
+		ObjectMeta: relayMeta(RelayHostKeySecret, namespace),
+		Type:       coreAPI.SecretTypeOpaque,
+		Data: map[string][]byte{
+			RelayHostKeyKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		},
+	}
+	_, err = k.client.CoreV1().Secrets(namespace).Create(ctx, secret, metaAPI.CreateOptions{})
+	return err
+}
+
+func (k *Client) applyConfigMap(ctx context.Context, configMap *coreAPI.ConfigMap) error {
+	_, err := k.client.CoreV1().ConfigMaps(configMap.Namespace).Create(ctx, configMap, metaAPI.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = k.client.CoreV1().ConfigMaps(configMap.Namespace).Update(ctx, configMap, metaAPI.UpdateOptions{})
+	}
+	return err
+}
+
+func (k *Client) applySecret(ctx context.Context, secret *coreAPI.Secret) error {
+	_, err := k.client.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metaAPI.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = k.client.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metaAPI.UpdateOptions{})
+	}
+	return err
+}
+
+func (k *Client) applyDeployment(ctx context.Context, deployment *appsAPI.Deployment) error {
+	_, err := k.client.AppsV1().Deployments(deployment.Namespace).Create(ctx, deployment, metaAPI.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = k.client.AppsV1().Deployments(deployment.Namespace).Update(ctx, deployment, metaAPI.UpdateOptions{})
+	}
+	return err
+}
+
+// relayDeployment returns the deployment of the relays, which listen on port. The relays are
+// restarted whenever checksum, the checksum of their config, changes. If storeTLS is set,
+// the relays get the certificates of RelayStoreTLSSecret.
+func relayDeployment(d config.RelayDeployment, port int32, checksum string, storeTLS bool) *appsAPI.Deployment {
+	meta := relayMeta(RelayName, d.Namespace)
+	replicas := d.Replicas
+	user := int64(relayUser)
+	yes, no := true, false
+	readOnly := int32(0o440)
+	deployment := &appsAPI.Deployment{
+		ObjectMeta: meta,
+		Spec: appsAPI.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metaAPI.LabelSelector{MatchLabels: map[string]string{"app.kubernetes.io/name": RelayName}},
+			Template: coreAPI.PodTemplateSpec{
+				ObjectMeta: metaAPI.ObjectMeta{
+					Labels:      meta.Labels,
+					Annotations: map[string]string{relayConfigChecksum: checksum},
+				},
+				Spec: coreAPI.PodSpec{
+					ServiceAccountName: RelayName,
+					SecurityContext: &coreAPI.PodSecurityContext{
+						RunAsUser:    &user,
+						RunAsGroup:   &user,
+						RunAsNonRoot: &yes,
+						// The host key is readable by the group of the relay.
+						FSGroup: &user,
+					},
+					Containers: []coreAPI.Container{{
+						Name:  RelayName,
+						Image: d.Image,
+						Args:  []string{"-config", path.Join(relayConfigDir, RelayConfigKey)},
+						Ports: []coreAPI.ContainerPort{{Name: "ssh", ContainerPort: port, Protocol: coreAPI.ProtocolTCP}},
+						ReadinessProbe: &coreAPI.Probe{
+							ProbeHandler: coreAPI.ProbeHandler{TCPSocket: &coreAPI.TCPSocketAction{Port: intstr.FromInt(int(port))}},
+						},
+						SecurityContext: &coreAPI.SecurityContext{
+							AllowPrivilegeEscalation: &no,
+							ReadOnlyRootFilesystem:   &yes,
+							Capabilities:             &coreAPI.Capabilities{Drop: []coreAPI.Capability{"ALL"}},
+						},
+						VolumeMounts: []coreAPI.VolumeMount{
+							{Name: "config", MountPath: relayConfigDir, ReadOnly: true},
+							{Name: "host-key", MountPath: relayHostKeyDir, ReadOnly: true},
+						},
+					}},
+					Volumes: []coreAPI.Volume{
+						{
+							Name: "config",
+							VolumeSource: coreAPI.VolumeSource{
+								ConfigMap: &coreAPI.ConfigMapVolumeSource{LocalObjectReference: coreAPI.LocalObjectReference{Name: RelayName + "-config"}},
+							},
+						},
+						{
+							Name: "host-key",
+							VolumeSource: coreAPI.VolumeSource{
+								Secret: &coreAPI.SecretVolumeSource{SecretName: RelayHostKeySecret, DefaultMode: &readOnly},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if storeTLS {
+		spec := &deployment.Spec.Template.Spec
+		spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, coreAPI.VolumeMount{Name: "store-tls", MountPath: relayStoreTLSDir, ReadOnly: true})
+		spec.Volumes = append(spec.Volumes, coreAPI.Volume{
+			Name: "store-tls",
+			VolumeSource: coreAPI.VolumeSource{
+				Secret: &coreAPI.SecretVolumeSource{SecretName: RelayStoreTLSSecret, DefaultMode: &readOnly},
+			},
+		})
+	}
+	return deployment
+}
+
+// applyRelayService creates or updates the service in front of the relays. An assigned node
+// port is kept unless the config sets one.
+func (k *Client) applyRelayService(ctx context.Context, port int32) (*coreAPI.Service, error) {
+	d := k.config.SSH.Deployment
+	services := k.client.CoreV1().Services(d.Namespace)
+	servicePort := coreAPI.ServicePort{
+		Name:       "ssh",
+		Protocol:   coreAPI.ProtocolTCP,
+		Port:       relayServicePort,
+		TargetPort: intstr.FromInt(int(port)),
+		NodePort:   d.NodePort,
+	}
+	existing, err := services.Get(ctx, RelayName, metaAPI.GetOptions{})
+	if errors.IsNotFound(err) {
+		return services.Create(ctx, &coreAPI.Service{
+			ObjectMeta: relayMeta(RelayName, d.Namespace),
+			Spec: coreAPI.ServiceSpec{
+				Type:     coreAPI.ServiceType(d.ServiceType),
+				Selector: map[string]string{"app.kubernetes.io/name": RelayName},
+				Ports:    []coreAPI.ServicePort{servicePort},
+			},
+		}, metaAPI.CreateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if servicePort.NodePort == 0 && len(existing.Spec.Ports) > 0 {
+		servicePort.NodePort = existing.Spec.Ports[0].NodePort
+	}
+	existing.Spec.Type = coreAPI.ServiceType(d.ServiceType)
+	existing.Spec.Ports = []coreAPI.ServicePort{servicePort}
+	return services.Update(ctx, existing, metaAPI.UpdateOptions{})
+}
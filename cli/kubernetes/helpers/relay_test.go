@@ -0,0 +1,233 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/kubernetes/helpers"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/crypto/ssh"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func relayTestConfig() *config.Config {
+	cfg := config.Default()
+	cfg.SSH.Deployment.Image = "ghcr.io/benschlueter/delegatio/ssh-relay:test"
+	cfg.SSH.Deployment.Replicas = 2
+	cfg.SSH.Users = config.UserStoreConfig{Source: config.UserSourceKubernetes, Namespace: "delegatio", ConfigMap: "users"}
+	return cfg
+}
+
+func TestDeployRelay(t *testing.T) {
+	cfg := relayTestConfig()
+	clientset := fake.NewSimpleClientset()
+	client := helpers.NewClientWithInterface(clientset, cfg, zaptest.NewLogger(t))
+	ctx := context.Background()
+	namespace := cfg.SSH.Deployment.Namespace
+	if err := client.DeployRelay(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metaAPI.GetOptions{}); err != nil {
+		t.Errorf("namespace not created: %v", err)
+	}
+	if _, err := clientset.CoreV1().ServiceAccounts(namespace).Get(ctx, helpers.RelayName, metaAPI.GetOptions{}); err != nil {
+		t.Errorf("service account not created: %v", err)
+	}
+	clusterRole, err := clientset.RbacV1().ClusterRoles().Get(ctx, "delegatio-ssh-relay", metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exec bool
+	for _, rule := range clusterRole.Rules {
+		for _, value := range append(append(rule.Resources, rule.Verbs...), rule.APIGroups...) {
+			if value == "*" {
+				t.Errorf("rule %+v uses a wildcard", rule)
+			}
+		}
+		if reflect.DeepEqual(rule.Resources, []string{"pods/exec"}) && reflect.DeepEqual(rule.Verbs, []string{"create"}) {
+			exec = true
+		}
+	}
+	if !exec {
+		t.Errorf("the relay may not exec in pods: %+v", clusterRole.Rules)
+	}
+	role, err := clientset.RbacV1().Roles("delegatio").Get(ctx, helpers.RelayName+"-users", metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(role.Rules) != 1 || !reflect.DeepEqual(role.Rules[0].ResourceNames, []string{"users"}) {
+		t.Errorf("the relay may read more than the users config map: %+v", role.Rules)
+	}
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, helpers.RelayHostKeySecret, metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ssh.ParsePrivateKey(secret.Data[helpers.RelayHostKeyKey]); err != nil {
+		t.Errorf("invalid host key: %v", err)
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, helpers.RelayName+"-config", metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayCfg := config.Default()
+	if err := yaml.UnmarshalStrict([]byte(configMap.Data[helpers.RelayConfigKey]), relayCfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := relayCfg.Validate(); err != nil {
+		t.Errorf("invalid config of the relay: %v", err)
+	}
+	if relayCfg.SSH.KubeconfigPath != "" || relayCfg.SSH.HostKeyPath != "/etc/delegatio/ssh/"+helpers.RelayHostKeyKey {
+		t.Errorf("the relay does not use its service account and host key: %+v", relayCfg.SSH)
+	}
+
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, helpers.RelayName, metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 2 || deployment.Spec.Template.Spec.ServiceAccountName != helpers.RelayName {
+		t.Errorf("deployment %+v does not match the config", deployment.Spec)
+	}
+	if container := deployment.Spec.Template.Spec.Containers[0]; container.Image != cfg.SSH.Deployment.Image || container.Ports[0].ContainerPort != 2200 {
+		t.Errorf("container %+v does not match the config", container)
+	}
+	service, err := clientset.CoreV1().Services(namespace).Get(ctx, helpers.RelayName, metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Type != coreAPI.ServiceTypeNodePort || service.Spec.Ports[0].TargetPort.IntValue() != 2200 {
+		t.Errorf("service %+v does not match the config", service.Spec)
+	}
+}
+
+func TestDeployRelayUpdate(t *testing.T) {
+	cfg := relayTestConfig()
+	existing := []runtime.Object{
+		&coreAPI.Secret{
+			ObjectMeta: metaAPI.ObjectMeta{Name: helpers.RelayHostKeySecret, Namespace: cfg.SSH.Deployment.Namespace},
+			Data:       map[string][]byte{helpers.RelayHostKeyKey: []byte("existing")},
+		},
+		&coreAPI.Service{
+			ObjectMeta: metaAPI.ObjectMeta{Name: helpers.RelayName, Namespace: cfg.SSH.Deployment.Namespace},
+			Spec: coreAPI.ServiceSpec{
+				Type:      coreAPI.ServiceTypeNodePort,
+				ClusterIP: "10.96.0.22",
+				Ports:     []coreAPI.ServicePort{{Port: 22, NodePort: 30022}},
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(existing...)
+	ctx := context.Background()
+	namespace := cfg.SSH.Deployment.Namespace
+	if err := helpers.NewClientWithInterface(clientset, cfg, zaptest.NewLogger(t)).DeployRelay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, helpers.RelayName, metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := deployment.Spec.Template.Annotations["delegatio/config-checksum"]
+
+	cfg.SSH.Deployment.ServiceType = config.ServiceTypeLoadBalancer
+	cfg.SSH.Users.ConfigMap = "students"
+	if err := helpers.NewClientWithInterface(clientset, cfg, zaptest.NewLogger(t)).DeployRelay(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, helpers.RelayHostKeySecret, metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data[helpers.RelayHostKeyKey]) != "existing" {
+		t.Error("the existing host key was replaced")
+	}
+	service, err := clientset.CoreV1().Services(namespace).Get(ctx, helpers.RelayName, metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Type != coreAPI.ServiceTypeLoadBalancer || service.Spec.Ports[0].NodePort != 30022 || service.Spec.ClusterIP != "10.96.0.22" {
+		t.Errorf("service %+v was not updated in place", service.Spec)
+	}
+	deployment, err = clientset.AppsV1().Deployments(namespace).Get(ctx, helpers.RelayName, metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deployment.Spec.Template.Annotations["delegatio/config-checksum"] == checksum {
+		t.Error("the relays are not restarted after a change of their config")
+	}
+	role, err := clientset.RbacV1().Roles("delegatio").Get(ctx, helpers.RelayName+"-users", metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(role.Rules[0].ResourceNames, []string{"students"}) {
+		t.Errorf("role %+v was not updated", role.Rules)
+	}
+}
+
+func TestDeployRelayStore(t *testing.T) {
+	cfg := relayTestConfig()
+	dir := t.TempDir()
+	cfg.SSH.Store.Endpoints = []string{"https://etcd-0:2379"}
+	cfg.SSH.Store.ClientTLS = config.TLSFiles{
+		CACert: filepath.Join(dir, "ca.crt"),
+		Cert:   filepath.Join(dir, "relay.crt"),
+		Key:    filepath.Join(dir, "relay.key"),
+	}
+	for _, file := range []string{cfg.SSH.Store.ClientTLS.CACert, cfg.SSH.Store.ClientTLS.Cert, cfg.SSH.Store.ClientTLS.Key} {
+		if err := os.WriteFile(file, []byte(filepath.Base(file)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clientset := fake.NewSimpleClientset()
+	ctx := context.Background()
+	namespace := cfg.SSH.Deployment.Namespace
+	if err := helpers.NewClientWithInterface(clientset, cfg, zaptest.NewLogger(t)).DeployRelay(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, helpers.RelayStoreTLSSecret, metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantData := map[string][]byte{"ca.crt": []byte("ca.crt"), "tls.crt": []byte("relay.crt"), "tls.key": []byte("relay.key")}
+	if !reflect.DeepEqual(secret.Data, wantData) {
+		t.Errorf("got secret %v, want %v", secret.Data, wantData)
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, helpers.RelayName+"-config", metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayCfg := config.Default()
+	if err := yaml.UnmarshalStrict([]byte(configMap.Data[helpers.RelayConfigKey]), relayCfg); err != nil {
+		t.Fatal(err)
+	}
+	if relayCfg.SSH.Store.ClientTLS.Key != "/etc/delegatio/store/tls.key" {
+		t.Errorf("the relay does not use the certificates of the secret: %+v", relayCfg.SSH.Store.ClientTLS)
+	}
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, helpers.RelayName, metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mounted bool
+	for _, volume := range deployment.Spec.Template.Spec.Volumes {
+		if volume.Secret != nil && volume.Secret.SecretName == helpers.RelayStoreTLSSecret {
+			mounted = true
+		}
+	}
+	if !mounted {
+		t.Error("the store certificates are not mounted into the relays")
+	}
+}
@@ -0,0 +1,35 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCreateHeadlessService(t *testing.T) {
+	client, clientset := newTestClient(t)
+	ctx := context.Background()
+	if err := client.CreateHeadlessService(ctx, "testchallenge1", "user1"); err != nil {
+		t.Fatal(err)
+	}
+	service, err := clientset.CoreV1().Services("testchallenge1").Get(ctx, "user1-service", metaAPI.GetOptions{})
+	if err != nil {
+		t.Fatalf("service not created: %v", err)
+	}
+	if service.Spec.ClusterIP != "None" {
+		t.Errorf("got cluster IP %q, want a headless service", service.Spec.ClusterIP)
+	}
+	if want := map[string]string{"app.kubernetes.io/name": "user1"}; !reflect.DeepEqual(service.Spec.Selector, want) {
+		t.Errorf("got selector %v, want %v", service.Spec.Selector, want)
+	}
+	if err := client.CreateHeadlessService(ctx, "testchallenge1", "user1"); !errors.IsAlreadyExists(err) {
+		t.Fatalf("creating the service twice: got %v, want AlreadyExists", err)
+	}
+}
@@ -6,6 +6,7 @@ package helpers
 
 import (
 	"context"
+	"errors"
 	"io"
 
 	"go.uber.org/zap"
@@ -14,18 +15,46 @@ import (
 	"k8s.io/kubectl/pkg/scheme"
 )
 
+// ExecOptions describes a command in a pod.
+type ExecOptions struct {
+	Command []string
+	// TTY allocates a terminal, its output is written to Stdout only.
+	TTY               bool
+	Stdin             io.Reader
+	Stdout            io.Writer
+	Stderr            io.Writer
+	TerminalSizeQueue remotecommand.TerminalSizeQueue
+}
+
 // CreatePodShell creates a shell on the specified pod.
 func (k *Client) CreatePodShell(ctx context.Context, namespace, podName string, stdin io.Reader, stdout io.Writer, stderr io.Writer, resizeQueue remotecommand.TerminalSizeQueue) error {
-	cmd := []string{
-		"bash",
+	return k.ExecInPod(ctx, namespace, podName, ExecOptions{
+		Command:           []string{"bash"},
+		TTY:               true,
+		Stdin:             stdin,
+		Stdout:            stdout,
+		Stderr:            stderr,
+		TerminalSizeQueue: resizeQueue,
+	})
+}
+
+// ExecInPod runs a command in the specified pod until it exits. A non-zero exit status is
+// returned as a k8s.io/client-go/util/exec.CodeExitError.
+func (k *Client) ExecInPod(ctx context.Context, namespace, podName string, opts ExecOptions) error {
+	if k.restClient == nil {
+		return errors.New("shells in pods require a client with a rest config")
+	}
+	stderr := opts.Stderr
+	if opts.TTY {
+		stderr = nil
 	}
 	req := k.client.CoreV1().RESTClient().Post().Resource("pods").Name(podName).Namespace(namespace).SubResource("exec")
 	option := &v1.PodExecOptions{
-		Command: cmd,
-		Stdin:   true,
-		Stdout:  true,
-		Stderr:  true,
-		TTY:     true,
+		Command: opts.Command,
+		Stdin:   opts.Stdin != nil,
+		Stdout:  opts.Stdout != nil,
+		Stderr:  stderr != nil,
+		TTY:     opts.TTY,
 	}
 	req.VersionedParams(
 		option,
@@ -35,12 +64,12 @@ func (k *Client) CreatePodShell(ctx context.Context, namespace, podName string,
 	if err != nil {
 		return err
 	}
-	k.logger.Info("spawning shell in pod", zap.String("name", podName))
+	k.logger.Info("executing in pod", zap.String("name", podName), zap.Strings("command", opts.Command), zap.Bool("tty", opts.TTY))
 	return exec.StreamWithContext(ctx, remotecommand.StreamOptions{
-		Stdin:             stdin,
-		Stdout:            stdout,
+		Stdin:             opts.Stdin,
+		Stdout:            opts.Stdout,
 		Stderr:            stderr,
-		Tty:               true,
-		TerminalSizeQueue: resizeQueue,
+		Tty:               opts.TTY,
+		TerminalSizeQueue: opts.TerminalSizeQueue,
 	})
 }
@@ -18,8 +18,16 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
-// CreateChallengeStatefulSet creates a statefulset.
+// CreateChallengeStatefulSet creates a statefulset with the image of the challenge.
 func (k *Client) CreateChallengeStatefulSet(ctx context.Context, challengeNamespace, userID string) error {
+	challenge, ok := k.config.Challenge(challengeNamespace)
+	if !ok {
+		return fmt.Errorf("challenge %s is not configured", challengeNamespace)
+	}
+	storageSize, err := resource.ParseQuantity(k.config.Storage.Size)
+	if err != nil {
+		return err
+	}
 	sSet := appsAPI.StatefulSet{
 		TypeMeta: metaAPI.TypeMeta{
 			Kind:       "StatefulSet",
@@ -52,7 +60,7 @@ func (k *Client) CreateChallengeStatefulSet(ctx context.Context, challengeNamesp
 					Containers: []coreAPI.Container{
 						{
 							Name:  "archlinux-container-ssh",
-							Image: "ghcr.io/benschlueter/delegatio/archimage:0.1",
+							Image: challenge.Image,
 							TTY:   true,
 							LivenessProbe: &coreAPI.Probe{
 								ProbeHandler: coreAPI.ProbeHandler{
@@ -95,7 +103,7 @@ func (k *Client) CreateChallengeStatefulSet(ctx context.Context, challengeNamesp
 					ObjectMeta: metaAPI.ObjectMeta{
 						Name: "pvc",
 						Annotations: map[string]string{
-							"volume.beta.kubernetes.io/storage-class": "azurefile-csi",
+							"volume.beta.kubernetes.io/storage-class": k.config.Storage.StorageClass,
 						},
 					},
 					Spec: coreAPI.PersistentVolumeClaimSpec{
@@ -104,7 +112,7 @@ func (k *Client) CreateChallengeStatefulSet(ctx context.Context, challengeNamesp
 						},
 						Resources: coreAPI.ResourceRequirements{
 							Requests: coreAPI.ResourceList{
-								coreAPI.ResourceStorage: resource.MustParse("5Gi"),
+								coreAPI.ResourceStorage: storageSize,
 							},
 						},
 					},
@@ -113,10 +121,11 @@ func (k *Client) CreateChallengeStatefulSet(ctx context.Context, challengeNamesp
 		},
 	}
 
-	if err := k.CreateHeadlessService(ctx, challengeNamespace, userID); err != nil {
+	// The service is left behind if the creation of the statefulset failed before.
+	if err := k.CreateHeadlessService(ctx, challengeNamespace, userID); err != nil && !errors.IsAlreadyExists(err) {
 		return err
 	}
-	_, err := k.client.AppsV1().StatefulSets(challengeNamespace).Create(ctx, &sSet, metaAPI.CreateOptions{})
+	_, err = k.client.AppsV1().StatefulSets(challengeNamespace).Create(ctx, &sSet, metaAPI.CreateOptions{})
 
 	return err
 }
@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package helpers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/cli/kubernetes/helpers"
+	"go.uber.org/zap/zaptest"
+	appsAPI "k8s.io/api/apps/v1"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestCreateChallengeStatefulSet(t *testing.T) {
+	existingService := &coreAPI.Service{ObjectMeta: metaAPI.ObjectMeta{Name: "user1-service", Namespace: "testchallenge1"}}
+	existingStatefulSet := &appsAPI.StatefulSet{ObjectMeta: metaAPI.ObjectMeta{Name: "user1-statefulset", Namespace: "testchallenge1"}}
+	testCases := map[string]struct {
+		namespace   string
+		storageSize string
+		existing    []runtime.Object
+		wantErr     bool
+		// wantCreated is set if the call creates the statefulset.
+		wantCreated bool
+	}{
+		"create": {
+			namespace:   "testchallenge1",
+			wantCreated: true,
+		},
+		"service left behind": {
+			namespace:   "testchallenge1",
+			existing:    []runtime.Object{existingService},
+			wantCreated: true,
+		},
+		"statefulset exists": {
+			namespace: "testchallenge1",
+			existing:  []runtime.Object{existingService, existingStatefulSet},
+			wantErr:   true,
+		},
+		"unknown challenge": {
+			namespace: "unknown",
+			wantErr:   true,
+		},
+		"invalid storage size": {
+			namespace:   "testchallenge1",
+			storageSize: "a lot",
+			wantErr:     true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			client, clientset := newTestClient(t, tc.existing...)
+			if tc.storageSize != "" {
+				cfg := config.Default()
+				cfg.Storage.Size = tc.storageSize
+				client = helpers.NewClientWithInterface(clientset, cfg, zaptest.NewLogger(t))
+			}
+			ctx := context.Background()
+			err := client.CreateChallengeStatefulSet(ctx, tc.namespace, "user1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if !tc.wantCreated {
+				return
+			}
+			sSet, err := clientset.AppsV1().StatefulSets(tc.namespace).Get(ctx, "user1-statefulset", metaAPI.GetOptions{})
+			if err != nil {
+				t.Fatalf("statefulset not created: %v", err)
+			}
+			if sSet.Spec.ServiceName != "user1-service" {
+				t.Errorf("got service name %q, want user1-service", sSet.Spec.ServiceName)
+			}
+			if image := sSet.Spec.Template.Spec.Containers[0].Image; image != "ghcr.io/benschlueter/delegatio/archimage:0.1" {
+				t.Errorf("got image %q, want the image of the challenge", image)
+			}
+			claim := sSet.Spec.VolumeClaimTemplates[0]
+			if size := claim.Spec.Resources.Requests[coreAPI.ResourceStorage]; size.String() != "5Gi" {
+				t.Errorf("got storage size %v, want 5Gi", size.String())
+			}
+			if _, err := clientset.CoreV1().Services(tc.namespace).Get(ctx, "user1-service", metaAPI.GetOptions{}); err != nil {
+				t.Errorf("service not created: %v", err)
+			}
+		})
+	}
+}
+
+func TestStatefulSetExists(t *testing.T) {
+	existing := &appsAPI.StatefulSet{ObjectMeta: metaAPI.ObjectMeta{Name: "user1-statefulset", Namespace: "testchallenge1"}}
+	client, _ := newTestClient(t, existing)
+	ctx := context.Background()
+	exists, err := client.StatefulSetExists(ctx, "testchallenge1", "user1")
+	if err != nil || !exists {
+		t.Errorf("existing statefulset: got %v, %v", exists, err)
+	}
+	exists, err = client.StatefulSetExists(ctx, "testchallenge1", "user2")
+	if err != nil || exists {
+		t.Errorf("missing statefulset: got %v, %v", exists, err)
+	}
+	if err := client.WaitForStatefulSet(ctx, "testchallenge1", "user1", 10*time.Millisecond); err != nil {
+		t.Errorf("waiting for an existing statefulset: %v", err)
+	}
+	if err := client.WaitForStatefulSet(ctx, "testchallenge1", "user2", 10*time.Millisecond); err != wait.ErrWaitTimeout {
+		t.Errorf("waiting for a missing statefulset: got %v, want a timeout", err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"time"
 
+	"github.com/benschlueter/delegatio/cli/config"
 	"github.com/benschlueter/delegatio/cli/kubernetes/helm"
 	"github.com/benschlueter/delegatio/cli/kubernetes/helpers"
 	"go.uber.org/zap"
@@ -17,26 +18,35 @@ import (
 
 // Client is the struct used to access kubernetes helpers.
 type Client struct {
-	Client *helpers.Client
-	logger *zap.Logger
+	Client         *helpers.Client
+	logger         *zap.Logger
+	config         *config.Config
+	kubeconfigPath string
 }
 
 // NewK8sClient returns a new kuberenetes client-go wrapper.
-func NewK8sClient(kubeconfigPath string, logger *zap.Logger) (*Client, error) {
+func NewK8sClient(kubeconfigPath string, cfg *config.Config, logger *zap.Logger) (*Client, error) {
 	// use the current context in kubeconfig
-	client, err := helpers.NewClient(kubeconfigPath, logger)
+	client, err := helpers.NewClient(kubeconfigPath, cfg, logger)
 	if err != nil {
 		return nil, err
 	}
 	return &Client{
-		Client: client,
-		logger: logger,
+		Client:         client,
+		logger:         logger,
+		config:         cfg,
+		kubeconfigPath: kubeconfigPath,
 	}, nil
 }
 
 // InstallCilium installs cilium in the cluster.
 func (k *Client) InstallCilium(ctx context.Context) error {
-	return helm.Install(ctx, k.logger.Named("helm"), "cilium")
+	return helm.Install(ctx, k.logger.Named("helm"), "cilium", k.config.Kubernetes.CiliumChartPath, k.kubeconfigPath)
+}
+
+// DeployRelay runs the ssh relay inside of the cluster.
+func (k *Client) DeployRelay(ctx context.Context) error {
+	return k.Client.DeployRelay(ctx)
 }
 
 // CreateAndWaitForRessources creates the ressources for a user in a namespace.
@@ -61,6 +71,11 @@ func (k *Client) CreatePodShell(ctx context.Context, namespace, podName string,
 	return k.Client.CreatePodShell(ctx, namespace, podName, stdin, stdout, stderr, resizeQueue)
 }
 
+// ExecInPod runs a command in the specified pod.
+func (k *Client) ExecInPod(ctx context.Context, namespace, podName string, opts helpers.ExecOptions) error {
+	return k.Client.ExecInPod(ctx, namespace, podName, opts)
+}
+
 // CreatePersistentVolume creates a shell on the specified pod.
 func (k *Client) CreatePersistentVolume(ctx context.Context, namespace, volumeName string) error {
 	/* 	if err := exec.Command("kubectl", "apply", "-f", "secret.yaml").Run(); err != nil {
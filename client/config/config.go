@@ -9,4 +9,6 @@ const (
 	DefaultIP = "0.0.0.0"
 	// PublicAPIport is the port where we can access the public API.
 	PublicAPIport = "9000"
+	// PKIDir is the directory in the image which contains the certificates of the agent.
+	PKIDir = "/etc/delegatio/pki"
 )
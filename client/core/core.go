@@ -5,20 +5,88 @@
 package core
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/benschlueter/delegatio/client/metadata"
 	"go.uber.org/zap"
 )
 
+// ErrNotProvisioned is returned by Provisioned until Provision ran.
+var ErrNotProvisioned = errors.New("the node is not provisioned yet")
+
 // Core is responsible for maintaining state information
-// of the VM-agent. Currently we do not need any state.
+// of the VM-agent. The state is the metadata the node configured itself from.
 type Core struct {
 	zaplogger *zap.Logger
+	host      Host
+	mux       sync.RWMutex
+	metadata  *metadata.Metadata
+	// provisionErr is nil once the node is provisioned.
+	provisionErr error
 }
 
 // NewCore creates and initializes a new Core object.
-func NewCore(zapLogger *zap.Logger) (*Core, error) {
+func NewCore(zapLogger *zap.Logger, host Host) (*Core, error) {
 	c := &Core{
-		zaplogger: zapLogger,
+		zaplogger:    zapLogger,
+		host:         host,
+		provisionErr: ErrNotProvisioned,
 	}
 
 	return c, nil
 }
+
+// Provision configures the node from its metadata. Without metadata the image
+// is expected to contain the configuration and the node is provisioned right away.
+func (c *Core) Provision(md *metadata.Metadata) error {
+	if md == nil {
+		c.zaplogger.Info("no metadata, using the configuration of the image")
+		c.setProvisioned(nil, nil)
+		return nil
+	}
+	c.zaplogger.Info("provisioning the node", zap.String("hostname", md.Hostname), zap.String("role", string(md.Role)))
+	if err := c.host.SetHostname(md.Hostname); err != nil {
+		err = fmt.Errorf("setting the hostname: %w", err)
+		c.setProvisioned(nil, fmt.Errorf("provisioning failed: %w", err))
+		return err
+	}
+	c.setProvisioned(md, nil)
+	c.zaplogger.Info("node provisioned")
+	return nil
+}
+
+// Provisioned returns nil once the node is provisioned, the reason why it is not otherwise.
+func (c *Core) Provisioned() error {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.provisionErr
+}
+
+// Role returns the role of the node, it is empty without metadata.
+func (c *Core) Role() metadata.Role {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.metadata == nil {
+		return ""
+	}
+	return c.metadata.Role
+}
+
+// KubeadmConfig returns the kubeadm configuration of the metadata, nil if there is none.
+func (c *Core) KubeadmConfig() []byte {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.metadata == nil {
+		return nil
+	}
+	return c.metadata.KubeadmConfig
+}
+
+func (c *Core) setProvisioned(md *metadata.Metadata, err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.metadata = md
+	c.provisionErr = err
+}
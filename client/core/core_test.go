@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package core_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/benschlueter/delegatio/client/core"
+	"github.com/benschlueter/delegatio/client/metadata"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeHost records the hostname instead of changing the one of the test machine.
+type fakeHost struct {
+	hostname string
+	err      error
+}
+
+func (h *fakeHost) SetHostname(name string) error {
+	if h.err != nil {
+		return h.err
+	}
+	h.hostname = name
+	return nil
+}
+
+func TestProvision(t *testing.T) {
+	errHostname := errors.New("operation not permitted")
+	testCases := map[string]struct {
+		metadata          *metadata.Metadata
+		hostErr           error
+		wantErr           bool
+		wantHostname      string
+		wantRole          metadata.Role
+		wantKubeadmConfig []byte
+	}{
+		"control plane": {
+			metadata: &metadata.Metadata{
+				Version:       metadata.Version,
+				Hostname:      "delegatio-0",
+				Role:          metadata.RoleControlPlane,
+				KubeadmConfig: []byte("kind: InitConfiguration"),
+			},
+			wantHostname:      "delegatio-0",
+			wantRole:          metadata.RoleControlPlane,
+			wantKubeadmConfig: []byte("kind: InitConfiguration"),
+		},
+		"worker": {
+			metadata:     &metadata.Metadata{Version: metadata.Version, Hostname: "delegatio-1", Role: metadata.RoleWorker},
+			wantHostname: "delegatio-1",
+			wantRole:     metadata.RoleWorker,
+		},
+		"without metadata": {},
+		"hostname fails": {
+			metadata: &metadata.Metadata{Version: metadata.Version, Hostname: "delegatio-1", Role: metadata.RoleWorker},
+			hostErr:  errHostname,
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			host := &fakeHost{err: tc.hostErr}
+			c, err := core.NewCore(zaptest.NewLogger(t), host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Provisioned(); !errors.Is(err, core.ErrNotProvisioned) {
+				t.Fatalf("new core: got %v, want ErrNotProvisioned", err)
+			}
+
+			err = c.Provision(tc.metadata)
+			if tc.wantErr {
+				if !errors.Is(err, tc.hostErr) {
+					t.Fatalf("got error %v, want %v", err, tc.hostErr)
+				}
+				if err := c.Provisioned(); !errors.Is(err, tc.hostErr) {
+					t.Fatalf("failed provisioning: Provisioned returned %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Provisioned(); err != nil {
+				t.Fatalf("Provisioned returned %v", err)
+			}
+			if host.hostname != tc.wantHostname {
+				t.Errorf("hostname %q, want %q", host.hostname, tc.wantHostname)
+			}
+			if c.Role() != tc.wantRole {
+				t.Errorf("role %q, want %q", c.Role(), tc.wantRole)
+			}
+			if !bytes.Equal(c.KubeadmConfig(), tc.wantKubeadmConfig) {
+				t.Errorf("kubeadm config %q, want %q", c.KubeadmConfig(), tc.wantKubeadmConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+const hostnamePath = "/etc/hostname"
+
+// Host is the operating system of the VM. Necessary to stub it for local testing.
+type Host interface {
+	SetHostname(name string) error
+}
+
+// OSHost is the operating system of the VM.
+type OSHost struct{}
+
+// SetHostname sets the hostname of the running system and persists it for the next boot.
+func (OSHost) SetHostname(name string) error {
+	if err := syscall.Sethostname([]byte(name)); err != nil {
+		return err
+	}
+	return os.WriteFile(hostnamePath, []byte(name+"\n"), 0o644)
+}
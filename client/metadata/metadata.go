@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package metadata describes the data the infrastructure hands to every node at boot.
+// The agent configures the node from it instead of relying on state baked into the image.
+// On QEMU the metadata is a JSON document in a fw_cfg entry of the domain.
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.uber.org/multierr"
+)
+
+const (
+	// Version is the version of the format, the agent rejects metadata of other versions.
+	Version = 1
+	// FWCfgName is the name of the fw_cfg entry of the domain, QEMU requires the opt/ prefix.
+	FWCfgName = "opt/delegatio/metadata"
+	// FWCfgPath is the file of the entry in the guest, it requires the qemu_fw_cfg kernel module.
+	FWCfgPath = "/sys/firmware/qemu_fw_cfg/by_name/" + FWCfgName + "/raw"
+)
+
+// Role is the role of a node in the Kubernetes cluster.
+type Role string
+
+const (
+	// RoleControlPlane runs the Kubernetes control plane.
+	RoleControlPlane Role = "control-plane"
+	// RoleWorker runs the workloads.
+	RoleWorker Role = "worker"
+)
+
+// Metadata is everything a node needs to configure itself. The certificates are PEM encoded.
+type Metadata struct {
+	Version   int    `json:"version"`
+	Hostname  string `json:"hostname"`
+	Role      Role   `json:"role"`
+	CACert    []byte `json:"caCert"`
+	AgentCert []byte `json:"agentCert"`
+	AgentKey  []byte `json:"agentKey"`
+	// KubeadmConfig is only set on the node which initializes the cluster.
+	KubeadmConfig []byte `json:"kubeadmConfig,omitempty"`
+}
+
+// Marshal validates the metadata and encodes it.
+func (m *Metadata) Marshal() ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// Validate checks that all required fields are set.
+func (m *Metadata) Validate() error {
+	var err error
+	if m.Version != Version {
+		err = multierr.Append(err, fmt.Errorf("unsupported version %d, want %d", m.Version, Version))
+	}
+	if m.Hostname == "" {
+		err = multierr.Append(err, errors.New("hostname must not be empty"))
+	}
+	if m.Role != RoleControlPlane && m.Role != RoleWorker {
+		err = multierr.Append(err, fmt.Errorf("unknown role %q", m.Role))
+	}
+	if len(m.CACert) == 0 || len(m.AgentCert) == 0 || len(m.AgentKey) == 0 {
+		err = multierr.Append(err, errors.New("the CA and the certificate of the agent with its key are required"))
+	}
+	return err
+}
+
+// Unmarshal decodes and validates metadata.
+func Unmarshal(data []byte) (*Metadata, error) {
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	return &m, nil
+}
+
+// Read loads the metadata from path. The error wraps os.ErrNotExist if the node has none.
+func Read(path string) (*Metadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(data)
+}
@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package metadata_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/benschlueter/delegatio/client/metadata"
+)
+
+func validMetadata() *metadata.Metadata {
+	return &metadata.Metadata{
+		Version:       metadata.Version,
+		Hostname:      "delegatio-0",
+		Role:          metadata.RoleControlPlane,
+		CACert:        []byte("ca"),
+		AgentCert:     []byte("cert"),
+		AgentKey:      []byte("key"),
+		KubeadmConfig: []byte("kind: InitConfiguration"),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	testCases := map[string]struct {
+		modify  func(m *metadata.Metadata)
+		wantErr bool
+	}{
+		"valid": {
+			modify: func(m *metadata.Metadata) {},
+		},
+		"worker without kubeadm config": {
+			modify: func(m *metadata.Metadata) {
+				m.Role = metadata.RoleWorker
+				m.KubeadmConfig = nil
+			},
+		},
+		"other version": {
+			modify:  func(m *metadata.Metadata) { m.Version = metadata.Version + 1 },
+			wantErr: true,
+		},
+		"no hostname": {
+			modify:  func(m *metadata.Metadata) { m.Hostname = "" },
+			wantErr: true,
+		},
+		"unknown role": {
+			modify:  func(m *metadata.Metadata) { m.Role = "etcd" },
+			wantErr: true,
+		},
+		"no agent key": {
+			modify:  func(m *metadata.Metadata) { m.AgentKey = nil },
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			m := validMetadata()
+			tc.modify(m)
+			data, err := m.Marshal()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("invalid metadata was marshaled")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(t.TempDir(), "raw")
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := metadata.Read(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Errorf("got %+v, want %+v", got, m)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := metadata.Read(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing metadata: got %v, want os.ErrNotExist", err)
+	}
+	path := filepath.Join(dir, "raw")
+	if err := os.WriteFile(path, []byte(`{"version": 1, "hostname": "delegatio-0"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := metadata.Read(path); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("incomplete metadata: got %v, want a validation error", err)
+	}
+}
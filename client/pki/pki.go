@@ -0,0 +1,275 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package pki creates and loads the certificates which secure the gRPC API of the agent.
+// A private CA signs the certificate of the agent and the client certificate of the CLI,
+// the agent only accepts connections with a client certificate of this CA.
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// CACertFilename is the certificate of the CA, it is shared by the CLI and the agent.
+	CACertFilename = "ca.crt"
+	// CAKeyFilename is the private key of the CA, it never leaves the CLI.
+	CAKeyFilename = "ca.key"
+	// AgentCertFilename is the server certificate of the agent.
+	AgentCertFilename = "agent.crt"
+	// AgentKeyFilename is the private key of the agent.
+	AgentKeyFilename = "agent.key"
+	// ClientCertFilename is the client certificate of the CLI.
+	ClientCertFilename = "client.crt"
+	// ClientKeyFilename is the private key of the CLI.
+	ClientKeyFilename = "client.key"
+	// AgentServerName is the name in the certificate of the agent which is baked into the
+	// image. The VMs get their addresses from DHCP, the CLI verifies this name instead of the
+	// address. Agents which get their certificate with the metadata of the node present the
+	// name of the node instead.
+	AgentServerName = "delegatio-agent"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 2 * 365 * 24 * time.Hour
+)
+
+// Generate creates a new CA and the certificates of the CLI and the agent.
+// clientDir receives the CA with its key and the client certificate, agentDir the CA and
+// the agent certificate. Existing files are never overwritten.
+func Generate(clientDir, agentDir string) error {
+	for _, file := range []string{
+		filepath.Join(clientDir, CACertFilename), filepath.Join(clientDir, CAKeyFilename),
+		filepath.Join(clientDir, ClientCertFilename), filepath.Join(clientDir, ClientKeyFilename),
+		filepath.Join(agentDir, CACertFilename), filepath.Join(agentDir, AgentCertFilename),
+		filepath.Join(agentDir, AgentKeyFilename),
+	} {
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("%s already exists", file)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "delegatio CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	if caTemplate.SerialNumber, err = serialNumber(); err != nil {
+		return err
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("creating CA certificate: %w", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	agentCert, agentKey, err := newLeaf(ca, caKey, AgentServerName, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return fmt.Errorf("creating agent certificate: %w", err)
+	}
+	clientCert, clientKey, err := newLeaf(ca, caKey, "delegatio-cli", x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return fmt.Errorf("creating client certificate: %w", err)
+	}
+	caKeyPEM, err := encodeKey(caKey)
+	if err != nil {
+		return err
+	}
+	caPEM := encodeCert(caDER)
+
+	if err := writeFiles(clientDir, map[string][]byte{
+		CACertFilename:     caPEM,
+		CAKeyFilename:      caKeyPEM,
+		ClientCertFilename: clientCert,
+		ClientKeyFilename:  clientKey,
+	}); err != nil {
+		return err
+	}
+	return writeFiles(agentDir, map[string][]byte{
+		CACertFilename:    caPEM,
+		AgentCertFilename: agentCert,
+		AgentKeyFilename:  agentKey,
+	})
+}
+
+// IssueAgentCertificate creates a certificate for the agent on node name with the CA in dir.
+// The certificate is only valid for name, such that the agent of one node cannot pose as
+// another. It returns the CA certificate, the agent certificate and its key, all PEM encoded.
+func IssueAgentCertificate(dir, name string) (caPEM, certPEM, keyPEM []byte, err error) {
+	caPEM, err = os.ReadFile(filepath.Join(dir, CACertFilename))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("loading CA certificate: %w", err)
+	}
+	caKeyPEM, err := os.ReadFile(filepath.Join(dir, CAKeyFilename))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("loading CA key: %w", err)
+	}
+	caPair, err := tls.X509KeyPair(caPEM, caKeyPEM)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("loading CA: %w", err)
+	}
+	ca, err := x509.ParseCertificate(caPair.Certificate[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	caKey, ok := caPair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("unsupported CA key type %T", caPair.PrivateKey)
+	}
+	certPEM, keyPEM, err = newLeaf(ca, caKey, name, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("creating agent certificate: %w", err)
+	}
+	return caPEM, certPEM, keyPEM, nil
+}
+
+// ServerCredentials loads the certificates of the agent from dir.
+// Clients must present a certificate signed by the CA.
+func ServerCredentials(dir string) (credentials.TransportCredentials, error) {
+	cert, pool, err := load(dir, AgentCertFilename, AgentKeyFilename)
+	if err != nil {
+		return nil, err
+	}
+	return serverCredentials(cert, pool), nil
+}
+
+// ServerCredentialsFromPEM is ServerCredentials for certificates which are not stored in files.
+func ServerCredentialsFromPEM(caPEM, certPEM, keyPEM []byte) (credentials.TransportCredentials, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no CA certificate found")
+	}
+	return serverCredentials(cert, pool), nil
+}
+
+func serverCredentials(cert tls.Certificate, pool *x509.CertPool) credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	})
+}
+
+// ClientCredentials loads the certificates of the CLI from dir.
+// Only agents with a certificate signed by the CA are accepted. The name the agent must
+// present is the authority of the connection, see grpc.WithAuthority.
+func ClientCredentials(dir string) (credentials.TransportCredentials, error) {
+	cert, pool, err := load(dir, ClientCertFilename, ClientKeyFilename)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS13,
+	}), nil
+}
+
+// load reads a key pair and the CA certificate from dir.
+func load(dir, certFile, keyFile string) (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, certFile), filepath.Join(dir, keyFile))
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(filepath.Join(dir, CACertFilename))
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("loading CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return tls.Certificate{}, nil, fmt.Errorf("no certificate found in %s", filepath.Join(dir, CACertFilename))
+	}
+	return cert, pool, nil
+}
+
+// newLeaf creates a key and a certificate for it signed by the CA, both PEM encoded.
+// The certificate is valid for name and the altNames.
+func newLeaf(ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string, usage x509.ExtKeyUsage, altNames ...string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    append([]string{name}, altNames...),
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	}
+	if template.SerialNumber, err = serialNumber(); err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCert(der), keyPEM, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeFiles writes the files readable for the owner only, they contain private keys.
+func writeFiles(dir string, files map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package pki_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/client/pki"
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// serve starts an agent API without any implementation, every authenticated call returns Unimplemented.
+func serve(t *testing.T, creds credentials.TransportCredentials) string {
+	t.Helper()
+	server := grpc.NewServer(grpc.Creds(creds))
+	vmproto.RegisterAPIServer(server, vmproto.UnimplementedAPIServer{})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+func call(t *testing.T, addr, serverName string, creds credentials.TransportCredentials) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(creds), grpc.WithAuthority(serverName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = vmproto.NewAPIClient(conn).ExecCommand(ctx, &vmproto.ExecCommandRequest{Command: "whoami"})
+	return err
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientDir, agentDir := filepath.Join(dir, "cli"), filepath.Join(dir, "agent")
+	if err := pki.Generate(clientDir, agentDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(agentDir, pki.CAKeyFilename)); err == nil {
+		t.Fatal("the CA key was written to the agent directory")
+	}
+	if err := pki.Generate(clientDir, agentDir); err == nil {
+		t.Fatal("existing certificates were overwritten")
+	}
+	agentCreds, err := pki.ServerCredentials(agentDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, agentCreds)
+
+	creds, err := pki.ClientCredentials(clientDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := call(t, addr, pki.AgentServerName, creds); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("authenticated call: got %v, want Unimplemented", err)
+	}
+
+	caPEM, err := os.ReadFile(filepath.Join(clientDir, pki.CACertFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	noClientCert := credentials.NewTLS(&tls.Config{RootCAs: pool, ServerName: pki.AgentServerName, MinVersion: tls.VersionTLS13})
+	if err := call(t, addr, pki.AgentServerName, noClientCert); status.Code(err) != codes.Unavailable {
+		t.Fatalf("call without client certificate: got %v, want Unavailable", err)
+	}
+
+	// A certificate of a different CA is rejected as well.
+	otherDir := filepath.Join(dir, "other")
+	if err := pki.Generate(otherDir, filepath.Join(dir, "other-agent")); err != nil {
+		t.Fatal(err)
+	}
+	otherCreds, err := pki.ClientCredentials(otherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := call(t, addr, pki.AgentServerName, otherCreds); status.Code(err) != codes.Unavailable {
+		t.Fatalf("call of a foreign CA: got %v, want Unavailable", err)
+	}
+}
+
+func TestIssueAgentCertificate(t *testing.T) {
+	dir := t.TempDir()
+	clientDir := filepath.Join(dir, "cli")
+	if err := pki.Generate(clientDir, filepath.Join(dir, "agent")); err != nil {
+		t.Fatal(err)
+	}
+	caPEM, certPEM, keyPEM, err := pki.IssueAgentCertificate(clientDir, "delegatio-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("delegatio-1"); err != nil {
+		t.Errorf("certificate is not valid for its node: %v", err)
+	}
+	for _, name := range []string{pki.AgentServerName, "delegatio-2"} {
+		if err := cert.VerifyHostname(name); err == nil {
+			t.Errorf("certificate is valid for %s", name)
+		}
+	}
+
+	agentCreds, err := pki.ServerCredentialsFromPEM(caPEM, certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, agentCreds)
+	creds, err := pki.ClientCredentials(clientDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := call(t, addr, "delegatio-1", creds); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("authenticated call: got %v, want Unimplemented", err)
+	}
+	// The agent of delegatio-1 cannot pose as another node.
+	if err := call(t, addr, "delegatio-2", creds); status.Code(err) != codes.Unavailable {
+		t.Fatalf("call to the wrong node: got %v, want Unavailable", err)
+	}
+
+	if _, _, _, err := pki.IssueAgentCertificate(filepath.Join(dir, "agent"), "delegatio-1"); err == nil {
+		t.Fatal("issued a certificate without the CA key")
+	}
+}
@@ -4,5 +4,50 @@
 
 package vmapi
 
+import (
+	"context"
+	"strings"
+
+	"github.com/benschlueter/delegatio/client/metadata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
 // Core interface contains functions to access the state Core data.
-type Core interface{}
+type Core interface {
+	// Provisioned returns nil once the node configured itself from its metadata.
+	Provisioned() error
+	// Role returns the role of the node, it is empty without metadata.
+	Role() metadata.Role
+	// KubeadmConfig returns the kubeadm configuration of the metadata, nil if there is none.
+	KubeadmConfig() []byte
+}
+
+// ProvisionedUnaryInterceptor rejects every call until core is provisioned. The health
+// service is exempt, it reports itself whether the node is provisioned.
+func ProvisionedUnaryInterceptor(core Core) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := core.Provisioned(); err != nil && !isHealthMethod(info.FullMethod) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return handler(ctx, req)
+	}
+}
+
+// ProvisionedStreamInterceptor rejects every stream until core is provisioned, except the
+// streams of the health service.
+func ProvisionedStreamInterceptor(core Core) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := core.Provisioned(); err != nil && !isHealthMethod(info.FullMethod) {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return handler(srv, ss)
+	}
+}
+
+// isHealthMethod returns true if fullMethod belongs to the gRPC health service.
+func isHealthMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
@@ -0,0 +1,196 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package vmapi_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/benschlueter/delegatio/client/metadata"
+	"github.com/benschlueter/delegatio/client/vmapi"
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeCore is the state of a node, it returns the values of its fields.
+type fakeCore struct {
+	provisionErr  error
+	role          metadata.Role
+	kubeadmConfig []byte
+}
+
+func (c *fakeCore) Provisioned() error    { return c.provisionErr }
+func (c *fakeCore) Role() metadata.Role   { return c.role }
+func (c *fakeCore) KubeadmConfig() []byte { return c.kubeadmConfig }
+
+func TestProvisionedInterceptor(t *testing.T) {
+	testCases := map[string]struct {
+		core     *fakeCore
+		wantCode codes.Code
+	}{
+		"provisioned": {
+			core:     &fakeCore{},
+			wantCode: codes.OK,
+		},
+		"not provisioned": {
+			core:     &fakeCore{provisionErr: errors.New("the node is not provisioned yet")},
+			wantCode: codes.FailedPrecondition,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ctx := testContext(t)
+			client := newTestClientWithCore(t, tc.core, &fakeRunner{commands: testCommands}, newMemFS())
+
+			_, err := client.ExecCommand(ctx, &vmproto.ExecCommandRequest{Command: "echo"})
+			if status.Code(err) != tc.wantCode {
+				t.Errorf("unary call: got %v, want %v", err, tc.wantCode)
+			}
+
+			stream, err := client.ExecCommandStream(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.Send(startRequest(&vmproto.ExecCommandRequest{Command: "echo"})); err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if _, err := recvAll(stream); status.Code(err) != tc.wantCode {
+				t.Errorf("stream: got %v, want %v", err, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestProvisionedInterceptorHealth(t *testing.T) {
+	ctx := testContext(t)
+	core := &fakeCore{provisionErr: errors.New("the node is not provisioned yet")}
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(vmapi.ProvisionedUnaryInterceptor(core)),
+		grpc.StreamInterceptor(vmapi.ProvisionedStreamInterceptor(core)),
+	)
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(ctx, "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	client := healthpb.NewHealthClient(conn)
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("checking before provisioning: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("got %v before provisioning, want NOT_SERVING", resp.Status)
+	}
+
+	core.provisionErr = nil
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	resp, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("checking after provisioning: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("got %v after provisioning, want SERVING", resp.Status)
+	}
+}
+
+func TestJoinClusterRole(t *testing.T) {
+	joinToken := &vmproto.JoinToken{
+		ApiServerEndpoint: "10.42.0.100:6443",
+		Token:             "abcdef.0123456789abcdef",
+		CaCertHash:        "sha256:0000",
+		CertificateKey:    "key",
+	}
+	testCases := map[string]struct {
+		role         metadata.Role
+		controlPlane bool
+		wantCode     codes.Code
+	}{
+		"worker joins as worker": {
+			role:     metadata.RoleWorker,
+			wantCode: codes.OK,
+		},
+		"worker joins as control plane": {
+			role:         metadata.RoleWorker,
+			controlPlane: true,
+			wantCode:     codes.FailedPrecondition,
+		},
+		"control plane joins as worker": {
+			role:     metadata.RoleControlPlane,
+			wantCode: codes.FailedPrecondition,
+		},
+		"without metadata": {
+			controlPlane: true,
+			wantCode:     codes.OK,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			runner := &fakeRunner{commands: map[string]fakeCommand{
+				"/usr/bin/kubeadm": func(ctx context.Context, in *vmproto.ExecCommandRequest, stdin io.Reader, stdout, stderr io.Writer) int {
+					return 0
+				},
+			}}
+			client := newTestClientWithCore(t, &fakeCore{role: tc.role}, runner, newMemFS())
+
+			_, err := client.JoinCluster(testContext(t), &vmproto.JoinClusterRequest{JoinToken: joinToken, ControlPlane: tc.controlPlane})
+			if status.Code(err) != tc.wantCode {
+				t.Fatalf("got %v, want %v", err, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestInitClusterConfigFromMetadata(t *testing.T) {
+	runner := &fakeRunner{commands: map[string]fakeCommand{
+		"/usr/bin/kubeadm": func(ctx context.Context, in *vmproto.ExecCommandRequest, stdin io.Reader, stdout, stderr io.Writer) int {
+			_, _ = io.WriteString(stderr, "init failed")
+			return 1
+		},
+	}}
+	fs := newMemFS("/tmp")
+	core := &fakeCore{kubeadmConfig: []byte("kind: InitConfiguration")}
+	client := newTestClientWithCore(t, core, runner, fs)
+
+	// kubeadm fails, but it got the config of the metadata.
+	if _, err := client.InitCluster(testContext(t), &vmproto.InitClusterRequest{}); status.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want the failure of kubeadm", err)
+	}
+	file, ok := fs.file("/tmp/kubeadmconf.yaml")
+	if !ok {
+		t.Fatal("the kubeadm config was not written")
+	}
+	if string(file.data) != string(core.kubeadmConfig) {
+		t.Errorf("kubeadm config %q, want %q", file.data, core.kubeadmConfig)
+	}
+
+	core.kubeadmConfig = nil
+	if _, err := client.InitCluster(testContext(t), &vmproto.InitClusterRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("without any config: got %v, want InvalidArgument", err)
+	}
+}
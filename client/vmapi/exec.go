@@ -7,8 +7,13 @@ package vmapi
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
 	"go.uber.org/zap"
@@ -16,6 +21,12 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// errTimeout is the reason to kill a command whose timeout expired.
+var errTimeout = errors.New("command timed out")
+
+// maxErrorOutput limits the error output of a failed command which is returned to the client.
+const maxErrorOutput = 4096
+
 type streamWriter struct {
 	forward func([]byte) error
 }
@@ -29,41 +40,168 @@ func (sw streamWriter) Write(p []byte) (int, error) {
 
 // ExecCommandStream executes a command in the VM and streams the output to the caller.
 // This is useful if the command needs much time to run and we want to log the current state, i.e. kubeadm.
-func (a *API) ExecCommandStream(in *vmproto.ExecCommandStreamRequest, srv vmproto.API_ExecCommandStreamServer) error {
+func (a *API) ExecCommandStream(srv vmproto.API_ExecCommandStreamServer) error {
+	req, err := srv.Recv()
+	if err != nil {
+		return err
+	}
+	in := req.GetStart()
+	if in == nil {
+		return status.Error(codes.InvalidArgument, "the first message must start a command")
+	}
 	a.logger.Info("request to execute command", zap.String("command", in.Command), zap.Strings("args", in.Args))
-	command := exec.Command(in.Command, in.Args...)
-	streamer := streamWriter{forward: func(b []byte) error {
-		return srv.Send(&vmproto.ExecCommandStreamResponse{
-			Content: &vmproto.ExecCommandStreamResponse_Log{
-				Log: &vmproto.Log{
-					Message: string(b),
-				},
-			},
-		})
-	}}
-	var stdoutBuf, stderrBuf bytes.Buffer
 
-	command.Stdout = io.MultiWriter(streamer, &stdoutBuf)
-	command.Stderr = io.MultiWriter(streamer, &stderrBuf)
+	// stdout and stderr are copied by different goroutines, but a stream must not be sent to concurrently.
+	var sendMux sync.Mutex
+	send := func(resp *vmproto.ExecCommandStreamResponse) error {
+		sendMux.Lock()
+		defer sendMux.Unlock()
+		return srv.Send(resp)
+	}
+	stdout := streamWriter{forward: func(b []byte) error {
+		return send(&vmproto.ExecCommandStreamResponse{Content: &vmproto.ExecCommandStreamResponse_Stdout{Stdout: b}})
+	}}
+	stderr := streamWriter{forward: func(b []byte) error {
+		return send(&vmproto.ExecCommandStreamResponse{Content: &vmproto.ExecCommandStreamResponse_Stderr{Stderr: b}})
+	}}
 
-	err := command.Start()
+	command, stdin, err := a.startCommand(in, stdout, stderr)
 	if err != nil {
-		return status.Errorf(codes.Internal, "command exited with error code: %v and output: %s", err, stdoutBuf.Bytes())
+		return err
 	}
+	go func() {
+		// Writes fail once the command exited, the remaining input is dropped.
+		if _, err := stdin.Write(in.Stdin); err != nil {
+			return
+		}
+		for {
+			req, err := srv.Recv()
+			if err != nil {
+				// io.EOF means the client closed its side of the stream.
+				_ = stdin.Close()
+				return
+			}
+			if _, err := stdin.Write(req.GetStdin()); err != nil {
+				return
+			}
+		}
+	}()
 
-	if err := command.Wait(); err != nil {
-		return status.Errorf(codes.Internal, "command exited with error code: %v and output: %s", err, stdoutBuf.Bytes())
+	exitStatus, err := a.waitCommand(srv.Context(), command, in)
+	if err != nil {
+		return err
 	}
-	return srv.Send(&vmproto.ExecCommandStreamResponse{Content: &vmproto.ExecCommandStreamResponse_Output{Output: stdoutBuf.Bytes()}})
+	return send(&vmproto.ExecCommandStreamResponse{Content: &vmproto.ExecCommandStreamResponse_Exit{Exit: exitStatus}})
 }
 
 // ExecCommand executes a command in the VM.
 func (a *API) ExecCommand(ctx context.Context, in *vmproto.ExecCommandRequest) (*vmproto.ExecCommandResponse, error) {
 	a.logger.Info("request to execute command", zap.String("command", in.Command), zap.Strings("args", in.Args))
-	command := exec.Command(in.Command, in.Args...)
-	output, err := command.Output()
+	var stdoutBuf, stderrBuf bytes.Buffer
+	command, stdin, err := a.startCommand(in, &stdoutBuf, &stderrBuf)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, _ = stdin.Write(in.Stdin)
+		_ = stdin.Close()
+	}()
+	exitStatus, err := a.waitCommand(ctx, command, in)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "command exited with error code: %v and output: %s", err, string(output))
+		return nil, err
+	}
+	return &vmproto.ExecCommandResponse{Stdout: stdoutBuf.Bytes(), Stderr: stderrBuf.Bytes(), Exit: exitStatus}, nil
+}
+
+// startCommand validates in and starts the command with the runner of the API.
+// The returned stdin is closed by the caller once all input is written.
+func (a *API) startCommand(in *vmproto.ExecCommandRequest, stdout, stderr io.Writer) (Process, io.WriteCloser, error) {
+	if in.Command == "" {
+		return nil, nil, status.Error(codes.InvalidArgument, "command must not be empty")
+	}
+	for _, env := range in.Env {
+		if !strings.Contains(env, "=") {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "environment variable %q is not of the form KEY=VALUE", env)
+		}
+	}
+	if in.Timeout != nil {
+		if err := in.Timeout.CheckValid(); err != nil || in.Timeout.AsDuration() <= 0 {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "invalid timeout %v", in.Timeout.AsDuration())
+		}
+	}
+	process, stdin, err := a.runner.Start(in, stdout, stderr)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			return nil, nil, status.Errorf(codes.NotFound, "starting command: %v", err)
+		}
+		return nil, nil, status.Errorf(codes.Internal, "starting command: %v", err)
+	}
+	return process, stdin, nil
+}
+
+// waitCommand waits until the process exits. The process is killed if ctx is canceled,
+// i.e., the client went away, or the timeout of the command expires.
+func (a *API) waitCommand(ctx context.Context, process Process, in *vmproto.ExecCommandRequest) (*vmproto.ExitStatus, error) {
+	var timeout <-chan time.Time
+	if in.Timeout != nil {
+		timer := time.NewTimer(in.Timeout.AsDuration())
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	done := make(chan struct{})
+	killReason := make(chan error, 1)
+	go func() {
+		var reason error
+		select {
+		case <-done:
+		case <-ctx.Done():
+			reason = ctx.Err()
+		case <-timeout:
+			reason = errTimeout
+		}
+		if reason != nil {
+			a.logger.Info("killing command", zap.String("command", in.Command), zap.Error(reason))
+			if err := process.Kill(); err != nil {
+				a.logger.Error("failed to kill command", zap.String("command", in.Command), zap.Error(err))
+			}
+		}
+		killReason <- reason
+	}()
+	code, err := process.Wait()
+	close(done)
+	reason := <-killReason
+
+	if reason != nil && reason != errTimeout {
+		return nil, status.FromContextError(reason).Err()
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "waiting for command: %v", err)
+	}
+	return &vmproto.ExitStatus{Code: int32(code), TimedOut: reason == errTimeout}, nil
+}
+
+// runCommand runs a command on behalf of another RPC. It fails if the command does not exit
+// with code zero, the error contains the end of its error output.
+func (a *API) runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	in := &vmproto.ExecCommandRequest{Command: name, Args: args}
+	var stdout, stderr bytes.Buffer
+	command, stdin, err := a.startCommand(in, &stdout, &stderr)
+	if err != nil {
+		return nil, err
+	}
+	_ = stdin.Close()
+	exitStatus, err := a.waitCommand(ctx, command, in)
+	if err != nil {
+		return nil, err
+	}
+	if exitStatus.Code != 0 {
+		// The arguments are not logged, they might contain secrets like join tokens.
+		a.logger.Error("command failed", zap.String("command", name), zap.ByteString("stderr", stderr.Bytes()))
+		errOutput := stderr.Bytes()
+		if len(errOutput) > maxErrorOutput {
+			errOutput = errOutput[len(errOutput)-maxErrorOutput:]
+		}
+		return nil, status.Errorf(codes.Internal, "%s exited with code %d: %s", name, exitStatus.Code, bytes.TrimSpace(errOutput))
 	}
-	return &vmproto.ExecCommandResponse{Output: output}, nil
+	return stdout.Bytes(), nil
 }
@@ -0,0 +1,271 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package vmapi_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// testCommands are the commands of the fakeRunner used by the tests.
+var testCommands = map[string]fakeCommand{
+	// echo prints its arguments to stdout and the environment and directory to stderr.
+	"echo": func(ctx context.Context, in *vmproto.ExecCommandRequest, stdin io.Reader, stdout, stderr io.Writer) int {
+		_, _ = io.WriteString(stdout, strings.Join(in.Args, " "))
+		_, _ = io.WriteString(stderr, strings.Join(append(in.Env, in.Dir), " "))
+		return 0
+	},
+	"cat": func(ctx context.Context, in *vmproto.ExecCommandRequest, stdin io.Reader, stdout, stderr io.Writer) int {
+		if _, err := io.Copy(stdout, stdin); err != nil {
+			return 1
+		}
+		return 0
+	},
+	"false": func(ctx context.Context, in *vmproto.ExecCommandRequest, stdin io.Reader, stdout, stderr io.Writer) int {
+		return 3
+	},
+	// interleave alternates between stdout and stderr.
+	"interleave": func(ctx context.Context, in *vmproto.ExecCommandRequest, stdin io.Reader, stdout, stderr io.Writer) int {
+		_, _ = io.WriteString(stdout, "1")
+		_, _ = io.WriteString(stderr, "2")
+		_, _ = io.WriteString(stdout, "3")
+		return 7
+	},
+	// sleep blocks until it is killed.
+	"sleep": func(ctx context.Context, in *vmproto.ExecCommandRequest, stdin io.Reader, stdout, stderr io.Writer) int {
+		<-ctx.Done()
+		return 0
+	},
+}
+
+func TestExecCommand(t *testing.T) {
+	testCases := map[string]struct {
+		req      *vmproto.ExecCommandRequest
+		wantResp *vmproto.ExecCommandResponse
+		wantCode codes.Code
+	}{
+		"output": {
+			req: &vmproto.ExecCommandRequest{Command: "echo", Args: []string{"hello", "world"}, Env: []string{"A=1"}, Dir: "/tmp"},
+			wantResp: &vmproto.ExecCommandResponse{
+				Stdout: []byte("hello world"),
+				Stderr: []byte("A=1 /tmp"),
+				Exit:   &vmproto.ExitStatus{},
+			},
+		},
+		"stdin": {
+			req:      &vmproto.ExecCommandRequest{Command: "cat", Stdin: []byte("input")},
+			wantResp: &vmproto.ExecCommandResponse{Stdout: []byte("input"), Exit: &vmproto.ExitStatus{}},
+		},
+		"exit code": {
+			req:      &vmproto.ExecCommandRequest{Command: "false"},
+			wantResp: &vmproto.ExecCommandResponse{Exit: &vmproto.ExitStatus{Code: 3}},
+		},
+		"timeout": {
+			req:      &vmproto.ExecCommandRequest{Command: "sleep", Timeout: durationpb.New(10 * time.Millisecond)},
+			wantResp: &vmproto.ExecCommandResponse{Exit: &vmproto.ExitStatus{Code: -1, TimedOut: true}},
+		},
+		"unknown command": {
+			req:      &vmproto.ExecCommandRequest{Command: "unknown"},
+			wantCode: codes.NotFound,
+		},
+		"empty command": {
+			req:      &vmproto.ExecCommandRequest{},
+			wantCode: codes.InvalidArgument,
+		},
+		"invalid environment": {
+			req:      &vmproto.ExecCommandRequest{Command: "echo", Env: []string{"A"}},
+			wantCode: codes.InvalidArgument,
+		},
+		"negative timeout": {
+			req:      &vmproto.ExecCommandRequest{Command: "sleep", Timeout: durationpb.New(-time.Second)},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			client := newTestClient(t, &fakeRunner{commands: testCommands}, newMemFS())
+			resp, err := client.ExecCommand(testContext(t), tc.req)
+			if tc.wantCode != codes.OK {
+				if status.Code(err) != tc.wantCode {
+					t.Fatalf("got error %v, want code %v", err, tc.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(resp, tc.wantResp) {
+				t.Errorf("got response %v, want %v", resp, tc.wantResp)
+			}
+		})
+	}
+}
+
+// recvAll receives the messages of an exec stream until the server closes it.
+func recvAll(stream vmproto.API_ExecCommandStreamClient) ([]*vmproto.ExecCommandStreamResponse, error) {
+	var resps []*vmproto.ExecCommandStreamResponse
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return resps, nil
+		}
+		if err != nil {
+			return resps, err
+		}
+		resps = append(resps, resp)
+	}
+}
+
+func startRequest(in *vmproto.ExecCommandRequest) *vmproto.ExecCommandStreamRequest {
+	return &vmproto.ExecCommandStreamRequest{Content: &vmproto.ExecCommandStreamRequest_Start{Start: in}}
+}
+
+func TestExecCommandStreamOrdering(t *testing.T) {
+	client := newTestClient(t, &fakeRunner{commands: testCommands}, newMemFS())
+	stream, err := client.ExecCommandStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(startRequest(&vmproto.ExecCommandRequest{Command: "interleave"})); err != nil {
+		t.Fatal(err)
+	}
+	resps, err := recvAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*vmproto.ExecCommandStreamResponse{
+		{Content: &vmproto.ExecCommandStreamResponse_Stdout{Stdout: []byte("1")}},
+		{Content: &vmproto.ExecCommandStreamResponse_Stderr{Stderr: []byte("2")}},
+		{Content: &vmproto.ExecCommandStreamResponse_Stdout{Stdout: []byte("3")}},
+		{Content: &vmproto.ExecCommandStreamResponse_Exit{Exit: &vmproto.ExitStatus{Code: 7}}},
+	}
+	if len(resps) != len(want) {
+		t.Fatalf("got %d messages %v, want %v", len(resps), resps, want)
+	}
+	for i := range want {
+		if !proto.Equal(resps[i], want[i]) {
+			t.Errorf("message %d: got %v, want %v", i, resps[i], want[i])
+		}
+	}
+}
+
+func TestExecCommandStreamStdin(t *testing.T) {
+	client := newTestClient(t, &fakeRunner{commands: testCommands}, newMemFS())
+	stream, err := client.ExecCommandStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(startRequest(&vmproto.ExecCommandRequest{Command: "cat", Stdin: []byte("first ")})); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&vmproto.ExecCommandStreamRequest{Content: &vmproto.ExecCommandStreamRequest_Stdin{Stdin: []byte("second")}}); err != nil {
+		t.Fatal(err)
+	}
+	// cat only exits once its input is closed.
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	resps, err := recvAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	for _, resp := range resps[:len(resps)-1] {
+		stdout.Write(resp.GetStdout())
+	}
+	if stdout.String() != "first second" {
+		t.Errorf("got stdout %q, want %q", stdout.String(), "first second")
+	}
+	if exit := resps[len(resps)-1].GetExit(); exit == nil || exit.Code != 0 {
+		t.Errorf("the last message is %v, want exit code 0", resps[len(resps)-1])
+	}
+}
+
+func TestExecCommandStreamTermination(t *testing.T) {
+	testCases := map[string]struct {
+		first    *vmproto.ExecCommandStreamRequest
+		cancel   bool
+		wantExit *vmproto.ExitStatus
+		wantCode codes.Code
+	}{
+		"timeout": {
+			first:    startRequest(&vmproto.ExecCommandRequest{Command: "sleep", Timeout: durationpb.New(10 * time.Millisecond)}),
+			wantExit: &vmproto.ExitStatus{Code: -1, TimedOut: true},
+		},
+		"client cancels": {
+			first:    startRequest(&vmproto.ExecCommandRequest{Command: "sleep"}),
+			cancel:   true,
+			wantCode: codes.Canceled,
+		},
+		"first message is not a command": {
+			first:    &vmproto.ExecCommandStreamRequest{Content: &vmproto.ExecCommandStreamRequest_Stdin{Stdin: []byte("input")}},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			started, killed := make(chan struct{}), make(chan struct{})
+			commands := map[string]fakeCommand{
+				"sleep": func(ctx context.Context, in *vmproto.ExecCommandRequest, stdin io.Reader, stdout, stderr io.Writer) int {
+					close(started)
+					<-ctx.Done()
+					close(killed)
+					return 0
+				},
+			}
+			client := newTestClient(t, &fakeRunner{commands: commands}, newMemFS())
+			ctx, cancel := context.WithCancel(testContext(t))
+			defer cancel()
+			stream, err := client.ExecCommandStream(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.Send(tc.first); err != nil {
+				t.Fatal(err)
+			}
+			if tc.cancel {
+				<-started
+				cancel()
+			}
+			resps, err := recvAll(stream)
+			if tc.wantCode != codes.OK {
+				if status.Code(err) != tc.wantCode {
+					t.Fatalf("got error %v, want code %v", err, tc.wantCode)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(resps) != 1 || !proto.Equal(resps[0].GetExit(), tc.wantExit) {
+					t.Fatalf("got messages %v, want exit %v", resps, tc.wantExit)
+				}
+			}
+			if tc.first.GetStart() == nil {
+				return
+			}
+			// The command must not outlive the call.
+			select {
+			case <-killed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the command was not killed")
+			}
+		})
+	}
+}
@@ -6,21 +6,247 @@ package vmapi
 
 import (
 	"context"
+	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// defaultFileMode is used if a request does not set the permission bits.
+	defaultFileMode = 0o644
+	// readChunkSize is the size of the chunks of ReadFile, it stays below the gRPC message limit.
+	readChunkSize = 1 << 20
 )
 
 // WriteFile creates a file and writes output to it.
 func (a *API) WriteFile(ctx context.Context, in *vmproto.WriteFileRequest) (*vmproto.WriteFileResponse, error) {
 	a.logger.Info("request to write file", zap.String("path", in.Filepath), zap.String("name", in.Filename))
-	if err := os.WriteFile(filepath.Join(in.Filepath, in.Filename), in.Content, os.ModeAppend); err != nil {
+	err := a.writeAtomic(in.Filepath, in.Filename, in.Options, func(w io.Writer) error {
+		_, err := w.Write(in.Content)
+		return err
+	})
+	if err != nil {
 		a.logger.Error("failed to write file", zap.String("path", in.Filepath), zap.String("name", in.Filename), zap.Error(err))
-		return nil, status.Errorf(codes.Internal, "file write failed exited with error code: %v", err)
+		return nil, fileError(err)
 	}
 	return &vmproto.WriteFileResponse{}, nil
 }
+
+// UploadFile writes a file which is streamed in chunks.
+// The file only appears once the client closed the stream and all chunks are written.
+func (a *API) UploadFile(srv vmproto.API_UploadFileServer) error {
+	req, err := srv.Recv()
+	if err != nil {
+		return err
+	}
+	header := req.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "the first message must be the header")
+	}
+	a.logger.Info("request to upload file", zap.String("path", header.Filepath), zap.String("name", header.Filename))
+	var size int64
+	err = a.writeAtomic(header.Filepath, header.Filename, header.Options, func(w io.Writer) error {
+		for {
+			req, err := srv.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			n, err := w.Write(req.GetChunk())
+			size += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		a.logger.Error("failed to upload file", zap.String("path", header.Filepath), zap.String("name", header.Filename), zap.Error(err))
+		return fileError(err)
+	}
+	return srv.SendAndClose(&vmproto.UploadFileResponse{Size: size})
+}
+
+// ReadFile streams the content of a file.
+func (a *API) ReadFile(in *vmproto.ReadFileRequest, srv vmproto.API_ReadFileServer) error {
+	a.logger.Info("request to read file", zap.String("path", in.Path))
+	file, err := a.fs.Open(in.Path)
+	if err != nil {
+		return fileError(err)
+	}
+	defer file.Close()
+	buf := make([]byte, readChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := srv.Send(&vmproto.ReadFileResponse{Chunk: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			// reading a directory fails with EISDIR.
+			return fileError(err)
+		}
+	}
+}
+
+// Stat returns the attributes of a file, symlinks are followed.
+func (a *API) Stat(ctx context.Context, in *vmproto.StatRequest) (*vmproto.StatResponse, error) {
+	info, err := a.fs.Stat(in.Path)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	return &vmproto.StatResponse{Info: fileInfo(info)}, nil
+}
+
+// ListDir returns the entries of a directory, symlinks are not followed.
+func (a *API) ListDir(ctx context.Context, in *vmproto.ListDirRequest) (*vmproto.ListDirResponse, error) {
+	entries, err := a.fs.ReadDir(in.Path)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	resp := &vmproto.ListDirResponse{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		// the entry was removed after the directory was read.
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fileError(err)
+		}
+		resp.Entries = append(resp.Entries, fileInfo(info))
+	}
+	return resp, nil
+}
+
+// writeAtomic writes dir/name through a temporary file in the same directory, which replaces
+// the target once write succeeded. Readers never see a partially written file.
+func (a *API) writeAtomic(dir, name string, opts *vmproto.FileOptions, write func(io.Writer) error) (retErr error) {
+	if name == "" || name != filepath.Base(name) {
+		return status.Errorf(codes.InvalidArgument, "invalid filename %q", name)
+	}
+	if opts.GetCreateParents() {
+		if err := a.fs.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	mode := os.FileMode(defaultFileMode)
+	if opts.GetMode() != 0 {
+		mode = fileMode(opts.GetMode())
+	}
+	tmp, err := a.fs.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = tmp.Close()
+			_ = a.fs.Remove(tmp.Name())
+		}
+	}()
+	if err := write(tmp); err != nil {
+		return err
+	}
+	// CreateTemp uses 0600, chmod is not subject to the umask.
+	if err := tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if int(opts.GetUid()) != os.Geteuid() || int(opts.GetGid()) != os.Getegid() {
+		if err := tmp.Chown(int(opts.GetUid()), int(opts.GetGid())); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return a.fs.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// fileInfo converts the attributes of a file to their wire format.
+func fileInfo(info fs.FileInfo) *vmproto.FileInfo {
+	result := &vmproto.FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Mode:    unixMode(info.Mode()),
+		ModTime: timestamppb.New(info.ModTime()),
+	}
+	switch {
+	case info.Mode().IsRegular():
+		result.Type = vmproto.FileInfo_TYPE_REGULAR
+	case info.IsDir():
+		result.Type = vmproto.FileInfo_TYPE_DIRECTORY
+	case info.Mode()&fs.ModeSymlink != 0:
+		result.Type = vmproto.FileInfo_TYPE_SYMLINK
+	default:
+		result.Type = vmproto.FileInfo_TYPE_OTHER
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		result.Uid = stat.Uid
+		result.Gid = stat.Gid
+	}
+	return result
+}
+
+// unixMode converts the permission bits of mode to the ones of chmod(2).
+func unixMode(mode fs.FileMode) uint32 {
+	result := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		result |= syscall.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		result |= syscall.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		result |= syscall.S_ISVTX
+	}
+	return result
+}
+
+// fileMode converts permission bits of chmod(2) to an fs.FileMode.
+func fileMode(mode uint32) fs.FileMode {
+	result := fs.FileMode(mode) & fs.ModePerm
+	if mode&syscall.S_ISUID != 0 {
+		result |= fs.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		result |= fs.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		result |= fs.ModeSticky
+	}
+	return result
+}
+
+// fileError converts errors of the file system into gRPC status errors.
+func fileError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, fs.ErrPermission):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, syscall.EISDIR), errors.Is(err, syscall.ENOTDIR):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package vmapi_test
+
+import (
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteFile(t *testing.T) {
+	testCases := map[string]struct {
+		fs        *memFS
+		req       *vmproto.WriteFileRequest
+		wantCode  codes.Code
+		wantFile  memFile
+		wantFiles []string
+	}{
+		"default mode": {
+			fs:        newMemFS("/etc"),
+			req:       &vmproto.WriteFileRequest{Filepath: "/etc", Filename: "hosts", Content: []byte("content")},
+			wantFile:  memFile{name: "/etc/hosts", data: []byte("content"), mode: 0o644, uid: os.Geteuid(), gid: os.Getegid()},
+			wantFiles: []string{"/etc/hosts"},
+		},
+		"mode and owner": {
+			fs: newMemFS("/etc"),
+			req: &vmproto.WriteFileRequest{
+				Filepath: "/etc", Filename: "secret", Content: []byte("content"),
+				Options: &vmproto.FileOptions{Mode: 0o4600, Uid: 1000, Gid: 1001},
+			},
+			wantFile:  memFile{name: "/etc/secret", data: []byte("content"), mode: fs.ModeSetuid | 0o600, uid: 1000, gid: 1001},
+			wantFiles: []string{"/etc/secret"},
+		},
+		"replaces existing file": {
+			fs: func() *memFS {
+				m := newMemFS("/etc")
+				m.files["/etc/hosts"] = &memFile{fs: m, name: "/etc/hosts", data: []byte("old content"), mode: 0o600}
+				return m
+			}(),
+			req:       &vmproto.WriteFileRequest{Filepath: "/etc", Filename: "hosts", Content: []byte("new")},
+			wantFile:  memFile{name: "/etc/hosts", data: []byte("new"), mode: 0o644, uid: os.Geteuid(), gid: os.Getegid()},
+			wantFiles: []string{"/etc/hosts"},
+		},
+		"create parents": {
+			fs: newMemFS(),
+			req: &vmproto.WriteFileRequest{
+				Filepath: "/etc/kubernetes/manifests", Filename: "kube-vip.yaml", Content: []byte("content"),
+				Options: &vmproto.FileOptions{CreateParents: true},
+			},
+			wantFile:  memFile{name: "/etc/kubernetes/manifests/kube-vip.yaml", data: []byte("content"), mode: 0o644, uid: os.Geteuid(), gid: os.Getegid()},
+			wantFiles: []string{"/etc/kubernetes/manifests/kube-vip.yaml"},
+		},
+		"missing directory": {
+			fs:       newMemFS(),
+			req:      &vmproto.WriteFileRequest{Filepath: "/etc", Filename: "hosts", Content: []byte("content")},
+			wantCode: codes.NotFound,
+		},
+		"filename with directory": {
+			fs:       newMemFS("/etc"),
+			req:      &vmproto.WriteFileRequest{Filepath: "/etc", Filename: "../hosts", Content: []byte("content")},
+			wantCode: codes.InvalidArgument,
+		},
+		"empty filename": {
+			fs:       newMemFS("/etc"),
+			req:      &vmproto.WriteFileRequest{Filepath: "/etc", Content: []byte("content")},
+			wantCode: codes.InvalidArgument,
+		},
+		"failure keeps the old file": {
+			fs: func() *memFS {
+				m := newMemFS("/etc")
+				m.files["/etc/hosts"] = &memFile{fs: m, name: "/etc/hosts", data: []byte("old content"), mode: 0o644}
+				m.chownErr = &fs.PathError{Op: "chown", Path: "/etc", Err: fs.ErrPermission}
+				return m
+			}(),
+			req: &vmproto.WriteFileRequest{
+				Filepath: "/etc", Filename: "hosts", Content: []byte("new"),
+				Options: &vmproto.FileOptions{Uid: 1000, Gid: 1000},
+			},
+			wantCode:  codes.PermissionDenied,
+			wantFile:  memFile{name: "/etc/hosts", data: []byte("old content"), mode: 0o644},
+			wantFiles: []string{"/etc/hosts"},
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			client := newTestClient(t, &fakeRunner{}, tc.fs)
+			_, err := client.WriteFile(testContext(t), tc.req)
+			if status.Code(err) != tc.wantCode {
+				t.Fatalf("got error %v, want code %v", err, tc.wantCode)
+			}
+			// The temporary file must not be left behind.
+			if names := tc.fs.names(); !reflect.DeepEqual(names, tc.wantFiles) {
+				t.Errorf("got files %v, want %v", names, tc.wantFiles)
+			}
+			if tc.wantFile.name == "" {
+				return
+			}
+			file, ok := tc.fs.file(tc.wantFile.name)
+			if !ok {
+				t.Fatalf("%s was not written", tc.wantFile.name)
+			}
+			if !reflect.DeepEqual(file, tc.wantFile) {
+				t.Errorf("got file %+v, want %+v", file, tc.wantFile)
+			}
+		})
+	}
+}
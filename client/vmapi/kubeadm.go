@@ -0,0 +1,244 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package vmapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/benschlueter/delegatio/client/metadata"
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/client-go/tools/clientcmd"
+	bootstraputil "k8s.io/cluster-bootstrap/token/util"
+	"k8s.io/kubernetes/cmd/kubeadm/app/util/pubkeypin"
+)
+
+const (
+	kubeadmPath      = "/usr/bin/kubeadm"
+	kubeadmConfigDir = "/tmp"
+	kubeadmConfig    = "kubeadmconf.yaml"
+	adminConfPath    = "/etc/kubernetes/admin.conf"
+	caCertPath       = "/etc/kubernetes/pki/ca.crt"
+	// defaultTokenTTL is kubeadm's default lifetime of bootstrap tokens.
+	defaultTokenTTL = 24 * time.Hour
+	// certificateKeyTTL is the time after which kubeadm deletes the uploaded certificates.
+	certificateKeyTTL = 2 * time.Hour
+)
+
+// InitCluster runs kubeadm init and returns the join token for the other nodes.
+func (a *API) InitCluster(ctx context.Context, in *vmproto.InitClusterRequest) (*vmproto.InitClusterResponse, error) {
+	a.logger.Info("request to initialize the cluster", zap.Bool("uploadCerts", in.UploadCerts))
+	config := in.Config
+	// Nodes which received the config with their metadata are initialized without one.
+	if len(config) == 0 && a.core != nil {
+		config = a.core.KubeadmConfig()
+	}
+	if len(config) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "the kubeadm config must not be empty")
+	}
+	// The config contains the bootstrap tokens of kubeadm, only root may read it.
+	if err := a.writeAtomic(kubeadmConfigDir, kubeadmConfig, &vmproto.FileOptions{Mode: 0o600}, func(w io.Writer) error {
+		_, err := w.Write(config)
+		return err
+	}); err != nil {
+		return nil, fileError(err)
+	}
+	args := []string{"init", "--config", filepath.Join(kubeadmConfigDir, kubeadmConfig), "--skip-token-print"}
+	var certificateKey string
+	initTime := time.Now()
+	if in.UploadCerts {
+		var err error
+		if certificateKey, err = newCertificateKey(); err != nil {
+			return nil, status.Errorf(codes.Internal, "creating certificate key: %v", err)
+		}
+		args = append(args, "--upload-certs", "--certificate-key", certificateKey)
+	}
+	if _, err := a.runCommand(ctx, kubeadmPath, args...); err != nil {
+		return nil, err
+	}
+	a.logger.Info("kubeadm init succeeded")
+
+	joinToken, err := a.createJoinToken(ctx, defaultTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	if in.UploadCerts {
+		joinToken.CertificateKey = certificateKey
+		joinToken.CertificateKeyExpiry = timestamppb.New(initTime.Add(certificateKeyTTL))
+	}
+	kubeconfig, err := a.fs.ReadFile(adminConfPath)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	return &vmproto.InitClusterResponse{JoinToken: joinToken, Kubeconfig: kubeconfig}, nil
+}
+
+// JoinCluster runs kubeadm join.
+func (a *API) JoinCluster(ctx context.Context, in *vmproto.JoinClusterRequest) (*vmproto.JoinClusterResponse, error) {
+	a.logger.Info("request to join the cluster", zap.String("endpoint", in.GetJoinToken().GetApiServerEndpoint()), zap.Bool("controlPlane", in.ControlPlane))
+	token := in.GetJoinToken()
+	if token.GetApiServerEndpoint() == "" || token.GetToken() == "" || token.GetCaCertHash() == "" {
+		return nil, status.Error(codes.InvalidArgument, "the join token requires the API server endpoint, the token and the CA hash")
+	}
+	if a.core != nil {
+		if role := a.core.Role(); role != "" && (role == metadata.RoleControlPlane) != in.ControlPlane {
+			return nil, status.Errorf(codes.FailedPrecondition, "the metadata of the node assigns the %s role", role)
+		}
+	}
+	args := []string{
+		"join", token.ApiServerEndpoint,
+		"--token", token.Token,
+		"--discovery-token-ca-cert-hash", token.CaCertHash,
+	}
+	if in.ControlPlane {
+		if token.CertificateKey == "" {
+			return nil, status.Error(codes.InvalidArgument, "control planes require a certificate key to join")
+		}
+		args = append(args, "--control-plane", "--certificate-key", token.CertificateKey)
+	}
+	if _, err := a.runCommand(ctx, kubeadmPath, args...); err != nil {
+		return nil, err
+	}
+	a.logger.Info("kubeadm join succeeded")
+	return &vmproto.JoinClusterResponse{}, nil
+}
+
+// ResetNode runs kubeadm reset.
+func (a *API) ResetNode(ctx context.Context, in *vmproto.ResetNodeRequest) (*vmproto.ResetNodeResponse, error) {
+	a.logger.Info("request to reset the node")
+	if _, err := a.runCommand(ctx, kubeadmPath, "reset", "--force"); err != nil {
+		return nil, err
+	}
+	return &vmproto.ResetNodeResponse{}, nil
+}
+
+// CreateJoinToken creates a bootstrap token and, if requested, uploads the control plane certificates again.
+func (a *API) CreateJoinToken(ctx context.Context, in *vmproto.CreateJoinTokenRequest) (*vmproto.CreateJoinTokenResponse, error) {
+	a.logger.Info("request to create a join token", zap.Bool("uploadCerts", in.UploadCerts))
+	ttl := defaultTokenTTL
+	if in.Ttl != nil {
+		if err := in.Ttl.CheckValid(); err != nil || in.Ttl.AsDuration() <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid ttl %v", in.Ttl.AsDuration())
+		}
+		ttl = in.Ttl.AsDuration()
+	}
+	joinToken, err := a.createJoinToken(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if in.UploadCerts {
+		uploadTime := time.Now()
+		certificateKey, err := newCertificateKey()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "creating certificate key: %v", err)
+		}
+		if _, err := a.runCommand(ctx, kubeadmPath, "init", "phase", "upload-certs", "--upload-certs", "--certificate-key", certificateKey); err != nil {
+			return nil, err
+		}
+		joinToken.CertificateKey = certificateKey
+		joinToken.CertificateKeyExpiry = timestamppb.New(uploadTime.Add(certificateKeyTTL))
+	}
+	return &vmproto.CreateJoinTokenResponse{JoinToken: joinToken}, nil
+}
+
+// GetKubeconfig returns the admin kubeconfig.
+func (a *API) GetKubeconfig(ctx context.Context, in *vmproto.GetKubeconfigRequest) (*vmproto.GetKubeconfigResponse, error) {
+	kubeconfig, err := a.fs.ReadFile(adminConfPath)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	return &vmproto.GetKubeconfigResponse{Kubeconfig: kubeconfig}, nil
+}
+
+// createJoinToken creates a bootstrap token with kubeadm and collects the remaining
+// information to join from the files kubeadm wrote.
+func (a *API) createJoinToken(ctx context.Context, ttl time.Duration) (*vmproto.JoinToken, error) {
+	createTime := time.Now()
+	token, err := bootstraputil.GenerateBootstrapToken()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "generating bootstrap token: %v", err)
+	}
+	if _, err := a.runCommand(ctx, kubeadmPath, "token", "create", token, "--ttl", ttl.String(), "--kubeconfig", adminConfPath); err != nil {
+		return nil, err
+	}
+	endpoint, err := a.apiServerEndpoint(adminConfPath)
+	if err != nil {
+		return nil, err
+	}
+	caCertHash, err := a.caCertHash(caCertPath)
+	if err != nil {
+		return nil, err
+	}
+	return &vmproto.JoinToken{
+		ApiServerEndpoint: endpoint,
+		Token:             token,
+		CaCertHash:        caCertHash,
+		Expiry:            timestamppb.New(createTime.Add(ttl)),
+	}, nil
+}
+
+// apiServerEndpoint returns host:port of the API server in the kubeconfig at path.
+// With a control plane endpoint, kubeadm writes it instead of the address of the node.
+func (a *API) apiServerEndpoint(path string) (string, error) {
+	raw, err := a.fs.ReadFile(path)
+	if err != nil {
+		return "", fileError(err)
+	}
+	kubeconfig, err := clientcmd.Load(raw)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "loading %s: %v", path, err)
+	}
+	kubeContext, ok := kubeconfig.Contexts[kubeconfig.CurrentContext]
+	if !ok {
+		return "", status.Errorf(codes.Internal, "%s has no current context", path)
+	}
+	cluster, ok := kubeconfig.Clusters[kubeContext.Cluster]
+	if !ok {
+		return "", status.Errorf(codes.Internal, "%s has no cluster %q", path, kubeContext.Cluster)
+	}
+	server, err := url.Parse(cluster.Server)
+	if err != nil || server.Host == "" {
+		return "", status.Errorf(codes.Internal, "invalid server %q in %s", cluster.Server, path)
+	}
+	return server.Host, nil
+}
+
+// caCertHash returns the hash of the public key of the cluster CA in the format of kubeadm join.
+func (a *API) caCertHash(path string) (string, error) {
+	caPEM, err := a.fs.ReadFile(path)
+	if err != nil {
+		return "", fileError(err)
+	}
+	block, _ := pem.Decode(caPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", status.Errorf(codes.Internal, "no certificate found in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "parsing %s: %v", path, err)
+	}
+	return pubkeypin.Hash(cert), nil
+}
+
+// newCertificateKey creates a key to encrypt the uploaded certificates, like kubeadm certs certificate-key.
+func newCertificateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("reading random bytes: %w", err)
+	}
+	return hex.EncodeToString(key), nil
+}
@@ -0,0 +1,166 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package vmapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const meminfoPath = "/proc/meminfo"
+
+var (
+	// nodeServices are the services a node needs to run Kubernetes.
+	nodeServices = []string{"crio", "kubelet"}
+	// nodeDisks are the mount points whose usage is reported, the containers live in /var.
+	nodeDisks = []string{"/", "/var"}
+)
+
+// GetNodeInfo reports the state of the VM.
+func (a *API) GetNodeInfo(ctx context.Context, in *vmproto.GetNodeInfoRequest) (*vmproto.GetNodeInfoResponse, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "getting hostname: %v", err)
+	}
+	resp := &vmproto.GetNodeInfoResponse{Hostname: hostname}
+
+	if resp.Addresses, err = interfaceAddresses(); err != nil {
+		return nil, status.Errorf(codes.Internal, "listing addresses: %v", err)
+	}
+
+	var uname syscall.Utsname
+	if err := syscall.Uname(&uname); err != nil {
+		return nil, status.Errorf(codes.Internal, "uname: %v", err)
+	}
+	resp.KernelRelease = utsString(uname.Release)
+
+	var sysinfo syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&sysinfo); err != nil {
+		return nil, status.Errorf(codes.Internal, "sysinfo: %v", err)
+	}
+	resp.Uptime = durationpb.New(time.Duration(sysinfo.Uptime) * time.Second)
+
+	for _, service := range nodeServices {
+		resp.Services = append(resp.Services, &vmproto.ServiceStatus{
+			Name:        service,
+			ActiveState: a.serviceState(ctx, service),
+		})
+	}
+
+	for _, path := range nodeDisks {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err != nil {
+			a.logger.Warn("failed to get disk usage", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		resp.Disks = append(resp.Disks, &vmproto.DiskUsage{
+			Path:           path,
+			TotalBytes:     stat.Blocks * uint64(stat.Bsize),
+			AvailableBytes: stat.Bavail * uint64(stat.Bsize),
+		})
+	}
+
+	if resp.Memory, err = a.memoryUsage(meminfoPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "reading memory usage: %v", err)
+	}
+	return resp, nil
+}
+
+// interfaceAddresses returns the addresses of all interfaces except loopback.
+func interfaceAddresses() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			addresses = append(addresses, addr.String())
+		}
+	}
+	return addresses, nil
+}
+
+// serviceState returns the state of a systemd unit. systemctl exits with a non-zero code for
+// every state except active, the state is printed nevertheless.
+func (a *API) serviceState(ctx context.Context, service string) string {
+	in := &vmproto.ExecCommandRequest{Command: "systemctl", Args: []string{"is-active", service}}
+	var stdout bytes.Buffer
+	process, stdin, err := a.startCommand(in, &stdout, io.Discard)
+	if err != nil {
+		return "unknown"
+	}
+	_ = stdin.Close()
+	if _, err := a.waitCommand(ctx, process, in); err != nil {
+		return "unknown"
+	}
+	if state := string(bytes.TrimSpace(stdout.Bytes())); state != "" {
+		return state
+	}
+	return "unknown"
+}
+
+// memoryUsage parses the total and available memory of /proc/meminfo.
+func (a *API) memoryUsage(path string) (*vmproto.MemoryUsage, error) {
+	file, err := a.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	usage := &vmproto.MemoryUsage{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// MemTotal:       16384256 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %w", scanner.Text(), err)
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			usage.TotalBytes = value * 1024
+		case "MemAvailable:":
+			usage.AvailableBytes = value * 1024
+		}
+	}
+	return usage, scanner.Err()
+}
+
+// utsString converts a field of syscall.Utsname, whose element type differs between architectures.
+func utsString[T int8 | uint8](field [65]T) string {
+	var b strings.Builder
+	for _, c := range field {
+		if c == 0 {
+			break
+		}
+		b.WriteByte(byte(c))
+	}
+	return b.String()
+}
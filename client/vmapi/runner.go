@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package vmapi
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+)
+
+// CommandRunner starts the commands requested by clients. Necessary to stub the
+// processes of the VM for local testing.
+type CommandRunner interface {
+	// Start starts the command described by in. The returned stdin is closed by the
+	// caller once all input is written.
+	Start(in *vmproto.ExecCommandRequest, stdout, stderr io.Writer) (Process, io.WriteCloser, error)
+}
+
+// Process is a command started by a CommandRunner.
+type Process interface {
+	// Wait waits until the process exited and returns its exit code, which is -1
+	// if the process was killed by a signal.
+	Wait() (int, error)
+	// Kill stops the process and all of its children.
+	Kill() error
+}
+
+// ExecRunner runs the commands as processes of the VM.
+type ExecRunner struct{}
+
+// Start starts the command in its own process group.
+func (ExecRunner) Start(in *vmproto.ExecCommandRequest, stdout, stderr io.Writer) (Process, io.WriteCloser, error) {
+	command := exec.Command(in.Command, in.Args...)
+	command.Env = append(os.Environ(), in.Env...)
+	command.Dir = in.Dir
+	command.Stdout = stdout
+	command.Stderr = stderr
+	// Killing the process group also stops the children, which would keep stdout open otherwise.
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := command.Start(); err != nil {
+		return nil, nil, err
+	}
+	return execProcess{command}, stdin, nil
+}
+
+type execProcess struct {
+	command *exec.Cmd
+}
+
+func (p execProcess) Wait() (int, error) {
+	err := p.command.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+func (p execProcess) Kill() error {
+	return syscall.Kill(-p.command.Process.Pid, syscall.SIGKILL)
+}
@@ -17,15 +17,19 @@ type API struct {
 	logger *zap.Logger
 	core   Core
 	dialer Dialer
+	runner CommandRunner
+	fs     FS
 	vmproto.UnimplementedAPIServer
 }
 
 // New creates a new API.
-func New(logger *zap.Logger, core Core, dialer Dialer) *API {
+func New(logger *zap.Logger, core Core, dialer Dialer, runner CommandRunner, fs FS) *API {
 	return &API{
 		logger: logger,
 		core:   core,
 		dialer: dialer,
+		runner: runner,
+		fs:     fs,
 	}
 }
 
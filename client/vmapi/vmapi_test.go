@@ -0,0 +1,351 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package vmapi_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/benschlueter/delegatio/client/vmapi"
+	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// bufDialer connects to an in-memory listener regardless of the address.
+type bufDialer struct {
+	lis *bufconn.Listener
+}
+
+func (d bufDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.lis.DialContext(ctx)
+}
+
+// newTestClient starts the API with runner and fs on a bufconn and returns a client connected to it.
+func newTestClient(t *testing.T, runner vmapi.CommandRunner, fs vmapi.FS) vmproto.APIClient {
+	t.Helper()
+	return newTestClientWithCore(t, nil, runner, fs)
+}
+
+// newTestClientWithCore is newTestClient with core, the server rejects calls until it is provisioned.
+func newTestClientWithCore(t *testing.T, core vmapi.Core, runner vmapi.CommandRunner, fs vmapi.FS) vmproto.APIClient {
+	t.Helper()
+	dialer := bufDialer{lis: bufconn.Listen(1 << 20)}
+	var opts []grpc.ServerOption
+	if core != nil {
+		opts = append(opts,
+			grpc.UnaryInterceptor(vmapi.ProvisionedUnaryInterceptor(core)),
+			grpc.StreamInterceptor(vmapi.ProvisionedStreamInterceptor(core)),
+		)
+	}
+	server := grpc.NewServer(opts...)
+	vmproto.RegisterAPIServer(server, vmapi.New(zaptest.NewLogger(t), core, dialer, runner, fs))
+	go func() { _ = server.Serve(dialer.lis) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", address)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return vmproto.NewAPIClient(conn)
+}
+
+// testContext returns a context which ends the test if a call blocks.
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// fakeCommand implements a command of the fakeRunner. ctx is canceled once the process is
+// killed, the return value is the exit code.
+type fakeCommand func(ctx context.Context, in *vmproto.ExecCommandRequest, stdin io.Reader, stdout, stderr io.Writer) int
+
+// fakeRunner runs the commands in goroutines instead of processes.
+type fakeRunner struct {
+	commands map[string]fakeCommand
+}
+
+func (r *fakeRunner) Start(in *vmproto.ExecCommandRequest, stdout, stderr io.Writer) (vmapi.Process, io.WriteCloser, error) {
+	command, ok := r.commands[in.Command]
+	if !ok {
+		return nil, nil, fmt.Errorf("exec: %q: %w", in.Command, exec.ErrNotFound)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stdinReader, stdinWriter := io.Pipe()
+	process := &fakeProcess{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		code := command(ctx, in, stdinReader, stdout, stderr)
+		// Like the pipe to an exited process, the remaining input is rejected.
+		_ = stdinReader.CloseWithError(io.ErrClosedPipe)
+		if ctx.Err() != nil {
+			code = -1
+		}
+		process.code = code
+		close(process.done)
+	}()
+	return process, stdinWriter, nil
+}
+
+type fakeProcess struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	code   int
+}
+
+func (p *fakeProcess) Wait() (int, error) {
+	<-p.done
+	p.cancel()
+	return p.code, nil
+}
+
+func (p *fakeProcess) Kill() error {
+	p.cancel()
+	return nil
+}
+
+// memFS is a file system in memory, it implements the subset of the semantics of the
+// os package the API relies on.
+type memFS struct {
+	mux   sync.Mutex
+	dirs  map[string]bool
+	files map[string]*memFile
+	temps int
+	// chownErr is returned by every call to Chown if set.
+	chownErr error
+}
+
+func newMemFS(dirs ...string) *memFS {
+	m := &memFS{dirs: map[string]bool{"/": true}, files: map[string]*memFile{}}
+	for _, dir := range dirs {
+		_ = m.MkdirAll(dir, 0o755)
+	}
+	return m
+}
+
+// file returns a copy of the file at name.
+func (m *memFS) file(name string) (memFile, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	file, ok := m.files[name]
+	if !ok {
+		return memFile{}, false
+	}
+	return memFile{name: file.name, data: append([]byte{}, file.data...), mode: file.mode, uid: file.uid, gid: file.gid}, true
+}
+
+// names returns the paths of all files.
+func (m *memFS) names() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	var names []string
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *memFS) MkdirAll(path string, perm fs.FileMode) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for dir := filepath.Clean(path); !m.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *memFS) CreateTemp(dir, pattern string) (vmapi.File, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !m.dirs[filepath.Clean(dir)] {
+		return nil, &fs.PathError{Op: "createtemp", Path: dir, Err: fs.ErrNotExist}
+	}
+	m.temps++
+	name := filepath.Join(dir, strings.Replace(pattern, "*", strconv.Itoa(m.temps), 1))
+	file := &memFile{fs: m, name: name, mode: 0o600, uid: os.Geteuid(), gid: os.Getegid()}
+	m.files[name] = file
+	return file, nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	file, ok := m.files[oldpath]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+	if !m.dirs[filepath.Dir(newpath)] {
+		return &fs.PathError{Op: "rename", Path: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	file.name = newpath
+	m.files[newpath] = file
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memFS) Open(name string) (io.ReadCloser, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.dirs[name] {
+		return io.NopCloser(iotest.ErrReader(&fs.PathError{Op: "read", Path: name, Err: syscall.EISDIR})), nil
+	}
+	file, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(append([]byte{}, file.data...))), nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	file, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.stat(name)
+}
+
+func (m *memFS) stat(name string) (fs.FileInfo, error) {
+	if m.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), mode: fs.ModeDir | 0o755}, nil
+	}
+	file, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memFileInfo{name: filepath.Base(name), size: int64(len(file.data)), mode: file.mode}, nil
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !m.dirs[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	var children []string
+	for dir := range m.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			children = append(children, dir)
+		}
+	}
+	for file := range m.files {
+		if filepath.Dir(file) == name {
+			children = append(children, file)
+		}
+	}
+	sort.Strings(children)
+	var entries []fs.DirEntry
+	for _, child := range children {
+		info, err := m.stat(child)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+type memFile struct {
+	fs       *memFS
+	name     string
+	data     []byte
+	mode     fs.FileMode
+	uid, gid int
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mux.Lock()
+	defer f.fs.mux.Unlock()
+	f.data = append(f.data, p...)
+	return len(p), nil
+}
+
+func (f *memFile) Name() string {
+	f.fs.mux.Lock()
+	defer f.fs.mux.Unlock()
+	return f.name
+}
+
+func (f *memFile) Chmod(mode fs.FileMode) error {
+	f.fs.mux.Lock()
+	defer f.fs.mux.Unlock()
+	f.mode = mode
+	return nil
+}
+
+func (f *memFile) Chown(uid, gid int) error {
+	f.fs.mux.Lock()
+	defer f.fs.mux.Unlock()
+	if f.fs.chownErr != nil {
+		return f.fs.chownErr
+	}
+	f.uid, f.gid = uid, gid
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	mode fs.FileMode
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memFileInfo) Sys() any           { return nil }
@@ -18,9 +18,32 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type APIClient interface {
-	ExecCommandStream(ctx context.Context, in *ExecCommandStreamRequest, opts ...grpc.CallOption) (API_ExecCommandStreamClient, error)
+	// ExecCommandStream runs a command and streams its output while it runs. The first request
+	// starts the command, the following ones are written to its stdin. Stdin is closed once the
+	// client closes its side of the stream. The last response carries the exit status.
+	ExecCommandStream(ctx context.Context, opts ...grpc.CallOption) (API_ExecCommandStreamClient, error)
 	ExecCommand(ctx context.Context, in *ExecCommandRequest, opts ...grpc.CallOption) (*ExecCommandResponse, error)
+	// WriteFile writes a small file at once, UploadFile streams large files in chunks.
+	// Both write to a temporary file which replaces the target once it is complete.
 	WriteFile(ctx context.Context, in *WriteFileRequest, opts ...grpc.CallOption) (*WriteFileResponse, error)
+	UploadFile(ctx context.Context, opts ...grpc.CallOption) (API_UploadFileClient, error)
+	// ReadFile streams the content of a file in chunks.
+	ReadFile(ctx context.Context, in *ReadFileRequest, opts ...grpc.CallOption) (API_ReadFileClient, error)
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
+	ListDir(ctx context.Context, in *ListDirRequest, opts ...grpc.CallOption) (*ListDirResponse, error)
+	// InitCluster runs kubeadm init, the node becomes the first control plane.
+	InitCluster(ctx context.Context, in *InitClusterRequest, opts ...grpc.CallOption) (*InitClusterResponse, error)
+	// JoinCluster runs kubeadm join, the node becomes a worker or an additional control plane.
+	JoinCluster(ctx context.Context, in *JoinClusterRequest, opts ...grpc.CallOption) (*JoinClusterResponse, error)
+	// ResetNode reverts the changes of InitCluster or JoinCluster.
+	ResetNode(ctx context.Context, in *ResetNodeRequest, opts ...grpc.CallOption) (*ResetNodeResponse, error)
+	// CreateJoinToken creates a bootstrap token on a control plane.
+	CreateJoinToken(ctx context.Context, in *CreateJoinTokenRequest, opts ...grpc.CallOption) (*CreateJoinTokenResponse, error)
+	// GetKubeconfig returns the admin kubeconfig of a control plane.
+	GetKubeconfig(ctx context.Context, in *GetKubeconfigRequest, opts ...grpc.CallOption) (*GetKubeconfigResponse, error)
+	// GetNodeInfo reports the state of the VM. The readiness of the agent itself is reported by
+	// the standard gRPC health service.
+	GetNodeInfo(ctx context.Context, in *GetNodeInfoRequest, opts ...grpc.CallOption) (*GetNodeInfoResponse, error)
 }
 
 type aPIClient struct {
@@ -31,22 +54,17 @@ func NewAPIClient(cc grpc.ClientConnInterface) APIClient {
 	return &aPIClient{cc}
 }
 
-func (c *aPIClient) ExecCommandStream(ctx context.Context, in *ExecCommandStreamRequest, opts ...grpc.CallOption) (API_ExecCommandStreamClient, error) {
+func (c *aPIClient) ExecCommandStream(ctx context.Context, opts ...grpc.CallOption) (API_ExecCommandStreamClient, error) {
 	stream, err := c.cc.NewStream(ctx, &API_ServiceDesc.Streams[0], "/vmapi.API/ExecCommandStream", opts...)
 	if err != nil {
 		return nil, err
 	}
 	x := &aPIExecCommandStreamClient{stream}
-	if err := x.ClientStream.SendMsg(in); err != nil {
-		return nil, err
-	}
-	if err := x.ClientStream.CloseSend(); err != nil {
-		return nil, err
-	}
 	return x, nil
 }
 
 type API_ExecCommandStreamClient interface {
+	Send(*ExecCommandStreamRequest) error
 	Recv() (*ExecCommandStreamResponse, error)
 	grpc.ClientStream
 }
@@ -55,6 +73,10 @@ type aPIExecCommandStreamClient struct {
 	grpc.ClientStream
 }
 
+func (x *aPIExecCommandStreamClient) Send(m *ExecCommandStreamRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
 func (x *aPIExecCommandStreamClient) Recv() (*ExecCommandStreamResponse, error) {
 	m := new(ExecCommandStreamResponse)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
@@ -81,13 +103,174 @@ func (c *aPIClient) WriteFile(ctx context.Context, in *WriteFileRequest, opts ..
 	return out, nil
 }
 
+func (c *aPIClient) UploadFile(ctx context.Context, opts ...grpc.CallOption) (API_UploadFileClient, error) {
+	stream, err := c.cc.NewStream(ctx, &API_ServiceDesc.Streams[1], "/vmapi.API/UploadFile", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &aPIUploadFileClient{stream}
+	return x, nil
+}
+
+type API_UploadFileClient interface {
+	Send(*UploadFileRequest) error
+	CloseAndRecv() (*UploadFileResponse, error)
+	grpc.ClientStream
+}
+
+type aPIUploadFileClient struct {
+	grpc.ClientStream
+}
+
+func (x *aPIUploadFileClient) Send(m *UploadFileRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *aPIUploadFileClient) CloseAndRecv() (*UploadFileResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UploadFileResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *aPIClient) ReadFile(ctx context.Context, in *ReadFileRequest, opts ...grpc.CallOption) (API_ReadFileClient, error) {
+	stream, err := c.cc.NewStream(ctx, &API_ServiceDesc.Streams[2], "/vmapi.API/ReadFile", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &aPIReadFileClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type API_ReadFileClient interface {
+	Recv() (*ReadFileResponse, error)
+	grpc.ClientStream
+}
+
+type aPIReadFileClient struct {
+	grpc.ClientStream
+}
+
+func (x *aPIReadFileClient) Recv() (*ReadFileResponse, error) {
+	m := new(ReadFileResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *aPIClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
+	out := new(StatResponse)
+	err := c.cc.Invoke(ctx, "/vmapi.API/Stat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) ListDir(ctx context.Context, in *ListDirRequest, opts ...grpc.CallOption) (*ListDirResponse, error) {
+	out := new(ListDirResponse)
+	err := c.cc.Invoke(ctx, "/vmapi.API/ListDir", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) InitCluster(ctx context.Context, in *InitClusterRequest, opts ...grpc.CallOption) (*InitClusterResponse, error) {
+	out := new(InitClusterResponse)
+	err := c.cc.Invoke(ctx, "/vmapi.API/InitCluster", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) JoinCluster(ctx context.Context, in *JoinClusterRequest, opts ...grpc.CallOption) (*JoinClusterResponse, error) {
+	out := new(JoinClusterResponse)
+	err := c.cc.Invoke(ctx, "/vmapi.API/JoinCluster", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) ResetNode(ctx context.Context, in *ResetNodeRequest, opts ...grpc.CallOption) (*ResetNodeResponse, error) {
+	out := new(ResetNodeResponse)
+	err := c.cc.Invoke(ctx, "/vmapi.API/ResetNode", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) CreateJoinToken(ctx context.Context, in *CreateJoinTokenRequest, opts ...grpc.CallOption) (*CreateJoinTokenResponse, error) {
+	out := new(CreateJoinTokenResponse)
+	err := c.cc.Invoke(ctx, "/vmapi.API/CreateJoinToken", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) GetKubeconfig(ctx context.Context, in *GetKubeconfigRequest, opts ...grpc.CallOption) (*GetKubeconfigResponse, error) {
+	out := new(GetKubeconfigResponse)
+	err := c.cc.Invoke(ctx, "/vmapi.API/GetKubeconfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aPIClient) GetNodeInfo(ctx context.Context, in *GetNodeInfoRequest, opts ...grpc.CallOption) (*GetNodeInfoResponse, error) {
+	out := new(GetNodeInfoResponse)
+	err := c.cc.Invoke(ctx, "/vmapi.API/GetNodeInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // APIServer is the server API for API service.
 // All implementations must embed UnimplementedAPIServer
 // for forward compatibility
 type APIServer interface {
-	ExecCommandStream(*ExecCommandStreamRequest, API_ExecCommandStreamServer) error
+	// ExecCommandStream runs a command and streams its output while it runs. The first request
+	// starts the command, the following ones are written to its stdin. Stdin is closed once the
+	// client closes its side of the stream. The last response carries the exit status.
+	ExecCommandStream(API_ExecCommandStreamServer) error
 	ExecCommand(context.Context, *ExecCommandRequest) (*ExecCommandResponse, error)
+	// WriteFile writes a small file at once, UploadFile streams large files in chunks.
+	// Both write to a temporary file which replaces the target once it is complete.
 	WriteFile(context.Context, *WriteFileRequest) (*WriteFileResponse, error)
+	UploadFile(API_UploadFileServer) error
+	// ReadFile streams the content of a file in chunks.
+	ReadFile(*ReadFileRequest, API_ReadFileServer) error
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
+	ListDir(context.Context, *ListDirRequest) (*ListDirResponse, error)
+	// InitCluster runs kubeadm init, the node becomes the first control plane.
+	InitCluster(context.Context, *InitClusterRequest) (*InitClusterResponse, error)
+	// JoinCluster runs kubeadm join, the node becomes a worker or an additional control plane.
+	JoinCluster(context.Context, *JoinClusterRequest) (*JoinClusterResponse, error)
+	// ResetNode reverts the changes of InitCluster or JoinCluster.
+	ResetNode(context.Context, *ResetNodeRequest) (*ResetNodeResponse, error)
+	// CreateJoinToken creates a bootstrap token on a control plane.
+	CreateJoinToken(context.Context, *CreateJoinTokenRequest) (*CreateJoinTokenResponse, error)
+	// GetKubeconfig returns the admin kubeconfig of a control plane.
+	GetKubeconfig(context.Context, *GetKubeconfigRequest) (*GetKubeconfigResponse, error)
+	// GetNodeInfo reports the state of the VM. The readiness of the agent itself is reported by
+	// the standard gRPC health service.
+	GetNodeInfo(context.Context, *GetNodeInfoRequest) (*GetNodeInfoResponse, error)
 	mustEmbedUnimplementedAPIServer()
 }
 
@@ -95,7 +278,7 @@ type APIServer interface {
 type UnimplementedAPIServer struct {
 }
 
-func (UnimplementedAPIServer) ExecCommandStream(*ExecCommandStreamRequest, API_ExecCommandStreamServer) error {
+func (UnimplementedAPIServer) ExecCommandStream(API_ExecCommandStreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method ExecCommandStream not implemented")
 }
 func (UnimplementedAPIServer) ExecCommand(context.Context, *ExecCommandRequest) (*ExecCommandResponse, error) {
@@ -104,6 +287,36 @@ func (UnimplementedAPIServer) ExecCommand(context.Context, *ExecCommandRequest)
 func (UnimplementedAPIServer) WriteFile(context.Context, *WriteFileRequest) (*WriteFileResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method WriteFile not implemented")
 }
+func (UnimplementedAPIServer) UploadFile(API_UploadFileServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadFile not implemented")
+}
+func (UnimplementedAPIServer) ReadFile(*ReadFileRequest, API_ReadFileServer) error {
+	return status.Errorf(codes.Unimplemented, "method ReadFile not implemented")
+}
+func (UnimplementedAPIServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedAPIServer) ListDir(context.Context, *ListDirRequest) (*ListDirResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDir not implemented")
+}
+func (UnimplementedAPIServer) InitCluster(context.Context, *InitClusterRequest) (*InitClusterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InitCluster not implemented")
+}
+func (UnimplementedAPIServer) JoinCluster(context.Context, *JoinClusterRequest) (*JoinClusterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method JoinCluster not implemented")
+}
+func (UnimplementedAPIServer) ResetNode(context.Context, *ResetNodeRequest) (*ResetNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResetNode not implemented")
+}
+func (UnimplementedAPIServer) CreateJoinToken(context.Context, *CreateJoinTokenRequest) (*CreateJoinTokenResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateJoinToken not implemented")
+}
+func (UnimplementedAPIServer) GetKubeconfig(context.Context, *GetKubeconfigRequest) (*GetKubeconfigResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetKubeconfig not implemented")
+}
+func (UnimplementedAPIServer) GetNodeInfo(context.Context, *GetNodeInfoRequest) (*GetNodeInfoResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetNodeInfo not implemented")
+}
 func (UnimplementedAPIServer) mustEmbedUnimplementedAPIServer() {}
 
 // UnsafeAPIServer may be embedded to opt out of forward compatibility for this service.
@@ -118,15 +331,12 @@ func RegisterAPIServer(s grpc.ServiceRegistrar, srv APIServer) {
 }
 
 func _API_ExecCommandStream_Handler(srv interface{}, stream grpc.ServerStream) error {
-	m := new(ExecCommandStreamRequest)
-	if err := stream.RecvMsg(m); err != nil {
-		return err
-	}
-	return srv.(APIServer).ExecCommandStream(m, &aPIExecCommandStreamServer{stream})
+	return srv.(APIServer).ExecCommandStream(&aPIExecCommandStreamServer{stream})
 }
 
 type API_ExecCommandStreamServer interface {
 	Send(*ExecCommandStreamResponse) error
+	Recv() (*ExecCommandStreamRequest, error)
 	grpc.ServerStream
 }
 
@@ -138,6 +348,14 @@ func (x *aPIExecCommandStreamServer) Send(m *ExecCommandStreamResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func (x *aPIExecCommandStreamServer) Recv() (*ExecCommandStreamRequest, error) {
+	m := new(ExecCommandStreamRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func _API_ExecCommand_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(ExecCommandRequest)
 	if err := dec(in); err != nil {
@@ -174,6 +392,197 @@ func _API_WriteFile_Handler(srv interface{}, ctx context.Context, dec func(inter
 	return interceptor(ctx, in, info, handler)
 }
 
+func _API_UploadFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(APIServer).UploadFile(&aPIUploadFileServer{stream})
+}
+
+type API_UploadFileServer interface {
+	SendAndClose(*UploadFileResponse) error
+	Recv() (*UploadFileRequest, error)
+	grpc.ServerStream
+}
+
+type aPIUploadFileServer struct {
+	grpc.ServerStream
+}
+
+func (x *aPIUploadFileServer) SendAndClose(m *UploadFileResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *aPIUploadFileServer) Recv() (*UploadFileRequest, error) {
+	m := new(UploadFileRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _API_ReadFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReadFileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(APIServer).ReadFile(m, &aPIReadFileServer{stream})
+}
+
+type API_ReadFileServer interface {
+	Send(*ReadFileResponse) error
+	grpc.ServerStream
+}
+
+type aPIReadFileServer struct {
+	grpc.ServerStream
+}
+
+func (x *aPIReadFileServer) Send(m *ReadFileResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _API_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/vmapi.API/Stat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_ListDir_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDirRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).ListDir(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/vmapi.API/ListDir",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).ListDir(ctx, req.(*ListDirRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_InitCluster_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InitClusterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).InitCluster(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/vmapi.API/InitCluster",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).InitCluster(ctx, req.(*InitClusterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_JoinCluster_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JoinClusterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).JoinCluster(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/vmapi.API/JoinCluster",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).JoinCluster(ctx, req.(*JoinClusterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_ResetNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResetNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).ResetNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/vmapi.API/ResetNode",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).ResetNode(ctx, req.(*ResetNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_CreateJoinToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateJoinTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).CreateJoinToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/vmapi.API/CreateJoinToken",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).CreateJoinToken(ctx, req.(*CreateJoinTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_GetKubeconfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetKubeconfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).GetKubeconfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/vmapi.API/GetKubeconfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).GetKubeconfig(ctx, req.(*GetKubeconfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _API_GetNodeInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetNodeInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(APIServer).GetNodeInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/vmapi.API/GetNodeInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(APIServer).GetNodeInfo(ctx, req.(*GetNodeInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // API_ServiceDesc is the grpc.ServiceDesc for API service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -189,12 +598,55 @@ var API_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "WriteFile",
 			Handler:    _API_WriteFile_Handler,
 		},
+		{
+			MethodName: "Stat",
+			Handler:    _API_Stat_Handler,
+		},
+		{
+			MethodName: "ListDir",
+			Handler:    _API_ListDir_Handler,
+		},
+		{
+			MethodName: "InitCluster",
+			Handler:    _API_InitCluster_Handler,
+		},
+		{
+			MethodName: "JoinCluster",
+			Handler:    _API_JoinCluster_Handler,
+		},
+		{
+			MethodName: "ResetNode",
+			Handler:    _API_ResetNode_Handler,
+		},
+		{
+			MethodName: "CreateJoinToken",
+			Handler:    _API_CreateJoinToken_Handler,
+		},
+		{
+			MethodName: "GetKubeconfig",
+			Handler:    _API_GetKubeconfig_Handler,
+		},
+		{
+			MethodName: "GetNodeInfo",
+			Handler:    _API_GetNodeInfo_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "ExecCommandStream",
 			Handler:       _API_ExecCommandStream_Handler,
 			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "UploadFile",
+			Handler:       _API_UploadFile_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ReadFile",
+			Handler:       _API_ReadFile_Handler,
+			ServerStreams: true,
 		},
 	},
 	Metadata: "vmapi.proto",
@@ -5,13 +5,18 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"net"
+	"os"
 
 	"github.com/benschlueter/delegatio/client/config"
+	"github.com/benschlueter/delegatio/client/metadata"
+	"github.com/benschlueter/delegatio/client/pki"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
@@ -19,6 +24,8 @@ func main() {
 	cfg := zap.NewDevelopmentConfig()
 
 	logLevelUser := flag.Bool("debug", false, "enables gRPC debug output")
+	pkiDir := flag.String("pki", config.PKIDir, "directory with the CA and the certificate of the agent, used without metadata")
+	metadataPath := flag.String("metadata", metadata.FWCfgPath, "file with the metadata of the node")
 	flag.Parse()
 	cfg.Level.SetLevel(zap.DebugLevel)
 
@@ -37,5 +44,24 @@ func main() {
 	bindPort = config.PublicAPIport
 	dialer := &net.Dialer{}
 
-	run(dialer, bindIP, bindPort, zapLoggerCore)
+	// Nodes without metadata use the certificates baked into the image.
+	md, err := metadata.Read(*metadataPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		zapLoggerCore.Info("no metadata found", zap.String("path", *metadataPath))
+		md = nil
+	case err != nil:
+		zapLoggerCore.Fatal("failed to read the metadata", zap.Error(err))
+	}
+	var creds credentials.TransportCredentials
+	if md != nil {
+		creds, err = pki.ServerCredentialsFromPEM(md.CACert, md.AgentCert, md.AgentKey)
+	} else {
+		creds, err = pki.ServerCredentials(*pkiDir)
+	}
+	if err != nil {
+		zapLoggerCore.Fatal("failed to load the agent certificates", zap.Error(err))
+	}
+
+	run(dialer, bindIP, bindPort, creds, md, zapLoggerCore)
 }
@@ -10,6 +10,7 @@ import (
 	"sync"
 
 	"github.com/benschlueter/delegatio/client/core"
+	"github.com/benschlueter/delegatio/client/metadata"
 	"github.com/benschlueter/delegatio/client/vmapi"
 	"github.com/benschlueter/delegatio/client/vmapi/vmproto"
 	"github.com/edgelesssys/constellation/coordinator/pubapi"
@@ -18,36 +19,46 @@ import (
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 var version = "0.0.0"
 
-func run(dialer pubapi.Dialer, bindIP, bindPort string, zapLoggerCore *zap.Logger,
+func run(dialer pubapi.Dialer, bindIP, bindPort string, creds credentials.TransportCredentials, md *metadata.Metadata, zapLoggerCore *zap.Logger,
 ) {
 	defer func() { _ = zapLoggerCore.Sync() }()
 	zapLoggerCore.Info("starting coordinator", zap.String("version", version))
 
-	core, err := core.NewCore(zapLoggerCore)
+	core, err := core.NewCore(zapLoggerCore, core.OSHost{})
 	if err != nil {
 		zapLoggerCore.Fatal("failed to create core", zap.Error(err))
 	}
 
-	vapi := vmapi.New(zapLoggerCore.Named("pubapi"), core, dialer)
+	vapi := vmapi.New(zapLoggerCore.Named("pubapi"), core, dialer, vmapi.ExecRunner{}, vmapi.OSFS{})
 
 	zapLoggergRPC := zapLoggerCore.Named("gRPC")
 	grpcServer := grpc.NewServer(
-		grpc.Creds(insecure.NewCredentials()),
+		// Only the CLI holds a client certificate of the CA, everybody else on the network is rejected.
+		grpc.Creds(creds),
 		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
 			grpc_ctxtags.StreamServerInterceptor(),
 			grpc_zap.StreamServerInterceptor(zapLoggergRPC),
+			vmapi.ProvisionedStreamInterceptor(core),
 		)),
 		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
 			grpc_ctxtags.UnaryServerInterceptor(),
 			grpc_zap.UnaryServerInterceptor(zapLoggergRPC),
+			vmapi.ProvisionedUnaryInterceptor(core),
 		)),
 	)
 	vmproto.RegisterAPIServer(grpcServer, vapi)
+	// The health service reports NOT_SERVING until the node is provisioned.
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthServer.SetServingStatus(vmproto.API_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
 
 	lis, err := net.Listen("tcp", net.JoinHostPort(bindIP, bindPort))
 	if err != nil {
@@ -64,4 +75,12 @@ func run(dialer pubapi.Dialer, bindIP, bindPort string, zapLoggerCore *zap.Logge
 			zapLoggergRPC.Fatal("failed to serve gRPC", zap.Error(err))
 		}
 	}()
+
+	// A node which failed to provision keeps serving, the calls return the reason.
+	if err := core.Provision(md); err != nil {
+		zapLoggerCore.Error("failed to provision the node", zap.Error(err))
+		return
+	}
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus(vmproto.API_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
 }
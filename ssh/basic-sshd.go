@@ -8,24 +8,32 @@ package main
 import (
 	"context"
 	"encoding/base64"
-	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/benschlueter/delegatio/cli/config"
 	"github.com/benschlueter/delegatio/cli/kubernetes"
+	"github.com/benschlueter/delegatio/cli/kubernetes/helpers"
+	"github.com/benschlueter/delegatio/ssh/kvstore"
+	"github.com/benschlueter/delegatio/ssh/userstore"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 	"k8s.io/client-go/tools/remotecommand"
 )
 
-// TODO: Add support for multiple users (i.e. network storage for sshRelay.users / sshRelay.publicKeys)
 // TODO: Add support for vscode ssh extension
 
 type sshRelay struct {
@@ -33,37 +41,94 @@ type sshRelay struct {
 	client             *kubernetes.Client
 	handleConnWG       *sync.WaitGroup
 	currentConnections int64
-	users              map[string]struct{}
-	publicKeys         map[string]struct{}
+	challenges         map[string]struct{}
+	users              userstore.UserStore
+	// kv is the state shared with the other relays, it is nil if the relay runs alone.
+	kv     *kvstore.Store
+	config *config.SSHConfig
+	// uploads counts the bytes the students sent, in kv if the relays share their state.
+	uploads uploadQuota
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to the config file of the course, the defaults are used if it is empty")
+	name := flag.String("name", "", "name of the relay in the replicated store, defaults to the hostname")
+	importUsers := flag.String("import-users", "", "path to a users file, which replaces the students in the replicated store")
+	flag.Parse()
 	logger := zap.NewExample()
-	client, err := kubernetes.NewK8sClient("admin.conf", logger.Named("k8sAPI"))
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logger.Fatal("loading config", zap.Error(err))
+	}
+	client, err := kubernetes.NewK8sClient(cfg.SSH.KubeconfigPath, cfg, logger.Named("k8sAPI"))
 	if err != nil {
 		panic(err)
 	}
-	relay := NewSSHRelay(client, logger)
-	relay.StartServer(context.Background())
+	ctx := context.Background()
+	var kv *kvstore.Store
+	if cfg.SSH.Store.Enabled() {
+		if *name == "" {
+			if *name, err = os.Hostname(); err != nil {
+				logger.Fatal("getting the hostname", zap.Error(err))
+			}
+		}
+		kv, err = kvstore.Open(ctx, kvstore.FromConfig(cfg.SSH.Store, *name), logger.Named("store"))
+		if err != nil {
+			logger.Fatal("opening the replicated store", zap.Error(err))
+		}
+		defer kv.Close()
+		go pruneAuditLog(ctx, kv, logger)
+	}
+	if *importUsers != "" {
+		if err := importUsersFile(ctx, kv, *importUsers); err != nil {
+			logger.Fatal("importing users", zap.Error(err))
+		}
+	}
+	users, err := userstore.New(ctx, cfg, client.Client.GetClient(), kv, logger.Named("users"))
+	if err != nil {
+		logger.Fatal("loading users", zap.Error(err))
+	}
+	go users.Watch(ctx)
+	go reloadOnHangup(ctx, users, logger)
+	relay := NewSSHRelay(client, cfg, users, kv, logger)
+	relay.StartServer(ctx)
+}
+
+// reloadOnHangup reloads the users whenever the relay receives SIGHUP.
+func reloadOnHangup(ctx context.Context, users userstore.UserStore, log *zap.Logger) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := users.Reload(ctx); err != nil {
+				log.Error("reloading users, keeping the previous users", zap.Error(err))
+			}
+		}
+	}
 }
 
-// NewSSHRelay returns a sshRelay.
-func NewSSHRelay(client *kubernetes.Client, log *zap.Logger) *sshRelay {
+// NewSSHRelay returns a sshRelay. Every challenge of the config is a ssh user, the students of
+// users may log into the challenges they are allowed to enter. Logins and sessions are recorded
+// in kv unless it is nil.
+func NewSSHRelay(client *kubernetes.Client, cfg *config.Config, users userstore.UserStore, kv *kvstore.Store, log *zap.Logger) *sshRelay {
+	challenges := make(map[string]struct{}, len(cfg.Challenges))
+	for _, challenge := range cfg.Challenges {
+		challenges[challenge.Name] = struct{}{}
+	}
 	return &sshRelay{
+		config:             &cfg.SSH,
 		client:             client,
 		log:                log,
 		handleConnWG:       &sync.WaitGroup{},
 		currentConnections: 0,
-		users: map[string]struct{}{
-			"testchallenge":  {},
-			"testchallenge1": {},
-			"testchallenge2": {},
-			"testchallenge3": {},
-			"testchallenge4": {},
-		},
-		publicKeys: map[string]struct{}{
-			"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDLYDO+DPlwJTKYU+S9Q1YkgC7lUJgfsq+V6VxmzdP+omp2EmEIEUsB8WFtr3kAgtAQntaCejJ9ITgoLimkoPs7bV1rA7BZZgRTL2sF+F5zJ1uXKNZz1BVeGGDDXHW5X5V/ZIlH5Bl4kNaAWGx/S5PIszkhyNXEkE6GHsSU4dz69rlutjSbwQRFLx8vjgdAxP9+jUbJMh9u5Dg1SrXiMYpzplJWFt/jI13dDlNTrhWW7790xhHur4fiQbhrVzru29BKNQtSywC+3eH2XKTzobK6h7ECS5X75ghemRIDPw32SHbQP7or1xI+MjFCrZsGyZr1L0yBFNkNAsztpWAqE2FZ": {},
-		},
+		challenges:         challenges,
+		users:              users,
+		kv:                 kv,
+		uploads:            newUploadQuota(kv),
 	}
 }
 
@@ -76,18 +141,23 @@ func (s *sshRelay) StartServer(ctx context.Context) {
 		// Function is called to determine if the user is allowed to connect with the ssh server
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 			s.log.Info("publickeycallback called", zap.String("user", conn.User()), zap.Binary("session", conn.SessionID()))
-			if _, ok := s.users[conn.User()]; !ok {
+			if _, ok := s.challenges[conn.User()]; !ok {
 				return nil, fmt.Errorf("user %s not in database", conn.User())
 			}
-			encodeKey := base64.StdEncoding.EncodeToString(key.Marshal())
-			compareKey := fmt.Sprintf("%s %s", key.Type(), encodeKey)
-			if _, ok := s.publicKeys[compareKey]; !ok {
-				return nil, fmt.Errorf("pubkey %v not in database", compareKey)
+			user, ok := s.users.Lookup(key)
+			if !ok {
+				return nil, fmt.Errorf("pubkey %s %s not in database", key.Type(), base64.StdEncoding.EncodeToString(key.Marshal()))
+			}
+			if !user.MayEnter(conn.User()) {
+				return nil, fmt.Errorf("%s may not enter %s", user.Name, conn.User())
 			}
 			return &ssh.Permissions{
 				Extensions: map[string]string{
 					"authType": "pk",
 					"pubKey":   strings.ToLower(ssh.FingerprintSHA256(key)[7:47]),
+					"userID":   user.Name,
+					// uploadLimit is the limit of non-interactive sessions in bytes.
+					"uploadLimit": strconv.FormatInt(s.uploadLimit(user), 10),
 				},
 			}, nil
 		},
@@ -95,9 +165,9 @@ func (s *sshRelay) StartServer(ctx context.Context) {
 	done := make(chan struct{})
 	go s.periodicLogs(done)
 
-	privateBytes, err := os.ReadFile("./server_test")
+	privateBytes, err := os.ReadFile(s.config.HostKeyPath)
 	if err != nil {
-		log.Fatal("Failed to load private key (./server_test)", err)
+		log.Fatalf("Failed to load private key (%s): %s", s.config.HostKeyPath, err)
 	}
 
 	private, err := ssh.ParsePrivateKey(privateBytes)
@@ -107,13 +177,13 @@ func (s *sshRelay) StartServer(ctx context.Context) {
 
 	config.AddHostKey(private)
 
-	listener, err := net.Listen("tcp", "0.0.0.0:2200")
+	listener, err := net.Listen("tcp", s.config.ListenAddress)
 	if err != nil {
-		log.Fatalf("Failed to listen on 2200 (%s)", err)
+		log.Fatalf("Failed to listen on %s (%s)", s.config.ListenAddress, err)
 	}
 	defer listener.Close()
 
-	s.log.Info("Listening on  \"0.0.0.0:2200\"")
+	s.log.Info("Listening", zap.String("address", s.config.ListenAddress))
 	go func(ctx context.Context) {
 		for {
 			tcpConn, err := listener.Accept()
@@ -145,6 +215,7 @@ func (s *sshRelay) handeConn(ctx context.Context, tcpConn net.Conn, config *ssh.
 	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, config)
 	if err != nil {
 		s.log.Info("failed to handshake", zap.Error(err))
+		s.audit(kvstore.AuditEvent{Type: kvstore.AuditLoginFailed, Addr: tcpConn.RemoteAddr().String(), Error: err.Error()})
 		return
 	}
 	defer sshConn.Close()
@@ -153,6 +224,27 @@ func (s *sshRelay) handeConn(ctx context.Context, tcpConn net.Conn, config *ssh.
 		s.log.Error("no permissions found in ssh connection")
 		return
 	}
+	event := kvstore.AuditEvent{
+		Type:        kvstore.AuditLogin,
+		User:        sshConn.Permissions.Extensions["userID"],
+		Challenge:   sshConn.User(),
+		Session:     hex.EncodeToString(sshConn.SessionID()),
+		Addr:        sshConn.RemoteAddr().String(),
+		Fingerprint: sshConn.Permissions.Extensions["pubKey"],
+	}
+	s.audit(event)
+	endSession := s.startSession(kvstore.Session{
+		ID:        event.Session,
+		User:      event.User,
+		Challenge: event.Challenge,
+		Addr:      event.Addr,
+		Started:   time.Now(),
+	})
+	defer func() {
+		endSession()
+		event.Type = kvstore.AuditLogout
+		s.audit(event)
+	}()
 	// if the connection is dead terminate it.
 	ctx, cancel := context.WithCancel(ctx)
 	done := make(chan struct{})
@@ -166,6 +258,7 @@ func (s *sshRelay) handeConn(ctx context.Context, tcpConn net.Conn, config *ssh.
 		zap.Binary("client version", sshConn.ClientVersion()),
 		zap.Binary("session", sshConn.SessionID()),
 		zap.String("keyFingerprint", sshConn.Permissions.Extensions["pubKey"]),
+		zap.String("userID", sshConn.Permissions.Extensions["userID"]),
 	)
 	// Discard all global out-of-band Requests.
 	// We dont care about graceful termination of this routine.
@@ -182,16 +275,21 @@ func (s *sshRelay) handeConn(ctx context.Context, tcpConn net.Conn, config *ssh.
 
 	// Check if the pods are ready and we can exec on them.
 	// Otherwise spawn the pods.
-	if err := s.client.CreateAndWaitForRessources(ctx, sshConn.User(), sshConn.Permissions.Extensions["pubKey"]); err != nil {
+	if err := s.client.CreateAndWaitForRessources(ctx, sshConn.User(), sshConn.Permissions.Extensions["userID"]); err != nil {
 		s.log.Error("creating/waiting for kubernetes ressources",
 			zap.Error(err),
-			zap.String("userID", sshConn.Permissions.Extensions["pubKey"]),
+			zap.String("userID", sshConn.Permissions.Extensions["userID"]),
 			zap.String("namespace", sshConn.User()),
 		)
 		return
 	}
 	// Accept all channels.
-	s.handleChannels(ctx, chans, sshConn.User(), sshConn.Permissions.Extensions["pubKey"])
+	uploadLimit, err := strconv.ParseInt(sshConn.Permissions.Extensions["uploadLimit"], 10, 64)
+	if err != nil {
+		s.log.Error("parsing the upload limit", zap.Error(err))
+		return
+	}
+	s.handleChannels(ctx, chans, sshConn.User(), sshConn.Permissions.Extensions["userID"], uploadLimit)
 	s.log.Info("closing ssh session",
 		zap.String("addr", sshConn.RemoteAddr().String()),
 		zap.Binary("client version", sshConn.ClientVersion()),
@@ -200,7 +298,7 @@ func (s *sshRelay) handeConn(ctx context.Context, tcpConn net.Conn, config *ssh.
 	)
 }
 
-func (s *sshRelay) handleChannels(ctx context.Context, chans <-chan ssh.NewChannel, namespace, userID string) {
+func (s *sshRelay) handleChannels(ctx context.Context, chans <-chan ssh.NewChannel, namespace, userID string, uploadLimit int64) {
 	// Service the incoming Channel channel in go routine
 	handleChannelWg := &sync.WaitGroup{}
 	defer handleChannelWg.Wait()
@@ -216,12 +314,14 @@ func (s *sshRelay) handleChannels(ctx context.Context, chans <-chan ssh.NewChann
 			}
 			handleChannelWg.Add(1)
 			s.log.Debug("handling new channel request")
-			go s.handleChannel(ctx, handleChannelWg, newChannel, namespace, userID)
+			go s.handleChannel(ctx, handleChannelWg, newChannel, namespace, userID, uploadLimit)
 		}
 	}
 }
 
-func (s *sshRelay) handleChannel(ctx context.Context, wg *sync.WaitGroup, newChannel ssh.NewChannel, namespace, userID string) {
+// handleChannel runs the session of newChannel in the pod of the student. The non-interactive
+// sessions of a student may send at most uploadLimit bytes into the pods in total, unless it is 0.
+func (s *sshRelay) handleChannel(ctx context.Context, wg *sync.WaitGroup, newChannel ssh.NewChannel, namespace, userID string, uploadLimit int64) {
 	defer wg.Done()
 
 	// Since we're handling a shell, we expect a
@@ -253,60 +353,67 @@ func (s *sshRelay) handleChannel(ctx context.Context, wg *sync.WaitGroup, newCha
 	}(s.log)
 
 	window := &Winsize{
-		Queue: make(chan *remotecommand.TerminalSize),
+		Queue: make(chan *remotecommand.TerminalSize, 1),
 	}
+	start := make(chan sessionCommand, 1)
+	// Sessions have out-of-band requests such as "shell", "exec", "pty-req" and "env".
+	go s.handleSessionRequests(requests, window, start)
 
-	// Sessions have out-of-band requests such as "shell", "pty-req" and "env"
-	go func(<-chan *ssh.Request) {
-		for req := range requests {
-			s.log.Debug("received data over request channel", zap.Any("req", req))
-			switch req.Type {
-			case "shell":
-				// We only accept the default shell
-				// (i.e. no command in the Payload)
-				if len(req.Payload) != 0 {
-					s.log.Error("failled to respond to \"shell\" request", zap.Error(err))
-					continue
-				}
-				if err := req.Reply(true, nil); err != nil {
-					s.log.Error("failled to respond to \"shell\" request", zap.Error(err))
-				}
-			case "pty-req":
-				termLen := req.Payload[3]
-				window.Queue <- parseDims(req.Payload[termLen+4:])
-				// Responding true (OK) here will let the client
-				// know we have a pty ready for input
-				if err := req.Reply(true, nil); err != nil {
-					s.log.Error("failled to respond to \"pty-req\" request", zap.Error(err))
-				}
-			case "window-change":
-				window.Queue <- parseDims(req.Payload)
-			}
+	var cmd sessionCommand
+	select {
+	case <-ctx.Done():
+		return
+	case c, ok := <-start:
+		if !ok {
+			return
 		}
-	}(requests)
+		cmd = c
+	}
+	var resizeQueue remotecommand.TerminalSizeQueue
+	if cmd.tty() {
+		resizeQueue = window
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stdin io.Reader = channel
+	var upload *uploadLimiter
+	if !cmd.interactive() && uploadLimit > 0 {
+		upload = &uploadLimiter{ctx: ctx, r: channel, user: userID, limit: uploadLimit, quota: s.uploads, exceeded: cancel}
+		stdin = upload
+	}
 	// Fire up "kubectl exec" for this session
-	err = s.client.CreatePodShell(ctx,
+	err = s.client.ExecInPod(ctx,
 		namespace,
 		fmt.Sprintf("%s-statefulset-0", userID),
-		channel,
-		channel,
-		channel,
-		window)
-	if err != nil {
-		s.log.Error("createPodShell exited with errorcode", zap.Error(err))
-		_, _ = channel.Write([]byte(fmt.Sprintf("closing connection, reason: %v", err)))
-		return
+		helpers.ExecOptions{
+			Command:           cmd.podCommand(),
+			TTY:               cmd.tty(),
+			Stdin:             stdin,
+			Stdout:            channel,
+			Stderr:            channel.Stderr(),
+			TerminalSizeQueue: resizeQueue,
+		})
+	status := exitCode(err)
+	if upload != nil {
+		releaseCtx, cancelRelease := context.WithTimeout(context.Background(), storeTimeout)
+		if err := upload.release(releaseCtx); err != nil {
+			s.log.Error("failed to release the reserved upload quota", zap.String("userID", userID), zap.Error(err))
+		}
+		cancelRelease()
 	}
-	_, _ = channel.Write([]byte("graceful termination"))
-}
-
-// parseDims extracts terminal dimensions (width x height) from the provided buffer.
-func parseDims(b []byte) *remotecommand.TerminalSize {
-	w := binary.BigEndian.Uint32(b)
-	h := binary.BigEndian.Uint32(b[4:])
-	return &remotecommand.TerminalSize{
-		Width:  uint16(w),
-		Height: uint16(h),
+	if upload != nil && upload.limitExceeded() {
+		s.log.Info("upload limit exceeded", zap.String("userID", userID), zap.Int64("limit", uploadLimit))
+		_, _ = channel.Stderr().Write([]byte(fmt.Sprintf("closing connection, reason: upload limit of %d bytes exceeded\r\n", uploadLimit)))
+		status = exitStatusFailure
+	} else if err != nil && status == exitStatusFailure {
+		s.log.Error("exec in pod exited with error", zap.Error(err))
+		_, _ = channel.Stderr().Write([]byte(fmt.Sprintf("closing connection, reason: %v\r\n", err)))
+	}
+	if err := channel.CloseWrite(); err != nil {
+		s.log.Debug("failed to send EOF", zap.Error(err))
+	}
+	if _, err := channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: status})); err != nil {
+		s.log.Error("failed to send the exit status", zap.Error(err))
 	}
 }
 
@@ -315,11 +422,27 @@ type Winsize struct {
 	Queue chan *remotecommand.TerminalSize
 }
 
-// Next sets the size.
+// Next sets the size. It returns nil once the queue is closed.
 func (w *Winsize) Next() *remotecommand.TerminalSize {
 	return <-w.Queue
 }
 
+// push replaces a pending size with size, so requests are never blocked by a slow reader.
+// It must only be called by one goroutine.
+func (w *Winsize) push(size *remotecommand.TerminalSize) {
+	for {
+		select {
+		case w.Queue <- size:
+			return
+		default:
+		}
+		select {
+		case <-w.Queue:
+		default:
+		}
+	}
+}
+
 func (s *sshRelay) keepAlive(cancel context.CancelFunc, sshConn *ssh.ServerConn, done <-chan struct{}) {
 	t := time.NewTicker(10 * time.Second)
 	defer t.Stop()
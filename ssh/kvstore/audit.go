@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// auditPrefix is the prefix of the audit log, the keys are audit/<unix nano>-<relay>-<counter>
+// so the log is ordered by time.
+const auditPrefix = "audit/"
+
+// Types of audit events.
+const (
+	AuditLogin       = "login"
+	AuditLoginFailed = "login-failed"
+	AuditLogout      = "logout"
+)
+
+// AuditEvent is an entry of the audit log.
+type AuditEvent struct {
+	Time        time.Time `json:"time"`
+	Relay       string    `json:"relay"`
+	Type        string    `json:"type"`
+	User        string    `json:"user,omitempty"`
+	Challenge   string    `json:"challenge,omitempty"`
+	Session     string    `json:"session,omitempty"`
+	Addr        string    `json:"addr,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// auditCounter tells apart the events of a relay in the same nanosecond.
+var auditCounter atomic.Uint64
+
+// auditKey returns the first key of the audit log at t.
+func auditKey(t time.Time) string {
+	return fmt.Sprintf("%s%020d", auditPrefix, t.UnixNano())
+}
+
+// Audit appends event to the audit log. Time defaults to now and Relay is set to the relay.
+func (s *Store) Audit(ctx context.Context, event AuditEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Relay = s.name
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s-%s-%d", auditKey(event.Time), s.name, auditCounter.Add(1))
+	return s.Put(ctx, key, value)
+}
+
+// AuditLog returns the events of all relays since since, ordered by time.
+func (s *Store) AuditLog(ctx context.Context, since time.Time) ([]AuditEvent, error) {
+	values, err := s.listRange(ctx, auditKey(since), clientv3.GetPrefixRangeEnd(keyPrefix+auditPrefix))
+	if err != nil {
+		return nil, err
+	}
+	events := make([]AuditEvent, 0, len(values))
+	for _, value := range values {
+		var event AuditEvent
+		if err := json.Unmarshal(value, &event); err != nil {
+			return nil, fmt.Errorf("decoding audit event: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// PruneAudit removes the events before before and returns how many were removed.
+func (s *Store) PruneAudit(ctx context.Context, before time.Time) (int64, error) {
+	return s.deleteRange(ctx, auditPrefix, auditKey(before))
+}
@@ -0,0 +1,287 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package kvstore keeps the state of the ssh relays in etcd, so several relays behind one
+// address share the same view. Every relay either runs a member of an embedded etcd cluster
+// or connects to an external cluster.
+//
+// Reads are served by the member the relay is connected to without asking the leader. They
+// keep working while the cluster has no leader, but might miss the latest writes.
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+)
+
+const (
+	// keyPrefix separates the keys of delegatio from others in an external cluster.
+	keyPrefix = "/delegatio/"
+	// clusterToken is the initial cluster token of the embedded members.
+	clusterToken = "delegatio-relay"
+	// dialTimeout is the time the client has to connect to a member.
+	dialTimeout = 5 * time.Second
+)
+
+// ErrNotFound is returned by Get if the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// Config describes the store of one relay.
+type Config struct {
+	// Name identifies the relay in sessions and audit events and names its embedded member.
+	Name string
+	// Endpoints are the client URLs of an external etcd cluster.
+	Endpoints []string
+	// Members maps the names of the embedded members to their peer URLs, it must contain Name.
+	Members map[string]string
+	// ClientURL is where the embedded member serves the relay.
+	ClientURL string
+	// DataDir is the directory of the embedded member.
+	DataDir string
+	// ClientTLS secures the connection of the relay to the cluster and the client URL of the
+	// embedded member, PeerTLS the connections between the embedded members.
+	ClientTLS config.TLSFiles
+	PeerTLS   config.TLSFiles
+}
+
+// FromConfig returns the store of the relay called name.
+func FromConfig(cfg config.StoreConfig, name string) Config {
+	return Config{
+		Name:      name,
+		Endpoints: cfg.Endpoints,
+		Members:   cfg.Members,
+		ClientURL: cfg.ClientURL,
+		DataDir:   cfg.DataDir,
+		ClientTLS: cfg.ClientTLS,
+		PeerTLS:   cfg.PeerTLS,
+	}
+}
+
+// tlsInfo returns the TLS settings of etcd for files. Both sides have to present a
+// certificate signed by the CA.
+func tlsInfo(files config.TLSFiles) transport.TLSInfo {
+	return transport.TLSInfo{
+		CertFile:       files.Cert,
+		KeyFile:        files.Key,
+		TrustedCAFile:  files.CACert,
+		ClientCertAuth: true,
+	}
+}
+
+// Store is the state shared by the relays.
+type Store struct {
+	log    *zap.Logger
+	name   string
+	member *embed.Etcd
+	client *clientv3.Client
+	// closeOnce guards Close, the embedded member can only be stopped once.
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Open starts the embedded member and connects to the cluster. The embedded member blocks
+// until a quorum of the members is up, it is stopped if ctx ends before.
+func Open(ctx context.Context, cfg Config, log *zap.Logger) (*Store, error) {
+	s := &Store{log: log, name: cfg.Name}
+	endpoints := cfg.Endpoints
+	if len(cfg.Members) > 0 {
+		member, err := startMember(ctx, cfg, log)
+		if err != nil {
+			return nil, err
+		}
+		s.member = member
+		endpoints = []string{cfg.ClientURL}
+	}
+	tlsConfig, err := tlsInfo(cfg.ClientTLS).ClientConfig()
+	if err == nil {
+		s.client, err = clientv3.New(clientv3.Config{
+			Endpoints:   endpoints,
+			DialTimeout: dialTimeout,
+			TLS:         tlsConfig,
+			Logger:      log.Named("etcd-client").WithOptions(zap.IncreaseLevel(zap.WarnLevel)),
+		})
+	}
+	if err != nil {
+		if s.member != nil {
+			s.member.Close()
+		}
+		return nil, fmt.Errorf("connecting to %v: %w", endpoints, err)
+	}
+	return s, nil
+}
+
+// startMember starts the embedded member of the relay and waits until it joined the cluster.
+func startMember(ctx context.Context, cfg Config, log *zap.Logger) (*embed.Etcd, error) {
+	peerURL, ok := cfg.Members[cfg.Name]
+	if !ok {
+		return nil, fmt.Errorf("relay %q is not a member of the store", cfg.Name)
+	}
+	memberCfg := embed.NewConfig()
+	memberCfg.Name = cfg.Name
+	memberCfg.Dir = cfg.DataDir
+	memberCfg.InitialClusterToken = clusterToken
+	memberCfg.ClusterState = embed.ClusterStateFlagNew
+	memberCfg.ZapLoggerBuilder = embed.NewZapLoggerBuilder(log.Named("etcd").WithOptions(zap.IncreaseLevel(zap.WarnLevel)))
+	memberCfg.ClientTLSInfo = tlsInfo(cfg.ClientTLS)
+	memberCfg.PeerTLSInfo = tlsInfo(cfg.PeerTLS)
+	var err error
+	if memberCfg.APUrls, memberCfg.LPUrls, err = memberURLs(peerURL); err != nil {
+		return nil, err
+	}
+	if memberCfg.ACUrls, memberCfg.LCUrls, err = memberURLs(cfg.ClientURL); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(cfg.Members))
+	for name := range cfg.Members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	initialCluster := make([]string, 0, len(names))
+	for _, name := range names {
+		initialCluster = append(initialCluster, name+"="+cfg.Members[name])
+	}
+	memberCfg.InitialCluster = strings.Join(initialCluster, ",")
+
+	log.Info("starting the member of the store", zap.String("name", cfg.Name), zap.String("cluster", memberCfg.InitialCluster))
+	member, err := embed.StartEtcd(memberCfg)
+	if err != nil {
+		return nil, fmt.Errorf("starting the member of the store: %w", err)
+	}
+	select {
+	case <-member.Server.ReadyNotify():
+		return member, nil
+	case err := <-member.Err():
+		member.Close()
+		return nil, fmt.Errorf("starting the member of the store: %w", err)
+	case <-ctx.Done():
+		member.Close()
+		return nil, fmt.Errorf("waiting for the quorum of the store: %w", ctx.Err())
+	}
+}
+
+// memberURLs returns the advertised URL and the URL a member listens on. etcd only listens on
+// addresses, a member with a host name listens on all interfaces.
+func memberURLs(rawURL string) ([]url.URL, []url.URL, error) {
+	advertise, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	listen := *advertise
+	if net.ParseIP(advertise.Hostname()) == nil {
+		listen.Host = net.JoinHostPort("0.0.0.0", advertise.Port())
+	}
+	return []url.URL{*advertise}, []url.URL{listen}, nil
+}
+
+// Close disconnects from the cluster and stops the embedded member.
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.client.Close()
+		if s.member != nil {
+			s.member.Close()
+		}
+	})
+	return s.closeErr
+}
+
+// Name returns the name of the relay.
+func (s *Store) Name() string {
+	return s.name
+}
+
+// Get returns the value of key and the revision of the store at the time of the read.
+// The read is served by the local member, see the package documentation.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, int64, error) {
+	resp, err := s.client.Get(ctx, keyPrefix+key, clientv3.WithSerializable())
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return resp.Kvs[0].Value, resp.Header.Revision, nil
+}
+
+// Put sets the value of key.
+func (s *Store) Put(ctx context.Context, key string, value []byte) error {
+	_, err := s.client.Put(ctx, keyPrefix+key, string(value))
+	return err
+}
+
+// Delete removes key.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.Delete(ctx, keyPrefix+key)
+	return err
+}
+
+// list returns the values of all keys with prefix in the order of the keys. The read is
+// served by the local member, see the package documentation.
+func (s *Store) list(ctx context.Context, prefix string) ([][]byte, error) {
+	return s.listRange(ctx, prefix, clientv3.GetPrefixRangeEnd(keyPrefix+prefix))
+}
+
+// listRange returns the values of all keys from start up to the absolute key end, which is
+// excluded, in the order of the keys.
+func (s *Store) listRange(ctx context.Context, start, end string) ([][]byte, error) {
+	resp, err := s.client.Get(ctx, keyPrefix+start, clientv3.WithRange(end), clientv3.WithSerializable())
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		values = append(values, kv.Value)
+	}
+	return values, nil
+}
+
+// Event is a change of a key.
+type Event struct {
+	Value []byte
+	// Revision is the revision of the store which contains the change.
+	Revision int64
+	// Deleted is set if the key was removed, Value is empty then.
+	Deleted bool
+}
+
+// Watch calls fn for every change of key since the revision fromRevision until ctx ends.
+// It returns an error if the watch fails, i.e. because the revision was compacted or the
+// member lost the leader.
+func (s *Store) Watch(ctx context.Context, key string, fromRevision int64, fn func(Event)) error {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	for resp := range s.client.Watch(ctx, keyPrefix+key, clientv3.WithRev(fromRevision)) {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		for _, event := range resp.Events {
+			fn(Event{Value: event.Kv.Value, Revision: event.Kv.ModRevision, Deleted: event.Type == clientv3.EventTypeDelete})
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.New("watch closed")
+}
+
+// deleteRange removes all keys from start up to end, which is excluded.
+func (s *Store) deleteRange(ctx context.Context, start, end string) (int64, error) {
+	resp, err := s.client.Delete(ctx, keyPrefix+start, clientv3.WithRange(keyPrefix+end))
+	if err != nil {
+		return 0, err
+	}
+	return resp.Deleted, nil
+}
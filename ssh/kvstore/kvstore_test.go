@@ -0,0 +1,316 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package kvstore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/ssh/kvstore"
+	"github.com/benschlueter/delegatio/ssh/kvstore/kvstoretest"
+	"go.uber.org/zap/zaptest"
+)
+
+// newCluster starts an embedded cluster with a relay per name. The members are started at
+// once, every member waits for the quorum.
+func newCluster(t *testing.T, names ...string) []*kvstore.Store {
+	t.Helper()
+	members := make(map[string]string, len(names))
+	for _, name := range names {
+		members[name] = kvstoretest.FreeURL(t)
+	}
+	dir := t.TempDir()
+	clientTLS, peerTLS := kvstoretest.NewTLS(t), kvstoretest.NewTLS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	stores := make([]*kvstore.Store, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			stores[i], errs[i] = kvstore.Open(ctx, kvstore.Config{
+				Name:      name,
+				Members:   members,
+				ClientURL: kvstoretest.FreeURL(t),
+				DataDir:   filepath.Join(dir, name),
+				ClientTLS: clientTLS,
+				PeerTLS:   peerTLS,
+			}, zaptest.NewLogger(t).Named(name))
+		}(i, name)
+	}
+	wg.Wait()
+	for i, store := range stores {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		store := store
+		t.Cleanup(func() { store.Close() })
+	}
+	return stores
+}
+
+// eventually calls fn until it succeeds or 10 seconds passed.
+func eventually(t *testing.T, fn func() error) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	stores := newCluster(t, "relay-0", "relay-1", "relay-2")
+	ctx := context.Background()
+	if _, _, err := stores[1].Get(ctx, "missing"); !errors.Is(err, kvstore.ErrNotFound) {
+		t.Fatalf("missing key: got %v, want ErrNotFound", err)
+	}
+	if err := stores[0].Put(ctx, "greeting", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range stores {
+		store := store
+		eventually(t, func() error {
+			value, _, err := store.Get(ctx, "greeting")
+			if err != nil {
+				return err
+			}
+			if string(value) != "hello" {
+				return fmt.Errorf("%s read %q, want hello", store.Name(), value)
+			}
+			return nil
+		})
+	}
+
+	// Without a quorum the cluster has no leader, the last member still serves reads.
+	stores[0].Close()
+	stores[1].Close()
+	readCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	value, _, err := stores[2].Get(readCtx, "greeting")
+	if err != nil {
+		t.Fatalf("reading without a leader: %v", err)
+	}
+	if string(value) != "hello" {
+		t.Errorf("read %q without a leader, want hello", value)
+	}
+}
+
+func TestClientAuthentication(t *testing.T) {
+	clientTLS := kvstoretest.NewTLS(t)
+	clientURL := kvstoretest.FreeURL(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	member, err := kvstore.Open(ctx, kvstore.Config{
+		Name:      "relay-0",
+		Members:   map[string]string{"relay-0": kvstoretest.FreeURL(t)},
+		ClientURL: clientURL,
+		DataDir:   t.TempDir(),
+		ClientTLS: clientTLS,
+		PeerTLS:   kvstoretest.NewTLS(t),
+	}, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer member.Close()
+	if err := member.Put(ctx, "key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		clientTLS config.TLSFiles
+		wantErr   bool
+	}{
+		"certificate of the CA": {clientTLS: clientTLS},
+		"foreign certificate":   {clientTLS: kvstoretest.NewTLS(t), wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			relay, err := kvstore.Open(ctx, kvstore.Config{
+				Name:      "relay-1",
+				Endpoints: []string{clientURL},
+				ClientTLS: tc.clientTLS,
+			}, zaptest.NewLogger(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer relay.Close()
+			readCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
+			_, _, err = relay.Get(readCtx, "key")
+			if tc.wantErr != (err != nil) {
+				t.Errorf("got error %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	stores := newCluster(t, "relay-0")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := stores[0].Put(ctx, "key", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	_, revision, err := stores[0].Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan kvstore.Event, 2)
+	done := make(chan error)
+	go func() {
+		done <- stores[0].Watch(ctx, "key", revision+1, func(event kvstore.Event) { events <- event })
+	}()
+	if err := stores[0].Put(ctx, "key", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[0].Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event.Deleted || string(event.Value) != "second" {
+		t.Errorf("first event %+v, want the value second", event)
+	}
+	if event := <-events; !event.Deleted {
+		t.Errorf("second event %+v, want the deletion", event)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("watch ended with %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	stores := newCluster(t, "relay-0", "relay-1")
+	ctx := context.Background()
+	end, err := stores[0].StartSession(ctx, kvstore.Session{ID: "abc", User: "alice", Challenge: "web", Started: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() error {
+		sessions, err := stores[1].Sessions(ctx)
+		if err != nil {
+			return err
+		}
+		if len(sessions) != 1 || sessions[0].ID != "abc" || sessions[0].Relay != "relay-0" || sessions[0].User != "alice" {
+			return fmt.Errorf("sessions %+v, want the session of alice on relay-0", sessions)
+		}
+		return nil
+	})
+	end()
+	eventually(t, func() error {
+		sessions, err := stores[1].Sessions(ctx)
+		if err != nil {
+			return err
+		}
+		if len(sessions) != 0 {
+			return fmt.Errorf("ended sessions %+v are still recorded", sessions)
+		}
+		return nil
+	})
+}
+
+func TestAudit(t *testing.T) {
+	stores := newCluster(t, "relay-0")
+	ctx := context.Background()
+	start := time.Now()
+	for i, eventType := range []string{kvstore.AuditLogin, kvstore.AuditLogout, kvstore.AuditLoginFailed} {
+		if err := stores[0].Audit(ctx, kvstore.AuditEvent{Time: start.Add(time.Duration(i) * time.Hour), Type: eventType, User: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := stores[0].AuditLog(ctx, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Type != kvstore.AuditLogout || events[1].Type != kvstore.AuditLoginFailed {
+		t.Fatalf("events %+v, want the logout and the failed login", events)
+	}
+	if events[0].Relay != "relay-0" {
+		t.Errorf("relay %q, want relay-0", events[0].Relay)
+	}
+
+	pruned, err := stores[0].PruneAudit(ctx, start.Add(90*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Errorf("pruned %d events, want 2", pruned)
+	}
+	events, err = stores[0].AuditLog(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != kvstore.AuditLoginFailed {
+		t.Errorf("events %+v after pruning, want the failed login", events)
+	}
+}
+
+func TestUploads(t *testing.T) {
+	stores := newCluster(t, "relay-0", "relay-1")
+	ctx := context.Background()
+	const limit = 1000
+
+	// The relays count concurrently, together they never pass the limit.
+	var wg sync.WaitGroup
+	added := make([]int64, 20)
+	errs := make([]error, len(added))
+	for i := range added {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			added[i], errs[i] = stores[i%2].AddUpload(ctx, "alice", 100, limit)
+		}(i)
+	}
+	wg.Wait()
+	var total int64
+	for i, n := range added {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		total += n
+	}
+	if total != limit {
+		t.Errorf("added %d bytes in total, want %d", total, limit)
+	}
+
+	// The steps depend on each other, they run in order.
+	steps := []struct {
+		name    string
+		user    string
+		n       int64
+		wantAdd int64
+	}{
+		{name: "limit reached", user: "alice", n: 1, wantAdd: 0},
+		{name: "bytes given back", user: "alice", n: -300, wantAdd: -300},
+		{name: "more than sent given back", user: "bob", n: -10, wantAdd: 0},
+		{name: "other student", user: "bob", n: 600, wantAdd: 600},
+	}
+	for _, step := range steps {
+		got, err := stores[1].AddUpload(ctx, step.user, step.n, limit)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got != step.wantAdd {
+			t.Errorf("%s: added %d, want %d", step.name, got, step.wantAdd)
+		}
+	}
+}
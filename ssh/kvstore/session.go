@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// sessionsPrefix is the prefix of the sessions, the keys are sessions/<relay>/<id>.
+	sessionsPrefix = "sessions/"
+	// sessionTTL is the time in seconds until the session of a dead relay expires.
+	sessionTTL = 30
+	// endTimeout is the time the relay has to remove an ended session.
+	endTimeout = 5 * time.Second
+)
+
+// Session is a connection of a student to a challenge.
+type Session struct {
+	ID        string    `json:"id"`
+	Relay     string    `json:"relay"`
+	User      string    `json:"user"`
+	Challenge string    `json:"challenge"`
+	Addr      string    `json:"addr"`
+	Started   time.Time `json:"started"`
+}
+
+// StartSession records session until the returned function is called. The session is bound
+// to a lease which the relay keeps alive, it expires if the relay dies.
+func (s *Store) StartSession(ctx context.Context, session Session) (func(), error) {
+	session.Relay = s.name
+	value, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	lease, err := s.client.Grant(ctx, sessionTTL)
+	if err != nil {
+		return nil, fmt.Errorf("granting the lease of session %s: %w", session.ID, err)
+	}
+	key := keyPrefix + sessionsPrefix + s.name + "/" + session.ID
+	if _, err := s.client.Put(ctx, key, string(value), clientv3.WithLease(lease.ID)); err != nil {
+		return nil, fmt.Errorf("recording session %s: %w", session.ID, err)
+	}
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	keepAlive, err := s.client.KeepAlive(keepAliveCtx, lease.ID)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("keeping session %s alive: %w", session.ID, err)
+	}
+	go func() {
+		for range keepAlive {
+		}
+	}()
+	return func() {
+		cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), endTimeout)
+		defer cancel()
+		if _, err := s.client.Revoke(ctx, lease.ID); err != nil {
+			s.log.Error("removing session, it expires with its lease", zap.String("session", session.ID), zap.Error(err))
+		}
+	}, nil
+}
+
+// Sessions returns the sessions of all relays.
+func (s *Store) Sessions(ctx context.Context) ([]Session, error) {
+	values, err := s.list(ctx, sessionsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]Session, 0, len(values))
+	for _, value := range values {
+		var session Session
+		if err := json.Unmarshal(value, &session); err != nil {
+			return nil, fmt.Errorf("decoding session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// uploadsPrefix is the prefix of the upload counters, the keys are uploads/<user>.
+const uploadsPrefix = "uploads/"
+
+// AddUpload adds n bytes to the bytes user sent into their pods, but not beyond limit, and
+// returns how many of them were added. A negative n gives bytes back. The counters are shared
+// by all relays, they are updated with a compare-and-swap.
+func (s *Store) AddUpload(ctx context.Context, user string, n, limit int64) (int64, error) {
+	key := keyPrefix + uploadsPrefix + user
+	for {
+		resp, err := s.client.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		// A missing key has the revision 0.
+		var sent, revision int64
+		if len(resp.Kvs) > 0 {
+			if sent, err = strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64); err != nil {
+				return 0, fmt.Errorf("upload counter of %s: %w", user, err)
+			}
+			revision = resp.Kvs[0].ModRevision
+		}
+		add := clampUpload(sent, n, limit)
+		txn, err := s.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+			Then(clientv3.OpPut(key, strconv.FormatInt(sent+add, 10))).
+			Commit()
+		if err != nil {
+			return 0, err
+		}
+		if txn.Succeeded {
+			return add, nil
+		}
+	}
+}
+
+// clampUpload returns how many of n bytes can be added to sent without exceeding limit or
+// dropping below 0.
+func clampUpload(sent, n, limit int64) int64 {
+	if n > 0 {
+		remaining := limit - sent
+		if remaining < 0 {
+			remaining = 0
+		}
+		if n > remaining {
+			return remaining
+		}
+		return n
+	}
+	if n < -sent {
+		return -sent
+	}
+	return n
+}
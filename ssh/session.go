@@ -0,0 +1,325 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/benschlueter/delegatio/ssh/kvstore"
+	"github.com/benschlueter/delegatio/ssh/userstore"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+)
+
+// The payloads of the session requests, see RFC 4254 section 6.
+type (
+	ptyRequest struct {
+		Term    string
+		Columns uint32
+		Rows    uint32
+		Width   uint32
+		Height  uint32
+		Modes   string
+	}
+	windowChange struct {
+		Columns uint32
+		Rows    uint32
+		Width   uint32
+		Height  uint32
+	}
+	envRequest struct {
+		Name  string
+		Value string
+	}
+	execRequest struct {
+		Command string
+	}
+	subsystemRequest struct {
+		Name string
+	}
+	exitStatus struct {
+		Status uint32
+	}
+)
+
+// exitStatusFailure is sent if the command could not run, like OpenSSH does.
+const exitStatusFailure = 255
+
+// envName matches the names of environment variables which can be passed to env.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sessionCommand is what a session runs in the pod of the student.
+type sessionCommand struct {
+	// command is passed to the shell, the session is interactive if it is empty.
+	command string
+	// argv of a subsystem, it runs without a shell and without a terminal.
+	argv []string
+	// env contains the allowed environment variables as NAME=value.
+	env []string
+	// pty is set if the client requested a terminal.
+	pty *ptyRequest
+}
+
+// podCommand returns the command line in the pod. The environment is set with env, because
+// exec does not support it.
+func (c sessionCommand) podCommand() []string {
+	env := c.env
+	if c.pty != nil && c.pty.Term != "" {
+		env = append(env[:len(env):len(env)], "TERM="+c.pty.Term)
+	}
+	var args []string
+	if len(env) > 0 {
+		args = append([]string{"env"}, env...)
+	}
+	if c.argv != nil {
+		return append(args, c.argv...)
+	}
+	if c.command == "" {
+		return append(args, "bash")
+	}
+	return append(args, "bash", "-c", c.command)
+}
+
+// interactive reports whether the session is a shell in a terminal, which is the only one
+// without an upload limit. Commands are limited even if they run in a terminal, shells
+// without a terminal because their input can be piped.
+func (c sessionCommand) interactive() bool {
+	return c.pty != nil && c.command == "" && c.argv == nil
+}
+
+// tty reports whether the command runs in a terminal. Subsystems speak binary protocols,
+// which a terminal would break.
+func (c sessionCommand) tty() bool {
+	return c.pty != nil && c.argv == nil
+}
+
+// exitCode returns the exit status of the command in the pod which ended with err.
+func exitCode(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	var exitErr exec.ExitError
+	if errors.As(err, &exitErr) {
+		return uint32(exitErr.ExitStatus())
+	}
+	return exitStatusFailure
+}
+
+// uploadLimit returns the bytes user may send into non-interactive sessions, 0 is unlimited.
+func (s *sshRelay) uploadLimit(user userstore.User) int64 {
+	limit := s.config.UploadLimit
+	if user.UploadLimit != "" {
+		limit = user.UploadLimit
+	}
+	// Both limits are validated when they are loaded.
+	q, err := resource.ParseQuantity(limit)
+	if err != nil {
+		return 0
+	}
+	return q.Value()
+}
+
+// envAllowed reports whether students may set the environment variable name.
+func (s *sshRelay) envAllowed(name string) bool {
+	if !envName.MatchString(name) {
+		return false
+	}
+	for _, pattern := range s.config.AllowedEnv {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSessionRequests configures the command of a session with the "pty-req" and "env"
+// requests and sends it to start on the first "shell", "exec" or "subsystem" request. Later
+// changes of the terminal size are pushed to window. Both channels are closed once the
+// requests end.
+func (s *sshRelay) handleSessionRequests(requests <-chan *ssh.Request, window *Winsize, start chan<- sessionCommand) {
+	defer close(window.Queue)
+	defer close(start)
+	var cmd sessionCommand
+	started := false
+	for req := range requests {
+		s.log.Debug("received data over request channel", zap.String("type", req.Type))
+		ok, begin := false, false
+		switch req.Type {
+		case "pty-req":
+			var pty ptyRequest
+			if err := ssh.Unmarshal(req.Payload, &pty); err == nil && !started {
+				cmd.pty = &pty
+				window.push(&remotecommand.TerminalSize{Width: uint16(pty.Columns), Height: uint16(pty.Rows)})
+				ok = true
+			}
+		case "window-change":
+			var change windowChange
+			if err := ssh.Unmarshal(req.Payload, &change); err == nil {
+				window.push(&remotecommand.TerminalSize{Width: uint16(change.Columns), Height: uint16(change.Rows)})
+				ok = true
+			}
+		case "env":
+			var env envRequest
+			if err := ssh.Unmarshal(req.Payload, &env); err == nil && !started && s.envAllowed(env.Name) {
+				cmd.env = append(cmd.env, env.Name+"="+env.Value)
+				ok = true
+			} else {
+				s.log.Debug("rejected environment variable", zap.String("name", env.Name))
+			}
+		case "shell":
+			// We only accept the default shell (i.e. no command in the Payload).
+			ok = !started && len(req.Payload) == 0
+			begin = ok
+		case "subsystem":
+			var subsystem subsystemRequest
+			if err := ssh.Unmarshal(req.Payload, &subsystem); err == nil && !started && subsystem.Name == "sftp" {
+				cmd.argv = []string{s.config.SFTPServer}
+				ok, begin = true, true
+			} else {
+				s.log.Info("rejected subsystem", zap.String("name", subsystem.Name))
+			}
+		case "exec":
+			var execReq execRequest
+			if err := ssh.Unmarshal(req.Payload, &execReq); err == nil && !started && execReq.Command != "" {
+				cmd.command = execReq.Command
+				ok, begin = true, true
+			}
+		}
+		if req.WantReply {
+			if err := req.Reply(ok, nil); err != nil {
+				s.log.Error("failed to respond to request", zap.String("type", req.Type), zap.Error(err))
+			}
+		}
+		if begin {
+			started = true
+			start <- cmd
+		}
+	}
+}
+
+// errUploadLimit is returned once a student sent more than their upload limit.
+var errUploadLimit = errors.New("upload limit exceeded")
+
+// uploadReservation is the number of bytes a session reserves from the quota of the student
+// at once, such that the replicated store is not written for every read.
+const uploadReservation = 64 << 10
+
+// uploadQuota counts the bytes every student sent into non-interactive sessions, summed over
+// all their sessions and connections.
+type uploadQuota interface {
+	// add adds n bytes to the bytes user sent, but not beyond limit, and returns how many
+	// of them were added. A negative n gives bytes back.
+	add(ctx context.Context, user string, n, limit int64) (int64, error)
+}
+
+// newUploadQuota returns the quota shared by all relays in kv, or the quota of this relay
+// since it started if kv is nil.
+func newUploadQuota(kv *kvstore.Store) uploadQuota {
+	if kv != nil {
+		return storeQuota{kv: kv}
+	}
+	return &uploadCounter{sent: make(map[string]int64)}
+}
+
+// storeQuota is the quota in the replicated store.
+type storeQuota struct {
+	kv *kvstore.Store
+}
+
+func (q storeQuota) add(ctx context.Context, user string, n, limit int64) (int64, error) {
+	return q.kv.AddUpload(ctx, user, n, limit)
+}
+
+// uploadCounter is the quota of a relay which runs alone.
+type uploadCounter struct {
+	mux  sync.Mutex
+	sent map[string]int64
+}
+
+func (c *uploadCounter) add(_ context.Context, user string, n, limit int64) (int64, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	sent := c.sent[user]
+	// The limit of a student may have been lowered below what they sent.
+	if remaining := limit - sent; n > 0 && n > remaining {
+		n = 0
+		if remaining > 0 {
+			n = remaining
+		}
+	}
+	if n < -sent {
+		n = -sent
+	}
+	c.sent[user] += n
+	return n, nil
+}
+
+// uploadLimiter passes the bytes from r into a pod while user is within limit and calls
+// exceeded once the student tries to send more. It reserves the bytes from the quota in
+// chunks, release gives back what was not used.
+type uploadLimiter struct {
+	ctx      context.Context
+	r        io.Reader
+	user     string
+	limit    int64
+	quota    uploadQuota
+	exceeded func()
+	hit      atomic.Bool
+	// mux guards reserved, the session releases it while the pod may still read.
+	mux      sync.Mutex
+	reserved int64
+}
+
+func (u *uploadLimiter) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if need := int64(n) - u.reserved; need > 0 {
+		if need < uploadReservation {
+			need = uploadReservation
+		}
+		added, qErr := u.quota.add(u.ctx, u.user, need, u.limit)
+		if qErr != nil {
+			return 0, fmt.Errorf("counting the upload: %w", qErr)
+		}
+		u.reserved += added
+	}
+	if int64(n) > u.reserved {
+		n = int(u.reserved)
+		u.reserved = 0
+		u.hit.Store(true)
+		u.exceeded()
+		return n, errUploadLimit
+	}
+	u.reserved -= int64(n)
+	return n, err
+}
+
+// release gives the reserved bytes which were not sent back to the quota.
+func (u *uploadLimiter) release(ctx context.Context) error {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if u.reserved == 0 {
+		return nil
+	}
+	_, err := u.quota.add(ctx, u.user, -u.reserved, u.limit)
+	u.reserved = 0
+	return err
+}
+
+// limitExceeded reports whether the student tried to send more than the limit.
+func (u *uploadLimiter) limitExceeded() bool {
+	return u.hit.Load()
+}
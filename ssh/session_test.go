@@ -0,0 +1,266 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/ssh/userstore"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+)
+
+func TestPodCommand(t *testing.T) {
+	testCases := map[string]struct {
+		cmd  sessionCommand
+		want []string
+	}{
+		"shell": {
+			want: []string{"bash"},
+		},
+		"shell with terminal": {
+			cmd:  sessionCommand{pty: &ptyRequest{Term: "xterm-256color"}},
+			want: []string{"env", "TERM=xterm-256color", "bash"},
+		},
+		"exec": {
+			cmd:  sessionCommand{command: "make test"},
+			want: []string{"bash", "-c", "make test"},
+		},
+		"exec with environment": {
+			cmd:  sessionCommand{command: "locale", env: []string{"LANG=C.UTF-8"}},
+			want: []string{"env", "LANG=C.UTF-8", "bash", "-c", "locale"},
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if got := tc.cmd.podCommand(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	testCases := map[string]struct {
+		err  error
+		want uint32
+	}{
+		"success":       {want: 0},
+		"exit status":   {err: exec.CodeExitError{Err: errors.New("command terminated with exit code 2"), Code: 2}, want: 2},
+		"stream failed": {err: errors.New("connection reset"), want: exitStatusFailure},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if got := exitCode(tc.err); got != tc.want {
+				t.Errorf("got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleSessionRequests(t *testing.T) {
+	cfg := config.Default()
+	relay := NewSSHRelay(nil, cfg, nil, nil, zaptest.NewLogger(t))
+	requests := make(chan *ssh.Request, 10)
+	window := &Winsize{Queue: make(chan *remotecommand.TerminalSize, 1)}
+	start := make(chan sessionCommand, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay.handleSessionRequests(requests, window, start)
+	}()
+
+	requests <- &ssh.Request{Type: "env", Payload: ssh.Marshal(envRequest{Name: "LANG", Value: "C.UTF-8"})}
+	requests <- &ssh.Request{Type: "env", Payload: ssh.Marshal(envRequest{Name: "LD_PRELOAD", Value: "/tmp/evil.so"})}
+	requests <- &ssh.Request{Type: "env", Payload: ssh.Marshal(envRequest{Name: "LC_ALL=x PATH", Value: "/tmp"})}
+	requests <- &ssh.Request{Type: "pty-req", Payload: ssh.Marshal(ptyRequest{Term: "xterm", Columns: 80, Rows: 24})}
+	requests <- &ssh.Request{Type: "window-change", Payload: ssh.Marshal(windowChange{Columns: 120, Rows: 40})}
+	requests <- &ssh.Request{Type: "exec", Payload: ssh.Marshal(execRequest{Command: "make test"})}
+	requests <- &ssh.Request{Type: "env", Payload: ssh.Marshal(envRequest{Name: "LC_ALL", Value: "C"})}
+	requests <- &ssh.Request{Type: "shell"}
+
+	cmd := <-start
+	if cmd.command != "make test" {
+		t.Errorf("command %q, want make test", cmd.command)
+	}
+	if want := []string{"LANG=C.UTF-8"}; !reflect.DeepEqual(cmd.env, want) {
+		t.Errorf("environment %q, want %q", cmd.env, want)
+	}
+	if cmd.pty == nil || cmd.pty.Term != "xterm" {
+		t.Errorf("terminal %+v, want xterm", cmd.pty)
+	}
+	// The pending size of the terminal is replaced by the latest one.
+	if size := window.Next(); size.Width != 120 || size.Height != 40 {
+		t.Errorf("terminal size %+v, want 120x40", size)
+	}
+
+	close(requests)
+	<-done
+	if _, ok := <-start; ok {
+		t.Error("a second command was started")
+	}
+	if size := window.Next(); size != nil {
+		t.Errorf("got terminal size %+v after the requests ended", size)
+	}
+}
+
+func TestSubsystemRequest(t *testing.T) {
+	relay := NewSSHRelay(nil, config.Default(), nil, nil, zaptest.NewLogger(t))
+	requests := make(chan *ssh.Request, 3)
+	window := &Winsize{Queue: make(chan *remotecommand.TerminalSize, 1)}
+	start := make(chan sessionCommand, 1)
+	requests <- &ssh.Request{Type: "subsystem", Payload: ssh.Marshal(subsystemRequest{Name: "x11"})}
+	requests <- &ssh.Request{Type: "pty-req", Payload: ssh.Marshal(ptyRequest{Term: "xterm"})}
+	requests <- &ssh.Request{Type: "subsystem", Payload: ssh.Marshal(subsystemRequest{Name: "sftp"})}
+	close(requests)
+	relay.handleSessionRequests(requests, window, start)
+
+	cmd := <-start
+	if want := []string{"env", "TERM=xterm", "/usr/lib/ssh/sftp-server"}; !reflect.DeepEqual(cmd.podCommand(), want) {
+		t.Errorf("command %q, want %q", cmd.podCommand(), want)
+	}
+	if cmd.tty() {
+		t.Error("the sftp server runs in a terminal")
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.SSH.UploadLimit = "1Ki"
+	relay := NewSSHRelay(nil, cfg, nil, nil, zaptest.NewLogger(t))
+	testCases := map[string]struct {
+		user userstore.User
+		want int64
+	}{
+		"default":   {want: 1024},
+		"own limit": {user: userstore.User{UploadLimit: "1Mi"}, want: 1 << 20},
+		"unlimited": {user: userstore.User{UploadLimit: "0"}, want: 0},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if got := relay.uploadLimit(tc.user); got != tc.want {
+				t.Errorf("got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	testCases := map[string]struct {
+		cmd  sessionCommand
+		want bool
+	}{
+		"shell without pty": {cmd: sessionCommand{}},
+		"shell with pty":    {cmd: sessionCommand{pty: &ptyRequest{}}, want: true},
+		"exec":              {cmd: sessionCommand{command: "cat > solution"}},
+		"exec with pty":     {cmd: sessionCommand{command: "cat > solution", pty: &ptyRequest{}}},
+		"subsystem":         {cmd: sessionCommand{argv: []string{"/usr/lib/ssh/sftp-server"}}},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if got := tc.cmd.interactive(); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUploadLimiter(t *testing.T) {
+	testCases := map[string]struct {
+		// sent maps the students to the bytes they sent in earlier sessions.
+		sent         map[string]int64
+		data         string
+		limit        int64
+		wantData     string
+		wantExceeded bool
+	}{
+		"below the limit": {
+			data:     "solution",
+			limit:    8,
+			wantData: "solution",
+		},
+		"above the limit": {
+			data:         "solution",
+			limit:        3,
+			wantData:     "sol",
+			wantExceeded: true,
+		},
+		"earlier sessions count": {
+			sent:         map[string]int64{"alice": 5},
+			data:         "solution",
+			limit:        8,
+			wantData:     "sol",
+			wantExceeded: true,
+		},
+		"limit reached before": {
+			sent:         map[string]int64{"alice": 8},
+			data:         "solution",
+			limit:        8,
+			wantExceeded: true,
+		},
+		"sessions of other students": {
+			sent:     map[string]int64{"bob": 8},
+			data:     "solution",
+			limit:    8,
+			wantData: "solution",
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			counter := &uploadCounter{sent: make(map[string]int64)}
+			for user, n := range tc.sent {
+				if _, err := counter.add(ctx, user, n, n); err != nil {
+					t.Fatal(err)
+				}
+			}
+			exceeded := false
+			limiter := &uploadLimiter{
+				ctx:      ctx,
+				r:        strings.NewReader(tc.data),
+				user:     "alice",
+				limit:    tc.limit,
+				quota:    counter,
+				exceeded: func() { exceeded = true },
+			}
+			var got bytes.Buffer
+			_, err := io.Copy(&got, limiter)
+			if tc.wantExceeded != errors.Is(err, errUploadLimit) {
+				t.Errorf("got error %v, want the limit exceeded: %v", err, tc.wantExceeded)
+			}
+			if exceeded != tc.wantExceeded || limiter.limitExceeded() != tc.wantExceeded {
+				t.Errorf("exceeded %v, want %v", exceeded, tc.wantExceeded)
+			}
+			if got.String() != tc.wantData {
+				t.Errorf("passed %q, want %q", got.String(), tc.wantData)
+			}
+			if err := limiter.release(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if want := tc.sent["alice"] + int64(len(tc.wantData)); counter.sent["alice"] != want {
+				t.Errorf("counted %d bytes after the session, want %d", counter.sent["alice"], want)
+			}
+		})
+	}
+}
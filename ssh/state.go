@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/benschlueter/delegatio/ssh/kvstore"
+	"github.com/benschlueter/delegatio/ssh/userstore"
+	"go.uber.org/zap"
+)
+
+const (
+	// storeTimeout is the time a write to the replicated store may take, logins do not wait longer.
+	storeTimeout = 5 * time.Second
+	// auditRetention is the time the events of the audit log are kept.
+	auditRetention = 30 * 24 * time.Hour
+	// auditPruneInterval is the time between two prunes of the audit log.
+	auditPruneInterval = time.Hour
+)
+
+// audit records event in the audit log of the replicated store. Failures are only logged,
+// a broken store must not lock out the students.
+func (s *sshRelay) audit(event kvstore.AuditEvent) {
+	if s.kv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := s.kv.Audit(ctx, event); err != nil {
+		s.log.Error("writing the audit log", zap.String("type", event.Type), zap.Error(err))
+	}
+}
+
+// startSession records session in the replicated store and returns the function which removes it.
+func (s *sshRelay) startSession(session kvstore.Session) func() {
+	if s.kv == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	end, err := s.kv.StartSession(ctx, session)
+	if err != nil {
+		s.log.Error("recording the session", zap.String("session", session.ID), zap.Error(err))
+		return func() {}
+	}
+	return end
+}
+
+// pruneAuditLog removes the events older than auditRetention from the audit log until ctx is done.
+func pruneAuditLog(ctx context.Context, kv *kvstore.Store, log *zap.Logger) {
+	t := time.NewTicker(auditPruneInterval)
+	defer t.Stop()
+	for {
+		pruned, err := kv.PruneAudit(ctx, time.Now().Add(-auditRetention))
+		if err != nil {
+			log.Error("pruning the audit log", zap.Error(err))
+		} else if pruned > 0 {
+			log.Info("pruned the audit log", zap.Int64("events", pruned))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// importUsersFile replaces the students in the replicated store with the ones in the file at path.
+func importUsersFile(ctx context.Context, kv *kvstore.Store, path string) error {
+	if kv == nil {
+		return errors.New("importing users requires ssh.store")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return userstore.Import(ctx, kv, data)
+}
@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package userstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// ConfigStore lets every authorized key of the config enter every challenge of the config.
+// The students are named after the fingerprint of their key, it never changes at runtime.
+type ConfigStore struct {
+	memoryStore
+}
+
+// NewConfigStore returns the students of the authorized keys in cfg.
+func NewConfigStore(cfg *config.Config) (*ConfigStore, error) {
+	challenges := make([]string, 0, len(cfg.Challenges))
+	for _, challenge := range cfg.Challenges {
+		challenges = append(challenges, challenge.Name)
+	}
+	byKey := make(map[string]User, len(cfg.SSH.AuthorizedKeys))
+	for _, authorizedKey := range cfg.SSH.AuthorizedKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+		if err != nil {
+			return nil, fmt.Errorf("ssh.authorizedKeys: %w", err)
+		}
+		byKey[keyID(key)] = User{
+			Name:       fingerprintName(key),
+			PublicKeys: []string{authorizedKey},
+			Challenges: challenges,
+		}
+	}
+	return &ConfigStore{memoryStore: memoryStore{byKey: byKey}}, nil
+}
+
+// Reload does nothing, the config is only read at startup.
+func (s *ConfigStore) Reload(ctx context.Context) error {
+	return nil
+}
+
+// Watch does nothing, the config is only read at startup.
+func (s *ConfigStore) Watch(ctx context.Context) {}
+
+// fingerprintName is the name of the student of key in the config store.
+// It is derived from the fingerprint like before the students had names.
+func fingerprintName(key ssh.PublicKey) string {
+	return strings.ToLower(ssh.FingerprintSHA256(key)[7:47])
+}
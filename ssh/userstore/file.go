@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package userstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fileReloadInterval is the time between two checks of the users file for changes.
+const fileReloadInterval = 5 * time.Second
+
+// FileStore reads the students from a YAML or JSON file, see Document.
+type FileStore struct {
+	memoryStore
+	log  *zap.Logger
+	path string
+	// reloadMux serializes the reloads of Watch and Reload.
+	reloadMux sync.Mutex
+	// modTime and size of the file at the last reload, a change of either triggers a reload.
+	modTime time.Time
+	size    int64
+}
+
+// NewFileStore returns the students in the file at path.
+func NewFileStore(path string, log *zap.Logger) (*FileStore, error) {
+	s := &FileStore{log: log, path: path}
+	if err := s.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the file again.
+func (s *FileStore) Reload(ctx context.Context) error {
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	// A broken file is not read again by Watch until it changes.
+	s.modTime, s.size = info.ModTime(), info.Size()
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	users, err := decode(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	if err := s.replace(users); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.log.Info("loaded users", zap.String("path", s.path), zap.Int("users", len(users)))
+	return nil
+}
+
+// Watch reloads the file whenever its modification time or size changes.
+func (s *FileStore) Watch(ctx context.Context) {
+	t := time.NewTicker(fileReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		changed, err := s.changed()
+		if err != nil {
+			s.log.Error("checking the users file", zap.Error(err))
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := s.Reload(ctx); err != nil {
+			s.log.Error("reloading the users file, keeping the previous users", zap.Error(err))
+		}
+	}
+}
+
+// changed reports whether the file changed since the last reload.
+func (s *FileStore) changed() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size, nil
+}
@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package userstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	coreAPI "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// UsersKey is the key of the config map which contains the Document.
+	UsersKey = "users.yaml"
+	// watchRetryInterval is the time between two attempts to watch the config map.
+	watchRetryInterval = 5 * time.Second
+)
+
+// KubernetesStore reads the students from a config map, see UsersKey.
+type KubernetesStore struct {
+	memoryStore
+	log       *zap.Logger
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewKubernetesStore returns the students in the config map name in namespace.
+func NewKubernetesStore(ctx context.Context, client kubernetes.Interface, namespace, name string, log *zap.Logger) (*KubernetesStore, error) {
+	s := &KubernetesStore{
+		log:       log,
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+	if err := s.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the config map again.
+func (s *KubernetesStore) Reload(ctx context.Context) error {
+	configMap, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metaAPI.GetOptions{})
+	if err != nil {
+		return err
+	}
+	return s.load(configMap)
+}
+
+// Watch reloads the config map whenever it changes. The watch is restarted if the API server ends it.
+// If the config map is deleted, the previous students are kept.
+func (s *KubernetesStore) Watch(ctx context.Context) {
+	for {
+		if err := s.watch(ctx); err != nil {
+			s.log.Error("watching the users config map", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
+func (s *KubernetesStore) watch(ctx context.Context) error {
+	watcher, err := s.client.CoreV1().ConfigMaps(s.namespace).Watch(ctx, metaAPI.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", s.name).String(),
+	})
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return errors.New("watch closed")
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				configMap, ok := event.Object.(*coreAPI.ConfigMap)
+				if !ok || configMap.Name != s.name {
+					continue
+				}
+				if err := s.load(configMap); err != nil {
+					s.log.Error("reloading the users config map, keeping the previous users", zap.Error(err))
+				}
+			case watch.Deleted:
+				if configMap, ok := event.Object.(*coreAPI.ConfigMap); ok && configMap.Name == s.name {
+					s.log.Warn("users config map deleted, keeping the previous users")
+				}
+			case watch.Error:
+				return apierrors.FromObject(event.Object)
+			}
+		}
+	}
+}
+
+// load replaces the students with the ones in configMap.
+func (s *KubernetesStore) load(configMap *coreAPI.ConfigMap) error {
+	data, ok := configMap.Data[UsersKey]
+	if !ok {
+		return fmt.Errorf("config map %s/%s has no key %s", s.namespace, s.name, UsersKey)
+	}
+	users, err := decode([]byte(data))
+	if err != nil {
+		return fmt.Errorf("config map %s/%s: %w", s.namespace, s.name, err)
+	}
+	if err := s.replace(users); err != nil {
+		return fmt.Errorf("config map %s/%s: %w", s.namespace, s.name, err)
+	}
+	s.log.Info("loaded users", zap.String("configMap", s.namespace+"/"+s.name), zap.Int("users", len(users)))
+	return nil
+}
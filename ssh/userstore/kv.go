@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package userstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benschlueter/delegatio/ssh/kvstore"
+	"go.uber.org/zap"
+)
+
+// StoreKey is the key of the Document in the replicated store of the relays.
+const StoreKey = "users"
+
+// errNoStore is returned by New if the store source is used without a store.
+var errNoStore = errors.New("the store user source requires the replicated store")
+
+// KVStore reads the students from the replicated store of the relays. The students are
+// cached and updated by Watch, Lookup does not access the store.
+type KVStore struct {
+	memoryStore
+	log *zap.Logger
+	kv  *kvstore.Store
+	// reloadMux serializes the reloads of Watch and Reload.
+	reloadMux sync.Mutex
+	// revision of the store at the last reload, Watch continues from there.
+	revision int64
+}
+
+// NewKVStore returns the students in kv.
+func NewKVStore(ctx context.Context, kv *kvstore.Store, log *zap.Logger) (*KVStore, error) {
+	s := &KVStore{log: log, kv: kv}
+	if err := s.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the students from the member of the relay again. Until the students are
+// imported, nobody can log in.
+func (s *KVStore) Reload(ctx context.Context) error {
+	s.reloadMux.Lock()
+	defer s.reloadMux.Unlock()
+	data, revision, err := s.kv.Get(ctx, StoreKey)
+	if errors.Is(err, kvstore.ErrNotFound) {
+		s.log.Warn("no users imported into the store yet", zap.String("store", StoreKey))
+		s.revision = revision
+		return s.replace(nil)
+	}
+	if err != nil {
+		return err
+	}
+	s.revision = revision
+	return s.load(data)
+}
+
+// Watch reloads the students whenever they change. The watch is restarted if it fails,
+// i.e. while the member of the relay has no leader. The cached students are kept meanwhile.
+func (s *KVStore) Watch(ctx context.Context) {
+	for {
+		s.reloadMux.Lock()
+		revision := s.revision
+		s.reloadMux.Unlock()
+		err := s.kv.Watch(ctx, StoreKey, revision+1, func(event kvstore.Event) {
+			s.reloadMux.Lock()
+			defer s.reloadMux.Unlock()
+			s.revision = event.Revision
+			if event.Deleted {
+				s.log.Warn("users deleted from the store, keeping the previous users")
+				return
+			}
+			if err := s.load(event.Value); err != nil {
+				s.log.Error("reloading the users from the store, keeping the previous users", zap.Error(err))
+			}
+		})
+		if err != nil {
+			s.log.Error("watching the users in the store", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+		// Changes might have been missed while the watch was down.
+		if err := s.Reload(ctx); err != nil {
+			s.log.Error("reloading the users from the store", zap.Error(err))
+		}
+	}
+}
+
+// load replaces the students with the ones in data.
+func (s *KVStore) load(data []byte) error {
+	users, err := decode(data)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	if err := s.replace(users); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	s.log.Info("loaded users", zap.String("store", StoreKey), zap.Int("users", len(users)))
+	return nil
+}
+
+// Import validates the YAML or JSON document data and replaces the students in kv with it.
+func Import(ctx context.Context, kv *kvstore.Store, data []byte) error {
+	users, err := decode(data)
+	if err != nil {
+		return err
+	}
+	if _, err := index(users); err != nil {
+		return err
+	}
+	return kv.Put(ctx, StoreKey, data)
+}
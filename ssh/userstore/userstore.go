@@ -0,0 +1,161 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+// Package userstore provides the students of the ssh relay. Every public key belongs to
+// exactly one student, who may only enter the challenges listed for them.
+package userstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/ssh/kvstore"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// UserStore maps public keys to students.
+type UserStore interface {
+	// Lookup returns the student the key belongs to.
+	Lookup(key ssh.PublicKey) (User, bool)
+	// Reload reads the students again. If the source is invalid, the previous students are kept.
+	Reload(ctx context.Context) error
+	// Watch reloads the students whenever the source changes until ctx is done.
+	Watch(ctx context.Context)
+}
+
+// User is a student.
+type User struct {
+	// Name identifies the student, it is part of the names of their Kubernetes resources.
+	Name string `json:"name"`
+	// PublicKeys are in the authorized_keys format.
+	PublicKeys []string `json:"publicKeys"`
+	Challenges []string `json:"challenges"`
+	// UploadLimit overrides ssh.uploadLimit of the config for the student.
+	UploadLimit string `json:"uploadLimit,omitempty"`
+}
+
+// MayEnter reports whether the student may enter challenge.
+func (u User) MayEnter(challenge string) bool {
+	for _, c := range u.Challenges {
+		if c == challenge {
+			return true
+		}
+	}
+	return false
+}
+
+// Document is the format of the users file, the config map and the store.
+type Document struct {
+	Users []User `json:"users"`
+}
+
+// decode decodes a YAML or JSON document.
+func decode(data []byte) ([]User, error) {
+	var doc Document
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return nil, fmt.Errorf("decoding users: %w", err)
+	}
+	return doc.Users, nil
+}
+
+// New returns the store of the source in the config. The kubernetes source requires client,
+// the store source requires kv.
+func New(ctx context.Context, cfg *config.Config, client kubernetes.Interface, kv *kvstore.Store, log *zap.Logger) (UserStore, error) {
+	switch cfg.SSH.Users.Source {
+	case config.UserSourceConfig:
+		return NewConfigStore(cfg)
+	case config.UserSourceFile:
+		return NewFileStore(cfg.SSH.Users.Path, log)
+	case config.UserSourceKubernetes:
+		return NewKubernetesStore(ctx, client, cfg.SSH.Users.Namespace, cfg.SSH.Users.ConfigMap, log)
+	case config.UserSourceStore:
+		if kv == nil {
+			return nil, errNoStore
+		}
+		return NewKVStore(ctx, kv, log)
+	default:
+		return nil, fmt.Errorf("unknown user source %q", cfg.SSH.Users.Source)
+	}
+}
+
+// keyID is the key of a public key in the index, the comment of authorized keys is ignored.
+func keyID(key ssh.PublicKey) string {
+	return string(key.Marshal())
+}
+
+// index maps the public keys to the students. It validates all students and reports all errors at once.
+func index(users []User) (map[string]User, error) {
+	byKey := make(map[string]User)
+	names := make(map[string]struct{}, len(users))
+	var err error
+	for _, user := range users {
+		for _, msg := range validation.IsDNS1123Label(user.Name) {
+			err = multierr.Append(err, fmt.Errorf("user %q: %s", user.Name, msg))
+		}
+		if _, ok := names[user.Name]; ok {
+			err = multierr.Append(err, fmt.Errorf("duplicate user %q", user.Name))
+		}
+		names[user.Name] = struct{}{}
+		if user.UploadLimit != "" {
+			if q, pErr := resource.ParseQuantity(user.UploadLimit); pErr != nil {
+				err = multierr.Append(err, fmt.Errorf("user %q: upload limit: %w", user.Name, pErr))
+			} else if q.Sign() < 0 {
+				err = multierr.Append(err, fmt.Errorf("user %q: negative upload limit", user.Name))
+			}
+		}
+		if len(user.PublicKeys) == 0 {
+			err = multierr.Append(err, fmt.Errorf("user %q has no public keys", user.Name))
+		}
+		for _, authorizedKey := range user.PublicKeys {
+			key, _, _, _, pErr := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+			if pErr != nil {
+				err = multierr.Append(err, fmt.Errorf("user %q: %w", user.Name, pErr))
+				continue
+			}
+			if other, ok := byKey[keyID(key)]; ok && other.Name != user.Name {
+				err = multierr.Append(err, fmt.Errorf("key %s belongs to %q and %q", ssh.FingerprintSHA256(key), other.Name, user.Name))
+				continue
+			}
+			byKey[keyID(key)] = user
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return byKey, nil
+}
+
+// memoryStore holds the students of a source in memory, the sources replace them on reloads.
+type memoryStore struct {
+	mux   sync.RWMutex
+	byKey map[string]User
+}
+
+// Lookup returns the student the key belongs to.
+func (m *memoryStore) Lookup(key ssh.PublicKey) (User, bool) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	user, ok := m.byKey[keyID(key)]
+	return user, ok
+}
+
+// replace validates users and replaces the students with them.
+func (m *memoryStore) replace(users []User) error {
+	byKey, err := index(users)
+	if err != nil {
+		return err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.byKey = byKey
+	return nil
+}
@@ -0,0 +1,345 @@
+/* SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) Benedict Schlueter
+ */
+
+package userstore_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benschlueter/delegatio/cli/config"
+	"github.com/benschlueter/delegatio/ssh/kvstore"
+	"github.com/benschlueter/delegatio/ssh/kvstore/kvstoretest"
+	"github.com/benschlueter/delegatio/ssh/userstore"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/crypto/ssh"
+	coreAPI "k8s.io/api/core/v1"
+	metaAPI "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newKey returns a new public key and its authorized_keys line.
+func newKey(t *testing.T) (ssh.PublicKey, string) {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// usersDocument returns a document with a student per name, who owns the key at the same index.
+func usersDocument(names []string, keys []string, challenges ...string) string {
+	var b strings.Builder
+	b.WriteString("users:\n")
+	for i, name := range names {
+		fmt.Fprintf(&b, "  - name: %s\n    publicKeys:\n      - %s\n    challenges: [%s]\n", name, keys[i], strings.Join(challenges, ", "))
+	}
+	return b.String()
+}
+
+func TestFileStore(t *testing.T) {
+	aliceKey, alice := newKey(t)
+	bobKey, bob := newKey(t)
+	testCases := map[string]struct {
+		document  string
+		wantErr   bool
+		wantAlice bool
+		wantBob   bool
+	}{
+		"valid": {
+			document:  usersDocument([]string{"alice", "bob"}, []string{alice, bob}, "web"),
+			wantAlice: true,
+			wantBob:   true,
+		},
+		"key with comment": {
+			document:  usersDocument([]string{"alice"}, []string{alice + " alice@laptop"}, "web"),
+			wantAlice: true,
+		},
+		"key of two students": {
+			document: usersDocument([]string{"alice", "bob"}, []string{alice, alice}, "web"),
+			wantErr:  true,
+		},
+		"duplicate student": {
+			document: usersDocument([]string{"alice", "alice"}, []string{alice, bob}, "web"),
+			wantErr:  true,
+		},
+		"invalid name": {
+			document: usersDocument([]string{"Alice_1"}, []string{alice}, "web"),
+			wantErr:  true,
+		},
+		"invalid key": {
+			document: usersDocument([]string{"alice"}, []string{"ssh-ed25519 AAAA"}, "web"),
+			wantErr:  true,
+		},
+		"invalid upload limit": {
+			document: "users:\n  - name: alice\n    publicKeys: [" + alice + "]\n    uploadLimit: lots\n",
+			wantErr:  true,
+		},
+		"upload limit": {
+			document:  "users:\n  - name: alice\n    publicKeys: [" + alice + "]\n    challenges: [web]\n    uploadLimit: 10Mi\n",
+			wantAlice: true,
+		},
+		"unknown field": {
+			document: "students: []\n",
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.yaml")
+			if err := os.WriteFile(path, []byte(tc.document), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			store, err := userstore.NewFileStore(path, zaptest.NewLogger(t))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("invalid users were loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, ok := store.Lookup(aliceKey)
+			if ok != tc.wantAlice {
+				t.Fatalf("alice found: %v, want %v", ok, tc.wantAlice)
+			}
+			if ok && (user.Name != "alice" || !user.MayEnter("web") || user.MayEnter("crypto")) {
+				t.Errorf("alice is %+v", user)
+			}
+			if _, ok := store.Lookup(bobKey); ok != tc.wantBob {
+				t.Errorf("bob found: %v, want %v", ok, tc.wantBob)
+			}
+		})
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	aliceKey, alice := newKey(t)
+	bobKey, bob := newKey(t)
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	if err := os.WriteFile(path, []byte(usersDocument([]string{"alice"}, []string{alice}, "web")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := userstore.NewFileStore(path, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid file keeps the previous users.
+	if err := os.WriteFile(path, []byte(usersDocument([]string{"alice", "bob"}, []string{alice, alice}, "web")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(context.Background()); err == nil {
+		t.Fatal("invalid users were loaded")
+	}
+	if _, ok := store.Lookup(aliceKey); !ok {
+		t.Fatal("the previous users were dropped")
+	}
+
+	if err := os.WriteFile(path, []byte(usersDocument([]string{"bob"}, []string{bob}, "web")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Lookup(aliceKey); ok {
+		t.Error("removed student alice can still log in")
+	}
+	if _, ok := store.Lookup(bobKey); !ok {
+		t.Error("new student bob was not loaded")
+	}
+}
+
+func TestConfigStore(t *testing.T) {
+	key, authorizedKey := newKey(t)
+	otherKey, _ := newKey(t)
+	cfg := config.Default()
+	cfg.Challenges = append(cfg.Challenges, config.ChallengeConfig{Name: "web", Image: "web:latest"})
+	cfg.SSH.AuthorizedKeys = []string{authorizedKey}
+
+	store, err := userstore.New(context.Background(), cfg, nil, nil, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, ok := store.Lookup(key)
+	if !ok {
+		t.Fatal("authorized key not found")
+	}
+	if want := strings.ToLower(ssh.FingerprintSHA256(key)[7:47]); user.Name != want {
+		t.Errorf("name %q, want the fingerprint %q", user.Name, want)
+	}
+	if want := []string{"testchallenge1", "web"}; !reflect.DeepEqual(user.Challenges, want) {
+		t.Errorf("challenges %v, want all challenges %v", user.Challenges, want)
+	}
+	if _, ok := store.Lookup(otherKey); ok {
+		t.Error("found a key which is not authorized")
+	}
+}
+
+func TestKubernetesStore(t *testing.T) {
+	aliceKey, alice := newKey(t)
+	bobKey, bob := newKey(t)
+	configMap := &coreAPI.ConfigMap{
+		ObjectMeta: metaAPI.ObjectMeta{Name: "users", Namespace: "delegatio"},
+		Data:       map[string]string{userstore.UsersKey: usersDocument([]string{"alice"}, []string{alice}, "web")},
+	}
+	client := fake.NewSimpleClientset(configMap)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := config.Default()
+	cfg.SSH.Users = config.UserStoreConfig{Source: config.UserSourceKubernetes, Namespace: "delegatio", ConfigMap: "users"}
+	store, err := userstore.New(ctx, cfg, client, nil, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := store.Lookup(aliceKey); !ok || user.Name != "alice" {
+		t.Fatalf("alice is %+v, found %v", user, ok)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		store.Watch(ctx)
+	}()
+
+	// The update is repeated, the watch might not be established yet.
+	configMap = configMap.DeepCopy()
+	configMap.Data[userstore.UsersKey] = usersDocument([]string{"bob"}, []string{bob}, "web")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := client.CoreV1().ConfigMaps("delegatio").Update(ctx, configMap, metaAPI.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := store.Lookup(bobKey); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the update of the config map was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := store.Lookup(aliceKey); ok {
+		t.Error("removed student alice can still log in")
+	}
+
+	// An invalid update keeps the previous users.
+	configMap.Data[userstore.UsersKey] = "users: ["
+	if _, err := client.CoreV1().ConfigMaps("delegatio").Update(ctx, configMap, metaAPI.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(ctx); err == nil {
+		t.Error("invalid users were loaded")
+	}
+	if _, ok := store.Lookup(bobKey); !ok {
+		t.Error("the previous users were dropped")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestKubernetesStoreMissing(t *testing.T) {
+	cfg := config.Default()
+	cfg.SSH.Users = config.UserStoreConfig{Source: config.UserSourceKubernetes, Namespace: "delegatio", ConfigMap: "users"}
+	if _, err := userstore.New(context.Background(), cfg, fake.NewSimpleClientset(), nil, zaptest.NewLogger(t)); err == nil {
+		t.Fatal("store without config map was created")
+	}
+}
+
+func TestKVStore(t *testing.T) {
+	aliceKey, alice := newKey(t)
+	bobKey, bob := newKey(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := config.Default()
+	cfg.SSH.Users.Source = config.UserSourceStore
+	cfg.SSH.Store.Members = map[string]string{"relay-0": kvstoretest.FreeURL(t)}
+	cfg.SSH.Store.ClientURL = kvstoretest.FreeURL(t)
+	cfg.SSH.Store.DataDir = t.TempDir()
+	cfg.SSH.Store.ClientTLS = kvstoretest.NewTLS(t)
+	cfg.SSH.Store.PeerTLS = kvstoretest.NewTLS(t)
+	kv, err := kvstore.Open(ctx, kvstore.FromConfig(cfg.SSH.Store, "relay-0"), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	// The relays start before the students are imported.
+	store, err := userstore.New(ctx, cfg, nil, kv, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := store.Lookup(aliceKey); ok {
+		t.Fatalf("%s logged in before the users were imported", user.Name)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		store.Watch(ctx)
+	}()
+
+	if err := userstore.Import(ctx, kv, []byte(usersDocument([]string{"alice", "bob"}, []string{alice, alice}, "web"))); err == nil {
+		t.Fatal("invalid users were imported")
+	}
+	if err := userstore.Import(ctx, kv, []byte(usersDocument([]string{"alice"}, []string{alice}, "web"))); err != nil {
+		t.Fatal(err)
+	}
+	waitForLookup(t, store, aliceKey)
+	if user, _ := store.Lookup(aliceKey); user.Name != "alice" {
+		t.Errorf("got user %+v, want alice", user)
+	}
+
+	if err := userstore.Import(ctx, kv, []byte(usersDocument([]string{"bob"}, []string{bob}, "web"))); err != nil {
+		t.Fatal(err)
+	}
+	waitForLookup(t, store, bobKey)
+	if _, ok := store.Lookup(aliceKey); ok {
+		t.Error("removed student alice can still log in")
+	}
+
+	// An invalid update keeps the previous users.
+	if err := kv.Put(ctx, userstore.StoreKey, []byte("users: [")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(ctx); err == nil {
+		t.Error("invalid users were loaded")
+	}
+	if _, ok := store.Lookup(bobKey); !ok {
+		t.Error("the previous users were dropped")
+	}
+
+	cancel()
+	<-done
+}
+
+// waitForLookup waits until the student with key can log in.
+func waitForLookup(t *testing.T, store userstore.UserStore, key ssh.PublicKey) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, ok := store.Lookup(key); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the update of the store was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}